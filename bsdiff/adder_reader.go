@@ -17,7 +17,7 @@ func (ar *AdderReader) Read(p []byte) (int, error) {
 		return n, err
 	}
 
-	for i := range p {
+	for i := range p[:n] {
 		p[i] += ar.Buffer[ar.offset]
 		ar.offset++
 	}
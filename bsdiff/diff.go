@@ -17,12 +17,13 @@ import (
 )
 
 // A Match is a pair of two regions from the old and new file that have been
-// selected by the bsdiff algorithm for subtraction.
+// selected by the bsdiff algorithm for subtraction. Positions are absolute,
+// even when diffing in windows.
 type Match struct {
-	addOldStart int
-	addNewStart int
-	addLength   int
-	copyEnd     int
+	addOldStart int64
+	addNewStart int64
+	addLength   int64
+	copyEnd     int64
 	eoc         bool
 }
 
@@ -32,22 +33,25 @@ type blockWorkerState struct {
 	matches  chan Match
 }
 
-func (m Match) copyStart() int {
+func (m Match) copyStart() int64 {
 	return m.addNewStart + m.addLength
 }
 
-// MaxFileSize is the largest size bsdiff will diff (for both old and new file): 2GB - 1 bytes
-// a different codepath could be used for larger files, at the cost of unreasonable memory usage
-// (even in 2016). If a big corporate user is willing to sponsor that part of the code, get in touch!
-// Fair warning though: it won't be covered, our CI workers don't have that much RAM :)
+// MaxFileSize is the largest size bsdiff will diff in one go (for both old and new file): 2GB - 1 bytes.
+// Larger files can be diffed in windows, see DiffContext.WindowSize
 const MaxFileSize = int64(math.MaxInt32 - 1)
 
 // MaxMessageSize is the maximum amount of bytes that will be stored
 // in a protobuf message generated by bsdiff. This enable friendlier streaming apply
-// at a small storage cost
-// TODO: actually use
+// at a small storage cost: larger controls are split into several messages,
+// which any version of Patch applies the same way.
 const MaxMessageSize int64 = 16 * 1024 * 1024
 
+// MaxControlOverhead is how many bytes an encoded Control message can take on
+// top of its add and copy data: a message-length limit of maxMessageSize +
+// MaxControlOverhead accepts all controls PatchWithMaxMessageSize does.
+const MaxControlOverhead int64 = 64
+
 // DiffContext holds settings for the diff process, along with some
 // internal storage: re-using a diff context is good to avoid GC thrashing
 // (but never do it concurrently!)
@@ -71,7 +75,24 @@ type DiffContext struct {
 
 	Stats *DiffStats
 
+	// WindowSize, if non-zero, bounds memory usage for large files: if either file
+	// is larger, the new file is diffed in windows of WindowSize/2 bytes, each
+	// against a WindowSize region of the old file at the same relative position.
+	// Changes that move data further than that are diffed less efficiently.
+	// Memory usage is then about 9.5 times WindowSize. Windowed diffing requires
+	// both old and new to be io.ReadSeekers.
+	WindowSize int64
+
+	// Filter is applied to both old and new before diffing, the patch must be
+	// applied with the same one. See DetectFilter.
+	Filter Filter
+
+	// MessageSize is the maximum amount of bytes stored in a single Control message.
+	// 0 (or anything larger) means MaxMessageSize.
+	MessageSize int64
+
 	db bytes.Buffer
+	cb bytes.Buffer
 	ws *gosaca.WorkSpace
 
 	obuf bytes.Buffer
@@ -91,52 +112,138 @@ type DiffStats struct {
 // after WriteMessageFunc returns. See the `wire` package for an example implementation.
 type WriteMessageFunc func(msg proto.Message) (err error)
 
-func (ctx *DiffContext) writeMessages(obuf []byte, nbuf []byte, matches chan Match, writeMessage WriteMessageFunc) error {
-	var err error
+// A controlWriter turns matches into Control messages. A Control's seek
+// depends on the next match, so each message is written when the next
+// match comes in (or in finish).
+type controlWriter struct {
+	ctx          *DiffContext
+	writeMessage WriteMessageFunc
+
+	// if true, Copy is copied out of the new file buffer, which
+	// might be overwritten before the message is written.
+	ownCopy bool
+
+	bsdc      Control
+	chunk     Control
+	prevMatch Match
+	first     bool
+}
 
-	bsdc := &Control{}
+func newControlWriter(ctx *DiffContext, writeMessage WriteMessageFunc, ownCopy bool) *controlWriter {
+	return &controlWriter{
+		ctx:          ctx,
+		writeMessage: writeMessage,
+		ownCopy:      ownCopy,
+		first:        true,
+	}
+}
 
-	var prevMatch Match
-	first := true
+// write handles a match. obuf and nbuf hold the old and new file starting
+// at oldOffset and newOffset respectively.
+func (cw *controlWriter) write(match Match, obuf []byte, oldOffset int64, nbuf []byte, newOffset int64) error {
+	ctx := cw.ctx
+	bsdc := &cw.bsdc
 
-	for match := range matches {
-		if first {
-			first = false
-		} else {
-			bsdc.Seek = int64(match.addOldStart - (prevMatch.addOldStart + prevMatch.addLength))
-
-			err := writeMessage(bsdc)
-			if err != nil {
-				return err
-			}
+	if cw.first {
+		cw.first = false
+	} else {
+		bsdc.Seek = match.addOldStart - (cw.prevMatch.addOldStart + cw.prevMatch.addLength)
+
+		err := cw.flush()
+		if err != nil {
+			return err
 		}
+	}
+
+	ctx.db.Reset()
+	ctx.db.Grow(int(match.addLength))
+
+	oldStart := match.addOldStart - oldOffset
+	newStart := match.addNewStart - newOffset
+	for i := int64(0); i < match.addLength; i++ {
+		ctx.db.WriteByte(nbuf[newStart+i] - obuf[oldStart+i])
+	}
+
+	bsdc.Add = ctx.db.Bytes()
+	copyData := nbuf[match.copyStart()-newOffset : match.copyEnd-newOffset]
+	if cw.ownCopy {
+		ctx.cb.Reset()
+		ctx.cb.Write(copyData)
+		copyData = ctx.cb.Bytes()
+	}
+	bsdc.Copy = copyData
+
+	if ctx.Stats != nil && ctx.Stats.BiggestAdd < int64(len(bsdc.Add)) {
+		ctx.Stats.BiggestAdd = int64(len(bsdc.Add))
+	}
+
+	cw.prevMatch = match
+	return nil
+}
 
-		ctx.db.Reset()
-		ctx.db.Grow(match.addLength)
+// flush writes the pending control as messages of at most MessageSize bytes
+// of payload: add data first, then copy data, and only the last one seeks.
+// Applying them in order is the same as applying the whole control.
+func (cw *controlWriter) flush() error {
+	bsdc := &cw.bsdc
+	maxSize := cw.ctx.messageSize()
 
-		for i := 0; i < match.addLength; i++ {
-			ctx.db.WriteByte(nbuf[match.addNewStart+i] - obuf[match.addOldStart+i])
+	if int64(len(bsdc.Add)+len(bsdc.Copy)) <= maxSize {
+		return cw.writeMessage(bsdc)
+	}
+
+	chunk := &cw.chunk
+	add := bsdc.Add
+	copyData := bsdc.Copy
+
+	for {
+		addLength := int64(len(add))
+		if addLength > maxSize {
+			addLength = maxSize
 		}
+		chunk.Add = add[:addLength]
+		add = add[addLength:]
+
+		var copyLength int64
+		if len(add) == 0 {
+			copyLength = int64(len(copyData))
+			if copyLength > maxSize-addLength {
+				copyLength = maxSize - addLength
+			}
+		}
+		chunk.Copy = copyData[:copyLength]
+		copyData = copyData[copyLength:]
 
-		bsdc.Add = ctx.db.Bytes()
-		bsdc.Copy = nbuf[match.copyStart():match.copyEnd]
+		last := len(add) == 0 && len(copyData) == 0
+		chunk.Seek = 0
+		if last {
+			chunk.Seek = bsdc.Seek
+		}
 
-		if ctx.Stats != nil && ctx.Stats.BiggestAdd < int64(len(bsdc.Add)) {
-			ctx.Stats.BiggestAdd = int64(len(bsdc.Add))
+		err := cw.writeMessage(chunk)
+		if err != nil {
+			return err
 		}
 
-		prevMatch = match
+		if last {
+			return nil
+		}
 	}
+}
+
+// finish writes the last control, and the eof control
+func (cw *controlWriter) finish() error {
+	bsdc := &cw.bsdc
 
 	bsdc.Seek = 0
-	err = writeMessage(bsdc)
+	err := cw.flush()
 	if err != nil {
 		return err
 	}
 
 	bsdc.Reset()
 	bsdc.Eof = true
-	err = writeMessage(bsdc)
+	err = cw.writeMessage(bsdc)
 	if err != nil {
 		return err
 	}
@@ -147,8 +254,42 @@ func (ctx *DiffContext) writeMessages(obuf []byte, nbuf []byte, matches chan Mat
 // Do computes the difference between old and new, according to the bsdiff
 // algorithm, and writes the result to patch.
 func (ctx *DiffContext) Do(old, new io.Reader, writeMessage WriteMessageFunc, consumer *state.Consumer) error {
+	err := ctx.Filter.validate()
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	_, oldOk := old.(io.Seeker)
+	_, newOk := new.(io.Seeker)
+
+	if ctx.Filter != FilterNone {
+		old = newFilterReader(old, ctx.Filter)
+		new = newFilterReader(new, ctx.Filter)
+	}
+
+	if ctx.WindowSize > 0 {
+		if !oldOk || !newOk {
+			return errors.Wrap(fmt.Errorf("bsdiff: diffing in windows requires old and new to be seekable"), 0)
+		}
+		oldSeeker := old.(io.ReadSeeker)
+		newSeeker := new.(io.ReadSeeker)
+
+		oldSize, err := seekerSize(oldSeeker)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+
+		newSize, err := seekerSize(newSeeker)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+
+		if oldSize > ctx.WindowSize || newSize > ctx.WindowSize {
+			return ctx.doWindowed(oldSeeker, oldSize, newSeeker, newSize, writeMessage, consumer)
+		}
+	}
+
 	var memstats *runtime.MemStats
-	var err error
 
 	if ctx.MeasureMem {
 		memstats = &runtime.MemStats{}
@@ -162,23 +303,152 @@ func (ctx *DiffContext) Do(old, new io.Reader, writeMessage WriteMessageFunc, co
 		return err
 	}
 
-	obuf := ctx.obuf.Bytes()
-	obuflen := ctx.obuf.Len()
-
 	ctx.nbuf.Reset()
 	_, err = io.Copy(&ctx.nbuf, new)
 	if err != nil {
 		return err
 	}
 
-	nbuf := ctx.nbuf.Bytes()
-	nbuflen := ctx.nbuf.Len()
+	if ctx.MeasureMem {
+		runtime.ReadMemStats(memstats)
+		fmt.Fprintf(os.Stderr, "\nAllocated bytes after ReadAll: %s (%s total)", humanize.IBytes(uint64(memstats.Alloc)), humanize.IBytes(uint64(memstats.TotalAlloc)))
+	}
 
-	matches := make(chan Match, 256)
+	cw := newControlWriter(ctx, writeMessage, false)
+
+	err = ctx.diffBuffers(ctx.obuf.Bytes(), 0, ctx.nbuf.Bytes(), 0, cw, consumer)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	err = cw.finish()
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
 
 	if ctx.MeasureMem {
 		runtime.ReadMemStats(memstats)
-		fmt.Fprintf(os.Stderr, "\nAllocated bytes after ReadAll: %s (%s total)", humanize.IBytes(uint64(memstats.Alloc)), humanize.IBytes(uint64(memstats.TotalAlloc)))
+		consumer.Debugf("\nAllocated bytes after scan: %s (%s total)", humanize.IBytes(uint64(memstats.Alloc)), humanize.IBytes(uint64(memstats.TotalAlloc)))
+		fmt.Fprintf(os.Stderr, "\nAllocated bytes after scan: %s (%s total)", humanize.IBytes(uint64(memstats.Alloc)), humanize.IBytes(uint64(memstats.TotalAlloc)))
+	}
+
+	return nil
+}
+
+// doWindowed diffs the new file in windows of WindowSize/2 bytes, each against the
+// WindowSize region of the old file at the same relative position, so that only
+// that much has to be held in memory and suffix-sorted at once.
+func (ctx *DiffContext) doWindowed(old io.ReadSeeker, oldSize int64, new io.ReadSeeker, newSize int64, writeMessage WriteMessageFunc, consumer *state.Consumer) error {
+	windowSize := ctx.WindowSize
+	newWindowSize := windowSize / 2
+	if newWindowSize < 1 {
+		newWindowSize = 1
+	}
+
+	_, err := new.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	numWindows := (newSize + newWindowSize - 1) / newWindowSize
+	cw := newControlWriter(ctx, writeMessage, true)
+
+	for windowIndex := int64(0); windowIndex < numWindows; windowIndex++ {
+		newOffset := windowIndex * newWindowSize
+		newLength := newWindowSize
+		if newOffset+newLength > newSize {
+			newLength = newSize - newOffset
+		}
+
+		// center the old region on where the middle of the window would be
+		// if the whole file had been scaled.
+		center := int64(float64(newOffset+newLength/2) / float64(newSize) * float64(oldSize))
+		oldOffset := center - windowSize/2
+		if oldOffset+windowSize > oldSize {
+			oldOffset = oldSize - windowSize
+		}
+		if oldOffset < 0 {
+			oldOffset = 0
+		}
+		oldLength := windowSize
+		if oldOffset+oldLength > oldSize {
+			oldLength = oldSize - oldOffset
+		}
+
+		consumer.ProgressLabel(fmt.Sprintf("Window %d/%d: %s against %s...",
+			windowIndex+1, numWindows, humanize.IBytes(uint64(newLength)), humanize.IBytes(uint64(oldLength))))
+
+		_, err = old.Seek(oldOffset, os.SEEK_SET)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+
+		ctx.obuf.Reset()
+		_, err = io.CopyN(&ctx.obuf, old, oldLength)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+
+		ctx.nbuf.Reset()
+		_, err = io.CopyN(&ctx.nbuf, new, newLength)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+
+		err = ctx.diffBuffers(ctx.obuf.Bytes(), oldOffset, ctx.nbuf.Bytes(), newOffset, cw, consumer)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+	}
+
+	err = cw.finish()
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+func (ctx *DiffContext) messageSize() int64 {
+	if ctx.MessageSize > 0 && ctx.MessageSize < MaxMessageSize {
+		return ctx.MessageSize
+	}
+	return MaxMessageSize
+}
+
+func seekerSize(seeker io.Seeker) (int64, error) {
+	size, err := seeker.Seek(0, os.SEEK_END)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = seeker.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// diffBuffers suffix-sorts obuf, then finds matches for nbuf in it and hands them
+// to cw. obuf and nbuf start at oldOffset and newOffset in their respective files.
+func (ctx *DiffContext) diffBuffers(obuf []byte, oldOffset int64, nbuf []byte, newOffset int64, cw *controlWriter, consumer *state.Consumer) error {
+	if len(nbuf) == 0 {
+		return nil
+	}
+
+	if len(obuf) == 0 {
+		// nothing to match against, it's all fresh data
+		return cw.write(Match{
+			addOldStart: oldOffset,
+			addNewStart: newOffset,
+			copyEnd:     newOffset + int64(len(nbuf)),
+		}, obuf, oldOffset, nbuf, newOffset)
+	}
+
+	var memstats *runtime.MemStats
+	if ctx.MeasureMem {
+		memstats = &runtime.MemStats{}
 	}
 
 	partitions := ctx.Partitions
@@ -186,7 +456,7 @@ func (ctx *DiffContext) Do(old, new io.Reader, writeMessage WriteMessageFunc, co
 		partitions = 1
 	}
 
-	consumer.ProgressLabel(fmt.Sprintf("Sorting %s...", humanize.IBytes(uint64(obuflen))))
+	consumer.ProgressLabel(fmt.Sprintf("Sorting %s...", humanize.IBytes(uint64(len(obuf)))))
 	consumer.Progress(0.0)
 
 	startTime := time.Now()
@@ -195,7 +465,7 @@ func (ctx *DiffContext) Do(old, new io.Reader, writeMessage WriteMessageFunc, co
 		ctx.I = make([]int, len(obuf))
 	}
 
-	psa := NewPSA(partitions, obuf, ctx.I)
+	psa := NewPSA(partitions, obuf, ctx.I[:len(obuf)])
 
 	if ctx.Stats != nil {
 		ctx.Stats.TimeSpentSorting += time.Since(startTime)
@@ -206,11 +476,37 @@ func (ctx *DiffContext) Do(old, new io.Reader, writeMessage WriteMessageFunc, co
 		fmt.Fprintf(os.Stderr, "\nAllocated bytes after qsufsort: %s (%s total)", humanize.IBytes(uint64(memstats.Alloc)), humanize.IBytes(uint64(memstats.TotalAlloc)))
 	}
 
+	startTime = time.Now()
+
+	matches := make(chan Match, 256)
+	go func() {
+		ctx.scan(psa, obuf, oldOffset, nbuf, newOffset, partitions, matches, consumer)
+		close(matches)
+	}()
+
+	for match := range matches {
+		err := cw.write(match, obuf, oldOffset, nbuf, newOffset)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+	}
+
+	if ctx.Stats != nil {
+		ctx.Stats.TimeSpentScanning += time.Since(startTime)
+	}
+
+	return nil
+}
+
+// scan finds matches for nbuf in the suffix-sorted obuf, and sends them to
+// matches in order, with absolute positions.
+func (ctx *DiffContext) scan(psa *PSA, obuf []byte, oldOffset int64, nbuf []byte, newOffset int64, partitions int, matches chan Match, consumer *state.Consumer) {
+	obuflen := len(obuf)
+	nbuflen := len(nbuf)
+
 	consumer.ProgressLabel(fmt.Sprintf("Preparing to scan %s...", humanize.IBytes(uint64(nbuflen))))
 	consumer.Progress(0.0)
 
-	startTime = time.Now()
-
 	analyzeBlock := func(nbuflen int, nbuf []byte, offset int, blockMatches chan Match) {
 		var lenf int
 
@@ -292,10 +588,10 @@ func (ctx *DiffContext) Do(old, new io.Reader, writeMessage WriteMessageFunc, co
 				}
 
 				m := Match{
-					addOldStart: lastpos,
-					addNewStart: lastscan + offset,
-					addLength:   lenf,
-					copyEnd:     scan - lenb + offset,
+					addOldStart: int64(lastpos) + oldOffset,
+					addNewStart: int64(lastscan+offset) + newOffset,
+					addLength:   int64(lenf),
+					copyEnd:     int64(scan-lenb+offset) + newOffset,
 				}
 
 				// if not a no-op, send
@@ -315,6 +611,9 @@ func (ctx *DiffContext) Do(old, new io.Reader, writeMessage WriteMessageFunc, co
 
 	if numBlocks < partitions {
 		blockSize = nbuflen / partitions
+		if blockSize < 1 {
+			blockSize = 1
+		}
 		numBlocks = (nbuflen + blockSize - 1) / blockSize
 	}
 
@@ -366,50 +665,23 @@ func (ctx *DiffContext) Do(old, new io.Reader, writeMessage WriteMessageFunc, co
 		// fmt.Fprintf(os.Stderr, "Sent all blockworks\n")
 	}()
 
-	if ctx.MeasureMem {
-		runtime.ReadMemStats(memstats)
-		fmt.Fprintf(os.Stderr, "\nAllocated bytes after scan-prepare: %s (%s total)", humanize.IBytes(uint64(memstats.Alloc)), humanize.IBytes(uint64(memstats.TotalAlloc)))
-	}
-
 	consumer.ProgressLabel(fmt.Sprintf("Scanning %s (%d blocks of %s)...", humanize.IBytes(uint64(nbuflen)), numBlocks, humanize.IBytes(uint64(blockSize))))
 
-	// collect workers' results, forward them to consumer
-	go func() {
-		workerIndex := 0
-		for blockIndex := 0; blockIndex < numBlocks; blockIndex++ {
-			consumer.Progress(float64(blockIndex) / float64(numBlocks))
-			state := blockWorkersState[workerIndex]
+	// collect workers' results, forward them in order
+	workerIndex := 0
+	for blockIndex := 0; blockIndex < numBlocks; blockIndex++ {
+		consumer.Progress(float64(blockIndex) / float64(numBlocks))
+		state := blockWorkersState[workerIndex]
 
-			for match := range state.matches {
-				if match.eoc {
-					break
-				}
-
-				matches <- match
+		for match := range state.matches {
+			if match.eoc {
+				break
 			}
 
-			state.consumed <- true
-			workerIndex = (workerIndex + 1) % numWorkers
+			matches <- match
 		}
 
-		close(matches)
-	}()
-
-	err = ctx.writeMessages(obuf, nbuf, matches, writeMessage)
-	if err != nil {
-		return errors.Wrap(err, 0)
-	}
-
-	if ctx.Stats != nil {
-		ctx.Stats.TimeSpentScanning += time.Since(startTime)
-	}
-
-	if ctx.MeasureMem {
-		runtime.ReadMemStats(memstats)
-		consumer.Debugf("\nAllocated bytes after scan: %s (%s total)", humanize.IBytes(uint64(memstats.Alloc)), humanize.IBytes(uint64(memstats.TotalAlloc)))
-		fmt.Fprintf(os.Stderr, "\nAllocated bytes after scan: %s (%s total)", humanize.IBytes(uint64(memstats.Alloc)), humanize.IBytes(uint64(memstats.TotalAlloc)))
+		state.consumed <- true
+		workerIndex = (workerIndex + 1) % numWorkers
 	}
-
-	return nil
-
 }
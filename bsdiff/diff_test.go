@@ -0,0 +1,222 @@
+package bsdiff
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"github.com/go-errors/errors"
+	"github.com/golang/protobuf/proto"
+	"github.com/itchio/wharf/state"
+	"github.com/itchio/wharf/wire"
+)
+
+type messageLog struct {
+	messages []proto.Message
+}
+
+func (ml *messageLog) write(msg proto.Message) error {
+	ml.messages = append(ml.messages, proto.Clone(msg))
+	return nil
+}
+
+func (ml *messageLog) reader() ReadMessageFunc {
+	i := 0
+	return func(msg proto.Message) error {
+		if i >= len(ml.messages) {
+			return io.EOF
+		}
+		proto.Merge(msg, ml.messages[i])
+		i++
+		return nil
+	}
+}
+
+// freshBytes counts bytes that weren't found in the old file: copied
+// bytes, and non-zero add bytes
+func (ml *messageLog) freshBytes() int64 {
+	var size int64
+	for _, msg := range ml.messages {
+		ctrl := msg.(*Control)
+		size += int64(len(ctrl.Copy))
+		for _, b := range ctrl.Add {
+			if b != 0 {
+				size++
+			}
+		}
+	}
+	return size
+}
+
+func randomBytes(prng *rand.Rand, size int) []byte {
+	buf := make([]byte, size)
+	prng.Read(buf)
+	return buf
+}
+
+func Test_DiffWindowed(t *testing.T) {
+	prng := rand.New(rand.NewSource(0x42))
+
+	// a big, mostly text-like file
+	var chunks [][]byte
+	for i := 0; i < 64; i++ {
+		chunk := randomBytes(prng, 4096)
+		for j := range chunk {
+			chunk[j] = 'a' + chunk[j]%16
+		}
+		chunks = append(chunks, chunk)
+	}
+	obuf := bytes.Join(chunks, nil)
+
+	// the new version has some chunks changed, inserted, and removed
+	var newChunks [][]byte
+	for i, chunk := range chunks {
+		switch i % 10 {
+		case 3:
+			edited := append([]byte{}, chunk...)
+			edited[100] ^= 0xff
+			edited[2000] ^= 0xff
+			newChunks = append(newChunks, edited)
+		case 5:
+			newChunks = append(newChunks, chunk, randomBytes(prng, 1000))
+		case 7:
+			// removed
+		default:
+			newChunks = append(newChunks, chunk)
+		}
+	}
+	nbuf := bytes.Join(newChunks, nil)
+
+	consumer := &state.Consumer{}
+
+	for _, windowSize := range []int64{0, 16 * 1024, 64 * 1024, int64(len(obuf) + len(nbuf))} {
+		t.Logf("Diffing %d -> %d bytes, window size %d", len(obuf), len(nbuf), windowSize)
+
+		ctx := &DiffContext{
+			WindowSize: windowSize,
+			Partitions: 2,
+		}
+
+		ml := &messageLog{}
+		assert.NoError(t, ctx.Do(bytes.NewReader(obuf), bytes.NewReader(nbuf), ml.write, consumer))
+
+		patched := applyPatch(t, obuf, int64(len(nbuf)), ml)
+		assert.True(t, bytes.Equal(nbuf, patched), "patched file should match new file")
+
+		// fresh data is mostly the inserted chunks
+		assert.True(t, ml.freshBytes() < int64(len(nbuf)/10), "most of the new file should come from the old file")
+	}
+
+	t.Logf("Diffing in windows without seekers")
+	ctx := &DiffContext{
+		WindowSize: 1024,
+	}
+	ml := &messageLog{}
+	err := ctx.Do(io.LimitReader(bytes.NewReader(obuf), int64(len(obuf))), bytes.NewReader(nbuf), ml.write, consumer)
+	assert.Error(t, err)
+}
+
+func Test_DiffWindowedEdgeCases(t *testing.T) {
+	prng := rand.New(rand.NewSource(0x43))
+	consumer := &state.Consumer{}
+
+	cases := []struct {
+		oldSize int
+		newSize int
+	}{
+		{0, 5000},
+		{5000, 0},
+		{5000, 1},
+		{1, 5000},
+		{3000, 9000},
+		{9000, 3000},
+	}
+
+	for _, c := range cases {
+		obuf := randomBytes(prng, c.oldSize)
+		nbuf := append(randomBytes(prng, c.newSize/2), obuf...)
+		nbuf = append(nbuf, randomBytes(prng, c.newSize)...)
+		nbuf = nbuf[:c.newSize]
+
+		ctx := &DiffContext{
+			WindowSize: 1000,
+		}
+
+		ml := &messageLog{}
+		assert.NoError(t, ctx.Do(bytes.NewReader(obuf), bytes.NewReader(nbuf), ml.write, consumer))
+
+		patched := applyPatch(t, obuf, int64(len(nbuf)), ml)
+		assert.True(t, bytes.Equal(nbuf, patched), "%d -> %d: patched file should match new file", c.oldSize, c.newSize)
+	}
+}
+
+// applyPatch applies a patch to obuf, returning the new file
+func applyPatch(t *testing.T, obuf []byte, newSize int64, ml *messageLog) []byte {
+	out := new(bytes.Buffer)
+	assert.NoError(t, Patch(bytes.NewReader(obuf), out, newSize, ml.reader()))
+	return out.Bytes()
+}
+
+func Test_DiffMessageSize(t *testing.T) {
+	prng := rand.New(rand.NewSource(0x44))
+	consumer := &state.Consumer{}
+
+	// long, lightly-modified runs make large adds, fresh data makes large copies
+	obuf := randomBytes(prng, 64*1024)
+	nbuf := append([]byte{}, obuf[:20*1024]...)
+	for i := 0; i < len(nbuf); i += 100 {
+		nbuf[i]++
+	}
+	nbuf = append(nbuf, randomBytes(prng, 12*1024)...)
+	nbuf = append(nbuf, obuf[30*1024:]...)
+
+	const messageSize = 1000
+
+	splitLog := &messageLog{}
+	ctx := &DiffContext{
+		MessageSize: messageSize,
+	}
+	assert.NoError(t, ctx.Do(bytes.NewReader(obuf), bytes.NewReader(nbuf), splitLog.write, consumer))
+
+	for _, msg := range splitLog.messages {
+		ctrl := msg.(*Control)
+		assert.True(t, len(ctrl.Add)+len(ctrl.Copy) <= messageSize, "controls should be split")
+	}
+
+	for _, maxMessageSize := range []int64{0, messageSize} {
+		out := new(bytes.Buffer)
+		assert.NoError(t, PatchWithMaxMessageSize(bytes.NewReader(obuf), out, int64(len(nbuf)), maxMessageSize, splitLog.reader()))
+		assert.True(t, bytes.Equal(nbuf, out.Bytes()), "patched file should match new file")
+	}
+
+	unsplitLog := &messageLog{}
+	ctx = &DiffContext{}
+	assert.NoError(t, ctx.Do(bytes.NewReader(obuf), bytes.NewReader(nbuf), unsplitLog.write, consumer))
+	assert.True(t, len(unsplitLog.messages) < len(splitLog.messages))
+
+	err := PatchWithMaxMessageSize(bytes.NewReader(obuf), new(bytes.Buffer), int64(len(nbuf)), messageSize, unsplitLog.reader())
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, ErrMessageTooLarge))
+
+	assert.EqualValues(t, nbuf, applyPatch(t, obuf, int64(len(nbuf)), unsplitLog))
+
+	// limiting message length on the wire refuses large controls before reading them
+	wirePatch := func(ml *messageLog) error {
+		buf := new(bytes.Buffer)
+		wctx := wire.NewWriteContext(buf)
+		for _, msg := range ml.messages {
+			assert.NoError(t, wctx.WriteMessage(msg))
+		}
+
+		rctx := wire.NewReadContext(bytes.NewReader(buf.Bytes()))
+		rctx.SetMaxMessageSize(messageSize + MaxControlOverhead)
+		return PatchWithMaxMessageSize(bytes.NewReader(obuf), new(bytes.Buffer), int64(len(nbuf)), messageSize, rctx.ReadMessage)
+	}
+	assert.NoError(t, wirePatch(splitLog))
+
+	err = wirePatch(unsplitLog)
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, wire.ErrMessageTooLarge))
+}
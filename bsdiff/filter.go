@@ -0,0 +1,322 @@
+package bsdiff
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/go-errors/errors"
+)
+
+// A Filter is a reversible transform applied to both old and new files before
+// diffing, and reversed after patching. Executable filters turn relative branch
+// targets into absolute ones, so that they don't all change when code moves,
+// which makes for much smaller adds.
+//
+// Filters work on blocks of filterBlockSize bytes, aligned on file offsets, so
+// that any part of a file can be filtered without reading what comes before.
+type Filter int32
+
+const (
+	// FilterNone leaves files as-is
+	FilterNone Filter = 0
+	// FilterX86 converts the targets of x86 and x86-64 relative calls and jumps (E8/E9)
+	FilterX86 Filter = 1
+	// FilterARM64 converts the targets of ARM64 branch-with-link (BL) instructions
+	FilterARM64 Filter = 2
+)
+
+const filterBlockSize = 64 * 1024
+
+func (f Filter) String() string {
+	switch f {
+	case FilterNone:
+		return "none"
+	case FilterX86:
+		return "x86"
+	case FilterARM64:
+		return "arm64"
+	default:
+		return fmt.Sprintf("unknown filter %d", int32(f))
+	}
+}
+
+func (f Filter) validate() error {
+	switch f {
+	case FilterNone, FilterX86, FilterARM64:
+		return nil
+	default:
+		return fmt.Errorf("bsdiff: unsupported filter %d", int32(f))
+	}
+}
+
+// apply filters (or unfilters, if decode is true) a block starting at
+// offset pos in the file
+func (f Filter) apply(block []byte, pos int64, decode bool) {
+	switch f {
+	case FilterX86:
+		filterX86(block, pos, decode)
+	case FilterARM64:
+		filterARM64(block, pos, decode)
+	}
+}
+
+// filterX86 only converts displacements that fit in 25 signed bits (most of
+// them, in practice), and keeps the result within 25 signed bits. The 4 bytes
+// after an opcode are never looked at for another opcode, converted or not, so
+// that the decoder makes the exact same decisions as the encoder.
+func filterX86(block []byte, pos int64, decode bool) {
+	for i := 0; i+5 <= len(block); {
+		if block[i] != 0xe8 && block[i] != 0xe9 {
+			i++
+			continue
+		}
+
+		if block[i+4] != 0x00 && block[i+4] != 0xff {
+			i += 5
+			continue
+		}
+
+		pc := uint32(pos + int64(i) + 5)
+		v := binary.LittleEndian.Uint32(block[i+1:])
+		if decode {
+			v -= pc
+		} else {
+			v += pc
+		}
+
+		// sign-extend from bit 24
+		v &= 0x1ffffff
+		if v&0x1000000 != 0 {
+			v |= 0xfe000000
+		}
+		binary.LittleEndian.PutUint32(block[i+1:], v)
+
+		i += 5
+	}
+}
+
+func filterARM64(block []byte, pos int64, decode bool) {
+	// instructions are aligned on 4 bytes in the file
+	start := int((4 - pos%4) % 4)
+
+	for i := start; i+4 <= len(block); i += 4 {
+		insn := binary.LittleEndian.Uint32(block[i:])
+		if insn&0xfc000000 != 0x94000000 {
+			continue
+		}
+
+		pc := uint32((pos + int64(i)) / 4)
+		imm := insn & 0x03ffffff
+		if decode {
+			imm -= pc
+		} else {
+			imm += pc
+		}
+		binary.LittleEndian.PutUint32(block[i:], 0x94000000|(imm&0x03ffffff))
+	}
+}
+
+// DetectFilter returns the filter suited to an executable, given its first few
+// kilobytes, or FilterNone if it doesn't look like a PE, ELF or Mach-O
+// executable for x86 or ARM64.
+func DetectFilter(header []byte) Filter {
+	le := binary.LittleEndian
+
+	switch {
+	case len(header) >= 0x40 && header[0] == 'M' && header[1] == 'Z':
+		// PE
+		peOffset := int64(le.Uint32(header[0x3c:]))
+		if peOffset+6 > int64(len(header)) || string(header[peOffset:peOffset+4]) != "PE\x00\x00" {
+			return FilterNone
+		}
+		switch le.Uint16(header[peOffset+4:]) {
+		case 0x014c, 0x8664:
+			return FilterX86
+		case 0xaa64:
+			return FilterARM64
+		}
+	case len(header) >= 20 && string(header[0:4]) == "\x7fELF" && header[5] == 1:
+		// little-endian ELF
+		switch le.Uint16(header[18:]) {
+		case 3, 62:
+			return FilterX86
+		case 183:
+			return FilterARM64
+		}
+	case len(header) >= 8 && (le.Uint32(header) == 0xfeedface || le.Uint32(header) == 0xfeedfacf):
+		// Mach-O
+		switch le.Uint32(header[4:]) {
+		case 0x00000007, 0x01000007:
+			return FilterX86
+		case 0x0100000c:
+			return FilterARM64
+		}
+	}
+
+	return FilterNone
+}
+
+// A filterReader filters what it reads from an underlying reader, one block at
+// a time. It can seek if the underlying reader can.
+type filterReader struct {
+	reader io.Reader
+	filter Filter
+
+	// position in the filtered stream
+	pos int64
+	// position in the underlying reader, or -1 if unknown
+	readerPos int64
+
+	block      []byte
+	blockStart int64
+	blockValid bool
+}
+
+var _ io.ReadSeeker = (*filterReader)(nil)
+
+func newFilterReader(reader io.Reader, filter Filter) *filterReader {
+	return &filterReader{
+		reader: reader,
+		filter: filter,
+		block:  make([]byte, filterBlockSize),
+	}
+}
+
+func (fr *filterReader) Read(p []byte) (int, error) {
+	blockStart := fr.pos - fr.pos%filterBlockSize
+	if !fr.blockValid || fr.blockStart != blockStart {
+		err := fr.loadBlock(blockStart)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	offset := int(fr.pos - fr.blockStart)
+	if offset >= len(fr.block) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, fr.block[offset:])
+	fr.pos += int64(n)
+	return n, nil
+}
+
+func (fr *filterReader) loadBlock(blockStart int64) error {
+	if fr.readerPos != blockStart {
+		seeker, ok := fr.reader.(io.Seeker)
+		if !ok {
+			return errors.Wrap(fmt.Errorf("bsdiff: filtered reader can't seek"), 0)
+		}
+
+		_, err := seeker.Seek(blockStart, os.SEEK_SET)
+		if err != nil {
+			return err
+		}
+		fr.readerPos = blockStart
+	}
+
+	fr.block = fr.block[:filterBlockSize]
+	n, err := io.ReadFull(fr.reader, fr.block)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		fr.blockValid = false
+		fr.readerPos = -1
+		return err
+	}
+
+	fr.block = fr.block[:n]
+	fr.readerPos += int64(n)
+	fr.blockStart = blockStart
+	fr.blockValid = true
+	fr.filter.apply(fr.block, blockStart, false)
+	return nil
+}
+
+func (fr *filterReader) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := fr.reader.(io.Seeker)
+	if !ok {
+		return 0, errors.Wrap(fmt.Errorf("bsdiff: filtered reader can't seek"), 0)
+	}
+
+	switch whence {
+	case os.SEEK_SET:
+		fr.pos = offset
+	case os.SEEK_CUR:
+		fr.pos += offset
+	case os.SEEK_END:
+		size, err := seeker.Seek(0, os.SEEK_END)
+		if err != nil {
+			return 0, err
+		}
+		fr.readerPos = size
+		fr.pos = size + offset
+	}
+
+	if fr.pos < 0 {
+		return 0, fmt.Errorf("bsdiff: negative position in filtered reader")
+	}
+	return fr.pos, nil
+}
+
+// A filterWriter unfilters what's written to it, one block at a time. flush
+// must be called once everything has been written.
+type filterWriter struct {
+	writer io.Writer
+	filter Filter
+
+	block      []byte
+	blockStart int64
+}
+
+var _ io.Writer = (*filterWriter)(nil)
+
+func newFilterWriter(writer io.Writer, filter Filter) *filterWriter {
+	return &filterWriter{
+		writer: writer,
+		filter: filter,
+		block:  make([]byte, 0, filterBlockSize),
+	}
+}
+
+func (fw *filterWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		n := filterBlockSize - len(fw.block)
+		if n > len(p) {
+			n = len(p)
+		}
+
+		fw.block = append(fw.block, p[:n]...)
+		p = p[n:]
+		written += n
+
+		if len(fw.block) == filterBlockSize {
+			err := fw.flush()
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// flush unfilters and writes the current block, even if it's not full,
+// so it must only be called at the end.
+func (fw *filterWriter) flush() error {
+	if len(fw.block) == 0 {
+		return nil
+	}
+
+	fw.filter.apply(fw.block, fw.blockStart, true)
+	_, err := fw.writer.Write(fw.block)
+	if err != nil {
+		return err
+	}
+
+	fw.blockStart += int64(len(fw.block))
+	fw.block = fw.block[:0]
+	return nil
+}
@@ -0,0 +1,176 @@
+package bsdiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"github.com/itchio/wharf/state"
+)
+
+func Test_FilterRoundTrip(t *testing.T) {
+	prng := rand.New(rand.NewSource(0x45))
+
+	for _, filter := range []Filter{FilterX86, FilterARM64} {
+		original := randomBytes(prng, filterBlockSize*3+123)
+		for i := 0; i < len(original); i += 7 {
+			// plenty of call opcodes and BL instructions
+			original[i] = 0xe8
+			if i%4 == 0 && i+4 <= len(original) {
+				original[i+3] = 0x94
+			}
+		}
+
+		filtered, err := ioutil.ReadAll(newFilterReader(bytes.NewReader(original), filter))
+		assert.NoError(t, err)
+		assert.EqualValues(t, len(original), len(filtered))
+		assert.False(t, bytes.Equal(original, filtered), "%s filter should change something", filter)
+
+		// write in odd-sized chunks
+		out := new(bytes.Buffer)
+		fw := newFilterWriter(out, filter)
+		for i := 0; i < len(filtered); i += 1000 {
+			end := i + 1000
+			if end > len(filtered) {
+				end = len(filtered)
+			}
+			_, err = fw.Write(filtered[i:end])
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, fw.flush())
+		assert.True(t, bytes.Equal(original, out.Bytes()), "%s filter should round-trip", filter)
+
+		// read any part of the file
+		fr := newFilterReader(bytes.NewReader(original), filter)
+		for _, offset := range []int64{filterBlockSize*2 + 5, 17, filterBlockSize - 1} {
+			_, err = fr.Seek(offset, 0)
+			assert.NoError(t, err)
+			part := make([]byte, 300)
+			_, err = io.ReadFull(fr, part)
+			assert.NoError(t, err)
+			assert.EqualValues(t, filtered[offset:offset+int64(len(part))], part)
+		}
+	}
+}
+
+// fakeX86 lays out functions that call each other (mostly the first few, think
+// runtime and standard library), with calls encoded relative to the instruction
+// that follows them, like a compiler would.
+func fakeX86(numFunctions int, padding []int) []byte {
+	const functionSize = 256
+
+	var layout []int
+	offset := 0
+	for i := 0; i < numFunctions; i++ {
+		offset += padding[i]
+		layout = append(layout, offset)
+		offset += functionSize
+	}
+
+	code := make([]byte, offset)
+	body := rand.New(rand.NewSource(0x99))
+	for i, start := range layout {
+		fn := code[start : start+functionSize]
+		for j := 0; j+5 <= len(fn); j += 8 {
+			fn[j] = 0xe8
+			callee := layout[body.Intn(32)]
+			if body.Intn(8) == 0 {
+				callee = layout[body.Intn(numFunctions)]
+			}
+			binary.LittleEndian.PutUint32(fn[j+1:], uint32(callee-(start+j+5)))
+			fn[j+5] = byte(i)
+			fn[j+6] = byte(body.Intn(256))
+			fn[j+7] = 0x90
+		}
+	}
+	return code
+}
+
+func Test_FilterX86Diff(t *testing.T) {
+	consumer := &state.Consumer{}
+
+	const numFunctions = 1024
+	oldPadding := make([]int, numFunctions)
+	newPadding := make([]int, numFunctions)
+	// some functions grew, so everything after them moved
+	newPadding[100] = 64
+	newPadding[500] = 300
+
+	obuf := fakeX86(numFunctions, oldPadding)
+	nbuf := fakeX86(numFunctions, newPadding)
+
+	var freshBytes []int64
+	for _, windowSize := range []int64{0, 96 * 1024} {
+		for _, filter := range []Filter{FilterNone, FilterX86} {
+			ctx := &DiffContext{
+				Filter:     filter,
+				WindowSize: windowSize,
+			}
+
+			ml := &messageLog{}
+			assert.NoError(t, ctx.Do(bytes.NewReader(obuf), bytes.NewReader(nbuf), ml.write, consumer))
+			t.Logf("With %s filter (window size %d): %d fresh bytes", filter, windowSize, ml.freshBytes())
+			freshBytes = append(freshBytes, ml.freshBytes())
+
+			pc := &PatchContext{
+				Filter: filter,
+			}
+			out := new(bytes.Buffer)
+			assert.NoError(t, pc.Patch(bytes.NewReader(obuf), out, int64(len(nbuf)), ml.reader()))
+			assert.True(t, bytes.Equal(nbuf, out.Bytes()), "patched file should match new file")
+		}
+	}
+
+	assert.True(t, freshBytes[1] < freshBytes[0]/4, "filter should make for a much smaller patch")
+	assert.True(t, freshBytes[3] < freshBytes[2]/4, "filter should make for a much smaller patch in windows")
+
+	ctx := &DiffContext{
+		Filter: Filter(42),
+	}
+	assert.Error(t, ctx.Do(bytes.NewReader(obuf), bytes.NewReader(nbuf), (&messageLog{}).write, consumer))
+}
+
+func Test_DetectFilter(t *testing.T) {
+	pe := func(machine uint16) []byte {
+		header := make([]byte, 0x200)
+		copy(header, "MZ")
+		binary.LittleEndian.PutUint32(header[0x3c:], 0x80)
+		copy(header[0x80:], "PE\x00\x00")
+		binary.LittleEndian.PutUint16(header[0x84:], machine)
+		return header
+	}
+
+	elf := func(machine uint16) []byte {
+		header := make([]byte, 64)
+		copy(header, "\x7fELF\x02\x01")
+		binary.LittleEndian.PutUint16(header[18:], machine)
+		return header
+	}
+
+	machO := func(cpuType uint32) []byte {
+		header := make([]byte, 32)
+		binary.LittleEndian.PutUint32(header, 0xfeedfacf)
+		binary.LittleEndian.PutUint32(header[4:], cpuType)
+		return header
+	}
+
+	assert.EqualValues(t, FilterX86, DetectFilter(pe(0x8664)))
+	assert.EqualValues(t, FilterX86, DetectFilter(pe(0x014c)))
+	assert.EqualValues(t, FilterARM64, DetectFilter(pe(0xaa64)))
+	assert.EqualValues(t, FilterNone, DetectFilter(pe(0x01c4)))
+
+	assert.EqualValues(t, FilterX86, DetectFilter(elf(62)))
+	assert.EqualValues(t, FilterARM64, DetectFilter(elf(183)))
+	assert.EqualValues(t, FilterNone, DetectFilter(elf(40)))
+
+	assert.EqualValues(t, FilterX86, DetectFilter(machO(0x01000007)))
+	assert.EqualValues(t, FilterARM64, DetectFilter(machO(0x0100000c)))
+
+	assert.EqualValues(t, FilterNone, DetectFilter([]byte("MZ")))
+	assert.EqualValues(t, FilterNone, DetectFilter([]byte("just some text, nothing to see here")))
+	assert.EqualValues(t, FilterNone, DetectFilter(nil))
+}
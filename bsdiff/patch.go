@@ -15,16 +15,64 @@ import (
 // than specified
 var ErrCorrupt = errors.New("corrupt patch")
 
+// ErrMessageTooLarge indicates that a patch contains a control larger than
+// what the patcher accepts
+var ErrMessageTooLarge = errors.New("bsdiff control message too large")
+
 // ReadMessageFunc should read the passed protobuf and relay any errors.
 // See the `wire` package for an example implementation.
 type ReadMessageFunc func(msg proto.Message) error
 
 // Patch applies patch to old, according to the bspatch algorithm,
-// and writes the result to new.
+// and writes the result to new. Controls of any size are accepted.
 func Patch(old io.ReadSeeker, new io.Writer, newSize int64, readMessage ReadMessageFunc) error {
+	pc := &PatchContext{}
+	return pc.Patch(old, new, newSize, readMessage)
+}
+
+// PatchWithMaxMessageSize is like Patch, but rejects controls carrying more
+// than maxMessageSize bytes of add and copy data. 0 means no limit, which
+// patches made before controls were split need.
+//
+// Controls are only checked once readMessage has returned them: to bound memory
+// usage, readMessage itself must refuse large messages, see MaxControlOverhead.
+func PatchWithMaxMessageSize(old io.ReadSeeker, new io.Writer, newSize int64, maxMessageSize int64, readMessage ReadMessageFunc) error {
+	pc := &PatchContext{
+		MaxMessageSize: maxMessageSize,
+	}
+	return pc.Patch(old, new, newSize, readMessage)
+}
+
+// PatchContext holds settings for the patch process
+type PatchContext struct {
+	// MaxMessageSize is the largest amount of add and copy data a control
+	// may carry. 0 means no limit. See PatchWithMaxMessageSize.
+	MaxMessageSize int64
+
+	// Filter must be the one the patch was made with, see DiffContext.Filter
+	Filter Filter
+}
+
+// Patch applies patch to old, according to the bspatch algorithm,
+// and writes the result to new.
+func (pc *PatchContext) Patch(old io.ReadSeeker, new io.Writer, newSize int64, readMessage ReadMessageFunc) error {
 	var oldpos, newpos int64
 	var err error
 
+	err = pc.Filter.validate()
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	var fw *filterWriter
+	if pc.Filter != FilterNone {
+		old = newFilterReader(old, pc.Filter)
+		fw = newFilterWriter(new, pc.Filter)
+		new = fw
+	}
+
+	maxMessageSize := pc.MaxMessageSize
+
 	ctrl := &Control{}
 
 	for {
@@ -39,6 +87,10 @@ func Patch(old io.ReadSeeker, new io.Writer, newSize int64, readMessage ReadMess
 			break
 		}
 
+		if maxMessageSize > 0 && int64(len(ctrl.Add)+len(ctrl.Copy)) > maxMessageSize {
+			return errors.Wrap(ErrMessageTooLarge, 0)
+		}
+
 		// Sanity-check
 		if newpos+int64(len(ctrl.Add)) > newSize {
 			return errors.Wrap(ErrCorrupt, 0)
@@ -79,6 +131,13 @@ func Patch(old io.ReadSeeker, new io.Writer, newSize int64, readMessage ReadMess
 		}
 	}
 
+	if fw != nil {
+		err = fw.flush()
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+	}
+
 	if newpos != newSize {
 		return fmt.Errorf("bsdiff: expected new file to be %d, was %d (%s difference)", newSize, newpos, humanize.IBytes(uint64(newSize-newpos)))
 	}
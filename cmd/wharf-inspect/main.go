@@ -0,0 +1,65 @@
+// wharf-inspect dumps any wharf file (patch, signature, manifest or wounds)
+// as JSON or textproto.
+//
+//	wharf-inspect [-format json|text] [-messages] FILE
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/itchio/wharf/pwr/inspect"
+
+	_ "github.com/itchio/wharf/decompressors/cbrotli"
+	_ "github.com/itchio/wharf/decompressors/gzip"
+	_ "github.com/itchio/wharf/decompressors/zstd"
+)
+
+func main() {
+	format := flag.String("format", "json", "output format: json or text (textproto)")
+	messages := flag.Bool("messages", false, "dump every op, hash or wound, not just statistics")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-format json|text] [-messages] FILE\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err := run(flag.Arg(0), *format, *messages)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "wharf-inspect: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+func run(path string, format string, messages bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	inspector := &inspect.Inspector{
+		Messages: messages,
+	}
+
+	dump, err := inspector.Read(file)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "json":
+		return dump.WriteJSON(os.Stdout)
+	case "text":
+		return dump.WriteText(os.Stdout)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
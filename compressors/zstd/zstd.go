@@ -4,6 +4,7 @@ import (
 	"io"
 
 	"github.com/Datadog/zstd"
+	kzstd "github.com/klauspost/compress/zstd"
 
 	"github.com/itchio/wharf/pwr"
 )
@@ -14,6 +15,23 @@ func (gc *zstdCompressor) Apply(writer io.Writer, quality int32) (io.Writer, err
 	return zstd.NewWriterLevel(writer, int(quality)), nil
 }
 
+// ApplyPatchFrom compresses with ref as a raw dictionary. The Datadog bindings
+// can't change the window size, so this uses a pure-go encoder, which only has
+// a handful of levels: params.Quality is mapped to the closest one. Only the
+// best (10 and up) keeps looking for matches across the whole window.
+func (gc *zstdCompressor) ApplyPatchFrom(writer io.Writer, ref []byte, params *pwr.ZstdPatchParams) (io.WriteCloser, error) {
+	opts := []kzstd.EOption{
+		kzstd.WithEncoderLevel(kzstd.EncoderLevelFromZstd(int(params.Quality))),
+		kzstd.WithWindowSize(int(params.WindowSize)),
+		kzstd.WithEncoderConcurrency(1),
+	}
+	if len(ref) > 0 {
+		opts = append(opts, kzstd.WithEncoderDictRaw(0, ref))
+	}
+
+	return kzstd.NewWriter(writer, opts...)
+}
+
 func init() {
 	pwr.RegisterCompressor(pwr.CompressionAlgorithm_ZSTD, &zstdCompressor{})
 }
@@ -4,6 +4,8 @@ import (
 	"io"
 
 	"github.com/Datadog/zstd"
+	kzstd "github.com/klauspost/compress/zstd"
+
 	"github.com/itchio/wharf/pwr"
 )
 
@@ -13,6 +15,24 @@ func (zd *zstdDecompressor) Apply(reader io.Reader) (io.Reader, error) {
 	return zstd.NewReader(reader), nil
 }
 
+// ApplyPatchFrom decompresses with ref as a raw dictionary, refusing frames
+// that need a larger window than params allows.
+func (zd *zstdDecompressor) ApplyPatchFrom(reader io.Reader, ref []byte, params *pwr.ZstdPatchParams) (io.ReadCloser, error) {
+	opts := []kzstd.DOption{
+		kzstd.WithDecoderMaxWindow(uint64(params.WindowSize)),
+		kzstd.WithDecoderConcurrency(1),
+	}
+	if len(ref) > 0 {
+		opts = append(opts, kzstd.WithDecoderDictRaw(0, ref))
+	}
+
+	decoder, err := kzstd.NewReader(reader, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
 func init() {
 	pwr.RegisterDecompressor(pwr.CompressionAlgorithm_ZSTD, &zstdDecompressor{})
 }
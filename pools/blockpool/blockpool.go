@@ -18,6 +18,12 @@ type BlockPool struct {
 	Downstream Sink
 	Consumer   *state.Consumer
 
+	// ReadAhead is the number of blocks readers fetch in advance, in
+	// parallel, each from its own clone of Upstream. This helps a lot with
+	// high-latency sources (for example, when copying a container out of a
+	// remote pool). 0 or 1 means blocks are fetched synchronously, one at a time.
+	ReadAhead int
+
 	reader *Reader
 }
 
@@ -2,37 +2,113 @@ package blockpool
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 
-	"github.com/Datadog/zstd"
 	"github.com/go-errors/errors"
+	"github.com/itchio/wharf/pwr"
+
+	// blocks are compressed with zstd unless specified otherwise,
+	// and older block stores only contain zstd blocks
+	_ "github.com/itchio/wharf/compressors/zstd"
+	_ "github.com/itchio/wharf/decompressors/zstd"
+)
+
+// Compressed blocks start with a small header: blockHeaderMagic, followed by
+// a single byte holding the pwr.CompressionAlgorithm used for the rest of the
+// block. CompressionAlgorithm_NONE means the block is stored as-is.
+//
+// Blocks written before the header existed are plain zstd frames: they're
+// recognized by the zstd magic number, which can't be mistaken for ours.
+const (
+	blockHeaderMagic = 0xb7
+	blockHeaderSize  = 2
 )
 
+var zstdFrameMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// DefaultBlockCompression is used by Compressors that don't specify settings
+var DefaultBlockCompression = &pwr.CompressionSettings{
+	Algorithm: pwr.CompressionAlgorithm_ZSTD,
+	Quality:   9,
+}
+
 /////////////////////////////
 // Compressor
 /////////////////////////////
 
-// A Compressor compresses blocks with ztsd-q9
+// A Compressor compresses blocks with any algorithm registered with
+// pwr.RegisterCompressor (zstd-q9 by default). Blocks that don't get
+// any smaller (already-compressed media, for example) are stored uncompressed.
 type Compressor struct {
-	compressedBuf []byte
+	// optional
+	Settings *pwr.CompressionSettings
+
+	// internal
+	compressedBuf *bytes.Buffer
 }
 
+// Clone returns a copy of this compressor, with the same settings
 func (c *Compressor) Clone() *Compressor {
-	return &Compressor{}
+	return &Compressor{
+		Settings: c.Settings,
+	}
 }
 
-// Store first compresses the data, then stores it into the underlying sink
+// Compress writes a header and the compressed version of in to writer
 func (c *Compressor) Compress(writer io.Writer, in []byte) error {
+	settings := c.Settings
+	if settings == nil {
+		settings = DefaultBlockCompression
+	}
+
 	if c.compressedBuf == nil {
-		c.compressedBuf = make([]byte, BigBlockSize*2)
+		c.compressedBuf = new(bytes.Buffer)
+		c.compressedBuf.Grow(int(BigBlockSize * 2))
+	}
+	c.compressedBuf.Reset()
+
+	algorithm := settings.Algorithm
+	if algorithm != pwr.CompressionAlgorithm_NONE {
+		compressor := pwr.GetCompressor(algorithm)
+		if compressor == nil {
+			return errors.Wrap(fmt.Errorf("no compressor registered for %s", algorithm.String()), 1)
+		}
+
+		cw, err := compressor.Apply(c.compressedBuf, settings.Quality)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+
+		_, err = cw.Write(in)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+
+		if closer, ok := cw.(io.Closer); ok {
+			err = closer.Close()
+			if err != nil {
+				return errors.Wrap(err, 1)
+			}
+		}
+
+		if c.compressedBuf.Len() >= len(in) {
+			// compression didn't help, don't make decompression pay for it
+			algorithm = pwr.CompressionAlgorithm_NONE
+		}
+	}
+
+	payload := in
+	if algorithm != pwr.CompressionAlgorithm_NONE {
+		payload = c.compressedBuf.Bytes()
 	}
 
-	compressedBuf, err := zstd.CompressLevel(c.compressedBuf, in, 9)
+	_, err := writer.Write([]byte{blockHeaderMagic, byte(algorithm)})
 	if err != nil {
 		return errors.Wrap(err, 1)
 	}
 
-	_, err = writer.Write(compressedBuf)
+	_, err = writer.Write(payload)
 	if err != nil {
 		return errors.Wrap(err, 1)
 	}
@@ -44,16 +120,18 @@ func (c *Compressor) Compress(writer io.Writer, in []byte) error {
 // Decompressor
 /////////////////////////////
 
-// A Decompressor decompresses zstd-compressed blocks
+// A Decompressor decompresses blocks written by a Compressor, with whichever
+// algorithm is specified in their header.
 type Decompressor struct {
 	buffer *bytes.Buffer
 }
 
+// Clone returns a copy of this decompressor
 func (d *Decompressor) Clone() *Decompressor {
 	return &Decompressor{}
 }
 
-// Fetch first fetches from the underlying source, then decompresses
+// Decompress reads a whole block from reader and decompresses it into out
 func (d *Decompressor) Decompress(out []byte, reader io.Reader) (int, error) {
 	if d.buffer == nil {
 		d.buffer = new(bytes.Buffer)
@@ -62,15 +140,76 @@ func (d *Decompressor) Decompress(out []byte, reader io.Reader) (int, error) {
 
 	d.buffer.Reset()
 
-	compressedBytes, err := io.Copy(d.buffer, reader)
+	_, err := io.Copy(d.buffer, reader)
+	if err != nil {
+		return 0, errors.Wrap(err, 1)
+	}
+
+	block := d.buffer.Bytes()
+
+	var algorithm pwr.CompressionAlgorithm
+	var payload []byte
+
+	switch {
+	case bytes.HasPrefix(block, zstdFrameMagic):
+		algorithm = pwr.CompressionAlgorithm_ZSTD
+		payload = block
+	case len(block) >= blockHeaderSize && block[0] == blockHeaderMagic:
+		algorithm = pwr.CompressionAlgorithm(block[1])
+		payload = block[blockHeaderSize:]
+	default:
+		return 0, errors.Wrap(fmt.Errorf("invalid block header"), 1)
+	}
+
+	if algorithm == pwr.CompressionAlgorithm_NONE {
+		if len(payload) > len(out) {
+			return 0, errors.Wrap(fmt.Errorf("block too large: %d bytes, expected at most %d", len(payload), len(out)), 1)
+		}
+		return copy(out, payload), nil
+	}
+
+	decompressor := pwr.GetDecompressor(algorithm)
+	if decompressor == nil {
+		return 0, errors.Wrap(fmt.Errorf("no decompressor registered for %s", algorithm.String()), 1)
+	}
+
+	dr, err := decompressor.Apply(bytes.NewReader(payload))
 	if err != nil {
 		return 0, errors.Wrap(err, 1)
 	}
 
-	decompressedBuf, err := zstd.Decompress(out, d.buffer.Bytes()[:compressedBytes])
+	readBytes, err := readBlock(out, dr)
+	if closer, ok := dr.(io.Closer); ok {
+		// some decompressors hold native resources until closed
+		cErr := closer.Close()
+		if err == nil && cErr != nil {
+			err = cErr
+		}
+	}
 	if err != nil {
 		return 0, errors.Wrap(err, 1)
 	}
 
-	return len(decompressedBuf), nil
+	return readBytes, nil
+}
+
+// readBlock reads all of reader into out, which must be large enough
+func readBlock(out []byte, reader io.Reader) (int, error) {
+	readBytes, err := io.ReadFull(reader, out)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+
+	if readBytes == len(out) {
+		var extra [1]byte
+		n, err := reader.Read(extra[:])
+		if n > 0 {
+			return 0, fmt.Errorf("block too large: expected at most %d bytes", len(out))
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+	}
+
+	return readBytes, nil
 }
@@ -0,0 +1,114 @@
+package blockpool
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/Datadog/zstd"
+	"github.com/alecthomas/assert"
+	"github.com/itchio/wharf/pwr"
+
+	_ "github.com/itchio/wharf/compressors/gzip"
+	_ "github.com/itchio/wharf/decompressors/gzip"
+)
+
+func Test_Compression(t *testing.T) {
+	compressible := bytes.Repeat([]byte("wharf blocks "), 4096)
+
+	incompressible := make([]byte, 64*1024)
+	rand.New(rand.NewSource(0xf00d)).Read(incompressible)
+
+	roundtrip := func(c *Compressor, in []byte) []byte {
+		buf := new(bytes.Buffer)
+		assert.NoError(t, c.Compress(buf, in))
+		stored := append([]byte{}, buf.Bytes()...)
+
+		d := &Decompressor{}
+		out := make([]byte, len(in))
+		readBytes, err := d.Decompress(out, bytes.NewReader(stored))
+		assert.NoError(t, err)
+		assert.EqualValues(t, len(in), readBytes)
+		assert.True(t, bytes.Equal(in, out))
+
+		return stored
+	}
+
+	for _, settings := range []*pwr.CompressionSettings{
+		nil,
+		{Algorithm: pwr.CompressionAlgorithm_GZIP, Quality: 1},
+		{Algorithm: pwr.CompressionAlgorithm_NONE},
+	} {
+		c := &Compressor{Settings: settings}
+
+		stored := roundtrip(c, compressible)
+		assert.EqualValues(t, blockHeaderMagic, stored[0])
+
+		expectedAlgorithm := pwr.CompressionAlgorithm_ZSTD
+		if settings != nil {
+			expectedAlgorithm = settings.Algorithm
+		}
+		assert.EqualValues(t, expectedAlgorithm, stored[1])
+
+		if expectedAlgorithm != pwr.CompressionAlgorithm_NONE {
+			assert.True(t, len(stored) < len(compressible))
+		}
+
+		// compression doesn't help, so it's stored as-is
+		stored = roundtrip(c.Clone(), incompressible)
+		assert.EqualValues(t, pwr.CompressionAlgorithm_NONE, stored[1])
+		assert.EqualValues(t, len(incompressible)+blockHeaderSize, len(stored))
+	}
+
+	// blocks written before headers were introduced are raw zstd frames
+	legacy, err := zstd.CompressLevel(nil, compressible, 9)
+	assert.NoError(t, err)
+
+	out := make([]byte, len(compressible))
+	readBytes, err := (&Decompressor{}).Decompress(out, bytes.NewReader(legacy))
+	assert.NoError(t, err)
+	assert.EqualValues(t, len(compressible), readBytes)
+	assert.True(t, bytes.Equal(compressible, out))
+
+	// blocks that don't fit are an error, not silently cut off
+	_, err = (&Decompressor{}).Decompress(out[:len(out)-1], bytes.NewReader(legacy))
+	assert.Error(t, err)
+
+	// decompressors are closed once the block is read
+	closing := &closingDecompressor{}
+	pwr.RegisterDecompressor(closingAlgorithm, closing)
+	closingBlock := append([]byte{blockHeaderMagic, byte(closingAlgorithm)}, legacy...)
+	readBytes, err = (&Decompressor{}).Decompress(out, bytes.NewReader(closingBlock))
+	assert.NoError(t, err)
+	assert.EqualValues(t, len(compressible), readBytes)
+	assert.EqualValues(t, 1, closing.closed)
+
+	// unknown algorithms are an error
+	_, err = (&Decompressor{}).Decompress(out, bytes.NewReader([]byte{blockHeaderMagic, 0x7f, 1, 2, 3}))
+	assert.Error(t, err)
+
+	err = (&Compressor{Settings: &pwr.CompressionSettings{Algorithm: 0x7f}}).Compress(new(bytes.Buffer), compressible)
+	assert.Error(t, err)
+}
+
+const closingAlgorithm = pwr.CompressionAlgorithm(0x7e)
+
+// closingDecompressor decompresses zstd, counting how many readers get closed
+type closingDecompressor struct {
+	closed int
+}
+
+type closingReader struct {
+	io.ReadCloser
+	cd *closingDecompressor
+}
+
+func (cd *closingDecompressor) Apply(reader io.Reader) (io.Reader, error) {
+	return &closingReader{zstd.NewReader(reader), cd}, nil
+}
+
+func (cr *closingReader) Close() error {
+	cr.cd.closed++
+	return cr.ReadCloser.Close()
+}
@@ -15,11 +15,13 @@ import (
 // DiskSink stores blocks on disk by their hash and length. It's hard-coded to
 // use shake128-32 as a hashing algorithm.
 // If `BlockHashes` is set, will store block hashes there.
+// If `ManifestWriter` is set, block hashes are also streamed to it.
 type DiskSink struct {
 	BasePath string
 
-	Container   *tlc.Container
-	BlockHashes *BlockHashMap
+	Container      *tlc.Container
+	BlockHashes    *BlockHashMap
+	ManifestWriter *ManifestWriter
 
 	Compressor *Compressor
 
@@ -33,8 +35,9 @@ func (ds *DiskSink) Clone() Sink {
 	dsc := &DiskSink{
 		BasePath: ds.BasePath,
 
-		Container:   ds.Container,
-		BlockHashes: ds.BlockHashes,
+		Container:      ds.Container,
+		BlockHashes:    ds.BlockHashes,
+		ManifestWriter: ds.ManifestWriter,
 	}
 
 	if ds.Compressor != nil {
@@ -80,6 +83,13 @@ func (ds *DiskSink) Store(loc BlockLocation, data []byte) error {
 		ds.BlockHashes.Set(loc, append([]byte{}, ds.hashBuf...))
 	}
 
+	if ds.ManifestWriter != nil {
+		err = ds.ManifestWriter.WriteHash(loc, ds.hashBuf)
+		if err != nil {
+			return err
+		}
+	}
+
 	fileSize := ds.Container.Files[int(loc.FileIndex)].Size
 	blockSize := ComputeBlockSize(fileSize, loc.BlockIndex)
 	addr := fmt.Sprintf("shake128-32/%x/%d", ds.hashBuf, blockSize)
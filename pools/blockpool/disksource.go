@@ -39,13 +39,22 @@ func (ds *DiskSource) Clone() Source {
 	return dsc
 }
 
-// Fetch reads a block from disk
-func (ds *DiskSource) Fetch(loc BlockLocation, data []byte) (int, error) {
+// GetPath returns the native path at which a block is (or would be) stored
+// on disk, given its location
+func (ds *DiskSource) GetPath(loc BlockLocation) (string, error) {
 	addr := ds.BlockAddresses.Get(loc)
 	if addr == "" {
-		return 0, errors.Wrap(fmt.Errorf("no address for block %+v", loc), 1)
+		return "", errors.Wrap(fmt.Errorf("no address for block %+v", loc), 1)
+	}
+	return filepath.Join(ds.BasePath, addr), nil
+}
+
+// Fetch reads a block from disk
+func (ds *DiskSource) Fetch(loc BlockLocation, data []byte) (int, error) {
+	path, err := ds.GetPath(loc)
+	if err != nil {
+		return 0, err
 	}
-	path := filepath.Join(ds.BasePath, addr)
 
 	fr, err := os.Open(path)
 	if err != nil {
@@ -1,10 +1,14 @@
 package blockpool
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"sync"
 
 	"github.com/go-errors/errors"
+	"github.com/itchio/wharf/counter"
 	"github.com/itchio/wharf/pwr"
 	"github.com/itchio/wharf/tlc"
 	"github.com/itchio/wharf/wire"
@@ -13,10 +17,109 @@ import (
 // WriteManifest writes container info and block addresses in wharf's manifest format
 // Does not close manifestWriter.
 func WriteManifest(manifestWriter io.Writer, compression *pwr.CompressionSettings, container *tlc.Container, blockHashes *BlockHashMap) error {
+	mw, err := NewManifestWriter(manifestWriter, compression, container)
+	if err != nil {
+		return err
+	}
+
+	for fileIndex, f := range container.Files {
+		numBlocks := ComputeNumBlocks(f.Size)
+
+		for blockIndex := int64(0); blockIndex < numBlocks; blockIndex++ {
+			loc := BlockLocation{FileIndex: int64(fileIndex), BlockIndex: blockIndex}
+			hash := blockHashes.Get(loc)
+			if hash == nil {
+				err = fmt.Errorf("missing BlockHash for block %+v", loc)
+				return errors.Wrap(err, 1)
+			}
+
+			err = mw.WriteHash(loc, hash)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return mw.Close()
+}
+
+// ReadManifest reads container info and block addresses from a wharf manifest file.
+// Does not close manifestReader.
+func ReadManifest(manifestReader io.Reader) (*tlc.Container, *BlockHashMap, error) {
+	blockHashes := NewBlockHashMap()
+
+	container, err := WalkManifest(manifestReader, func(loc BlockLocation, hash []byte) error {
+		blockHashes.Set(loc, append([]byte{}, hash...))
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return container, blockHashes, nil
+}
+
+// WalkManifest reads a wharf manifest file, calling cb for every block hash
+// it contains, in file and block order. The hash passed to cb is only valid
+// for the duration of the call. Does not close manifestReader.
+func WalkManifest(manifestReader io.Reader, cb func(loc BlockLocation, hash []byte) error) (*tlc.Container, error) {
+	mr, err := NewManifestReader(manifestReader)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		loc, hash, err := mr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+
+		err = cb(loc, hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return mr.Container, nil
+}
+
+////////////////////////////
+// Writer
+////////////////////////////
+
+// A ManifestWriter writes a manifest file as block hashes become available,
+// so that they never all have to be in memory at once. Hashes may be written
+// in any order (and concurrently), but they're only buffered until all the
+// blocks that precede them have been written, so writing them roughly in
+// file and block order keeps memory usage low.
+type ManifestWriter struct {
+	container *tlc.Container
+
+	mutex      sync.Mutex
+	rawWire    *wire.WriteContext
+	wire       *wire.WriteContext
+	counter    *counter.Writer
+	pending    map[BlockLocation][]byte
+	fileIndex  int64
+	blockIndex int64
+	inFile     bool
+	offsets    []int64
+
+	sh  *pwr.SyncHeader
+	mbh *pwr.ManifestBlockHash
+}
+
+// NewManifestWriter writes the manifest's header and container to manifestWriter,
+// and returns a ManifestWriter ready to accept block hashes.
+// Closing the ManifestWriter does not close manifestWriter.
+func NewManifestWriter(manifestWriter io.Writer, compression *pwr.CompressionSettings, container *tlc.Container) (*ManifestWriter, error) {
 	rawWire := wire.NewWriteContext(manifestWriter)
 	err := rawWire.WriteMagic(pwr.ManifestMagic)
 	if err != nil {
-		return errors.Wrap(err, 1)
+		return nil, errors.Wrap(err, 1)
 	}
 
 	err = rawWire.WriteMessage(&pwr.ManifestHeader{
@@ -24,51 +127,112 @@ func WriteManifest(manifestWriter io.Writer, compression *pwr.CompressionSetting
 		Algorithm:   pwr.HashAlgorithm_SHAKE128_32,
 	})
 	if err != nil {
-		return errors.Wrap(err, 1)
+		return nil, errors.Wrap(err, 1)
 	}
 
-	wire, err := pwr.CompressWire(rawWire, compression)
+	compressedWire, err := pwr.CompressWire(rawWire, compression)
 	if err != nil {
-		return errors.Wrap(err, 1)
+		return nil, errors.Wrap(err, 1)
 	}
 
+	// offsets in the index are relative to the start of the (uncompressed) payload
+	cw := counter.NewWriter(compressedWire.Writer())
+	wire := wire.NewWriteContext(cw)
+
 	err = wire.WriteMessage(container)
 	if err != nil {
-		return errors.Wrap(err, 1)
+		return nil, errors.Wrap(err, 1)
 	}
 
-	sh := &pwr.SyncHeader{}
-	mbh := &pwr.ManifestBlockHash{}
+	mw := &ManifestWriter{
+		container: container,
 
-	for fileIndex, f := range container.Files {
-		sh.Reset()
-		sh.FileIndex = int64(fileIndex)
-		err = wire.WriteMessage(sh)
-		if err != nil {
-			return errors.Wrap(err, 1)
-		}
+		rawWire: compressedWire,
+		wire:    wire,
+		counter: cw,
+		pending: make(map[BlockLocation][]byte),
+		offsets: make([]int64, 0, len(container.Files)),
 
-		numBlocks := ComputeNumBlocks(f.Size)
+		sh:  &pwr.SyncHeader{},
+		mbh: &pwr.ManifestBlockHash{},
+	}
 
-		for blockIndex := int64(0); blockIndex < numBlocks; blockIndex++ {
-			loc := BlockLocation{FileIndex: int64(fileIndex), BlockIndex: blockIndex}
-			hash := blockHashes.Get(loc)
-			if hash == nil {
-				err = fmt.Errorf("missing BlockHash for block %+v", loc)
+	err = mw.flush()
+	if err != nil {
+		return nil, err
+	}
+
+	return mw, nil
+}
+
+// WriteHash records the hash of the block at loc. It's safe to call concurrently.
+func (mw *ManifestWriter) WriteHash(loc BlockLocation, hash []byte) error {
+	mw.mutex.Lock()
+	defer mw.mutex.Unlock()
+
+	if loc.FileIndex < mw.fileIndex || (loc.FileIndex == mw.fileIndex && loc.BlockIndex < mw.blockIndex) {
+		// already written, blocks are stored by content so it can only be the same hash
+		return nil
+	}
+
+	mw.pending[loc] = append([]byte{}, hash...)
+	return mw.flush()
+}
+
+// flush writes all pending hashes that can be written in order
+func (mw *ManifestWriter) flush() error {
+	for mw.fileIndex < int64(len(mw.container.Files)) {
+		if !mw.inFile {
+			mw.offsets = append(mw.offsets, mw.counter.Count())
+
+			mw.sh.Reset()
+			mw.sh.FileIndex = mw.fileIndex
+			err := mw.wire.WriteMessage(mw.sh)
+			if err != nil {
 				return errors.Wrap(err, 1)
 			}
+			mw.inFile = true
+		}
 
-			mbh.Reset()
-			mbh.Hash = hash
+		numBlocks := ComputeNumBlocks(mw.container.Files[mw.fileIndex].Size)
+		for mw.blockIndex < numBlocks {
+			loc := BlockLocation{FileIndex: mw.fileIndex, BlockIndex: mw.blockIndex}
+			hash, ok := mw.pending[loc]
+			if !ok {
+				return nil
+			}
+			delete(mw.pending, loc)
 
-			err = wire.WriteMessage(mbh)
+			mw.mbh.Reset()
+			mw.mbh.Hash = hash
+			err := mw.wire.WriteMessage(mw.mbh)
 			if err != nil {
 				return errors.Wrap(err, 1)
 			}
+			mw.blockIndex++
 		}
+
+		mw.fileIndex++
+		mw.blockIndex = 0
+		mw.inFile = false
 	}
 
-	err = wire.Close()
+	return nil
+}
+
+// Close makes sure all block hashes have been written, and flushes the
+// underlying compressor. It does not close the underlying writer.
+func (mw *ManifestWriter) Close() error {
+	mw.mutex.Lock()
+	defer mw.mutex.Unlock()
+
+	if mw.fileIndex < int64(len(mw.container.Files)) {
+		loc := BlockLocation{FileIndex: mw.fileIndex, BlockIndex: mw.blockIndex}
+		err := fmt.Errorf("missing BlockHash for block %+v", loc)
+		return errors.Wrap(err, 1)
+	}
+
+	err := mw.rawWire.Close()
 	if err != nil {
 		return errors.Wrap(err, 1)
 	}
@@ -76,66 +240,243 @@ func WriteManifest(manifestWriter io.Writer, compression *pwr.CompressionSetting
 	return nil
 }
 
-// ReadManifest reads container info and block addresses from a wharf manifest file.
-// Does not close manifestReader.
-func ReadManifest(manifestReader io.Reader) (*tlc.Container, *BlockHashMap, error) {
-	container := &tlc.Container{}
-	blockHashes := NewBlockHashMap()
+// Index returns an index of the manifest written so far, which lets
+// ManifestReader.SeekFile find a file's hashes quickly.
+func (mw *ManifestWriter) Index() *ManifestIndex {
+	mw.mutex.Lock()
+	defer mw.mutex.Unlock()
+
+	return &ManifestIndex{
+		FileOffsets: append([]int64{}, mw.offsets...),
+	}
+}
+
+////////////////////////////
+// Reader
+////////////////////////////
+
+// A ManifestReader reads block hashes from a manifest file one at a time,
+// instead of loading them all in memory.
+type ManifestReader struct {
+	// Container is read as soon as the reader is created
+	Container *tlc.Container
+
+	rawReader   io.Reader
+	compression *pwr.CompressionSettings
+	// payloadStart is the offset of the payload in rawReader, if it's seekable
+	payloadStart int64
+	seekable     bool
 
+	wire *wire.ReadContext
+	// position in the (uncompressed) payload is base + counter.Count()
+	counter *counter.Reader
+	base    int64
+
+	fileIndex  int64
+	blockIndex int64
+	numBlocks  int64
+	inFile     bool
+
+	sh  *pwr.SyncHeader
+	mbh *pwr.ManifestBlockHash
+}
+
+// NewManifestReader reads the header and container of a manifest file, and
+// returns a ManifestReader ready to read block hashes.
+func NewManifestReader(manifestReader io.Reader) (*ManifestReader, error) {
 	rawWire := wire.NewReadContext(manifestReader)
 	err := rawWire.ExpectMagic(pwr.ManifestMagic)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, 1)
+		return nil, errors.Wrap(err, 1)
 	}
 
 	mh := &pwr.ManifestHeader{}
 	err = rawWire.ReadMessage(mh)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, 1)
+		return nil, errors.Wrap(err, 1)
 	}
 
 	if mh.Algorithm != pwr.HashAlgorithm_SHAKE128_32 {
 		err = fmt.Errorf("Manifest has unsupported hash algorithm %d, expected %d", mh.Algorithm, pwr.HashAlgorithm_SHAKE128_32)
-		return nil, nil, errors.Wrap(err, 1)
+		return nil, errors.Wrap(err, 1)
+	}
+
+	mr := &ManifestReader{
+		rawReader:   manifestReader,
+		compression: mh.GetCompression(),
+
+		sh:  &pwr.SyncHeader{},
+		mbh: &pwr.ManifestBlockHash{},
+	}
+
+	if seeker, ok := manifestReader.(io.Seeker); ok && mr.compression.GetAlgorithm() == pwr.CompressionAlgorithm_NONE {
+		mr.payloadStart, err = seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, errors.Wrap(err, 1)
+		}
+		mr.seekable = true
 	}
 
-	wire, err := pwr.DecompressWire(rawWire, mh.GetCompression())
+	decompressedWire, err := pwr.DecompressWire(rawWire, mr.compression)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, 1)
+		return nil, errors.Wrap(err, 1)
 	}
 
-	err = wire.ReadMessage(container)
+	mr.counter = counter.NewReader(decompressedWire.Reader())
+	mr.wire = wire.NewReadContext(mr.counter)
+
+	mr.Container = &tlc.Container{}
+	err = mr.wire.ReadMessage(mr.Container)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, 1)
+		return nil, errors.Wrap(err, 1)
 	}
 
-	sh := &pwr.SyncHeader{}
-	mbh := &pwr.ManifestBlockHash{}
+	return mr, nil
+}
 
-	for fileIndex, f := range container.Files {
-		sh.Reset()
-		err = wire.ReadMessage(sh)
-		if err != nil {
-			return nil, nil, errors.Wrap(err, 1)
-		}
+// Next returns the location and hash of the next block in the manifest, or
+// io.EOF when there are no blocks left. The returned hash is only valid until
+// the next call to Next.
+func (mr *ManifestReader) Next() (BlockLocation, []byte, error) {
+	for mr.fileIndex < int64(len(mr.Container.Files)) {
+		if !mr.inFile {
+			mr.sh.Reset()
+			err := mr.wire.ReadMessage(mr.sh)
+			if err != nil {
+				return BlockLocation{}, nil, errors.Wrap(err, 1)
+			}
+
+			if mr.fileIndex != mr.sh.FileIndex {
+				err = fmt.Errorf("manifest format error: expected file %d, got %d", mr.fileIndex, mr.sh.FileIndex)
+				return BlockLocation{}, nil, errors.Wrap(err, 1)
+			}
 
-		if int64(fileIndex) != sh.FileIndex {
-			err = fmt.Errorf("manifest format error: expected file %d, got %d", fileIndex, sh.FileIndex)
-			return nil, nil, errors.Wrap(err, 1)
+			mr.inFile = true
+			mr.blockIndex = 0
+			mr.numBlocks = ComputeNumBlocks(mr.Container.Files[mr.fileIndex].Size)
 		}
 
-		numBlocks := ComputeNumBlocks(f.Size)
-		for blockIndex := int64(0); blockIndex < numBlocks; blockIndex++ {
-			mbh.Reset()
-			err = wire.ReadMessage(mbh)
+		if mr.blockIndex < mr.numBlocks {
+			mr.mbh.Reset()
+			err := mr.wire.ReadMessage(mr.mbh)
 			if err != nil {
-				return nil, nil, errors.Wrap(err, 1)
+				return BlockLocation{}, nil, errors.Wrap(err, 1)
 			}
 
-			loc := BlockLocation{FileIndex: int64(fileIndex), BlockIndex: blockIndex}
-			blockHashes.Set(loc, append([]byte{}, mbh.Hash...))
+			loc := BlockLocation{FileIndex: mr.fileIndex, BlockIndex: mr.blockIndex}
+			mr.blockIndex++
+			return loc, mr.mbh.Hash, nil
 		}
+
+		mr.fileIndex++
+		mr.inFile = false
 	}
 
-	return container, blockHashes, nil
+	return BlockLocation{}, nil, io.EOF
+}
+
+// SeekFile positions the reader so that the next call to Next returns the
+// first block of the given file. Uncompressed manifests are seeked directly
+// (if the underlying reader is an io.Seeker), compressed manifests can only
+// be seeked forward, and still have to be decompressed up to the file - but
+// none of the hashes before it are parsed.
+func (mr *ManifestReader) SeekFile(index *ManifestIndex, fileIndex int64) error {
+	if fileIndex < 0 || fileIndex >= int64(len(index.FileOffsets)) || fileIndex >= int64(len(mr.Container.Files)) {
+		return errors.Wrap(fmt.Errorf("file index %d out of range", fileIndex), 1)
+	}
+
+	target := index.FileOffsets[fileIndex]
+
+	if mr.seekable {
+		seeker := mr.rawReader.(io.Seeker)
+		_, err := seeker.Seek(mr.payloadStart+target, io.SeekStart)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+
+		mr.counter = counter.NewReader(mr.rawReader)
+		mr.wire = wire.NewReadContext(mr.counter)
+		mr.base = target
+	} else {
+		position := mr.base + mr.counter.Count()
+		if target < position {
+			return errors.Wrap(fmt.Errorf("can't seek backwards in a compressed manifest"), 1)
+		}
+
+		_, err := io.CopyN(ioutil.Discard, mr.counter, target-position)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+	}
+
+	mr.fileIndex = fileIndex
+	mr.inFile = false
+	return nil
+}
+
+////////////////////////////
+// Index
+////////////////////////////
+
+// A ManifestIndex contains the offset of each file's hashes in a manifest's
+// (uncompressed) payload. It's stored separately from the manifest.
+type ManifestIndex struct {
+	FileOffsets []int64
+}
+
+// WriteManifestIndex writes an index in wharf's manifest index format.
+// Does not close indexWriter.
+func WriteManifestIndex(indexWriter io.Writer, index *ManifestIndex) error {
+	err := binary.Write(indexWriter, pwr.Endianness, pwr.ManifestIndexMagic)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	err = binary.Write(indexWriter, pwr.Endianness, int64(len(index.FileOffsets)))
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	err = binary.Write(indexWriter, pwr.Endianness, index.FileOffsets)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	return nil
+}
+
+// ReadManifestIndex reads an index written by WriteManifestIndex.
+// Does not close indexReader.
+func ReadManifestIndex(indexReader io.Reader) (*ManifestIndex, error) {
+	var magic int32
+	err := binary.Read(indexReader, pwr.Endianness, &magic)
+	if err != nil {
+		return nil, errors.Wrap(err, 1)
+	}
+
+	if magic != pwr.ManifestIndexMagic {
+		return nil, errors.Wrap(wire.ErrFormat, 1)
+	}
+
+	var numFiles int64
+	err = binary.Read(indexReader, pwr.Endianness, &numFiles)
+	if err != nil {
+		return nil, errors.Wrap(err, 1)
+	}
+
+	if numFiles < 0 {
+		return nil, errors.Wrap(fmt.Errorf("invalid manifest index: %d files", numFiles), 1)
+	}
+
+	index := &ManifestIndex{}
+	for i := int64(0); i < numFiles; i++ {
+		var offset int64
+		err = binary.Read(indexReader, pwr.Endianness, &offset)
+		if err != nil {
+			return nil, errors.Wrap(err, 1)
+		}
+		index.FileOffsets = append(index.FileOffsets, offset)
+	}
+
+	return index, nil
 }
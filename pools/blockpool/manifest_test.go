@@ -0,0 +1,126 @@
+package blockpool
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/tlc"
+)
+
+func Test_ManifestStreaming(t *testing.T) {
+	container := &tlc.Container{
+		Files: []*tlc.File{
+			{Path: "empty", Size: 0},
+			{Path: "big", Size: BigBlockSize*3 + 1},
+			{Path: "also-empty", Size: 0},
+			{Path: "small", Size: 128},
+			{Path: "medium", Size: BigBlockSize * 2},
+		},
+	}
+
+	rng := rand.New(rand.NewSource(0xfaceb00c))
+	blockHashes := NewBlockHashMap()
+	var locs []BlockLocation
+	for fileIndex, f := range container.Files {
+		numBlocks := ComputeNumBlocks(f.Size)
+		for blockIndex := int64(0); blockIndex < numBlocks; blockIndex++ {
+			loc := BlockLocation{FileIndex: int64(fileIndex), BlockIndex: blockIndex}
+			hash := make([]byte, 32)
+			rng.Read(hash)
+			blockHashes.Set(loc, hash)
+			locs = append(locs, loc)
+		}
+	}
+
+	for _, compression := range []*pwr.CompressionSettings{
+		{Algorithm: pwr.CompressionAlgorithm_NONE},
+		{Algorithm: pwr.CompressionAlgorithm_GZIP, Quality: 1},
+	} {
+		t.Logf("with compression %s", compression.ToString())
+
+		reference := new(bytes.Buffer)
+		assert.NoError(t, WriteManifest(reference, compression, container, blockHashes))
+
+		// write hashes concurrently, in any order: output should be the same
+		streamed := new(bytes.Buffer)
+		mw, err := NewManifestWriter(streamed, compression, container)
+		assert.NoError(t, err)
+
+		shuffled := append([]BlockLocation{}, locs...)
+		rng.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+
+		wg := &sync.WaitGroup{}
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := i; j < len(shuffled); j += 4 {
+					assert.NoError(t, mw.WriteHash(shuffled[j], blockHashes.Get(shuffled[j])))
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		assert.NoError(t, mw.Close())
+		assert.True(t, bytes.Equal(reference.Bytes(), streamed.Bytes()))
+
+		// read them back in order
+		var readLocs []BlockLocation
+		readContainer, err := WalkManifest(bytes.NewReader(streamed.Bytes()), func(loc BlockLocation, hash []byte) error {
+			readLocs = append(readLocs, loc)
+			assert.True(t, bytes.Equal(blockHashes.Get(loc), hash))
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.EqualValues(t, len(container.Files), len(readContainer.Files))
+		assert.EqualValues(t, locs, readLocs)
+
+		// round-trip the index, then use it
+		indexBuf := new(bytes.Buffer)
+		assert.NoError(t, WriteManifestIndex(indexBuf, mw.Index()))
+		index, err := ReadManifestIndex(indexBuf)
+		assert.NoError(t, err)
+		assert.EqualValues(t, len(container.Files), len(index.FileOffsets))
+
+		mr, err := NewManifestReader(bytes.NewReader(streamed.Bytes()))
+		assert.NoError(t, err)
+
+		seekAndCheck := func(fileIndex int64) {
+			assert.NoError(t, mr.SeekFile(index, fileIndex))
+
+			numBlocks := ComputeNumBlocks(container.Files[fileIndex].Size)
+			for blockIndex := int64(0); blockIndex < numBlocks; blockIndex++ {
+				loc, hash, err := mr.Next()
+				assert.NoError(t, err)
+				assert.EqualValues(t, BlockLocation{FileIndex: fileIndex, BlockIndex: blockIndex}, loc)
+				assert.True(t, bytes.Equal(blockHashes.Get(loc), hash))
+			}
+		}
+
+		seekAndCheck(3)
+		seekAndCheck(4)
+
+		_, _, err = mr.Next()
+		assert.Equal(t, io.EOF, err)
+
+		if compression.Algorithm == pwr.CompressionAlgorithm_NONE {
+			seekAndCheck(1)
+			seekAndCheck(0)
+		} else {
+			assert.Error(t, mr.SeekFile(index, 1))
+		}
+	}
+
+	// missing hashes are an error
+	mw, err := NewManifestWriter(new(bytes.Buffer), &pwr.CompressionSettings{}, container)
+	assert.NoError(t, err)
+	assert.NoError(t, mw.WriteHash(locs[1], blockHashes.Get(locs[1])))
+	assert.Error(t, mw.Close())
+}
@@ -0,0 +1,137 @@
+package blockpool
+
+import (
+	"fmt"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/go-errors/errors"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/tlc"
+)
+
+// A DownloadPlan describes what needs to be fetched from a block store to go
+// from an installed build to a new build, given both their manifests.
+type DownloadPlan struct {
+	// MissingAddresses lists the addresses of blocks that aren't part of the
+	// installed build, each address appears only once.
+	MissingAddresses []string
+	// MissingBytes is the sum of the sizes of all MissingAddresses, ie.
+	// the actual update size
+	MissingBytes int64
+
+	// Filter contains the location (in the new container) of every block
+	// that needs to be fetched. It's suitable for a FilteringSource.
+	Filter BlockFilter
+
+	// Reused maps locations in the new container to locations in the old
+	// container, for every block that's already available locally.
+	Reused map[BlockLocation]BlockLocation
+	// ReusedBytes is the total size of reused blocks
+	ReusedBytes int64
+	// MovedBlocks is the number of reused blocks that don't come from the
+	// same position (same file path, same block index) in the installed build
+	MovedBlocks int64
+
+	// TotalBlocks is the number of blocks in the new container
+	TotalBlocks int64
+	// TotalBytes is the size of the new container
+	TotalBytes int64
+}
+
+// ComputeDownloadPlan compares the manifest of an installed build (oldContainer
+// and oldHashes) with the manifest of a new build, and finds out which blocks
+// are missing locally, and which ones can be reused.
+func ComputeDownloadPlan(oldContainer *tlc.Container, oldHashes *BlockHashMap, newContainer *tlc.Container, newHashes *BlockHashMap) (*DownloadPlan, error) {
+	oldAddresses, err := oldHashes.ToAddressMap(oldContainer, pwr.HashAlgorithm_SHAKE128_32)
+	if err != nil {
+		return nil, errors.Wrap(err, 1)
+	}
+
+	newAddresses, err := newHashes.ToAddressMap(newContainer, pwr.HashAlgorithm_SHAKE128_32)
+	if err != nil {
+		return nil, errors.Wrap(err, 1)
+	}
+
+	oldPathToIndex := make(map[string]int64)
+	for fileIndex, f := range oldContainer.Files {
+		oldPathToIndex[f.Path] = int64(fileIndex)
+	}
+
+	// index the installed build by address, so we can find
+	// blocks that moved around
+	available := make(map[string]BlockLocation)
+	for fileIndex, f := range oldContainer.Files {
+		numBlocks := ComputeNumBlocks(f.Size)
+		for blockIndex := int64(0); blockIndex < numBlocks; blockIndex++ {
+			loc := BlockLocation{FileIndex: int64(fileIndex), BlockIndex: blockIndex}
+			addr := oldAddresses.Get(loc)
+			if addr == "" {
+				// partial manifests are fine, we just won't reuse that block
+				continue
+			}
+
+			if _, ok := available[addr]; !ok {
+				available[addr] = loc
+			}
+		}
+	}
+
+	plan := &DownloadPlan{
+		Filter: make(BlockFilter),
+		Reused: make(map[BlockLocation]BlockLocation),
+	}
+	missing := make(map[string]bool)
+
+	for fileIndex, f := range newContainer.Files {
+		numBlocks := ComputeNumBlocks(f.Size)
+		for blockIndex := int64(0); blockIndex < numBlocks; blockIndex++ {
+			loc := BlockLocation{FileIndex: int64(fileIndex), BlockIndex: blockIndex}
+			size := ComputeBlockSize(f.Size, blockIndex)
+
+			plan.TotalBlocks++
+			plan.TotalBytes += size
+
+			addr := newAddresses.Get(loc)
+			if addr == "" {
+				return nil, errors.Wrap(fmt.Errorf("missing BlockHash for block %+v", loc), 1)
+			}
+
+			oldLoc, ok := available[addr]
+			if !ok {
+				plan.Filter.Set(loc)
+
+				if !missing[addr] {
+					missing[addr] = true
+					plan.MissingAddresses = append(plan.MissingAddresses, addr)
+					plan.MissingBytes += size
+				}
+				continue
+			}
+
+			// prefer reusing the block from the same position, if it's there
+			if oldFileIndex, ok := oldPathToIndex[f.Path]; ok {
+				sameLoc := BlockLocation{FileIndex: oldFileIndex, BlockIndex: blockIndex}
+				if oldAddresses.Get(sameLoc) == addr {
+					oldLoc = sameLoc
+				}
+			}
+
+			if oldContainer.Files[oldLoc.FileIndex].Path != f.Path || oldLoc.BlockIndex != blockIndex {
+				plan.MovedBlocks++
+			}
+
+			plan.Reused[loc] = oldLoc
+			plan.ReusedBytes += size
+		}
+	}
+
+	return plan, nil
+}
+
+// Stats returns a human-readable string summarizing this download plan
+func (dp *DownloadPlan) Stats() string {
+	return fmt.Sprintf("%s to download (%d blocks), reusing %s / %s (%d / %d blocks, %d moved)",
+		humanize.IBytes(uint64(dp.MissingBytes)), len(dp.MissingAddresses),
+		humanize.IBytes(uint64(dp.ReusedBytes)), humanize.IBytes(uint64(dp.TotalBytes)),
+		len(dp.Reused), dp.TotalBlocks, dp.MovedBlocks)
+}
@@ -0,0 +1,66 @@
+package blockpool
+
+import (
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"github.com/itchio/wharf/tlc"
+)
+
+func Test_DownloadPlan(t *testing.T) {
+	oldContainer := &tlc.Container{
+		Files: []*tlc.File{
+			{Path: "a", Size: BigBlockSize * 2},
+			{Path: "b", Size: 100},
+		},
+	}
+	oldHashes := NewBlockHashMap()
+	oldHashes.Set(BlockLocation{FileIndex: 0, BlockIndex: 0}, []byte{0xa0})
+	oldHashes.Set(BlockLocation{FileIndex: 0, BlockIndex: 1}, []byte{0xa1})
+	oldHashes.Set(BlockLocation{FileIndex: 1, BlockIndex: 0}, []byte{0xb0})
+
+	newContainer := &tlc.Container{
+		Files: []*tlc.File{
+			// file order changed, and "b" was copied as "c"
+			{Path: "b", Size: 100},
+			{Path: "c", Size: 100},
+			// a's first block is unchanged, the second one is new (twice)
+			{Path: "a", Size: BigBlockSize * 3},
+		},
+	}
+	newHashes := NewBlockHashMap()
+	newHashes.Set(BlockLocation{FileIndex: 0, BlockIndex: 0}, []byte{0xb0})
+	newHashes.Set(BlockLocation{FileIndex: 1, BlockIndex: 0}, []byte{0xb0})
+	newHashes.Set(BlockLocation{FileIndex: 2, BlockIndex: 0}, []byte{0xa0})
+	newHashes.Set(BlockLocation{FileIndex: 2, BlockIndex: 1}, []byte{0xf0})
+	newHashes.Set(BlockLocation{FileIndex: 2, BlockIndex: 2}, []byte{0xf0})
+
+	plan, err := ComputeDownloadPlan(oldContainer, oldHashes, newContainer, newHashes)
+	assert.NoError(t, err)
+	t.Logf("plan: %s", plan.Stats())
+
+	assert.EqualValues(t, 5, plan.TotalBlocks)
+	assert.EqualValues(t, BigBlockSize*3+200, plan.TotalBytes)
+
+	assert.EqualValues(t, []string{"shake128-32/f0/4194304"}, plan.MissingAddresses)
+	assert.EqualValues(t, BigBlockSize, plan.MissingBytes)
+
+	assert.True(t, plan.Filter.Has(BlockLocation{FileIndex: 2, BlockIndex: 1}))
+	assert.True(t, plan.Filter.Has(BlockLocation{FileIndex: 2, BlockIndex: 2}))
+	assert.False(t, plan.Filter.Has(BlockLocation{FileIndex: 2, BlockIndex: 0}))
+	assert.False(t, plan.Filter.Has(BlockLocation{FileIndex: 0, BlockIndex: 0}))
+
+	assert.EqualValues(t, 3, len(plan.Reused))
+	assert.EqualValues(t, BigBlockSize+200, plan.ReusedBytes)
+	assert.EqualValues(t, BlockLocation{FileIndex: 1, BlockIndex: 0}, plan.Reused[BlockLocation{FileIndex: 0, BlockIndex: 0}])
+	assert.EqualValues(t, BlockLocation{FileIndex: 1, BlockIndex: 0}, plan.Reused[BlockLocation{FileIndex: 1, BlockIndex: 0}])
+	assert.EqualValues(t, BlockLocation{FileIndex: 0, BlockIndex: 0}, plan.Reused[BlockLocation{FileIndex: 2, BlockIndex: 0}])
+
+	// only "c" comes from somewhere else
+	assert.EqualValues(t, 1, plan.MovedBlocks)
+
+	// missing hashes in the new manifest are an error
+	newHashes = NewBlockHashMap()
+	_, err = ComputeDownloadPlan(oldContainer, oldHashes, newContainer, newHashes)
+	assert.Error(t, err)
+}
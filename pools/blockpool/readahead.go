@@ -0,0 +1,127 @@
+package blockpool
+
+// A prefetch is a block fetch that has been scheduled (and may or may not
+// have completed yet). done is closed once buf, readBytes and err are set.
+type prefetch struct {
+	blockIndex int64
+	buf        []byte
+	readBytes  int
+	err        error
+	done       chan struct{}
+}
+
+// A readAhead fetches the next few blocks of a file concurrently, each worker
+// using its own clone of the upstream source. Memory usage is bounded: there
+// are never more than window buffers of BigBlockSize in flight.
+type readAhead struct {
+	fileIndex int64
+	size      int64
+	numBlocks int64
+
+	window  int64
+	jobs    chan *prefetch
+	free    chan []byte
+	pending map[int64]*prefetch
+}
+
+func newReadAhead(upstream Source, fileIndex int64, size int64, numBlocks int64, window int) *readAhead {
+	ra := &readAhead{
+		fileIndex: fileIndex,
+		size:      size,
+		numBlocks: numBlocks,
+
+		window:  int64(window),
+		jobs:    make(chan *prefetch, window),
+		free:    make(chan []byte, window),
+		pending: make(map[int64]*prefetch),
+	}
+
+	for i := 0; i < window; i++ {
+		ra.free <- make([]byte, BigBlockSize)
+		go ra.work(upstream.Clone())
+	}
+
+	return ra
+}
+
+func (ra *readAhead) work(source Source) {
+	for p := range ra.jobs {
+		loc := BlockLocation{FileIndex: ra.fileIndex, BlockIndex: p.blockIndex}
+		blockSize := ComputeBlockSize(ra.size, p.blockIndex)
+		p.readBytes, p.err = source.Fetch(loc, p.buf[:blockSize])
+		close(p.done)
+	}
+}
+
+// fetch copies the block at blockIndex into out, waiting for it if needed,
+// and makes sure the following blocks are being fetched.
+func (ra *readAhead) fetch(blockIndex int64, out []byte) (int, error) {
+	// anything outside of [blockIndex, blockIndex+window) is not going to
+	// be useful (we've seeked), recycle its buffer once it's done
+	for index, p := range ra.pending {
+		if index < blockIndex || index >= blockIndex+ra.window {
+			delete(ra.pending, index)
+			go ra.discard(p)
+		}
+	}
+
+	ra.schedule(blockIndex)
+
+	p := ra.pending[blockIndex]
+	<-p.done
+	delete(ra.pending, blockIndex)
+
+	copy(out, p.buf[:p.readBytes])
+	readBytes, err := p.readBytes, p.err
+	ra.free <- p.buf
+
+	// we just freed a buffer, use it to fetch further ahead
+	ra.schedule(blockIndex + 1)
+
+	return readBytes, err
+}
+
+func (ra *readAhead) schedule(blockIndex int64) {
+	end := blockIndex + ra.window
+	if end > ra.numBlocks {
+		end = ra.numBlocks
+	}
+
+	for index := blockIndex; index < end; index++ {
+		if ra.pending[index] != nil {
+			continue
+		}
+
+		var buf []byte
+		if index == blockIndex {
+			// we need this one now, wait for a buffer
+			buf = <-ra.free
+		} else {
+			select {
+			case buf = <-ra.free:
+			default:
+				// no buffers available, try again after the next fetch
+				return
+			}
+		}
+
+		p := &prefetch{
+			blockIndex: index,
+			buf:        buf,
+			done:       make(chan struct{}),
+		}
+		ra.pending[index] = p
+		ra.jobs <- p
+	}
+}
+
+func (ra *readAhead) discard(p *prefetch) {
+	<-p.done
+	ra.free <- p.buf
+}
+
+// close stops all workers. Fetches in flight are allowed
+// to complete, but their results are ignored.
+func (ra *readAhead) close() {
+	close(ra.jobs)
+}
@@ -0,0 +1,136 @@
+package blockpool
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert"
+	"github.com/itchio/wharf/tlc"
+)
+
+// A TestSource generates deterministic block contents, and keeps track
+// of how many fetches happen concurrently, and in total (across all its clones)
+type TestSource struct {
+	Container *tlc.Container
+	Latency   time.Duration
+
+	current *int64
+	max     *int64
+	fetches *int64
+}
+
+var _ Source = (*TestSource)(nil)
+
+func newTestSource(container *tlc.Container, latency time.Duration) *TestSource {
+	return &TestSource{
+		Container: container,
+		Latency:   latency,
+		current:   new(int64),
+		max:       new(int64),
+		fetches:   new(int64),
+	}
+}
+
+func (ts *TestSource) Clone() Source {
+	return ts
+}
+
+func (ts *TestSource) Fetch(loc BlockLocation, data []byte) (int, error) {
+	atomic.AddInt64(ts.fetches, 1)
+	current := atomic.AddInt64(ts.current, 1)
+	defer atomic.AddInt64(ts.current, -1)
+
+	for {
+		max := atomic.LoadInt64(ts.max)
+		if current <= max || atomic.CompareAndSwapInt64(ts.max, max, current) {
+			break
+		}
+	}
+
+	time.Sleep(ts.Latency)
+
+	offset := loc.BlockIndex * BigBlockSize
+	for i := range data {
+		data[i] = testByte(loc.FileIndex, offset+int64(i))
+	}
+	return len(data), nil
+}
+
+func (ts *TestSource) GetContainer() *tlc.Container {
+	return ts.Container
+}
+
+func testByte(fileIndex int64, offset int64) byte {
+	return byte((offset*7 + fileIndex*13 + offset/BigBlockSize) % 251)
+}
+
+func Test_ReadAhead(t *testing.T) {
+	fileSize := int64(BigBlockSize*5 + 1234)
+	container := &tlc.Container{
+		Files: []*tlc.File{
+			{Path: "a", Size: fileSize},
+			{Path: "b", Size: 42},
+		},
+	}
+
+	expected := make([]byte, fileSize)
+	for i := range expected {
+		expected[i] = testByte(0, int64(i))
+	}
+
+	for _, readAhead := range []int{0, 1, 3, 8} {
+		t.Logf("with read-ahead %d", readAhead)
+
+		source := newTestSource(container, 5*time.Millisecond)
+		pool := &BlockPool{
+			Container: container,
+			Upstream:  source,
+			ReadAhead: readAhead,
+		}
+
+		r, err := pool.GetReadSeeker(0)
+		assert.NoError(t, err)
+
+		actual, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(expected, actual))
+
+		// reading sequentially fetches each block exactly once
+		assert.EqualValues(t, 6, atomic.LoadInt64(source.fetches))
+
+		if readAhead > 1 {
+			assert.True(t, atomic.LoadInt64(source.max) > 1)
+		} else {
+			assert.EqualValues(t, 1, atomic.LoadInt64(source.max))
+		}
+
+		// seek backwards, forwards, then to the very end
+		buf := make([]byte, 1024)
+		for _, offset := range []int64{BigBlockSize + 12, 10, BigBlockSize*4 - 512, fileSize - 1024} {
+			_, err = r.Seek(offset, os.SEEK_SET)
+			assert.NoError(t, err)
+
+			_, err = io.ReadFull(r, buf)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(expected[offset:offset+1024], buf))
+		}
+
+		// switching files closes the previous reader
+		r, err = pool.GetReadSeeker(1)
+		assert.NoError(t, err)
+
+		actual, err = ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.EqualValues(t, 42, len(actual))
+		for i := range actual {
+			assert.EqualValues(t, testByte(1, int64(i)), actual[i])
+		}
+
+		assert.NoError(t, pool.Close())
+	}
+}
@@ -16,6 +16,8 @@ type Reader struct {
 	numBlocks  int64
 	blockIndex int64
 	blockBuf   []byte
+
+	readAhead *readAhead
 }
 
 var _ io.ReadSeeker = (*Reader)(nil)
@@ -28,11 +30,7 @@ func (npr *Reader) Read(buf []byte) (int, error) {
 		}
 
 		npr.blockIndex = blockIndex
-		loc := BlockLocation{FileIndex: npr.fileIndex, BlockIndex: blockIndex}
-		blockSize := ComputeBlockSize(npr.size, npr.blockIndex)
-
-		// FIXME: should we check readBytes here? it would break filtering sources though.
-		_, err := npr.pool.Upstream.Fetch(loc, npr.blockBuf[:blockSize])
+		err := npr.fetch(blockIndex)
 		if err != nil {
 			return 0, err
 		}
@@ -61,6 +59,25 @@ func (npr *Reader) Read(buf []byte) (int, error) {
 	return readSize, nil
 }
 
+func (npr *Reader) fetch(blockIndex int64) error {
+	if npr.pool.ReadAhead > 1 {
+		if npr.readAhead == nil {
+			npr.readAhead = newReadAhead(npr.pool.Upstream, npr.fileIndex, npr.size, npr.numBlocks, npr.pool.ReadAhead)
+		}
+
+		// FIXME: should we check readBytes here? it would break filtering sources though.
+		_, err := npr.readAhead.fetch(blockIndex, npr.blockBuf)
+		return err
+	}
+
+	loc := BlockLocation{FileIndex: npr.fileIndex, BlockIndex: blockIndex}
+	blockSize := ComputeBlockSize(npr.size, blockIndex)
+
+	// FIXME: should we check readBytes here? it would break filtering sources though.
+	_, err := npr.pool.Upstream.Fetch(loc, npr.blockBuf[:blockSize])
+	return err
+}
+
 // Seek moves the read head as specified by (offset, whence), see io.Seeker's doc
 func (npr *Reader) Seek(offset int64, whence int) (int64, error) {
 	switch whence {
@@ -74,7 +91,11 @@ func (npr *Reader) Seek(offset int64, whence int) (int64, error) {
 	return npr.offset, nil
 }
 
-// Close is actually a no-op
+// Close stops read-ahead workers, if any
 func (npr *Reader) Close() error {
+	if npr.readAhead != nil {
+		npr.readAhead.close()
+		npr.readAhead = nil
+	}
 	return nil
 }
@@ -0,0 +1,290 @@
+package blockpool
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/go-errors/errors"
+	"github.com/itchio/wharf/state"
+	"github.com/itchio/wharf/tlc"
+)
+
+// A TieredSource first tries to fetch blocks from a local DiskSource, and
+// falls back to a (presumably slower) upstream Source when they're missing.
+// Blocks fetched from upstream are stored into Sink on the way through, so
+// that the next fetch (from this build or from any other build sharing the
+// same blocks) is a local hit.
+type TieredSource struct {
+	// required
+
+	// Local is the block cache, it's always checked first
+	Local *DiskSource
+	// Upstream is where blocks missing from Local are fetched from
+	Upstream Source
+	// Sink stores blocks fetched from Upstream. It should store into
+	// Local.BasePath, typically it's a DiskSink.
+	Sink Sink
+
+	// optional
+
+	// MaxSize is the maximum size (in bytes) of the on-disk cache. When
+	// storing a block makes the cache grow beyond MaxSize, the least recently
+	// used blocks are evicted. 0 means the cache grows without bounds.
+	MaxSize int64
+
+	Consumer *state.Consumer
+
+	// internal
+	cache *tieredCache
+}
+
+var _ Source = (*TieredSource)(nil)
+
+// tieredCache keeps track of the on-disk cache size, it's shared
+// between a TieredSource and all its clones.
+type tieredCache struct {
+	mutex   sync.Mutex
+	scanned bool
+	size    int64
+
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+// cacheLowWaterMark is the fraction of MaxSize the cache is shrunk to when evicting,
+// so that we don't have to scan the cache every time a block is stored.
+const cacheLowWaterMark = 0.9
+
+// Clone returns a copy of this tiered source, suitable for fan-in. Clones
+// share cache accounting with the original.
+func (ts *TieredSource) Clone() Source {
+	if ts.cache == nil {
+		ts.cache = &tieredCache{}
+	}
+
+	return &TieredSource{
+		Local:    ts.Local.Clone().(*DiskSource),
+		Upstream: ts.Upstream.Clone(),
+		Sink:     ts.Sink.Clone(),
+
+		MaxSize:  ts.MaxSize,
+		Consumer: ts.Consumer,
+
+		cache: ts.cache,
+	}
+}
+
+// Fetch retrieves a block from the local cache if possible, otherwise
+// it fetches it from upstream and stores it into the local cache.
+func (ts *TieredSource) Fetch(loc BlockLocation, data []byte) (int, error) {
+	if ts.cache == nil {
+		ts.cache = &tieredCache{}
+	}
+
+	path, err := ts.Local.GetPath(loc)
+	if err != nil {
+		return 0, err
+	}
+
+	// cached blocks are always complete, so a short read means
+	// the block was truncated somehow
+	readBytes, err := ts.Local.Fetch(loc, data)
+	if err == nil && readBytes == len(data) {
+		atomic.AddInt64(&ts.cache.hits, 1)
+
+		// mark block as recently used, so it's evicted last
+		now := time.Now()
+		err = os.Chtimes(path, now, now)
+		if err != nil {
+			ts.debugf("could not touch %s: %s", path, err.Error())
+		}
+
+		return readBytes, nil
+	}
+
+	atomic.AddInt64(&ts.cache.misses, 1)
+
+	// if there was something at path, it's unreadable - make room for a
+	// fresh copy, otherwise the sink won't overwrite it.
+	if stats, sErr := os.Stat(path); sErr == nil {
+		ts.debugf("discarding unreadable cached block %+v", loc)
+		if rErr := os.Remove(path); rErr == nil {
+			ts.grow(-stats.Size())
+		}
+	}
+
+	readBytes, err = ts.Upstream.Fetch(loc, data)
+	if err != nil {
+		return 0, err
+	}
+
+	if readBytes != len(data) {
+		// short (or filtered) reads never make it into the cache
+		return readBytes, nil
+	}
+
+	err = ts.Sink.Store(loc, data)
+	if err != nil {
+		return 0, errors.Wrap(err, 1)
+	}
+
+	if stats, sErr := os.Stat(path); sErr == nil {
+		ts.grow(stats.Size())
+	}
+
+	err = ts.evict()
+	if err != nil {
+		return 0, err
+	}
+
+	return readBytes, nil
+}
+
+// GetContainer returns the tlc container associated with the local source
+func (ts *TieredSource) GetContainer() *tlc.Container {
+	return ts.Local.GetContainer()
+}
+
+// Stats returns a human-readable string containing hit rate and eviction
+// information for this source (and all its clones)
+func (ts *TieredSource) Stats() string {
+	if ts.cache == nil {
+		return "no fetches yet"
+	}
+
+	hits := atomic.LoadInt64(&ts.cache.hits)
+	misses := atomic.LoadInt64(&ts.cache.misses)
+
+	ts.cache.mutex.Lock()
+	defer ts.cache.mutex.Unlock()
+
+	return fmt.Sprintf("%d / %d fetches from cache (%.2f%% hit rate), %d evictions, cache is %s",
+		hits, hits+misses, float64(hits)/float64(hits+misses)*100.0,
+		ts.cache.evictions, humanize.IBytes(uint64(ts.cache.size)))
+}
+
+func (ts *TieredSource) grow(delta int64) {
+	ts.cache.mutex.Lock()
+	defer ts.cache.mutex.Unlock()
+
+	ts.cache.size += delta
+}
+
+type cachedBlock struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+type byModTime []cachedBlock
+
+func (s byModTime) Len() int {
+	return len(s)
+}
+
+func (s byModTime) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s byModTime) Less(i, j int) bool {
+	return s[i].modTime.Before(s[j].modTime)
+}
+
+// scan walks the whole cache, returning all the blocks it contains
+// and their total size
+func (ts *TieredSource) scan() ([]cachedBlock, int64, error) {
+	var blocks []cachedBlock
+	var totalSize int64
+
+	err := filepath.Walk(ts.Local.BasePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// cache doesn't exist yet, or block was evicted by someone else
+				return nil
+			}
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		blocks = append(blocks, cachedBlock{
+			path:    path,
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+		totalSize += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, 0, errors.Wrap(err, 1)
+	}
+
+	return blocks, totalSize, nil
+}
+
+// evict removes least recently used blocks from the cache until it's
+// smaller than MaxSize * cacheLowWaterMark. It's a no-op if MaxSize is 0
+// or if the cache is small enough.
+func (ts *TieredSource) evict() error {
+	if ts.MaxSize <= 0 {
+		return nil
+	}
+
+	ts.cache.mutex.Lock()
+	defer ts.cache.mutex.Unlock()
+
+	if ts.cache.scanned && ts.cache.size <= ts.MaxSize {
+		return nil
+	}
+
+	// other processes may share this cache, so the only
+	// reliable size is what's actually on disk.
+	blocks, totalSize, err := ts.scan()
+	if err != nil {
+		return err
+	}
+	ts.cache.scanned = true
+	ts.cache.size = totalSize
+
+	if totalSize <= ts.MaxSize {
+		return nil
+	}
+
+	sort.Sort(byModTime(blocks))
+	targetSize := int64(float64(ts.MaxSize) * cacheLowWaterMark)
+
+	for _, block := range blocks {
+		if ts.cache.size <= targetSize {
+			break
+		}
+
+		err := os.Remove(block.path)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, 1)
+		}
+
+		ts.cache.size -= block.size
+		ts.cache.evictions++
+	}
+
+	ts.debugf("evicted cache down to %s", humanize.IBytes(uint64(ts.cache.size)))
+
+	return nil
+}
+
+func (ts *TieredSource) debugf(format string, args ...interface{}) {
+	if ts.Consumer == nil {
+		return
+	}
+
+	ts.Consumer.Debugf(format, args...)
+}
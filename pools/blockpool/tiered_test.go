@@ -0,0 +1,115 @@
+package blockpool
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/tlc"
+)
+
+func Test_TieredSource(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "tieredsource")
+	assert.NoError(t, err)
+	defer os.RemoveAll(mainDir)
+
+	upstreamDir := filepath.Join(mainDir, "upstream")
+	cacheDir := filepath.Join(mainDir, "cache")
+
+	numFiles := 8
+	fileSize := int64(16 * 1024)
+
+	container := &tlc.Container{}
+	for i := 0; i < numFiles; i++ {
+		container.Files = append(container.Files, &tlc.File{
+			Path: fmt.Sprintf("file-%d", i),
+			Size: fileSize,
+		})
+		container.Size += fileSize
+	}
+
+	dataFor := func(fileIndex int) []byte {
+		return bytes.Repeat([]byte{byte(fileIndex + 1)}, int(fileSize))
+	}
+
+	blockHashes := NewBlockHashMap()
+	upstreamSink := &DiskSink{
+		BasePath:    upstreamDir,
+		Container:   container,
+		BlockHashes: blockHashes,
+	}
+
+	for i := 0; i < numFiles; i++ {
+		assert.NoError(t, upstreamSink.Store(BlockLocation{FileIndex: int64(i)}, dataFor(i)))
+	}
+
+	blockAddresses, err := blockHashes.ToAddressMap(container, pwr.HashAlgorithm_SHAKE128_32)
+	assert.NoError(t, err)
+
+	makeSource := func(maxSize int64) *TieredSource {
+		return &TieredSource{
+			Local: &DiskSource{
+				BasePath:       cacheDir,
+				BlockAddresses: blockAddresses,
+				Container:      container,
+			},
+			Upstream: &DiskSource{
+				BasePath:       upstreamDir,
+				BlockAddresses: blockAddresses,
+				Container:      container,
+			},
+			Sink: &DiskSink{
+				BasePath:  cacheDir,
+				Container: container,
+			},
+			MaxSize: maxSize,
+		}
+	}
+
+	fetchAll := func(source Source) {
+		buf := make([]byte, fileSize)
+		for i := 0; i < numFiles; i++ {
+			readBytes, err := source.Fetch(BlockLocation{FileIndex: int64(i)}, buf)
+			assert.NoError(t, err)
+			assert.EqualValues(t, fileSize, readBytes)
+			assert.Equal(t, dataFor(i), buf)
+		}
+	}
+
+	t.Logf("cold cache")
+	ts := makeSource(0)
+	fetchAll(ts)
+	assert.EqualValues(t, 0, ts.cache.hits)
+	assert.EqualValues(t, numFiles, ts.cache.misses)
+
+	t.Logf("warm cache, cloned source")
+	ts = makeSource(0)
+	fetchAll(ts.Clone())
+	assert.EqualValues(t, numFiles, ts.cache.hits)
+	assert.EqualValues(t, 0, ts.cache.misses)
+
+	t.Logf("corrupted cache entry")
+	path, err := ts.Local.GetPath(BlockLocation{FileIndex: 3})
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path, []byte("nope"), 0644))
+	ts = makeSource(0)
+	fetchAll(ts)
+	assert.EqualValues(t, numFiles-1, ts.cache.hits)
+	assert.EqualValues(t, 1, ts.cache.misses)
+
+	t.Logf("size-capped cache")
+	assert.NoError(t, os.RemoveAll(cacheDir))
+	maxSize := fileSize * 4
+	ts = makeSource(maxSize)
+	fetchAll(ts)
+	assert.True(t, ts.cache.evictions > 0)
+
+	_, cacheSize, err := ts.scan()
+	assert.NoError(t, err)
+	assert.True(t, cacheSize <= maxSize)
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"sync/atomic"
 
@@ -51,8 +52,14 @@ type ApplyStats struct {
 	// directories that were deleted as a result of applying the patch in-place
 	DeletedDirs int
 	// directories that could not be deleted as a result of applying the patch
-	LeftDirs  int
-	StageSize int64
+	LeftDirs int
+	// files and directories whose permissions were changed in-place, without
+	// rewriting them
+	ChangedModes int
+	StageSize    int64
+	// files that were moved to the backup folder instead of being overwritten
+	// or deleted, see ProtectionPolicy
+	BackedUpFiles []string
 }
 
 // ApplyContext holds the state while applying a patch
@@ -63,6 +70,16 @@ type ApplyContext struct {
 	OutputPath string
 	InPlace    bool
 
+	// Journal makes in-place applies atomic: every change made to OutputPath
+	// is logged, and replaced or deleted files are kept, until the apply is
+	// done. If it fails, it's rolled back. If it's interrupted, the next call to
+	// RecoverInPlace either rolls it back or finishes it.
+	Journal bool
+
+	// Protection keeps in-place applies from overwriting or deleting files the
+	// user modified or added, see ProtectionPolicy.
+	Protection *ProtectionPolicy
+
 	TargetContainer *tlc.Container
 	TargetPool      wsync.Pool
 	SourceContainer *tlc.Container
@@ -76,6 +93,12 @@ type ApplyContext struct {
 
 	Signature *SignatureInfo
 
+	// BsdiffMaxMessageSize is the largest bsdiff control accepted when applying,
+	// which bounds memory usage. Oversized controls are refused before being read.
+	// 0 means no limit, which patches optimized before controls were split need.
+	// See bsdiff.MaxMessageSize.
+	BsdiffMaxMessageSize int64
+
 	Stats ApplyStats
 
 	// optional, for checking
@@ -84,9 +107,11 @@ type ApplyContext struct {
 	// internal
 	actualOutputPath string
 	transpositions   map[string][]*Transposition
+	journal          *journal
 
 	// debug
-	debugBrokenRename bool
+	debugBrokenRename  bool
+	debugJournalFailAt int
 }
 
 type signature []wsync.BlockHash
@@ -117,10 +142,28 @@ type Ghost struct {
 }
 
 // ApplyPatch reads a patch, parses it, and generates the new file tree
-func (actx *ApplyContext) ApplyPatch(patchReader io.Reader) error {
+func (actx *ApplyContext) ApplyPatch(patchReader io.Reader) (retErr error) {
 	actx.actualOutputPath = actx.OutputPath
+	actx.journal = nil
 	if actx.OutputPool == nil {
 		if actx.InPlace {
+			if actx.Protection != nil {
+				err := actx.Protection.prepare(actx.actualOutputPath)
+				if err != nil {
+					return errors.Wrap(err, 0)
+				}
+			}
+
+			if actx.Journal {
+				j, err := openJournal(actx.actualOutputPath)
+				if err != nil {
+					return errors.Wrap(err, 0)
+				}
+				j.brokenRename = actx.debugBrokenRename
+				j.failAt = actx.debugJournalFailAt
+				actx.journal = j
+			}
+
 			// applying in-place is a bit tricky: we can't overwrite files in the
 			// target directory (old) while we're reading the patch otherwise
 			// we might be copying new bytes instead of old bytes into later files
@@ -133,6 +176,27 @@ func (actx *ApplyContext) ApplyPatch(patchReader io.Reader) error {
 
 			defer os.RemoveAll(stagePath)
 			actx.OutputPath = stagePath
+
+			if actx.journal != nil {
+				// runs before the stage is removed, since
+				// rolling back may move files back into it
+				defer func() {
+					if retErr == nil {
+						return
+					}
+
+					if errors.Is(retErr, errSimulatedCrash) {
+						// leave everything as-is, as if we crashed
+						actx.journal.close()
+						return
+					}
+
+					rbErr := actx.journal.rollback()
+					if rbErr != nil {
+						actx.Consumer.Warnf("Could not roll back in-place apply: %s", rbErr.Error())
+					}
+				}()
+			}
 		} else {
 			os.MkdirAll(actx.OutputPath, os.FileMode(0755))
 		}
@@ -218,6 +282,13 @@ func (actx *ApplyContext) ApplyPatch(patchReader io.Reader) error {
 		if err != nil {
 			return errors.Wrap(err, 0)
 		}
+
+		if actx.journal != nil {
+			err = actx.journal.commit()
+			if err != nil {
+				return errors.Wrap(err, 0)
+			}
+		}
 		actx.OutputPath = actx.actualOutputPath
 	}
 
@@ -265,6 +336,10 @@ func (actx *ApplyContext) patchAll(patchWire *wire.ReadContext, signature *Signa
 			}
 			actx.WoundsConsumer = healer
 
+			if sh, ok := healer.(SignatureHealer); ok {
+				sh.SetSignature(signature)
+			}
+
 			healer.SetConsumer(&state.Consumer{
 				OnProgress: func(progress float64) {
 					if atomic.LoadInt64(&relayWoundsProgress) == 1 {
@@ -388,7 +463,7 @@ func (actx *ApplyContext) patchAll(patchWire *wire.ReadContext, signature *Signa
 			skip = true
 		}
 
-		if sh.Type == SyncHeader_BSDIFF {
+		if sh.Type == SyncHeader_BSDIFF || sh.Type == SyncHeader_BSDIFF_FILTERED {
 			if skip {
 				retErr = errors.Wrap(fmt.Errorf("don't know how to skip bsdiff entry"), 0)
 				return
@@ -401,6 +476,12 @@ func (actx *ApplyContext) patchAll(patchWire *wire.ReadContext, signature *Signa
 				return
 			}
 
+			filter, err := bsdiffFilter(sh, bh)
+			if err != nil {
+				retErr = errors.Wrap(err, 0)
+				return
+			}
+
 			targetReader, err := targetPool.GetReadSeeker(bh.TargetIndex)
 			if err != nil {
 				retErr = errors.Wrap(err, 0)
@@ -421,7 +502,15 @@ func (actx *ApplyContext) patchAll(patchWire *wire.ReadContext, signature *Signa
 
 			newSize := actx.SourceContainer.Files[sh.FileIndex].Size
 
-			err = bsdiff.Patch(targetReader, sourceWriter, newSize, patchWire.ReadMessage)
+			pc := &bsdiff.PatchContext{
+				MaxMessageSize: actx.BsdiffMaxMessageSize,
+				Filter:         filter,
+			}
+			if actx.BsdiffMaxMessageSize > 0 {
+				patchWire.SetMaxMessageSize(actx.BsdiffMaxMessageSize + bsdiff.MaxControlOverhead)
+			}
+			err = pc.Patch(targetReader, sourceWriter, newSize, patchWire.ReadMessage)
+			patchWire.SetMaxMessageSize(0)
 			if err != nil {
 				retErr = errors.Wrap(err, 0)
 				return
@@ -440,6 +529,39 @@ func (actx *ApplyContext) patchAll(patchWire *wire.ReadContext, signature *Signa
 				return
 			}
 
+			actx.Stats.TouchedFiles++
+		} else if sh.Type == SyncHeader_ZSTD {
+			zh := &ZstdHeader{}
+			err := patchWire.ReadMessage(zh)
+			if err != nil {
+				retErr = errors.Wrap(err, 0)
+				return
+			}
+
+			if skip {
+				dor := &dataOpReader{rctx: patchWire}
+				err = dor.drain()
+				if err != nil {
+					retErr = errors.Wrap(err, 0)
+					return
+				}
+				continue
+			}
+
+			sourceWriter, err := outputPool.GetWriter(sh.FileIndex)
+			if err != nil {
+				retErr = errors.Wrap(err, 0)
+				return
+			}
+
+			newSize := actx.SourceContainer.Files[sh.FileIndex].Size
+
+			err = applyZstd(patchWire, targetPool, zh.TargetIndex, sourceWriter, newSize)
+			if err != nil {
+				retErr = errors.Wrap(err, 0)
+				return
+			}
+
 			actx.Stats.TouchedFiles++
 		} else if sh.Type == SyncHeader_RSYNC {
 			if skip {
@@ -543,6 +665,11 @@ func (actx *ApplyContext) applyTranspositions(transpositions map[string][]*Trans
 				return err
 			}
 			actx.Stats.TouchedFiles++
+
+			err = actx.fixTransposedMode(newAbsolutePath, transpo)
+			if err != nil {
+				return err
+			}
 		}
 
 		if noop == nil {
@@ -555,8 +682,19 @@ func (actx *ApplyContext) applyTranspositions(transpositions map[string][]*Trans
 				return err
 			}
 			actx.Stats.MovedFiles++
+
+			err = actx.fixTransposedMode(newAbsolutePath, transpo)
+			if err != nil {
+				return err
+			}
 		} else {
 			actx.Stats.NoopFiles++
+
+			noopAbsolutePath := filepath.Join(actx.actualOutputPath, filepath.FromSlash(noop.OutputPath))
+			err := actx.fixTransposedMode(noopAbsolutePath, noop)
+			if err != nil {
+				return err
+			}
 		}
 
 		return nil
@@ -595,19 +733,24 @@ func (actx *ApplyContext) applyTranspositions(transpositions map[string][]*Trans
 
 		if len(group) == 1 {
 			transpo := group[0]
+			newAbsolutePath := filepath.Join(actx.actualOutputPath, filepath.FromSlash(transpo.OutputPath))
 			if transpo.TargetPath == transpo.OutputPath {
-				// file wasn't touched at all
+				// file contents weren't touched at all
 				actx.Stats.NoopFiles++
 			} else {
 				// file was renamed
 				oldAbsolutePath := filepath.Join(actx.actualOutputPath, filepath.FromSlash(transpo.TargetPath))
-				newAbsolutePath := filepath.Join(actx.actualOutputPath, filepath.FromSlash(transpo.OutputPath))
 				err := actx.move(oldAbsolutePath, newAbsolutePath)
 				if err != nil {
 					return err
 				}
 				actx.Stats.MovedFiles++
 			}
+
+			err := actx.fixTransposedMode(newAbsolutePath, transpo)
+			if err != nil {
+				return err
+			}
 		} else {
 			err := applyMultipleTranspositions(groupTargetPath, group)
 			if err != nil {
@@ -628,8 +771,66 @@ func (actx *ApplyContext) applyTranspositions(transpositions map[string][]*Trans
 	return nil
 }
 
+func (actx *ApplyContext) fixTransposedMode(absolutePath string, transpo *Transposition) error {
+	if transpo.Mode == 0 {
+		return nil
+	}
+
+	changed, err := actx.fixMode(absolutePath, transpo.Mode)
+	if err != nil {
+		return err
+	}
+	if changed {
+		actx.Stats.ChangedModes++
+	}
+	return nil
+}
+
+// fixMode gives path the permissions from mode, unless it already has them.
+// It returns true if the permissions were changed.
+func (actx *ApplyContext) fixMode(path string, mode uint32) (bool, error) {
+	if runtime.GOOS == "windows" {
+		// all os.Chmod can do on windows is toggle read-only,
+		// which we never set.
+		return false, nil
+	}
+
+	stats, err := os.Stat(path)
+	if err != nil {
+		return false, errors.Wrap(err, 0)
+	}
+
+	// containers are walked with ModeMask or'd in, do the same here
+	// so we don't change permissions for nothing
+	actualPerm := stats.Mode().Perm() | tlc.ModeMask
+	perm := os.FileMode(mode).Perm() | tlc.ModeMask
+	if actualPerm == perm {
+		return false, nil
+	}
+
+	if actx.journal != nil {
+		err = actx.journal.chmod(path, perm)
+	} else {
+		err = os.Chmod(path, perm)
+	}
+	if err != nil {
+		return false, errors.Wrap(err, 0)
+	}
+
+	return true, nil
+}
+
 func (actx *ApplyContext) move(oldAbsolutePath string, newAbsolutePath string) error {
-	err := os.Remove(newAbsolutePath)
+	_, err := actx.protect(newAbsolutePath)
+	if err != nil {
+		return err
+	}
+
+	if actx.journal != nil {
+		return actx.journal.move(oldAbsolutePath, newAbsolutePath)
+	}
+
+	err = os.Remove(newAbsolutePath)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			return errors.Wrap(err, 0)
@@ -669,6 +870,15 @@ const (
 )
 
 func (actx *ApplyContext) copy(oldAbsolutePath string, newAbsolutePath string, mkdirBehavior mkdirBehavior) error {
+	_, err := actx.protect(newAbsolutePath)
+	if err != nil {
+		return err
+	}
+
+	if actx.journal != nil {
+		return actx.journal.copy(oldAbsolutePath, newAbsolutePath)
+	}
+
 	if mkdirBehavior == mkdirBehaviorIfNeeded {
 		err := os.MkdirAll(filepath.Dir(newAbsolutePath), os.FileMode(0755))
 		if err != nil {
@@ -676,7 +886,10 @@ func (actx *ApplyContext) copy(oldAbsolutePath string, newAbsolutePath string, m
 		}
 	}
 
-	// fall back to copy + remove
+	return copyFile(oldAbsolutePath, newAbsolutePath)
+}
+
+func copyFile(oldAbsolutePath string, newAbsolutePath string) error {
 	reader, err := os.Open(oldAbsolutePath)
 	if err != nil {
 		return err
@@ -793,7 +1006,25 @@ func (actx *ApplyContext) deleteGhosts(outPath string, ghosts []Ghost) error {
 
 		op := filepath.Join(outPath, filepath.FromSlash(ghost.Path))
 
-		err := os.Remove(op)
+		if ghost.Kind == GhostKindFile {
+			backedUp, err := actx.protect(op)
+			if err != nil {
+				return errors.Wrap(err, 0)
+			}
+			if backedUp {
+				// moved to the backup folder instead
+				continue
+			}
+		}
+
+		var err error
+		if actx.journal == nil {
+			err = os.Remove(op)
+		} else if ghost.Kind == GhostKindDir {
+			err = actx.journal.rmdir(op)
+		} else {
+			err = actx.journal.remove(op)
+		}
 		if err == nil || os.IsNotExist(err) {
 			// removed or already removed, good
 			switch ghost.Kind {
@@ -805,7 +1036,7 @@ func (actx *ApplyContext) deleteGhosts(outPath string, ghosts []Ghost) error {
 				actx.Stats.DeletedSymlinks++
 			}
 		} else {
-			if ghost.Kind == GhostKindDir {
+			if ghost.Kind == GhostKindDir && !errors.Is(err, errSimulatedCrash) {
 				// sometimes we can't delete directories, it's okay
 				actx.Stats.LeftDirs++
 			} else {
@@ -824,6 +1055,9 @@ func (actx *ApplyContext) deleteGhosts(outPath string, ghosts []Ghost) error {
 type Transposition struct {
 	TargetPath string
 	OutputPath string
+	// Mode of the output file: only the contents are transposed, the
+	// permissions may have changed (0 means leave them alone)
+	Mode uint32
 }
 
 func (actx *ApplyContext) lazilyPatchFile(sctx *wsync.Context, targetContainer *tlc.Container, targetPool wsync.Pool, outputContainer *tlc.Container, outputPool wsync.WritablePool,
@@ -862,6 +1096,7 @@ func (actx *ApplyContext) lazilyPatchFile(sctx *wsync.Context, targetContainer *
 					transposition = &Transposition{
 						TargetPath: targetFile.Path,
 						OutputPath: outputFile.Path,
+						Mode:       outputFile.Mode,
 					}
 				}
 			}
@@ -976,45 +1211,80 @@ func (actx *ApplyContext) ensureDirsAndSymlinks(actualOutputPath string) error {
 	for _, dir := range actx.SourceContainer.Dirs {
 		path := filepath.Join(actualOutputPath, filepath.FromSlash(dir.Path))
 
-		err := os.MkdirAll(path, 0755)
+		err := actx.mkdirAll(path)
 		if err != nil {
 			// If path is already a directory, MkdirAll does nothing and returns nil.
 			// so if we get a non-nil error, we know it's serious business (permissions, etc.)
 			return err
 		}
+
+		changed, err := actx.fixMode(path, dir.Mode)
+		if err != nil {
+			return err
+		}
+		if changed {
+			actx.Stats.ChangedModes++
+		}
 	}
 
+	// note: symlink permissions aren't fixed - they're ignored on linux
+	// and windows, and there's no portable way to change them anyway.
+
 	for _, symlink := range actx.SourceContainer.Symlinks {
 		path := filepath.Join(actualOutputPath, filepath.FromSlash(symlink.Path))
 		dest, err := os.Readlink(path)
 		if err != nil {
 			if os.IsNotExist(err) {
 				// symlink was missing
-				err = os.Symlink(filepath.FromSlash(symlink.Dest), path)
+				err = actx.symlink(filepath.FromSlash(symlink.Dest), path)
 				if err != nil {
 					return err
 				}
-			} else {
-				return err
+				continue
 			}
+			return err
 		}
 
 		// symlink is there
 		if dest != filepath.FromSlash(symlink.Dest) {
 			// wrong dest, fixing that
-			err = os.Remove(path)
+			err = actx.symlink(filepath.FromSlash(symlink.Dest), path)
 			if err != nil {
 				return err
 			}
-
-			err = os.Symlink(filepath.FromSlash(symlink.Dest), path)
-			if err != nil {
-				return err
-			}
-
-			return nil
 		}
 	}
 
 	return nil
 }
+
+func (actx *ApplyContext) mkdirAll(path string) error {
+	if actx.journal != nil {
+		return actx.journal.mkdirAll(path)
+	}
+
+	return os.MkdirAll(path, 0755)
+}
+
+// symlink creates a symlink at path, replacing whatever was there
+func (actx *ApplyContext) symlink(dest string, path string) error {
+	if actx.journal != nil {
+		return actx.journal.symlink(dest, path)
+	}
+
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.Symlink(dest, path)
+}
+
+// bsdiffFilter returns the filter a bsdiff'd file must be patched with. Only
+// SyncHeader_BSDIFF_FILTERED entries may have one, see its definition.
+func bsdiffFilter(sh *SyncHeader, bh *BsdiffHeader) (bsdiff.Filter, error) {
+	if sh.Type != SyncHeader_BSDIFF_FILTERED && bh.Filter != BsdiffHeader_NONE {
+		return bsdiff.FilterNone, errors.Wrap(ErrMalformedPatch, 1)
+	}
+	return bsdiff.Filter(bh.Filter), nil
+}
@@ -19,6 +19,30 @@ type Decompressor interface {
 	Apply(reader io.Reader) (io.Reader, error)
 }
 
+// ZstdPatchParams are the settings a zstd patch is compressed and decompressed with
+type ZstdPatchParams struct {
+	// Quality is the zstd level, only used when compressing
+	Quality int32
+	// WindowSize is how far back matches may reach: a power of two large enough
+	// for any part of the new file to reference any part of the old one.
+	// Decompressors must refuse frames that need a larger window.
+	WindowSize int64
+}
+
+// A ZstdPatchCompressor is a Compressor that can compress with a reference file
+// as a raw dictionary ("patch-from"), looking for matches across the whole window.
+// zstd patches need the ZSTD compressor to be one.
+type ZstdPatchCompressor interface {
+	ApplyPatchFrom(writer io.Writer, ref []byte, params *ZstdPatchParams) (io.WriteCloser, error)
+}
+
+// A ZstdPatchDecompressor is a Decompressor that can decompress what a
+// ZstdPatchCompressor wrote, given the same reference and params.
+// Applying zstd patches needs the ZSTD decompressor to be one.
+type ZstdPatchDecompressor interface {
+	ApplyPatchFrom(reader io.Reader, ref []byte, params *ZstdPatchParams) (io.ReadCloser, error)
+}
+
 var compressors map[CompressionAlgorithm]Compressor
 var decompressors map[CompressionAlgorithm]Decompressor
 
@@ -95,3 +119,15 @@ func DecompressWire(ctx *wire.ReadContext, compression *CompressionSettings) (*w
 
 	return wire.NewReadContext(compressedReader), nil
 }
+
+// GetCompressor returns the compressor registered for a given algorithm, or nil
+// if there is none.
+func GetCompressor(a CompressionAlgorithm) Compressor {
+	return compressors[a]
+}
+
+// GetDecompressor returns the decompressor registered for a given algorithm, or nil
+// if there is none.
+func GetDecompressor(a CompressionAlgorithm) Decompressor {
+	return decompressors[a]
+}
@@ -21,6 +21,12 @@ const (
 
 	// WoundsMagic is the magic number for wharf wounds file (.pww)
 	WoundsMagic
+
+	// ManifestIndexMagic is the magic number for wharf manifest index files (.pwmi)
+	ManifestIndexMagic
+
+	// ValidationCacheMagic is the magic number for wharf validation cache files (.pwv)
+	ValidationCacheMagic
 )
 
 // ModeMask is or'd with files being applied/created
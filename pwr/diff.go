@@ -3,6 +3,7 @@ package pwr
 import (
 	"fmt"
 	"io"
+	"sync/atomic"
 
 	"github.com/dustin/go-humanize"
 	"github.com/go-errors/errors"
@@ -24,6 +25,14 @@ type DiffContext struct {
 	TargetContainer *tlc.Container
 	TargetSignature []wsync.BlockHash
 
+	// NumWorkers is how many source files are diffed concurrently. The patch
+	// and signature are the same no matter how many workers are used.
+	// 0 or 1 means one file at a time, using Pool.
+	NumWorkers int
+	// PoolFactory returns a new pool for SourceContainer, it's required when
+	// NumWorkers > 1, since pools can't be shared between workers.
+	PoolFactory func() (wsync.Pool, error)
+
 	ReusedBytes int64
 	FreshBytes  int64
 
@@ -32,14 +41,14 @@ type DiffContext struct {
 }
 
 // WritePatch outputs a pwr patch to patchWriter
-func (dctx *DiffContext) WritePatch(patchWriter io.Writer, signatureWriter io.Writer) error {
+func (dctx *DiffContext) WritePatch(patchWriter io.Writer, signatureWriter io.Writer) (err error) {
 	if dctx.Compression == nil {
 		return errors.Wrap(fmt.Errorf("No compression settings specified, bailing out"), 1)
 	}
 
 	// signature header
 	rawSigWire := wire.NewWriteContext(signatureWriter)
-	err := rawSigWire.WriteMagic(SignatureMagic)
+	err = rawSigWire.WriteMagic(SignatureMagic)
 	if err != nil {
 		return errors.Wrap(err, 1)
 	}
@@ -92,18 +101,6 @@ func (dctx *DiffContext) WritePatch(patchWriter io.Writer, signatureWriter io.Wr
 		return errors.Wrap(err, 1)
 	}
 
-	sourceBytes := dctx.SourceContainer.Size
-	fileOffset := int64(0)
-
-	onSourceRead := func(count int64) {
-		dctx.Consumer.Progress(float64(fileOffset+count) / float64(sourceBytes))
-	}
-
-	sigWriter := makeSigWriter(sigWire)
-	opsWriter := makeOpsWriter(patchWire, dctx)
-
-	diffContext := mksync()
-	signContext := mksync()
 	blockLibrary := wsync.NewBlockLibrary(dctx.TargetSignature)
 
 	targetContainerPathToIndex := make(map[string]int64)
@@ -111,96 +108,166 @@ func (dctx *DiffContext) WritePatch(patchWriter io.Writer, signatureWriter io.Wr
 		targetContainerPathToIndex[f.Path] = int64(index)
 	}
 
-	// re-used messages
-	syncHeader := &SyncHeader{}
-	syncDelimiter := &SyncOp{
-		Type: SyncOp_HEY_YOU_DID_IT,
+	if dctx.Pool != nil {
+		pool := dctx.Pool
+		defer func() {
+			if fErr := pool.Close(); fErr != nil && err == nil {
+				err = errors.Wrap(fErr, 1)
+			}
+		}()
 	}
 
-	pool := dctx.Pool
-	defer func() {
-		if fErr := pool.Close(); fErr != nil && err == nil {
-			err = errors.Wrap(fErr, 1)
-		}
-	}()
-
-	for fileIndex, f := range dctx.SourceContainer.Files {
-		dctx.Consumer.ProgressLabel(f.Path)
-		dctx.Consumer.Debug(fmt.Sprintf("%s (%s)", f.Path, humanize.IBytes(uint64(f.Size))))
-		fileOffset = f.Offset
+	progress := &diffProgress{
+		consumer:    dctx.Consumer,
+		sourceBytes: dctx.SourceContainer.Size,
+	}
 
-		syncHeader.Reset()
-		syncHeader.FileIndex = int64(fileIndex)
-		err = patchWire.WriteMessage(syncHeader)
+	if dctx.NumWorkers > 1 {
+		err = dctx.diffParallel(patchWire, sigWire, blockLibrary, targetContainerPathToIndex, progress)
 		if err != nil {
 			return errors.Wrap(err, 1)
 		}
+	} else {
+		fd := &fileDiffer{
+			dctx:                       dctx,
+			pool:                       dctx.Pool,
+			diffContext:                mksync(),
+			signContext:                mksync(),
+			blockLibrary:               blockLibrary,
+			targetContainerPathToIndex: targetContainerPathToIndex,
+			progress:                   progress,
+		}
 
-		var sourceReader io.Reader
-		sourceReader, err = pool.GetReader(int64(fileIndex))
-		if err != nil {
-			return errors.Wrap(err, 1)
+		for fileIndex := range dctx.SourceContainer.Files {
+			err = fd.diff(int64(fileIndex), patchWire, sigWire)
+			if err != nil {
+				return errors.Wrap(err, 1)
+			}
 		}
 
-		//             / differ
-		// source file +
-		//             \ signer
-		diffReader, diffWriter := io.Pipe()
-		signReader, signWriter := io.Pipe()
+		dctx.ReusedBytes += fd.reusedBytes
+		dctx.FreshBytes += fd.freshBytes
+	}
 
-		done := make(chan bool)
-		errs := make(chan error)
+	err = patchWire.Close()
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+	err = sigWire.Close()
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
 
-		var preferredFileIndex int64 = -1
-		if oldIndex, ok := targetContainerPathToIndex[f.Path]; ok {
-			preferredFileIndex = oldIndex
-		}
+	return nil
+}
+
+// diffProgress reports progress as source bytes are read, from any
+// number of goroutines
+type diffProgress struct {
+	consumer    *state.Consumer
+	sourceBytes int64
+	doneBytes   int64
+}
+
+// reader wraps the reader of a source file so that bytes read from it
+// count towards progress
+func (dp *diffProgress) reader(reader io.Reader) io.Reader {
+	var lastCount int64
+
+	return counter.NewReaderCallback(func(count int64) {
+		done := atomic.AddInt64(&dp.doneBytes, count-lastCount)
+		lastCount = count
+		dp.consumer.Progress(float64(done) / float64(dp.sourceBytes))
+	}, reader)
+}
 
-		go diffFile(diffContext, dctx, blockLibrary, diffReader, opsWriter, preferredFileIndex, errs, done)
-		go signFile(signContext, fileIndex, signReader, sigWriter, errs, done)
-
-		go func() {
-			defer func() {
-				if dErr := diffWriter.Close(); dErr != nil {
-					errs <- errors.Wrap(dErr, 1)
-				}
-			}()
-			defer func() {
-				if sErr := signWriter.Close(); sErr != nil {
-					errs <- errors.Wrap(sErr, 1)
-				}
-			}()
-
-			mw := io.MultiWriter(diffWriter, signWriter)
-
-			sourceReadCounter := counter.NewReaderCallback(onSourceRead, sourceReader)
-			_, cErr := io.Copy(mw, sourceReadCounter)
-			if cErr != nil {
-				errs <- errors.Wrap(cErr, 1)
+// A fileDiffer diffs and signs source files one at a time
+type fileDiffer struct {
+	dctx                       *DiffContext
+	pool                       wsync.Pool
+	diffContext                *wsync.Context
+	signContext                *wsync.Context
+	blockLibrary               *wsync.BlockLibrary
+	targetContainerPathToIndex map[string]int64
+	progress                   *diffProgress
+
+	reusedBytes int64
+	freshBytes  int64
+}
+
+// diff writes the sync header, the operations and the delimiter for a source
+// file to patchWire, and its block hashes to sigWire
+func (fd *fileDiffer) diff(fileIndex int64, patchWire *wire.WriteContext, sigWire *wire.WriteContext) error {
+	dctx := fd.dctx
+	f := dctx.SourceContainer.Files[fileIndex]
+	dctx.Consumer.ProgressLabel(f.Path)
+	dctx.Consumer.Debug(fmt.Sprintf("%s (%s)", f.Path, humanize.IBytes(uint64(f.Size))))
+
+	err := patchWire.WriteMessage(&SyncHeader{
+		FileIndex: fileIndex,
+	})
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	sourceReader, err := fd.pool.GetReader(fileIndex)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	sigWriter := makeSigWriter(sigWire)
+	opsWriter := makeOpsWriter(patchWire, dctx.TargetContainer.Files, &fd.reusedBytes, &fd.freshBytes)
+
+	//             / differ
+	// source file +
+	//             \ signer
+	diffReader, diffWriter := io.Pipe()
+	signReader, signWriter := io.Pipe()
+
+	done := make(chan bool)
+	errs := make(chan error)
+
+	var preferredFileIndex int64 = -1
+	if oldIndex, ok := fd.targetContainerPathToIndex[f.Path]; ok {
+		preferredFileIndex = oldIndex
+	}
+
+	go diffFile(fd.diffContext, fd.blockLibrary, diffReader, opsWriter, preferredFileIndex, errs, done)
+	go signFile(fd.signContext, int(fileIndex), signReader, sigWriter, errs, done)
+
+	go func() {
+		defer func() {
+			if dErr := diffWriter.Close(); dErr != nil {
+				errs <- errors.Wrap(dErr, 1)
 			}
 		}()
-
-		// wait until all are done
-		// or an error occurs
-		for c := 0; c < 2; c++ {
-			select {
-			case wErr := <-errs:
-				return errors.Wrap(wErr, 1)
-			case <-done:
+		defer func() {
+			if sErr := signWriter.Close(); sErr != nil {
+				errs <- errors.Wrap(sErr, 1)
 			}
+		}()
+
+		mw := io.MultiWriter(diffWriter, signWriter)
+
+		_, cErr := io.Copy(mw, fd.progress.reader(sourceReader))
+		if cErr != nil {
+			errs <- errors.Wrap(cErr, 1)
 		}
+	}()
 
-		err = patchWire.WriteMessage(syncDelimiter)
-		if err != nil {
-			return errors.Wrap(err, 1)
+	// wait until all are done
+	// or an error occurs
+	for c := 0; c < 2; c++ {
+		select {
+		case wErr := <-errs:
+			return errors.Wrap(wErr, 1)
+		case <-done:
 		}
 	}
 
-	err = patchWire.Close()
-	if err != nil {
-		return errors.Wrap(err, 1)
-	}
-	err = sigWire.Close()
+	err = patchWire.WriteMessage(&SyncOp{
+		Type: SyncOp_HEY_YOU_DID_IT,
+	})
 	if err != nil {
 		return errors.Wrap(err, 1)
 	}
@@ -208,7 +275,7 @@ func (dctx *DiffContext) WritePatch(patchWriter io.Writer, signatureWriter io.Wr
 	return nil
 }
 
-func diffFile(sctx *wsync.Context, dctx *DiffContext, blockLibrary *wsync.BlockLibrary, reader io.Reader, opsWriter wsync.OperationWriter, preferredFileIndex int64, errs chan error, done chan bool) {
+func diffFile(sctx *wsync.Context, blockLibrary *wsync.BlockLibrary, reader io.Reader, opsWriter wsync.OperationWriter, preferredFileIndex int64, errs chan error, done chan bool) {
 	err := sctx.ComputeDiff(reader, blockLibrary, opsWriter, preferredFileIndex)
 	if err != nil {
 		errs <- errors.Wrap(err, 1)
@@ -251,12 +318,10 @@ func ComputeBlockSize(fileSize int64, blockIndex int64) int64 {
 	return BlockSize
 }
 
-func makeOpsWriter(wc *wire.WriteContext, dctx *DiffContext) wsync.OperationWriter {
+func makeOpsWriter(wc *wire.WriteContext, files []*tlc.File, reusedBytes *int64, freshBytes *int64) wsync.OperationWriter {
 	numOps := 0
 	wop := &SyncOp{}
 
-	files := dctx.TargetContainer.Files
-
 	return func(op wsync.Operation) error {
 		numOps++
 		wop.Reset()
@@ -271,13 +336,13 @@ func makeOpsWriter(wc *wire.WriteContext, dctx *DiffContext) wsync.OperationWrit
 			fileSize := files[op.FileIndex].Size
 			lastBlockIndex := op.BlockIndex + op.BlockSpan - 1
 			tailSize := ComputeBlockSize(fileSize, lastBlockIndex)
-			dctx.ReusedBytes += BlockSize*(op.BlockSpan-1) + tailSize
+			*reusedBytes += BlockSize*(op.BlockSpan-1) + tailSize
 
 		case wsync.OpData:
 			wop.Type = SyncOp_DATA
 			wop.Data = op.Data
 
-			dctx.FreshBytes += int64(len(op.Data))
+			*freshBytes += int64(len(op.Data))
 
 		default:
 			return errors.Wrap(fmt.Errorf("unknown rsync op type: %d", op.Type), 1)
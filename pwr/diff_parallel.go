@@ -0,0 +1,222 @@
+package pwr
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/go-errors/errors"
+	"github.com/itchio/wharf/wire"
+	"github.com/itchio/wharf/wsync"
+)
+
+// diffSpillThreshold is how much of a file's patch (or signature) is kept in
+// memory before spilling to a temporary file
+const diffSpillThreshold = 4 * 1024 * 1024
+
+// A spillBuffer keeps what's written to it in memory until it grows
+// past diffSpillThreshold, then moves it to a temporary file.
+type spillBuffer struct {
+	buf  bytes.Buffer
+	file *os.File
+	// how many bytes were written, in memory or not
+	size int64
+}
+
+var _ io.Writer = (*spillBuffer)(nil)
+
+func (sb *spillBuffer) Write(p []byte) (int, error) {
+	if sb.file == nil && sb.buf.Len()+len(p) > diffSpillThreshold {
+		file, err := ioutil.TempFile("", "wharf-diff")
+		if err != nil {
+			return 0, errors.Wrap(err, 1)
+		}
+		sb.file = file
+
+		_, err = sb.buf.WriteTo(file)
+		if err != nil {
+			return 0, errors.Wrap(err, 1)
+		}
+	}
+
+	sb.size += int64(len(p))
+	if sb.file != nil {
+		return sb.file.Write(p)
+	}
+	return sb.buf.Write(p)
+}
+
+// replayTo writes the wire messages that were written to the buffer to w,
+// see copyMessages.
+func (sb *spillBuffer) replayTo(w io.Writer) error {
+	var reader io.Reader = &sb.buf
+	if sb.file != nil {
+		_, err := sb.file.Seek(0, os.SEEK_SET)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+		reader = sb.file
+	}
+
+	return copyMessages(reader, w)
+}
+
+func (sb *spillBuffer) release() {
+	sb.buf.Reset()
+	if sb.file != nil {
+		sb.file.Close()
+		os.Remove(sb.file.Name())
+		sb.file = nil
+	}
+}
+
+// A diffResult holds the patch and signature bytes for one source file,
+// exactly as they would've been written to the (uncompressed) wires.
+type diffResult struct {
+	patch       spillBuffer
+	signature   spillBuffer
+	reusedBytes int64
+	freshBytes  int64
+	err         error
+}
+
+func (dr *diffResult) release() {
+	dr.patch.release()
+	dr.signature.release()
+}
+
+// diffParallel diffs source files with NumWorkers workers, and writes their
+// results in file index order so that the output doesn't depend on scheduling.
+func (dctx *DiffContext) diffParallel(patchWire *wire.WriteContext, sigWire *wire.WriteContext,
+	blockLibrary *wsync.BlockLibrary, targetContainerPathToIndex map[string]int64, progress *diffProgress) error {
+	if dctx.PoolFactory == nil {
+		return errors.New("diffing with more than one worker requires a PoolFactory")
+	}
+
+	numFiles := len(dctx.SourceContainer.Files)
+	numWorkers := dctx.NumWorkers
+
+	results := make([]chan *diffResult, numFiles)
+	for i := range results {
+		results[i] = make(chan *diffResult, 1)
+	}
+
+	// workers may only get ahead of the writer by that many files,
+	// so that memory and disk usage stay bounded.
+	window := make(chan bool, numWorkers*2)
+	fileIndices := make(chan int64)
+	cancel := make(chan struct{})
+
+	go func() {
+		defer close(fileIndices)
+
+		for fileIndex := 0; fileIndex < numFiles; fileIndex++ {
+			select {
+			case window <- true:
+				// muffin
+			case <-cancel:
+				return
+			}
+
+			select {
+			case fileIndices <- int64(fileIndex):
+				// muffin
+			case <-cancel:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dctx.diffWorker(fileIndices, results, blockLibrary, targetContainerPathToIndex, progress)
+		}()
+	}
+
+	var err error
+	for fileIndex := 0; fileIndex < numFiles; fileIndex++ {
+		result := <-results[fileIndex]
+
+		err = result.err
+		if err == nil {
+			err = result.patch.replayTo(patchWire.Writer())
+		}
+		if err == nil {
+			err = result.signature.replayTo(sigWire.Writer())
+		}
+		result.release()
+
+		if err != nil {
+			break
+		}
+
+		dctx.ReusedBytes += result.reusedBytes
+		dctx.FreshBytes += result.freshBytes
+		<-window
+	}
+
+	if err != nil {
+		close(cancel)
+
+		// wait for workers to be done with their current file,
+		// then clean up whatever they left behind.
+		wg.Wait()
+		for _, resultChan := range results {
+			select {
+			case result := <-resultChan:
+				result.release()
+			default:
+				// muffin
+			}
+		}
+
+		return errors.Wrap(err, 1)
+	}
+
+	wg.Wait()
+	return nil
+}
+
+func (dctx *DiffContext) diffWorker(fileIndices chan int64, results []chan *diffResult,
+	blockLibrary *wsync.BlockLibrary, targetContainerPathToIndex map[string]int64, progress *diffProgress) {
+	pool, err := dctx.PoolFactory()
+
+	var fd *fileDiffer
+	if err == nil {
+		defer pool.Close()
+
+		fd = &fileDiffer{
+			dctx:                       dctx,
+			pool:                       pool,
+			diffContext:                mksync(),
+			signContext:                mksync(),
+			blockLibrary:               blockLibrary,
+			targetContainerPathToIndex: targetContainerPathToIndex,
+			progress:                   progress,
+		}
+	}
+
+	for fileIndex := range fileIndices {
+		result := &diffResult{}
+
+		if err != nil {
+			result.err = err
+		} else {
+			fd.reusedBytes = 0
+			fd.freshBytes = 0
+
+			patchWire := wire.NewWriteContext(&result.patch)
+			sigWire := wire.NewWriteContext(&result.signature)
+			result.err = fd.diff(fileIndex, patchWire, sigWire)
+			result.reusedBytes = fd.reusedBytes
+			result.freshBytes = fd.freshBytes
+		}
+
+		results[fileIndex] <- result
+	}
+}
@@ -0,0 +1,119 @@
+package pwr
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"github.com/itchio/wharf/pools/fspool"
+	"github.com/itchio/wharf/state"
+	"github.com/itchio/wharf/tlc"
+	"github.com/itchio/wharf/wsync"
+)
+
+func Test_ParallelDiff(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "paralleldiff")
+	assert.NoError(t, err)
+	defer os.RemoveAll(mainDir)
+
+	v1Settings := testDirSettings{}
+	v2Settings := testDirSettings{}
+	for i := 0; i < 24; i++ {
+		seed := int64(0x100 + i)
+		size := BlockSize*int64(i%5) + int64(i*7)
+
+		v1Settings.entries = append(v1Settings.entries, testDirEntry{
+			path: fmt.Sprintf("dir%d/file%d", i%3, i), seed: seed, size: size,
+		})
+
+		if i%4 == 0 {
+			// changed
+			seed += 0x1000
+		}
+		v2Settings.entries = append(v2Settings.entries, testDirEntry{
+			path: fmt.Sprintf("dir%d/file%d", i%4, i), seed: seed, size: size,
+		})
+	}
+
+	// large enough to spill to disk
+	v2Settings.entries = append(v2Settings.entries, testDirEntry{
+		path: "big", seed: 0x42, size: diffSpillThreshold + BlockSize*3 + 17,
+	})
+
+	v1 := filepath.Join(mainDir, "v1")
+	makeTestDir(t, v1, v1Settings)
+
+	v2 := filepath.Join(mainDir, "v2")
+	makeTestDir(t, v2, v2Settings)
+
+	consumer := &state.Consumer{}
+
+	targetContainer, err := tlc.WalkAny(v1, nil)
+	assert.NoError(t, err)
+	targetSignature, err := ComputeSignature(targetContainer, fspool.New(targetContainer, v1), consumer)
+	assert.NoError(t, err)
+
+	sourceContainer, err := tlc.WalkAny(v2, nil)
+	assert.NoError(t, err)
+
+	for _, algo := range []CompressionAlgorithm{CompressionAlgorithm_NONE, CompressionAlgorithm_ZSTD} {
+		diff := func(numWorkers int) (*DiffContext, []byte, []byte) {
+			patchBuffer := new(bytes.Buffer)
+			signatureBuffer := new(bytes.Buffer)
+
+			dctx := &DiffContext{
+				Compression: &CompressionSettings{
+					Algorithm: algo,
+					Quality:   1,
+				},
+				Consumer: consumer,
+
+				SourceContainer: sourceContainer,
+				TargetContainer: targetContainer,
+				TargetSignature: targetSignature,
+
+				NumWorkers: numWorkers,
+			}
+
+			if numWorkers > 1 {
+				dctx.PoolFactory = func() (wsync.Pool, error) {
+					return fspool.New(sourceContainer, v2), nil
+				}
+			} else {
+				dctx.Pool = fspool.New(sourceContainer, v2)
+			}
+
+			assert.NoError(t, dctx.WritePatch(patchBuffer, signatureBuffer))
+			return dctx, patchBuffer.Bytes(), signatureBuffer.Bytes()
+		}
+
+		seqCtx, seqPatch, seqSignature := diff(1)
+		assert.True(t, seqCtx.ReusedBytes > 0)
+		assert.True(t, seqCtx.FreshBytes > 0)
+
+		for _, numWorkers := range []int{2, 8} {
+			t.Logf("Diffing with %d workers (%s)", numWorkers, algo)
+
+			parCtx, parPatch, parSignature := diff(numWorkers)
+			assert.True(t, bytes.Equal(seqPatch, parPatch), "patch should be byte-identical")
+			assert.True(t, bytes.Equal(seqSignature, parSignature), "signature should be byte-identical")
+			assert.EqualValues(t, seqCtx.ReusedBytes, parCtx.ReusedBytes)
+			assert.EqualValues(t, seqCtx.FreshBytes, parCtx.FreshBytes)
+		}
+	}
+
+	t.Logf("Diffing with workers but no pool factory")
+	dctx := &DiffContext{
+		Compression:     &CompressionSettings{Algorithm: CompressionAlgorithm_NONE},
+		Consumer:        consumer,
+		SourceContainer: sourceContainer,
+		TargetContainer: targetContainer,
+		TargetSignature: targetSignature,
+		NumWorkers:      4,
+	}
+	assert.Error(t, dctx.WritePatch(ioutil.Discard, ioutil.Discard))
+}
@@ -78,7 +78,7 @@ func makeTestDir(t *testing.T, dir string, s testDirSettings) {
 			if entry.mode != 0 {
 				mode = entry.mode
 			}
-			assert.NoError(t, os.MkdirAll(entry.path, os.FileMode(mode)))
+			assert.NoError(t, os.MkdirAll(path, os.FileMode(mode)))
 			continue
 		} else if entry.dest != "" {
 			assert.NoError(t, os.Symlink(entry.dest, path))
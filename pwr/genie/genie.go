@@ -5,6 +5,8 @@ import (
 	"io"
 
 	"github.com/go-errors/errors"
+	"github.com/golang/protobuf/proto"
+	"github.com/itchio/wharf/bsdiff"
 	"github.com/itchio/wharf/pwr"
 	"github.com/itchio/wharf/tlc"
 	"github.com/itchio/wharf/wire"
@@ -12,6 +14,13 @@ import (
 
 type CompositionListener func(comp *Composition)
 
+// A DiffEntryListener is called for files that are patched with bsdiff or zstd
+type DiffEntryListener func(entry *DiffEntry)
+
+// A MessageListener is called with every message ParseContents reads. Messages
+// are reused, so they must be cloned to be kept around.
+type MessageListener func(msg proto.Message)
+
 // A Genie analyzes a patch to figure out which parts of the target container
 // are used to build individual blocks of the source container.
 type Genie struct {
@@ -19,8 +28,13 @@ type Genie struct {
 
 	PatchWire *wire.ReadContext
 
+	Header          *pwr.PatchHeader
 	TargetContainer *tlc.Container
 	SourceContainer *tlc.Container
+
+	// optional
+	OnDiffEntry DiffEntryListener
+	OnMessage   MessageListener
 }
 
 // ParseHeader is the first step of the genie's operation - it reads both
@@ -38,6 +52,7 @@ func (g *Genie) ParseHeader(patchReader io.Reader) error {
 	if err != nil {
 		return errors.Wrap(err, 1)
 	}
+	g.Header = header
 
 	patchWire, err := pwr.DecompressWire(rawPatchWire, header.Compression)
 	if err != nil {
@@ -61,15 +76,15 @@ func (g *Genie) ParseHeader(patchReader io.Reader) error {
 }
 
 // ParseContents sends a Composition for each block of the source container
+// patched with block ranges and fresh data, and a DiffEntry (to OnDiffEntry,
+// if set) for each file patched with bsdiff or zstd.
 func (g *Genie) ParseContents(onComp CompositionListener) error {
-	patchWire := g.PatchWire
-
 	// for each file, the patch contains a SyncHeader followed by a series of
 	// operations, always ending in HEY_YOU_DID_IT
 	sh := &pwr.SyncHeader{}
 	for fileIndex, f := range g.SourceContainer.Files {
 		sh.Reset()
-		err := patchWire.ReadMessage(sh)
+		err := g.readMessage(sh)
 		if err != nil {
 			return errors.Wrap(err, 1)
 		}
@@ -79,16 +94,119 @@ func (g *Genie) ParseContents(onComp CompositionListener) error {
 			return errors.Wrap(pwr.ErrMalformedPatch, 1)
 		}
 
-		err = g.analyzeFile(patchWire, int64(fileIndex), f.Size, onComp)
+		switch sh.Type {
+		case pwr.SyncHeader_RSYNC:
+			err = g.analyzeFile(int64(fileIndex), f.Size, onComp)
+		case pwr.SyncHeader_BSDIFF, pwr.SyncHeader_BSDIFF_FILTERED:
+			err = g.analyzeBsdiff(int64(fileIndex), sh.Type)
+		case pwr.SyncHeader_ZSTD:
+			err = g.analyzeZstd(int64(fileIndex))
+		default:
+			err = errors.Wrap(pwr.ErrMalformedPatch, 1)
+		}
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+	}
+
+	return nil
+}
+
+func (g *Genie) readMessage(msg proto.Message) error {
+	err := g.PatchWire.ReadMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	if g.OnMessage != nil {
+		g.OnMessage(msg)
+	}
+	return nil
+}
+
+func (g *Genie) analyzeBsdiff(fileIndex int64, syncType pwr.SyncHeader_Type) error {
+	bh := &pwr.BsdiffHeader{}
+	err := g.readMessage(bh)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	entry := &DiffEntry{
+		FileIndex:   fileIndex,
+		TargetIndex: bh.TargetIndex,
+		Type:        syncType,
+	}
+
+	ctrl := &bsdiff.Control{}
+	for {
+		ctrl.Reset()
+		err = g.readMessage(ctrl)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+
+		if ctrl.Eof {
+			break
+		}
+
+		entry.AddBytes += int64(len(ctrl.Add))
+		entry.CopyBytes += int64(len(ctrl.Copy))
+	}
+
+	rop := &pwr.SyncOp{}
+	err = g.readMessage(rop)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	if rop.Type != pwr.SyncOp_HEY_YOU_DID_IT {
+		return errors.Wrap(pwr.ErrMalformedPatch, 1)
+	}
+
+	if g.OnDiffEntry != nil {
+		g.OnDiffEntry(entry)
+	}
+	return nil
+}
+
+func (g *Genie) analyzeZstd(fileIndex int64) error {
+	zh := &pwr.ZstdHeader{}
+	err := g.readMessage(zh)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	entry := &DiffEntry{
+		FileIndex:   fileIndex,
+		TargetIndex: zh.TargetIndex,
+		Type:        pwr.SyncHeader_ZSTD,
+	}
+
+	rop := &pwr.SyncOp{}
+	for {
+		rop.Reset()
+		err = g.readMessage(rop)
 		if err != nil {
 			return errors.Wrap(err, 1)
 		}
+
+		if rop.Type == pwr.SyncOp_HEY_YOU_DID_IT {
+			break
+		}
+
+		if rop.Type != pwr.SyncOp_DATA {
+			return errors.Wrap(pwr.ErrMalformedPatch, 1)
+		}
+		entry.DataBytes += int64(len(rop.Data))
 	}
 
+	if g.OnDiffEntry != nil {
+		g.OnDiffEntry(entry)
+	}
 	return nil
 }
 
-func (g *Genie) analyzeFile(patchWire *wire.ReadContext, fileIndex int64, fileSize int64, onComp CompositionListener) error {
+func (g *Genie) analyzeFile(fileIndex int64, fileSize int64, onComp CompositionListener) error {
 	rop := &pwr.SyncOp{}
 
 	smallBlockSize := int64(pwr.BlockSize)
@@ -101,7 +219,7 @@ func (g *Genie) analyzeFile(patchWire *wire.ReadContext, fileIndex int64, fileSi
 	// infinite loop, explicitly "break"'d out of
 	for {
 		rop.Reset()
-		pErr := patchWire.ReadMessage(rop)
+		pErr := g.readMessage(rop)
 		if pErr != nil {
 			return errors.Wrap(pErr, 1)
 		}
@@ -115,6 +233,14 @@ func (g *Genie) analyzeFile(patchWire *wire.ReadContext, fileIndex int64, fileSi
 				Size:      rop.BlockSpan * smallBlockSize,
 			}
 
+			// the last block of a target file may be short
+			if rop.FileIndex >= 0 && rop.FileIndex < int64(len(g.TargetContainer.Files)) {
+				targetSize := g.TargetContainer.Files[rop.FileIndex].Size
+				if bo.Offset+bo.Size > targetSize {
+					bo.Size = targetSize - bo.Offset
+				}
+			}
+
 			// As long as the block origin would span beyond the end of the
 			// big block we're currently analyzing, split it into {A, B},
 			// where A fits into the current big block, and B is the rest
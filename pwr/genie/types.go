@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/dustin/go-humanize"
+	"github.com/itchio/wharf/pwr"
 )
 
 type BlockOrigin struct {
@@ -50,3 +51,18 @@ func (comp *Composition) String() string {
 	}
 	return res
 }
+
+// A DiffEntry sums up a file that's patched with bsdiff or zstd, rather than
+// with block ranges and fresh data, so it has no compositions.
+type DiffEntry struct {
+	FileIndex   int64
+	TargetIndex int64
+	Type        pwr.SyncHeader_Type
+
+	// bsdiff: bytes added to the target file's, and bytes copied from the patch as-is
+	AddBytes  int64
+	CopyBytes int64
+
+	// zstd: size of the compressed frame
+	DataBytes int64
+}
@@ -2,6 +2,8 @@ package pwr
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/go-errors/errors"
@@ -36,8 +38,17 @@ type Healer interface {
 	TotalHealed() int64
 }
 
+// A SignatureHealer is a Healer that needs the signature of the container
+// it's healing, for example to verify the data it heals from.
+type SignatureHealer interface {
+	Healer
+
+	SetSignature(signature *SignatureInfo)
+}
+
 // NewHealer takes a spec of the form "type,url", and a target folder
 // and returns a healer that knows how to repair target from spec.
+// Several specs can be chained with "chain,spec1|spec2|...", see ChainHealer.
 func NewHealer(spec string, target string) (Healer, error) {
 	tokens := strings.SplitN(spec, ",", 2)
 	if len(tokens) != 2 {
@@ -59,9 +70,43 @@ func NewHealer(spec string, target string) (Healer, error) {
 			Target: target,
 		}
 		return ah, nil
+	case "dir":
+		dh := &DirHealer{
+			SourcePath: healerURL,
+			Target:     target,
+		}
+		return dh, nil
+	case "chain":
+		ch, err := NewChainHealer(healerURL, target)
+		if err != nil {
+			return nil, errors.Wrap(err, 1)
+		}
+		return ch, nil
 	case "manifest":
 		return nil, fmt.Errorf("Manifest healer: stub")
 	}
 
 	return nil, fmt.Errorf("Unknown healer type %s", healerType)
 }
+
+// healDir creates the directory a dir wound refers to
+func healDir(target string, container *tlc.Container, wound *Wound) error {
+	dirEntry := container.Dirs[wound.Index]
+	path := filepath.Join(target, filepath.FromSlash(dirEntry.Path))
+
+	return os.MkdirAll(path, 0755)
+}
+
+// healSymlink creates the symlink a symlink wound refers to
+func healSymlink(target string, container *tlc.Container, wound *Wound) error {
+	symlinkEntry := container.Symlinks[wound.Index]
+	path := filepath.Join(target, filepath.FromSlash(symlinkEntry.Path))
+
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	return os.Symlink(symlinkEntry.Dest, path)
+}
@@ -1,11 +1,11 @@
 package pwr
 
 import (
-	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sync"
 	"sync/atomic"
 
 	"github.com/itchio/arkive/zip"
@@ -35,15 +35,22 @@ type ArchiveHealer struct {
 	Consumer *state.Consumer
 
 	// internal
-	totalCorrupted int64
-	totalHealing   int64
-	totalHealed    int64
-	totalHealthy   int64
-	hasWounds      bool
+	totalHealed  int64
+	totalHealthy int64
 
 	container *tlc.Container
+	queue     healQueue
 
 	lockMap LockMap
+
+	// jobs on the same file are never run concurrently
+	fileLocks []sync.Mutex
+	// files that have been rewritten entirely, and don't need further healing
+	rewritten []bool
+	// ranges of each file healRanges healed, and how much of each file
+	// was counted as healthy so far
+	healedRanges [][]*Wound
+	healthy      []int64
 }
 
 var _ Healer = (*ArchiveHealer)(nil)
@@ -54,8 +61,10 @@ type chunkHealedFunc func(chunkHealed int64)
 func (ah *ArchiveHealer) Do(container *tlc.Container, wounds chan *Wound) error {
 	ah.container = container
 
-	files := make(map[int64]bool)
-	fileIndices := make(chan int64, len(container.Files))
+	ah.fileLocks = make([]sync.Mutex, len(container.Files))
+	ah.rewritten = make([]bool, len(container.Files))
+	ah.healedRanges = make([][]*Wound, len(container.Files))
+	ah.healthy = make([]int64, len(container.Files))
 
 	if ah.NumWorkers == 0 {
 		ah.NumWorkers = runtime.NumCPU() + 1
@@ -75,161 +84,62 @@ func (ah *ArchiveHealer) Do(container *tlc.Container, wounds chan *Wound) error
 
 	targetPool := fspool.New(container, ah.Target)
 
-	errs := make(chan error)
-	done := make(chan bool, ah.NumWorkers)
-	cancelled := make(chan struct{})
-
 	onChunkHealed := func(healedChunk int64) {
 		atomic.AddInt64(&ah.totalHealed, healedChunk)
 		ah.updateProgress()
 	}
 
-	for i := 0; i < ah.NumWorkers; i++ {
-		go ah.heal(container, zipReader, stat.Size(), targetPool, fileIndices, errs, done, cancelled, onChunkHealed)
+	ah.queue.target = ah.Target
+	ah.queue.container = container
+	ah.queue.numWorkers = ah.NumWorkers
+	ah.queue.consumer = ah.Consumer
+	ah.queue.lockMap = ah.lockMap
+	ah.queue.newWorker = func() (healFileFunc, func()) {
+		sourcePool := zippool.New(container, zipReader)
+		heal := func(fileIndex int64, wounds []*Wound) error {
+			return ah.healOne(sourcePool, targetPool, fileIndex, wounds, onChunkHealed)
+		}
+		return heal, func() { sourcePool.Close() }
+	}
+	ah.queue.onHealthy = func(fileSize int64) {
+		atomic.AddInt64(&ah.totalHealthy, fileSize)
+		ah.updateProgress()
 	}
 
-	processWound := func(wound *Wound) error {
-		if !wound.Healthy() {
-			ah.totalCorrupted += wound.Size()
-			ah.hasWounds = true
-		}
+	return ah.queue.run(wounds)
+}
 
-		switch wound.Kind {
-		case WoundKind_DIR:
-			dirEntry := container.Dirs[wound.Index]
-			path := filepath.Join(ah.Target, filepath.FromSlash(dirEntry.Path))
-
-			pErr := os.MkdirAll(path, 0755)
-			if pErr != nil {
-				return pErr
-			}
-
-		case WoundKind_SYMLINK:
-			symlinkEntry := container.Symlinks[wound.Index]
-			path := filepath.Join(ah.Target, filepath.FromSlash(symlinkEntry.Path))
-
-			dir := filepath.Dir(path)
-			pErr := os.MkdirAll(dir, 0755)
-			if pErr != nil {
-				return pErr
-			}
-
-			pErr = os.Symlink(symlinkEntry.Dest, path)
-			if pErr != nil {
-				return pErr
-			}
-
-		case WoundKind_FILE:
-			if files[wound.Index] {
-				// already queued
-				return nil
-			}
-
-			file := container.Files[wound.Index]
-			if ah.Consumer != nil {
-				ah.Consumer.ProgressLabel(file.Path)
-			}
-
-			atomic.AddInt64(&ah.totalHealing, file.Size)
-			ah.updateProgress()
-			files[wound.Index] = true
-
-			select {
-			case pErr := <-errs:
-				return pErr
-			case fileIndices <- wound.Index:
-				// queued for work!
-			}
-
-		case WoundKind_CLOSED_FILE:
-			if files[wound.Index] {
-				// already healing whole file
-			} else {
-				fileSize := container.Files[wound.Index].Size
-
-				// whole file was healthy
-				if wound.End == fileSize {
-					atomic.AddInt64(&ah.totalHealthy, fileSize)
-					ah.updateProgress()
-				}
-			}
-
-		default:
-			return fmt.Errorf("unknown wound kind: %d", wound.Kind)
-		}
+func (ah *ArchiveHealer) healOne(sourcePool wsync.Pool, targetPool wsync.WritablePool, fileIndex int64, wounds []*Wound, chunkHealed chunkHealedFunc) error {
+	ah.fileLocks[fileIndex].Lock()
+	defer ah.fileLocks[fileIndex].Unlock()
 
+	if ah.rewritten[fileIndex] {
+		// a previous job already healed the whole file
 		return nil
 	}
 
-	for wound := range wounds {
-		err = processWound(wound)
-		if err != nil {
-			close(fileIndices)
-			close(cancelled)
-			return errors.Wrap(err, 1)
-		}
-	}
-
-	// queued everything
-	close(fileIndices)
+	file := ah.container.Files[fileIndex]
+	path := filepath.Join(ah.Target, filepath.FromSlash(file.Path))
 
-	// expecting up to NumWorkers done, some may still
-	// send errors
-	for i := 0; i < ah.NumWorkers; i++ {
-		select {
-		case err = <-errs:
-			close(cancelled)
+	stats, err := os.Stat(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
 			return errors.Wrap(err, 1)
-		case <-done:
-			// good!
 		}
-	}
-
-	return nil
-}
-
-func (ah *ArchiveHealer) heal(container *tlc.Container, zipReader *zip.Reader, zipSize int64,
-	targetPool wsync.WritablePool,
-	fileIndices chan int64, errs chan error, done chan bool, cancelled chan struct{}, chunkHealed chunkHealedFunc) {
 
-	var sourcePool wsync.Pool
-	var err error
-
-	sourcePool = zippool.New(container, zipReader)
-	defer sourcePool.Close()
-
-	for {
-		select {
-		case <-cancelled:
-			// something else stopped the healing
-			return
-		case fileIndex, ok := <-fileIndices:
-			if !ok {
-				// no more files to heal
-				done <- true
-				return
-			}
-
-			err = ah.healOne(sourcePool, targetPool, fileIndex, chunkHealed)
-			if err != nil {
-				select {
-				case <-cancelled:
-					// already cancelled, no need for more errors
-					return
-				case errs <- err:
-					return
-				}
-			}
-		}
+		return ah.healWhole(sourcePool, targetPool, fileIndex, chunkHealed)
 	}
-}
 
-func (ah *ArchiveHealer) healOne(sourcePool wsync.Pool, targetPool wsync.WritablePool, fileIndex int64, chunkHealed chunkHealedFunc) error {
-	if ah.lockMap != nil {
-		lock := ah.lockMap[fileIndex]
-		<-lock
+	if !stats.Mode().IsRegular() || stats.Size() != file.Size {
+		return ah.healWhole(sourcePool, targetPool, fileIndex, chunkHealed)
 	}
 
+	return ah.healRanges(sourcePool, path, fileIndex, wounds, chunkHealed)
+}
+
+// healWhole rewrites a file entirely, it's used when a file is missing
+// or has the wrong size.
+func (ah *ArchiveHealer) healWhole(sourcePool wsync.Pool, targetPool wsync.WritablePool, fileIndex int64, chunkHealed chunkHealedFunc) error {
 	var err error
 	var reader io.Reader
 	var writer io.WriteCloser
@@ -261,12 +171,101 @@ func (ah *ArchiveHealer) healOne(sourcePool wsync.Pool, targetPool wsync.Writabl
 		return err
 	}
 
+	ah.rewritten[fileIndex] = true
+
+	// the whole file counts as healed now
+	ah.setHealthy(fileIndex, 0)
+
 	return err
 }
 
+// healRanges only rewrites the wounded parts of a file, in place, leaving
+// the rest of the file untouched.
+func (ah *ArchiveHealer) healRanges(sourcePool wsync.Pool, path string, fileIndex int64, wounds []*Wound, chunkHealed chunkHealedFunc) error {
+	fileSize := ah.container.Files[fileIndex].Size
+
+	reader, err := sourcePool.GetReadSeeker(fileIndex)
+	if err != nil {
+		return err
+	}
+
+	writer, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+	defer writer.Close()
+
+	lastCount := int64(0)
+	cw := counter.NewWriterCallback(func(count int64) {
+		chunk := count - lastCount
+		chunkHealed(chunk)
+		lastCount = count
+	}, writer)
+
+	// overlapping wounds are only healed once
+	wounds = MergeWounds(wounds)
+	for _, wound := range wounds {
+		start := wound.Start
+		end := wound.End
+		if end > fileSize {
+			end = fileSize
+		}
+		if start < 0 || start >= end {
+			continue
+		}
+
+		_, err = reader.Seek(start, os.SEEK_SET)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+
+		_, err = writer.Seek(start, os.SEEK_SET)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+
+		_, err = io.CopyN(cw, reader, end-start)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	// the file's closed wounds were ignored since it had wounds: whatever
+	// wasn't healed, by this heal or earlier ones, was healthy.
+	ah.healedRanges[fileIndex] = MergeWounds(append(ah.healedRanges[fileIndex], wounds...))
+	healthy := fileSize
+	for _, wound := range ah.healedRanges[fileIndex] {
+		start := wound.Start
+		end := wound.End
+		if end > fileSize {
+			end = fileSize
+		}
+		if start < 0 || start >= end {
+			continue
+		}
+		healthy -= end - start
+	}
+	ah.setHealthy(fileIndex, healthy)
+
+	return nil
+}
+
+// setHealthy records how much of a file is healthy, and updates progress.
+// The file's lock must be held.
+func (ah *ArchiveHealer) setHealthy(fileIndex int64, healthy int64) {
+	atomic.AddInt64(&ah.totalHealthy, healthy-ah.healthy[fileIndex])
+	ah.healthy[fileIndex] = healthy
+	ah.updateProgress()
+}
+
 // HasWounds returns true if the healer ever received wounds
 func (ah *ArchiveHealer) HasWounds() bool {
-	return ah.hasWounds
+	return ah.queue.hasWounds
 }
 
 // TotalCorrupted returns the total amount of corrupted data
@@ -274,15 +273,15 @@ func (ah *ArchiveHealer) HasWounds() bool {
 // and symlink wounds have 0-size, use HasWounds to know
 // if there were any wounds at all.
 func (ah *ArchiveHealer) TotalCorrupted() int64 {
-	return ah.totalCorrupted
+	return ah.queue.totalCorrupted
 }
 
 // TotalHealed returns the total amount of data written to disk
 // to repair the wounds. This might be more than TotalCorrupted,
-// since ArchiveHealer always redownloads whole files, even if
-// they're just partly corrupted
+// since ArchiveHealer redownloads whole files when they're missing
+// or have the wrong size.
 func (ah *ArchiveHealer) TotalHealed() int64 {
-	return ah.totalHealed
+	return atomic.LoadInt64(&ah.totalHealed)
 }
 
 // SetNumWorkers may be called before Do to adjust the concurrency
@@ -308,6 +307,11 @@ func (ah *ArchiveHealer) updateProgress() {
 	ah.Consumer.Progress(progress)
 }
 
+// setOnFileDone must be called before Do, see fileDoneNotifier
+func (ah *ArchiveHealer) setOnFileDone(onFileDone func(fh *fileHeal, err error)) {
+	ah.queue.onFileDone = onFileDone
+}
+
 func (ah *ArchiveHealer) SetLockMap(lockMap LockMap) {
 	ah.lockMap = lockMap
 }
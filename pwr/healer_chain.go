@@ -0,0 +1,612 @@
+package pwr
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/go-errors/errors"
+	"github.com/itchio/wharf/state"
+	"github.com/itchio/wharf/tlc"
+)
+
+// A HealerFactory returns a fresh healer, ready to receive wounds.
+type HealerFactory func() (Healer, error)
+
+// A HealerSource is one of the healers a ChainHealer can use, along with
+// statistics on how much it healed.
+type HealerSource struct {
+	// Name is used in logs and stats, for example the healer spec
+	Name string
+	// Factory is called the first time this source is used to heal a file,
+	// and the healer it returns is used for all files after that. Since
+	// healers can only Do once, it's called again if that healer fails.
+	// Healers other than ArchiveHealer and DirHealer can't tell when
+	// they're done with a file, so Factory is called for every file.
+	Factory HealerFactory
+
+	// internal
+	totalCorrupted int64
+	totalHealed    int64
+	filesHealed    int64
+	retries        int64
+	failures       int64
+
+	// sessionsMutex guards current, sessions and stopped. sessions are all
+	// the sessions whose healer hasn't returned yet.
+	sessionsMutex sync.Mutex
+	current       *healerSession
+	sessions      []*healerSession
+	stopped       bool
+}
+
+// TotalCorrupted returns the amount of corrupted data this source has healed
+func (hs *HealerSource) TotalCorrupted() int64 {
+	return atomic.LoadInt64(&hs.totalCorrupted)
+}
+
+// TotalHealed returns the amount of data this source has written to disk
+func (hs *HealerSource) TotalHealed() int64 {
+	hs.sessionsMutex.Lock()
+	defer hs.sessionsMutex.Unlock()
+
+	totalHealed := atomic.LoadInt64(&hs.totalHealed)
+	for _, session := range hs.sessions {
+		totalHealed += session.healer.TotalHealed()
+	}
+	return totalHealed
+}
+
+// FilesHealed returns the number of files this source has healed
+func (hs *HealerSource) FilesHealed() int64 {
+	return atomic.LoadInt64(&hs.filesHealed)
+}
+
+// Stats returns a human-readable string describing what this source has healed
+func (hs *HealerSource) Stats() string {
+	return fmt.Sprintf("%s: healed %s (%s corrupted) in %d files, %d retries, %d failures",
+		hs.Name, humanize.IBytes(uint64(hs.TotalHealed())), humanize.IBytes(uint64(hs.TotalCorrupted())),
+		hs.FilesHealed(), atomic.LoadInt64(&hs.retries), atomic.LoadInt64(&hs.failures))
+}
+
+// A ChainHealer tries several healers in order for each wounded file, for
+// example: a local directory first, then a block store, then the full
+// archive over HTTP. Transient errors are retried with exponential backoff
+// before falling back to the next source.
+type ChainHealer struct {
+	// required
+
+	// the directory we should heal
+	Target string
+
+	// Sources are tried in order, for each file
+	Sources []*HealerSource
+
+	// optional
+
+	// number of files healed in parallel
+	NumWorkers int
+
+	// MaxRetries is how many times a source is retried when it fails
+	// with a transient error. Defaults to 3
+	MaxRetries int
+
+	// RetryDelay is how long to wait before the first retry, it doubles
+	// with every retry. Defaults to 1 second
+	RetryDelay time.Duration
+
+	// IsTransient decides which errors are worth retrying, defaults
+	// to IsTransientError
+	IsTransient func(err error) bool
+
+	// A consumer to report progress to
+	Consumer *state.Consumer
+
+	// internal
+	totalHealthy int64
+
+	container *tlc.Container
+	queue     healQueue
+	signature *SignatureInfo
+	lockMap   LockMap
+
+	// a file is only healed by one source at a time
+	fileLocks []sync.Mutex
+
+	healedByMutex sync.Mutex
+	healedBy      map[int64]*HealerSource
+}
+
+var _ SignatureHealer = (*ChainHealer)(nil)
+
+// NewChainHealer parses a spec of the form "type,url|type,url|..." and returns
+// a healer that tries each of them in order.
+func NewChainHealer(spec string, target string) (*ChainHealer, error) {
+	ch := &ChainHealer{
+		Target: target,
+	}
+
+	for _, subSpec := range strings.Split(spec, "|") {
+		subSpec := subSpec
+		tokens := strings.SplitN(subSpec, ",", 2)
+		if len(tokens) != 2 {
+			return nil, fmt.Errorf("Invalid healer spec in chain: expected 'type,url' but got '%s'", subSpec)
+		}
+
+		if tokens[0] == "chain" {
+			return nil, fmt.Errorf("Invalid healer spec in chain: chains can't be nested")
+		}
+
+		ch.Sources = append(ch.Sources, &HealerSource{
+			Name: subSpec,
+			Factory: func() (Healer, error) {
+				return NewHealer(subSpec, target)
+			},
+		})
+	}
+
+	return ch, nil
+}
+
+// Do starts receiving from the wounds channel and healing
+func (ch *ChainHealer) Do(container *tlc.Container, wounds chan *Wound) error {
+	ch.container = container
+	ch.healedBy = make(map[int64]*HealerSource)
+	ch.fileLocks = make([]sync.Mutex, len(container.Files))
+
+	if len(ch.Sources) == 0 {
+		return errors.Wrap(fmt.Errorf("ChainHealer: no sources"), 1)
+	}
+
+	if ch.NumWorkers == 0 {
+		ch.NumWorkers = runtime.NumCPU() + 1
+	}
+
+	ch.queue.target = ch.Target
+	ch.queue.container = container
+	ch.queue.numWorkers = ch.NumWorkers
+	ch.queue.consumer = ch.Consumer
+	ch.queue.lockMap = ch.lockMap
+	ch.queue.newWorker = func() (healFileFunc, func()) {
+		return ch.healOne, nil
+	}
+	ch.queue.onHealthy = func(fileSize int64) {
+		atomic.AddInt64(&ch.totalHealthy, fileSize)
+		ch.updateProgress()
+	}
+
+	err := ch.queue.run(wounds)
+
+	// let the sources' healers finish, whatever happened. Their errors
+	// have already been returned by attempt, for the file that caused them.
+	for _, source := range ch.Sources {
+		source.sessionsMutex.Lock()
+		sessions := append([]*healerSession{}, source.sessions...)
+		source.current = nil
+		source.stopped = true
+		source.sessionsMutex.Unlock()
+
+		for _, session := range sessions {
+			session.close()
+			<-session.closed
+		}
+	}
+
+	return err
+}
+
+func (ch *ChainHealer) healOne(fileIndex int64, wounds []*Wound) error {
+	ch.fileLocks[fileIndex].Lock()
+	defer ch.fileLocks[fileIndex].Unlock()
+
+	file := ch.container.Files[fileIndex]
+
+	var lastErr error
+	for _, source := range ch.Sources {
+		err := ch.healWith(source, fileIndex, wounds)
+		if err == nil {
+			ch.healedByMutex.Lock()
+			ch.healedBy[fileIndex] = source
+			ch.healedByMutex.Unlock()
+			return nil
+		}
+
+		atomic.AddInt64(&source.failures, 1)
+		ch.debugf("could not heal %s from %s: %s", file.Path, source.Name, err.Error())
+		lastErr = err
+	}
+
+	return errors.Wrap(fmt.Errorf("could not heal %s from any source, last error: %s", file.Path, lastErr.Error()), 1)
+}
+
+// healWith tries to heal wounds with a given source, retrying on transient errors
+func (ch *ChainHealer) healWith(source *HealerSource, fileIndex int64, wounds []*Wound) error {
+	maxRetries := ch.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = 3
+	}
+
+	delay := ch.RetryDelay
+	if delay == 0 {
+		delay = 1 * time.Second
+	}
+
+	isTransient := ch.IsTransient
+	if isTransient == nil {
+		isTransient = IsTransientError
+	}
+
+	for retry := 0; ; retry++ {
+		err := ch.attempt(source, fileIndex, wounds)
+		if err == nil {
+			return nil
+		}
+
+		if retry >= maxRetries || !isTransient(err) {
+			return err
+		}
+
+		atomic.AddInt64(&source.retries, 1)
+		ch.debugf("%s: transient error, retrying in %s: %s", source.Name, delay, err.Error())
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (ch *ChainHealer) attempt(source *HealerSource, fileIndex int64, wounds []*Wound) error {
+	for {
+		session, err := ch.session(source)
+		if err != nil {
+			return err
+		}
+
+		err = session.heal(fileIndex, wounds)
+		if err == errSessionClosed {
+			// the healer failed on another file, try again with a fresh one
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		break
+	}
+
+	for _, wound := range wounds {
+		if !wound.Healthy() {
+			atomic.AddInt64(&source.totalCorrupted, wound.Size())
+		}
+	}
+	atomic.AddInt64(&source.filesHealed, 1)
+	ch.updateProgress()
+
+	return nil
+}
+
+// session returns the session files should be healed with for a source,
+// starting a new one if needed.
+func (ch *ChainHealer) session(source *HealerSource) (*healerSession, error) {
+	source.sessionsMutex.Lock()
+	defer source.sessionsMutex.Unlock()
+
+	if source.stopped {
+		return nil, errChainStopped
+	}
+
+	if source.current != nil && !source.current.isFailed() {
+		return source.current, nil
+	}
+
+	healer, err := source.Factory()
+	if err != nil {
+		return nil, err
+	}
+
+	healer.SetNumWorkers(ch.NumWorkers)
+	healer.SetConsumer(&state.Consumer{
+		OnProgress: func(progress float64) {
+			ch.updateProgress()
+		},
+	})
+	if sh, ok := healer.(SignatureHealer); ok {
+		sh.SetSignature(ch.signature)
+	}
+
+	session := &healerSession{
+		healer:  healer,
+		wounds:  make(chan *Wound),
+		closed:  make(chan struct{}),
+		waiters: make(map[int64]*sessionWaiter),
+	}
+
+	if fdn, ok := healer.(fileDoneNotifier); ok {
+		fdn.setOnFileDone(session.onFileDone)
+		source.current = session
+	} else {
+		session.single = true
+	}
+	source.sessions = append(source.sessions, session)
+
+	go func() {
+		session.err = healer.Do(ch.container, session.wounds)
+
+		source.sessionsMutex.Lock()
+		atomic.AddInt64(&source.totalHealed, healer.TotalHealed())
+		for i, s := range source.sessions {
+			if s == session {
+				source.sessions = append(source.sessions[:i], source.sessions[i+1:]...)
+				break
+			}
+		}
+		if source.current == session {
+			source.current = nil
+		}
+		source.sessionsMutex.Unlock()
+
+		close(session.closed)
+	}()
+
+	return session, nil
+}
+
+// A fileDoneNotifier can tell when it's done with the wounds it received
+// for a file, which lets ChainHealer use it for more than one file.
+type fileDoneNotifier interface {
+	setOnFileDone(onFileDone func(fh *fileHeal, err error))
+}
+
+var _ fileDoneNotifier = (*ArchiveHealer)(nil)
+var _ fileDoneNotifier = (*DirHealer)(nil)
+
+var (
+	errSessionClosed = errors.New("healer session closed")
+	errChainStopped  = errors.New("ChainHealer has stopped healing")
+)
+
+// A healerSession feeds the wounds of one file after the other to a single
+// healer, and waits for the healer to be done with each of them. Healers
+// stop at the first error, so a failed session is replaced by a fresh one.
+// Single sessions are for healers that aren't fileDoneNotifiers: they only
+// heal one file, and they're done with it once Do returns.
+type healerSession struct {
+	healer Healer
+	single bool
+
+	// sendMutex guards wounds and closing
+	sendMutex sync.Mutex
+	wounds    chan *Wound
+	closing   bool
+
+	// closed once Do has returned, err is what it returned
+	closed chan struct{}
+	err    error
+
+	// waitersMutex guards waiters and failed
+	waitersMutex sync.Mutex
+	waiters      map[int64]*sessionWaiter
+	failed       bool
+}
+
+type sessionWaiter struct {
+	// how many wounds the healer still has to be done with
+	remaining int
+	result    chan error
+}
+
+// heal sends the wounds of a file to the healer, and waits until it's done
+// with all of them. It returns errSessionClosed if the healer stopped before
+// then, because it failed to heal another file.
+func (s *healerSession) heal(fileIndex int64, wounds []*Wound) error {
+	waiter := &sessionWaiter{
+		remaining: len(wounds),
+		result:    make(chan error, 1),
+	}
+
+	s.waitersMutex.Lock()
+	s.waiters[fileIndex] = waiter
+	s.waitersMutex.Unlock()
+
+	err := s.send(wounds)
+	if err != nil {
+		s.waitersMutex.Lock()
+		delete(s.waiters, fileIndex)
+		s.waitersMutex.Unlock()
+		return err
+	}
+
+	if s.single {
+		<-s.closed
+		return s.err
+	}
+
+	select {
+	case err := <-waiter.result:
+		return err
+	case <-s.closed:
+		select {
+		case err := <-waiter.result:
+			return err
+		default:
+		}
+
+		if s.err != nil && !s.isFailed() {
+			// failed before getting to any file
+			return s.err
+		}
+		return errSessionClosed
+	}
+}
+
+func (s *healerSession) send(wounds []*Wound) error {
+	s.sendMutex.Lock()
+	defer s.sendMutex.Unlock()
+
+	if s.closing {
+		return errSessionClosed
+	}
+
+	for _, wound := range wounds {
+		select {
+		case s.wounds <- wound:
+		case <-s.closed:
+			return errSessionClosed
+		}
+	}
+
+	if s.single {
+		s.closing = true
+		close(s.wounds)
+	}
+	return nil
+}
+
+// close lets the healer's Do return once it's done with the wounds it has
+func (s *healerSession) close() {
+	s.sendMutex.Lock()
+	defer s.sendMutex.Unlock()
+
+	if !s.closing {
+		s.closing = true
+		close(s.wounds)
+	}
+}
+
+func (s *healerSession) onFileDone(fh *fileHeal, err error) {
+	s.waitersMutex.Lock()
+	if err != nil {
+		s.failed = true
+	}
+
+	waiter := s.waiters[fh.fileIndex]
+	if waiter != nil {
+		waiter.remaining -= len(fh.wounds)
+		if err != nil || waiter.remaining <= 0 {
+			waiter.result <- err
+			delete(s.waiters, fh.fileIndex)
+		}
+	}
+	s.waitersMutex.Unlock()
+
+	if err != nil {
+		// the healer's Do will return an error as soon as it's done
+		// receiving wounds, no point in sending it more.
+		go s.close()
+	}
+}
+
+func (s *healerSession) isFailed() bool {
+	s.waitersMutex.Lock()
+	defer s.waitersMutex.Unlock()
+
+	return s.failed
+}
+
+// IsTransientError returns true for errors that might go away if the
+// operation is retried, like network timeouts or connections being
+// closed unexpectedly.
+func IsTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if ee, ok := err.(*errors.Error); ok {
+		return IsTransientError(ee.Err)
+	}
+
+	if err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	if ne, ok := err.(net.Error); ok {
+		return ne.Timeout() || ne.Temporary()
+	}
+
+	return false
+}
+
+// HealedBy returns the source that healed a given file, or nil
+// if it wasn't healed (yet)
+func (ch *ChainHealer) HealedBy(fileIndex int64) *HealerSource {
+	ch.healedByMutex.Lock()
+	defer ch.healedByMutex.Unlock()
+
+	return ch.healedBy[fileIndex]
+}
+
+// HasWounds returns true if the healer ever received wounds
+func (ch *ChainHealer) HasWounds() bool {
+	return ch.queue.hasWounds
+}
+
+// TotalCorrupted returns the total amount of corrupted data
+// contained in the wounds this healer has received. See
+// each source's TotalCorrupted for a breakdown.
+func (ch *ChainHealer) TotalCorrupted() int64 {
+	return ch.queue.totalCorrupted
+}
+
+// TotalHealed returns the total amount of data written to disk
+// by all sources. See each source's TotalHealed for a breakdown.
+func (ch *ChainHealer) TotalHealed() int64 {
+	var totalHealed int64
+	for _, source := range ch.Sources {
+		totalHealed += source.TotalHealed()
+	}
+	return totalHealed
+}
+
+// Stats returns a human-readable string describing what each source healed
+func (ch *ChainHealer) Stats() string {
+	var lines []string
+	for _, source := range ch.Sources {
+		lines = append(lines, source.Stats())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// SetNumWorkers may be called before Do to adjust the concurrency
+// of ChainHealer (how many files it'll try to heal in parallel)
+func (ch *ChainHealer) SetNumWorkers(numWorkers int) {
+	ch.NumWorkers = numWorkers
+}
+
+// SetConsumer gives this healer a consumer to report progress to
+func (ch *ChainHealer) SetConsumer(consumer *state.Consumer) {
+	ch.Consumer = consumer
+}
+
+// SetLockMap gives this healer a lock map, see LockMap
+func (ch *ChainHealer) SetLockMap(lockMap LockMap) {
+	ch.lockMap = lockMap
+}
+
+// SetSignature passes the signature on to sources that need it
+func (ch *ChainHealer) SetSignature(signature *SignatureInfo) {
+	ch.signature = signature
+}
+
+func (ch *ChainHealer) updateProgress() {
+	if ch.Consumer == nil {
+		return
+	}
+
+	totalHealthy := atomic.LoadInt64(&ch.totalHealthy)
+	totalHealed := ch.TotalHealed()
+
+	progress := float64(totalHealthy+totalHealed) / float64(ch.container.Size)
+	ch.Consumer.Progress(progress)
+}
+
+func (ch *ChainHealer) debugf(format string, args ...interface{}) {
+	if ch.Consumer == nil {
+		return
+	}
+
+	ch.Consumer.Debugf(format, args...)
+}
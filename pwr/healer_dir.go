@@ -0,0 +1,255 @@
+package pwr
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-errors/errors"
+	"github.com/itchio/wharf/state"
+	"github.com/itchio/wharf/tlc"
+	"github.com/itchio/wharf/wsync"
+)
+
+// A DirHealer can repair from a local directory containing the same build,
+// for example another install, a backup or a network share. Every block read
+// from the source directory is checked against the signature before it's
+// written to the target, so that a broken copy can't spread corruption.
+type DirHealer struct {
+	// the directory we should heal
+	Target string
+
+	// the directory we should heal from
+	SourcePath string
+
+	// number of workers running in parallel
+	NumWorkers int
+
+	// A consumer to report progress to
+	Consumer *state.Consumer
+
+	// internal
+	totalHealed  int64
+	totalHealthy int64
+
+	container  *tlc.Container
+	queue      healQueue
+	signature  *SignatureInfo
+	hashGroups map[int64][]wsync.BlockHash
+
+	lockMap LockMap
+
+	// see ArchiveHealer
+	fileLocks []sync.Mutex
+}
+
+var _ SignatureHealer = (*DirHealer)(nil)
+
+// Do starts receiving from the wounds channel and healing
+func (dh *DirHealer) Do(container *tlc.Container, wounds chan *Wound) error {
+	dh.container = container
+
+	if dh.signature == nil {
+		return errors.Wrap(fmt.Errorf("DirHealer: no signature, can't verify %s", dh.SourcePath), 1)
+	}
+
+	hashGroups, err := makeHashGroups(container, dh.signature)
+	if err != nil {
+		return err
+	}
+	dh.hashGroups = hashGroups
+	dh.fileLocks = make([]sync.Mutex, len(container.Files))
+
+	if dh.NumWorkers == 0 {
+		dh.NumWorkers = runtime.NumCPU() + 1
+	}
+
+	dh.queue.target = dh.Target
+	dh.queue.container = container
+	dh.queue.numWorkers = dh.NumWorkers
+	dh.queue.consumer = dh.Consumer
+	dh.queue.lockMap = dh.lockMap
+	dh.queue.newWorker = func() (healFileFunc, func()) {
+		sctx := mksync()
+		buf := make([]byte, BlockSize)
+		heal := func(fileIndex int64, wounds []*Wound) error {
+			return dh.healOne(sctx, buf, fileIndex, wounds)
+		}
+		return heal, nil
+	}
+	dh.queue.onHealthy = func(fileSize int64) {
+		atomic.AddInt64(&dh.totalHealthy, fileSize)
+		dh.updateProgress()
+	}
+
+	return dh.queue.run(wounds)
+}
+
+func (dh *DirHealer) healOne(sctx *wsync.Context, buf []byte, fileIndex int64, wounds []*Wound) error {
+	dh.fileLocks[fileIndex].Lock()
+	defer dh.fileLocks[fileIndex].Unlock()
+
+	file := dh.container.Files[fileIndex]
+	numBlocks := ComputeNumBlocks(file.Size)
+
+	sourcePath := filepath.Join(dh.SourcePath, filepath.FromSlash(file.Path))
+	reader, err := os.Open(sourcePath)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+	defer reader.Close()
+
+	sourceStats, err := reader.Stat()
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	if sourceStats.Size() != file.Size {
+		err = fmt.Errorf("%s: source has wrong size (%d bytes, expected %d)", sourcePath, sourceStats.Size(), file.Size)
+		return errors.Wrap(err, 1)
+	}
+
+	targetPath := filepath.Join(dh.Target, filepath.FromSlash(file.Path))
+
+	// heal whole blocks only, since that's what we can verify
+	blocks := make(map[int64]bool)
+	for _, wound := range wounds {
+		for blockIndex := wound.Start / BlockSize; blockIndex < ComputeNumBlocks(wound.End) && blockIndex < numBlocks; blockIndex++ {
+			blocks[blockIndex] = true
+		}
+	}
+
+	rewrite := false
+	targetStats, err := os.Stat(targetPath)
+	if err != nil || !targetStats.Mode().IsRegular() || targetStats.Size() != file.Size {
+		// missing or wrong size, rewrite everything
+		rewrite = true
+		for blockIndex := int64(0); blockIndex < numBlocks; blockIndex++ {
+			blocks[blockIndex] = true
+		}
+
+		err = os.MkdirAll(filepath.Dir(targetPath), 0755)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+	}
+
+	writer, err := os.OpenFile(targetPath, os.O_WRONLY|os.O_CREATE, os.FileMode(file.Mode)|ModeMask)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+	defer writer.Close()
+
+	hashGroup := dh.hashGroups[fileIndex]
+
+	for blockIndex := int64(0); blockIndex < numBlocks; blockIndex++ {
+		if !blocks[blockIndex] {
+			continue
+		}
+
+		offset := blockIndex * BlockSize
+		blockSize := ComputeBlockSize(file.Size, blockIndex)
+		block := buf[:blockSize]
+
+		_, err = reader.ReadAt(block, offset)
+		if err != nil && err != io.EOF {
+			return errors.Wrap(err, 1)
+		}
+
+		bh := hashGroup[blockIndex]
+		weakHash, strongHash := sctx.HashBlock(block)
+		if bh.WeakHash != weakHash || !bytes.Equal(bh.StrongHash, strongHash) {
+			err = fmt.Errorf("%s: block %d doesn't match signature, refusing to heal from it", sourcePath, blockIndex)
+			return errors.Wrap(err, 1)
+		}
+
+		_, err = writer.WriteAt(block, offset)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+
+		atomic.AddInt64(&dh.totalHealed, blockSize)
+		dh.updateProgress()
+	}
+
+	if rewrite {
+		// only truncate now, in case the source turned out to be corrupted
+		err = writer.Truncate(file.Size)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	return nil
+}
+
+// HasWounds returns true if the healer ever received wounds
+func (dh *DirHealer) HasWounds() bool {
+	return dh.queue.hasWounds
+}
+
+// TotalCorrupted returns the total amount of corrupted data
+// contained in the wounds this healer has received. Dirs
+// and symlink wounds have 0-size, use HasWounds to know
+// if there were any wounds at all.
+func (dh *DirHealer) TotalCorrupted() int64 {
+	return dh.queue.totalCorrupted
+}
+
+// TotalHealed returns the total amount of data written to disk
+// to repair the wounds. Since DirHealer heals whole blocks, and whole
+// files when they're missing or have the wrong size, this might be
+// more than TotalCorrupted.
+func (dh *DirHealer) TotalHealed() int64 {
+	return atomic.LoadInt64(&dh.totalHealed)
+}
+
+// SetNumWorkers may be called before Do to adjust the concurrency
+// of DirHealer (how many files it'll try to heal in parallel)
+func (dh *DirHealer) SetNumWorkers(numWorkers int) {
+	dh.NumWorkers = numWorkers
+}
+
+// SetConsumer gives this healer a consumer to report progress to
+func (dh *DirHealer) SetConsumer(consumer *state.Consumer) {
+	dh.Consumer = consumer
+}
+
+// setOnFileDone must be called before Do, see fileDoneNotifier
+func (dh *DirHealer) setOnFileDone(onFileDone func(fh *fileHeal, err error)) {
+	dh.queue.onFileDone = onFileDone
+}
+
+// SetLockMap gives this healer a lock map, see LockMap
+func (dh *DirHealer) SetLockMap(lockMap LockMap) {
+	dh.lockMap = lockMap
+}
+
+// SetSignature gives this healer the signature of the container it's
+// healing, which it needs to verify the source directory. It must be
+// called before Do.
+func (dh *DirHealer) SetSignature(signature *SignatureInfo) {
+	dh.signature = signature
+}
+
+func (dh *DirHealer) updateProgress() {
+	if dh.Consumer == nil {
+		return
+	}
+
+	totalHealthy := atomic.LoadInt64(&dh.totalHealthy)
+	totalHealed := atomic.LoadInt64(&dh.totalHealed)
+
+	progress := float64(totalHealthy+totalHealed) / float64(dh.container.Size)
+	dh.Consumer.Progress(progress)
+}
@@ -0,0 +1,225 @@
+package pwr
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/go-errors/errors"
+	"github.com/itchio/wharf/state"
+	"github.com/itchio/wharf/tlc"
+)
+
+// A fileHeal is a list of wounds to repair in a single file. Wounds for
+// the same file are added to it until a worker starts healing it.
+type fileHeal struct {
+	fileIndex int64
+	wounds    []*Wound
+	started   bool
+}
+
+// A healFileFunc repairs the given (merged) wounds of a single file
+type healFileFunc func(fileIndex int64, wounds []*Wound) error
+
+// A healQueue is what healers that repair files with a pool of workers
+// have in common: it receives wounds, heals dirs and symlinks right away,
+// and groups the wounds of each file into a fileHeal for workers to pick up.
+type healQueue struct {
+	// required
+
+	// the directory we should heal
+	target    string
+	container *tlc.Container
+	// number of workers running in parallel
+	numWorkers int
+	// newWorker is called once per worker. It returns what heals a single
+	// file, and what to call when the worker stops, if anything.
+	newWorker func() (heal healFileFunc, cleanup func())
+
+	// optional
+
+	consumer *state.Consumer
+	lockMap  LockMap
+	// onHealthy is called with the size of files that were entirely healthy
+	onHealthy func(fileSize int64)
+	// onFileDone is called whenever a worker is done with a fileHeal, err
+	// is what its healFileFunc returned.
+	onFileDone func(fh *fileHeal, err error)
+
+	// internal
+	totalCorrupted int64
+	hasWounds      bool
+
+	// heals that haven't been picked up by a worker yet can still
+	// receive wounds, see fileHeal
+	healsMutex sync.Mutex
+}
+
+// run receives wounds until the channel is closed, and returns once all
+// workers are done, or when something fails. Either way, no worker is
+// still healing a file by the time it returns.
+func (hq *healQueue) run(wounds chan *Wound) error {
+	container := hq.container
+
+	files := make(map[int64]bool)
+	heals := make(map[int64]*fileHeal)
+
+	fileHeals := make(chan *fileHeal, len(container.Files))
+	errs := make(chan error)
+	done := make(chan bool, hq.numWorkers)
+	cancelled := make(chan struct{})
+
+	var workers sync.WaitGroup
+	for i := 0; i < hq.numWorkers; i++ {
+		heal, cleanup := hq.newWorker()
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			hq.work(heal, cleanup, fileHeals, errs, done, cancelled)
+		}()
+	}
+
+	// cancel stops the workers and waits for them: the files they're
+	// healing are left alone once run returns.
+	cancel := func(err error) error {
+		close(cancelled)
+		workers.Wait()
+		return errors.Wrap(err, 1)
+	}
+
+	processWound := func(wound *Wound) error {
+		if !wound.Healthy() {
+			hq.totalCorrupted += wound.Size()
+			hq.hasWounds = true
+		}
+
+		switch wound.Kind {
+		case WoundKind_DIR:
+			return healDir(hq.target, container, wound)
+
+		case WoundKind_SYMLINK:
+			return healSymlink(hq.target, container, wound)
+
+		case WoundKind_FILE:
+			files[wound.Index] = true
+
+			hq.healsMutex.Lock()
+			fh := heals[wound.Index]
+			if fh != nil && !fh.started {
+				// not picked up yet, heal it along with the others
+				fh.wounds = append(fh.wounds, wound)
+				hq.healsMutex.Unlock()
+				return nil
+			}
+
+			fh = &fileHeal{
+				fileIndex: wound.Index,
+				wounds:    []*Wound{wound},
+			}
+			heals[wound.Index] = fh
+			hq.healsMutex.Unlock()
+
+			file := container.Files[wound.Index]
+			if hq.consumer != nil {
+				hq.consumer.ProgressLabel(file.Path)
+			}
+
+			select {
+			case pErr := <-errs:
+				return pErr
+			case fileHeals <- fh:
+				// queued for work!
+			}
+
+		case WoundKind_CLOSED_FILE:
+			if files[wound.Index] {
+				// already healing (part of) that file
+			} else {
+				fileSize := container.Files[wound.Index].Size
+
+				// whole file was healthy
+				if wound.End == fileSize && hq.onHealthy != nil {
+					hq.onHealthy(fileSize)
+				}
+			}
+
+		default:
+			return fmt.Errorf("unknown wound kind: %d", wound.Kind)
+		}
+
+		return nil
+	}
+
+	for wound := range wounds {
+		err := processWound(wound)
+		if err != nil {
+			close(fileHeals)
+			return cancel(err)
+		}
+	}
+
+	// queued everything
+	close(fileHeals)
+
+	// expecting up to numWorkers done, some may still
+	// send errors
+	for i := 0; i < hq.numWorkers; i++ {
+		select {
+		case err := <-errs:
+			return cancel(err)
+		case <-done:
+			// good!
+		}
+	}
+
+	workers.Wait()
+	return nil
+}
+
+func (hq *healQueue) work(heal healFileFunc, cleanup func(), fileHeals chan *fileHeal, errs chan error, done chan bool, cancelled chan struct{}) {
+	if cleanup != nil {
+		defer cleanup()
+	}
+
+	for {
+		select {
+		case <-cancelled:
+			// something else stopped the healing
+			return
+		case fh, ok := <-fileHeals:
+			if !ok {
+				// no more files to heal
+				done <- true
+				return
+			}
+
+			err := hq.healOne(heal, fh)
+			if err != nil {
+				select {
+				case <-cancelled:
+					// already cancelled, no need for more errors
+					return
+				case errs <- err:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (hq *healQueue) healOne(heal healFileFunc, fh *fileHeal) error {
+	if hq.lockMap != nil {
+		lock := hq.lockMap[fh.fileIndex]
+		<-lock
+	}
+
+	hq.healsMutex.Lock()
+	fh.started = true
+	wounds := MergeWounds(fh.wounds)
+	hq.healsMutex.Unlock()
+
+	err := heal(fh.fileIndex, wounds)
+	if hq.onFileDone != nil {
+		hq.onFileDone(fh, err)
+	}
+	return err
+}
@@ -5,11 +5,18 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/alecthomas/assert"
+	"github.com/go-errors/errors"
+	"github.com/itchio/wharf/pools/fspool"
+	"github.com/itchio/wharf/state"
 	"github.com/itchio/wharf/tlc"
 )
 
@@ -65,35 +72,53 @@ func Test_ArchiveHealer(t *testing.T) {
 	container, err := tlc.WalkAny(archivePath, nil)
 	assert.NoError(t, err)
 
-	healAll := func() Healer {
+	var progressMutex sync.Mutex
+	lastProgress := 0.0
+
+	heal := func(wounds []*Wound) Healer {
 		healer, err := NewHealer(fmt.Sprintf("archive,%s", archivePath), targetDir)
 		assert.NoError(t, err)
+		healer.SetConsumer(&state.Consumer{
+			OnProgress: func(progress float64) {
+				progressMutex.Lock()
+				lastProgress = progress
+				progressMutex.Unlock()
+			},
+		})
 
-		wounds := make(chan *Wound)
+		woundsChan := make(chan *Wound)
 		done := make(chan bool)
 
 		go func() {
-			err := healer.Do(container, wounds)
+			err := healer.Do(container, woundsChan)
 			assert.NoError(t, err)
 			done <- true
 		}()
 
-		for i := 0; i < numFiles; i++ {
-			wounds <- &Wound{
-				Kind:  WoundKind_FILE,
-				Index: int64(i),
-				Start: 0,
-				End:   1,
-			}
+		for _, wound := range wounds {
+			woundsChan <- wound
 		}
 
-		close(wounds)
+		close(woundsChan)
 
 		<-done
 
 		return healer
 	}
 
+	healAll := func() Healer {
+		var wounds []*Wound
+		for i := 0; i < numFiles; i++ {
+			wounds = append(wounds, &Wound{
+				Kind:  WoundKind_FILE,
+				Index: int64(i),
+				Start: 0,
+				End:   int64(len(fakeData)),
+			})
+		}
+		return heal(wounds)
+	}
+
 	assertAllFilesHealed := func() {
 		for i := 0; i < numFiles; i++ {
 			data, err := ioutil.ReadFile(pathFor(i))
@@ -105,21 +130,21 @@ func Test_ArchiveHealer(t *testing.T) {
 
 	t.Logf("...with no files present")
 	healer := healAll()
-	assert.Equal(t, int64(numFiles), healer.TotalCorrupted())
+	assert.Equal(t, int64(numFiles*len(fakeData)), healer.TotalCorrupted())
 	assert.Equal(t, int64(numFiles*len(fakeData)), healer.TotalHealed())
 	assertAllFilesHealed()
 
 	t.Logf("...with one file too long")
 	assert.NoError(t, ioutil.WriteFile(pathFor(3), bytes.Repeat(fakeData, 4), 0644))
 	healer = healAll()
-	assert.Equal(t, int64(numFiles), healer.TotalCorrupted())
+	assert.Equal(t, int64(numFiles*len(fakeData)), healer.TotalCorrupted())
 	assert.Equal(t, int64(numFiles*len(fakeData)), healer.TotalHealed())
 	assertAllFilesHealed()
 
 	t.Logf("...with one file too short")
 	assert.NoError(t, ioutil.WriteFile(pathFor(7), fakeData[:1], 0644))
 	healer = healAll()
-	assert.Equal(t, int64(numFiles), healer.TotalCorrupted())
+	assert.Equal(t, int64(numFiles*len(fakeData)), healer.TotalCorrupted())
 	assert.Equal(t, int64(numFiles*len(fakeData)), healer.TotalHealed())
 	assertAllFilesHealed()
 
@@ -128,7 +153,410 @@ func Test_ArchiveHealer(t *testing.T) {
 	corruptedFakeData[2] = 255
 	assert.NoError(t, ioutil.WriteFile(pathFor(9), corruptedFakeData, 0644))
 	healer = healAll()
-	assert.Equal(t, int64(numFiles), healer.TotalCorrupted())
+	assert.Equal(t, int64(numFiles*len(fakeData)), healer.TotalCorrupted())
 	assert.Equal(t, int64(numFiles*len(fakeData)), healer.TotalHealed())
 	assertAllFilesHealed()
+
+	t.Logf("...only healing the wounded range")
+	corruptedFakeData[1] = 254
+	corruptedFakeData[2] = 255
+	assert.NoError(t, ioutil.WriteFile(pathFor(11), corruptedFakeData, 0644))
+	wounds := []*Wound{
+		&Wound{Kind: WoundKind_FILE, Index: 11, Start: 2, End: 3},
+		&Wound{Kind: WoundKind_FILE, Index: 11, Start: 1, End: 2},
+	}
+	for i := 0; i < numFiles; i++ {
+		if i != 11 {
+			wounds = append(wounds, &Wound{Kind: WoundKind_CLOSED_FILE, Index: int64(i), Start: 0, End: int64(len(fakeData))})
+		}
+	}
+	healer = heal(wounds)
+	assert.Equal(t, int64(2), healer.TotalCorrupted())
+	assert.Equal(t, int64(2), healer.TotalHealed())
+	assert.Equal(t, 1.0, lastProgress)
+	assertAllFilesHealed()
+
+	t.Logf("...leaving healthy data alone")
+	assert.NoError(t, ioutil.WriteFile(pathFor(12), corruptedFakeData, 0644))
+	healer = heal([]*Wound{
+		&Wound{Kind: WoundKind_FILE, Index: 12, Start: 0, End: 1},
+	})
+	assert.Equal(t, int64(1), healer.TotalHealed())
+	data, err := ioutil.ReadFile(pathFor(12))
+	assert.NoError(t, err)
+	assert.Equal(t, corruptedFakeData, data)
+}
+
+func Test_DirHealer(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "dirhealer")
+	assert.NoError(t, err)
+	defer os.RemoveAll(mainDir)
+
+	sourceDir := filepath.Join(mainDir, "source")
+	targetDir := filepath.Join(mainDir, "target")
+
+	makeTestDir(t, sourceDir, testDirSettings{
+		entries: []testDirEntry{
+			{path: "subdir/file-1", seed: 0x1, size: BlockSize*4 + 14},
+			{path: "file-2", seed: 0x2},
+			{path: "empty", size: 0},
+		},
+	})
+
+	container, err := tlc.WalkAny(sourceDir, nil)
+	assert.NoError(t, err)
+
+	hashes, err := ComputeSignature(container, fspool.New(container, sourceDir), &state.Consumer{})
+	assert.NoError(t, err)
+
+	signature := &SignatureInfo{
+		Container: container,
+		Hashes:    hashes,
+	}
+
+	healer, err := NewHealer(fmt.Sprintf("dir,%s", sourceDir), targetDir)
+	assert.NoError(t, err)
+
+	_, ok := healer.(*DirHealer)
+	assert.True(t, ok)
+
+	heal := func(wounds []*Wound) (Healer, error) {
+		healer, err := NewHealer(fmt.Sprintf("dir,%s", sourceDir), targetDir)
+		assert.NoError(t, err)
+		healer.(SignatureHealer).SetSignature(signature)
+
+		woundsChan := make(chan *Wound)
+		go func() {
+			for _, wound := range wounds {
+				woundsChan <- wound
+			}
+			close(woundsChan)
+		}()
+
+		return healer, healer.Do(container, woundsChan)
+	}
+
+	fileIndex := int64(-1)
+	for i, f := range container.Files {
+		if f.Path == "subdir/file-1" {
+			fileIndex = int64(i)
+		}
+	}
+	file := container.Files[fileIndex]
+	targetPath := filepath.Join(targetDir, "subdir", "file-1")
+	sourcePath := filepath.Join(sourceDir, "subdir", "file-1")
+
+	t.Logf("...with everything missing")
+	var wounds []*Wound
+	for i, f := range container.Files {
+		wounds = append(wounds, &Wound{Kind: WoundKind_FILE, Index: int64(i), Start: 0, End: f.Size})
+	}
+	for i := range container.Dirs {
+		wounds = append(wounds, &Wound{Kind: WoundKind_DIR, Index: int64(i)})
+	}
+	healer, err = heal(wounds)
+	assert.NoError(t, err)
+	assert.EqualValues(t, container.Size, healer.TotalHealed())
+	assert.NoError(t, AssertValid(targetDir, signature))
+
+	t.Logf("...with one block corrupted")
+	targetFile, err := os.OpenFile(targetPath, os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = targetFile.WriteAt([]byte{0xde, 0xad}, BlockSize*2+3)
+	assert.NoError(t, err)
+	assert.NoError(t, targetFile.Close())
+	assert.Error(t, AssertValid(targetDir, signature))
+
+	healer, err = heal([]*Wound{
+		{Kind: WoundKind_FILE, Index: fileIndex, Start: BlockSize * 2, End: BlockSize * 3},
+	})
+	assert.NoError(t, err)
+	assert.EqualValues(t, BlockSize, healer.TotalHealed())
+	assert.NoError(t, AssertValid(targetDir, signature))
+
+	t.Logf("...with a corrupted source")
+	sourceFile, err := os.OpenFile(sourcePath, os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = sourceFile.WriteAt([]byte{0xbe, 0xef}, BlockSize*1+3)
+	assert.NoError(t, err)
+	assert.NoError(t, sourceFile.Close())
+
+	assert.NoError(t, os.Truncate(targetPath, 12))
+	_, err = heal([]*Wound{
+		{Kind: WoundKind_FILE, Index: fileIndex, Start: 0, End: file.Size},
+	})
+	assert.Error(t, err)
+
+	t.Logf("...without a signature")
+	healer, err = NewHealer(fmt.Sprintf("dir,%s", sourceDir), targetDir)
+	assert.NoError(t, err)
+	woundsChan := make(chan *Wound)
+	close(woundsChan)
+	assert.Error(t, healer.Do(container, woundsChan))
+}
+
+type timeoutError struct{}
+
+var _ net.Error = (*timeoutError)(nil)
+
+func (te *timeoutError) Error() string   { return "i/o timeout" }
+func (te *timeoutError) Timeout() bool   { return true }
+func (te *timeoutError) Temporary() bool { return true }
+
+// A slowHealer pretends to heal files, slowly, with a healQueue like the
+// real healers. It fails to heal failOn, and counts how many times another
+// slowHealer was already busy with the file it was about to heal.
+type slowHealer struct {
+	failOn   int64
+	busy     []int32
+	overlaps *int32
+
+	numWorkers  int
+	totalHealed int64
+	queue       healQueue
+}
+
+var _ Healer = (*slowHealer)(nil)
+var _ fileDoneNotifier = (*slowHealer)(nil)
+
+func (sh *slowHealer) Do(container *tlc.Container, wounds chan *Wound) error {
+	sh.queue.container = container
+	sh.queue.numWorkers = sh.numWorkers
+	sh.queue.newWorker = func() (healFileFunc, func()) {
+		heal := func(fileIndex int64, wounds []*Wound) error {
+			if fileIndex == sh.failOn {
+				return errors.New("slowHealer: can't heal that one")
+			}
+
+			if atomic.AddInt32(&sh.busy[fileIndex], 1) > 1 {
+				atomic.AddInt32(sh.overlaps, 1)
+			}
+			time.Sleep(50 * time.Millisecond)
+			atomic.AddInt32(&sh.busy[fileIndex], -1)
+
+			atomic.AddInt64(&sh.totalHealed, container.Files[fileIndex].Size)
+			return nil
+		}
+		return heal, nil
+	}
+
+	return sh.queue.run(wounds)
+}
+
+func (sh *slowHealer) SetNumWorkers(numWorkers int)         { sh.numWorkers = numWorkers }
+func (sh *slowHealer) SetConsumer(consumer *state.Consumer) {}
+func (sh *slowHealer) SetLockMap(lockMap LockMap)           {}
+func (sh *slowHealer) TotalHealed() int64                   { return atomic.LoadInt64(&sh.totalHealed) }
+func (sh *slowHealer) HasWounds() bool                      { return sh.queue.hasWounds }
+func (sh *slowHealer) TotalCorrupted() int64                { return sh.queue.totalCorrupted }
+
+func (sh *slowHealer) setOnFileDone(onFileDone func(fh *fileHeal, err error)) {
+	sh.queue.onFileDone = onFileDone
+}
+
+func Test_ChainHealer(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "chainhealer")
+	assert.NoError(t, err)
+	defer os.RemoveAll(mainDir)
+
+	goodDir := filepath.Join(mainDir, "good")
+	brokenDir := filepath.Join(mainDir, "broken")
+	targetDir := filepath.Join(mainDir, "target")
+
+	for _, dir := range []string{goodDir, brokenDir} {
+		makeTestDir(t, dir, testDirSettings{
+			entries: []testDirEntry{
+				{path: "subdir/file-1", seed: 0x1, size: BlockSize*4 + 14},
+				{path: "file-2", seed: 0x2},
+			},
+		})
+	}
+
+	brokenFile, err := os.OpenFile(filepath.Join(brokenDir, "file-2"), os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = brokenFile.WriteAt([]byte{0xde, 0xad}, 3)
+	assert.NoError(t, err)
+	assert.NoError(t, brokenFile.Close())
+
+	container, err := tlc.WalkAny(goodDir, nil)
+	assert.NoError(t, err)
+
+	hashes, err := ComputeSignature(container, fspool.New(container, goodDir), &state.Consumer{})
+	assert.NoError(t, err)
+
+	signature := &SignatureInfo{
+		Container: container,
+		Hashes:    hashes,
+	}
+
+	healer, err := NewHealer(fmt.Sprintf("chain,dir,%s|dir,%s", brokenDir, goodDir), targetDir)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, len(healer.(*ChainHealer).Sources))
+
+	_, err = NewHealer("chain,dir", targetDir)
+	assert.Error(t, err)
+
+	_, err = NewHealer("chain,chain,dir,/dev/null", targetDir)
+	assert.Error(t, err)
+
+	failures := 0
+	ch := &ChainHealer{
+		Target:     targetDir,
+		RetryDelay: time.Millisecond,
+		Sources: []*HealerSource{
+			{
+				Name: "broken",
+				Factory: func() (Healer, error) {
+					return &DirHealer{Target: targetDir, SourcePath: brokenDir}, nil
+				},
+			},
+			{
+				Name: "flaky",
+				Factory: func() (Healer, error) {
+					if failures < 2 {
+						failures++
+						return nil, errors.Wrap(&timeoutError{}, 1)
+					}
+					return &DirHealer{Target: targetDir, SourcePath: goodDir}, nil
+				},
+			},
+		},
+	}
+	ch.SetSignature(signature)
+	ch.SetNumWorkers(1)
+
+	woundsChan := make(chan *Wound)
+	go func() {
+		for i, f := range container.Files {
+			woundsChan <- &Wound{Kind: WoundKind_FILE, Index: int64(i), Start: 0, End: f.Size}
+		}
+		for i := range container.Dirs {
+			woundsChan <- &Wound{Kind: WoundKind_DIR, Index: int64(i)}
+		}
+		close(woundsChan)
+	}()
+
+	assert.NoError(t, ch.Do(container, woundsChan))
+	assert.NoError(t, AssertValid(targetDir, signature))
+
+	broken := ch.Sources[0]
+	flaky := ch.Sources[1]
+
+	var file1, file2 int64
+	for i, f := range container.Files {
+		switch f.Path {
+		case "subdir/file-1":
+			file1 = int64(i)
+		case "file-2":
+			file2 = int64(i)
+		}
+	}
+
+	assert.Equal(t, broken, ch.HealedBy(file1))
+	assert.Equal(t, flaky, ch.HealedBy(file2))
+
+	assert.EqualValues(t, 1, broken.FilesHealed())
+	assert.EqualValues(t, container.Files[file1].Size, broken.TotalHealed())
+	assert.EqualValues(t, 1, flaky.FilesHealed())
+	assert.EqualValues(t, container.Files[file2].Size, flaky.TotalHealed())
+	assert.EqualValues(t, 2, flaky.retries)
+	assert.EqualValues(t, 1, broken.failures)
+
+	assert.EqualValues(t, container.Size, ch.TotalHealed())
+	assert.EqualValues(t, container.Size, ch.TotalCorrupted())
+
+	t.Logf("chain stats:\n%s", ch.Stats())
+
+	t.Logf("...with a single healer for all files")
+	for _, f := range container.Files {
+		assert.NoError(t, os.Remove(filepath.Join(targetDir, filepath.FromSlash(f.Path))))
+	}
+
+	goodHealers := 0
+	ch = &ChainHealer{
+		Target: targetDir,
+		Sources: []*HealerSource{
+			{
+				Name: "good",
+				Factory: func() (Healer, error) {
+					goodHealers++
+					return &DirHealer{Target: targetDir, SourcePath: goodDir}, nil
+				},
+			},
+		},
+	}
+	ch.SetSignature(signature)
+
+	woundsChan = make(chan *Wound, len(container.Files))
+	for i, f := range container.Files {
+		woundsChan <- &Wound{Kind: WoundKind_FILE, Index: int64(i), Start: 0, End: f.Size}
+	}
+	close(woundsChan)
+	assert.NoError(t, ch.Do(container, woundsChan))
+	assert.NoError(t, AssertValid(targetDir, signature))
+	assert.EqualValues(t, 1, goodHealers)
+	assert.EqualValues(t, len(container.Files), ch.Sources[0].FilesHealed())
+	assert.EqualValues(t, container.Size, ch.TotalHealed())
+
+	t.Logf("...with no working source")
+	assert.NoError(t, os.Remove(filepath.Join(targetDir, "file-2")))
+
+	ch = &ChainHealer{
+		Target: targetDir,
+		Sources: []*HealerSource{
+			{
+				Name: "broken",
+				Factory: func() (Healer, error) {
+					return &DirHealer{Target: targetDir, SourcePath: brokenDir}, nil
+				},
+			},
+		},
+	}
+	ch.SetSignature(signature)
+
+	woundsChan = make(chan *Wound, 1)
+	woundsChan <- &Wound{Kind: WoundKind_FILE, Index: file2, Start: 0, End: container.Files[file2].Size}
+	close(woundsChan)
+	assert.Error(t, ch.Do(container, woundsChan))
+
+	t.Logf("...with a source failing while it's healing other files")
+	slowContainer := &tlc.Container{}
+	for i := 0; i < 4; i++ {
+		slowContainer.Files = append(slowContainer.Files, &tlc.File{Path: fmt.Sprintf("file-%d", i), Size: 1024})
+	}
+	slowContainer.Size = 4 * 1024
+
+	busy := make([]int32, len(slowContainer.Files))
+	var overlaps int32
+	slowSource := func(name string, failOn int64) *HealerSource {
+		return &HealerSource{
+			Name: name,
+			Factory: func() (Healer, error) {
+				return &slowHealer{failOn: failOn, busy: busy, overlaps: &overlaps}, nil
+			},
+		}
+	}
+
+	ch = &ChainHealer{
+		Target: targetDir,
+		Sources: []*HealerSource{
+			slowSource("picky", 0),
+			slowSource("fallback", -1),
+		},
+	}
+	ch.SetNumWorkers(len(slowContainer.Files))
+
+	woundsChan = make(chan *Wound, len(slowContainer.Files))
+	for i, f := range slowContainer.Files {
+		woundsChan <- &Wound{Kind: WoundKind_FILE, Index: int64(i), Start: 0, End: f.Size}
+	}
+	close(woundsChan)
+	assert.NoError(t, ch.Do(slowContainer, woundsChan))
+
+	// the files that were being healed when picky failed on file-0 were
+	// left to it, instead of being healed again by another healer meanwhile
+	assert.EqualValues(t, 0, atomic.LoadInt32(&overlaps))
+	assert.EqualValues(t, 3, ch.Sources[0].FilesHealed())
+	assert.EqualValues(t, 1, ch.Sources[1].FilesHealed())
+	assert.EqualValues(t, slowContainer.Size, ch.TotalHealed())
 }
@@ -0,0 +1,152 @@
+package inspect
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/go-errors/errors"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+)
+
+type jsonDump struct {
+	Kind            Kind            `json:"kind"`
+	Header          json.RawMessage `json:"header"`
+	TargetContainer json.RawMessage `json:"targetContainer,omitempty"`
+	Container       json.RawMessage `json:"container,omitempty"`
+	Files           []*FileStats    `json:"files,omitempty"`
+	NumHashes       int64           `json:"numHashes,omitempty"`
+	NumWounds       int64           `json:"numWounds,omitempty"`
+	WoundedBytes    int64           `json:"woundedBytes,omitempty"`
+	Messages        []jsonMessage   `json:"messages,omitempty"`
+}
+
+type jsonMessage struct {
+	Type    string          `json:"type"`
+	Message json.RawMessage `json:"message"`
+}
+
+// WriteJSON writes the dump as a single JSON document. Protobuf messages
+// are written with their field names from the .proto files.
+func (d *Dump) WriteJSON(writer io.Writer) error {
+	marshaler := &jsonpb.Marshaler{
+		OrigName: true,
+	}
+
+	marshal := func(msg proto.Message) (json.RawMessage, error) {
+		if msg == nil {
+			return nil, nil
+		}
+
+		s, err := marshaler.MarshalToString(msg)
+		if err != nil {
+			return nil, errors.Wrap(err, 1)
+		}
+		return json.RawMessage(s), nil
+	}
+
+	jd := &jsonDump{
+		Kind:         d.Kind,
+		Files:        d.Files,
+		NumHashes:    d.NumHashes,
+		NumWounds:    d.NumWounds,
+		WoundedBytes: d.WoundedBytes,
+	}
+
+	var err error
+	jd.Header, err = marshal(d.Header)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	if d.TargetContainer != nil {
+		jd.TargetContainer, err = marshal(d.TargetContainer)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+	}
+
+	if d.Container != nil {
+		jd.Container, err = marshal(d.Container)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+	}
+
+	for _, msg := range d.Messages {
+		raw, err := marshal(msg)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+
+		jd.Messages = append(jd.Messages, jsonMessage{
+			Type:    proto.MessageName(msg),
+			Message: raw,
+		})
+	}
+
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(jd)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+// WriteText writes the dump as a series of textproto messages, each preceded
+// by a comment saying what it is. Statistics are written as comments.
+func (d *Dump) WriteText(writer io.Writer) error {
+	var err error
+	printf := func(format string, args ...interface{}) {
+		if err != nil {
+			return
+		}
+		_, err = fmt.Fprintf(writer, format, args...)
+	}
+
+	printMessage := func(title string, msg proto.Message) {
+		printf("# %s (%s)\n%s\n", title, proto.MessageName(msg), proto.MarshalTextString(msg))
+	}
+
+	printf("# wharf %s\n\n", d.Kind)
+	if d.Header != nil {
+		printMessage("header", d.Header)
+	}
+	if d.TargetContainer != nil {
+		printMessage("target container", d.TargetContainer)
+	}
+	if d.Container != nil {
+		printMessage("container", d.Container)
+	}
+
+	for _, stats := range d.Files {
+		printf("# file %d %q (%d bytes): %s", stats.Index, stats.Path, stats.Size, stats.Type)
+		if stats.TargetPath != "" {
+			printf(" from %q", stats.TargetPath)
+		}
+		printf(", blockRangeBytes=%d dataBytes=%d bsdiffAddBytes=%d bsdiffCopyBytes=%d\n",
+			stats.BlockRangeBytes, stats.DataBytes, stats.BsdiffAddBytes, stats.BsdiffCopyBytes)
+	}
+
+	switch d.Kind {
+	case KindSignature, KindManifest:
+		printf("# %d hashes\n", d.NumHashes)
+	case KindWounds:
+		printf("# %d wounds, %d bytes\n", d.NumWounds, d.WoundedBytes)
+	}
+
+	if len(d.Messages) > 0 {
+		printf("\n# messages\n")
+		for _, msg := range d.Messages {
+			printf("# %s\n%s\n", proto.MessageName(msg), proto.CompactTextString(msg))
+		}
+	}
+
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	return nil
+}
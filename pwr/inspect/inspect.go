@@ -0,0 +1,264 @@
+// Package inspect reads any wharf file (patch, signature, manifest or wounds)
+// into a Dump, which can be written out as JSON or textproto, for debugging.
+package inspect
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/golang/protobuf/proto"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/pwr/genie"
+	"github.com/itchio/wharf/tlc"
+	"github.com/itchio/wharf/wire"
+)
+
+// A Kind is the type of a wharf file, as told by its magic number
+type Kind string
+
+const (
+	// KindPatch is for patch files (.pwr)
+	KindPatch Kind = "patch"
+	// KindSignature is for signature files (.pws)
+	KindSignature Kind = "signature"
+	// KindManifest is for manifest files (.pwm)
+	KindManifest Kind = "manifest"
+	// KindWounds is for wounds files (.pww)
+	KindWounds Kind = "wounds"
+)
+
+// A Dump is what's inside a wharf file
+type Dump struct {
+	Kind   Kind
+	Header proto.Message
+
+	// TargetContainer is only set for patches
+	TargetContainer *tlc.Container
+	// Container is a patch's source container, or the container of
+	// a signature, manifest or wounds file
+	Container *tlc.Container
+
+	// Files sums up how a patch builds each file of its source container
+	Files []*FileStats
+
+	// NumHashes is how many block hashes a signature or manifest has
+	NumHashes int64
+
+	// NumWounds is how many wounds a wounds file has, WoundedBytes is how
+	// many bytes they cover
+	NumWounds    int64
+	WoundedBytes int64
+
+	// Messages is every message after the containers, if Inspector.Messages is set
+	Messages []proto.Message
+}
+
+// FileStats sums up how a patch builds a file
+type FileStats struct {
+	Index int64  `json:"index"`
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+
+	// Type is "rsync", "bsdiff" or "zstd"
+	Type string `json:"type"`
+	// TargetPath is the file bsdiff and zstd patch from
+	TargetPath string `json:"targetPath,omitempty"`
+
+	// BlockRangeBytes is how much is copied from target files by BLOCK_RANGE ops
+	BlockRangeBytes int64 `json:"blockRangeBytes,omitempty"`
+	// DataBytes is how much is stored in DATA ops (as-is with rsync, as a zstd frame with zstd)
+	DataBytes int64 `json:"dataBytes,omitempty"`
+	// BsdiffAddBytes is how many bytes bsdiff adds to the target file's
+	BsdiffAddBytes int64 `json:"bsdiffAddBytes,omitempty"`
+	// BsdiffCopyBytes is how many bytes bsdiff copies from the patch
+	BsdiffCopyBytes int64 `json:"bsdiffCopyBytes,omitempty"`
+}
+
+// An Inspector reads wharf files into dumps
+type Inspector struct {
+	// Messages keeps every message (ops, hashes or wounds) in the dump,
+	// rather than just statistics. Dumps of large files get very large.
+	Messages bool
+}
+
+// Read reads a wharf file, telling what kind it is by its magic number
+func (in *Inspector) Read(reader io.Reader) (*Dump, error) {
+	br := bufio.NewReader(reader)
+
+	magicBytes, err := br.Peek(4)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	dump := &Dump{}
+
+	switch int32(pwr.Endianness.Uint32(magicBytes)) {
+	case pwr.PatchMagic:
+		dump.Kind = KindPatch
+		err = in.readPatch(br, dump)
+	case pwr.SignatureMagic:
+		dump.Kind = KindSignature
+		err = in.readHashes(br, dump, pwr.SignatureMagic, &pwr.SignatureHeader{}, func() proto.Message {
+			return &pwr.BlockHash{}
+		})
+	case pwr.ManifestMagic:
+		dump.Kind = KindManifest
+		err = in.readHashes(br, dump, pwr.ManifestMagic, &pwr.ManifestHeader{}, func() proto.Message {
+			return &pwr.ManifestBlockHash{}
+		})
+	case pwr.WoundsMagic:
+		dump.Kind = KindWounds
+		err = in.readWounds(br, dump)
+	default:
+		err = wire.ErrFormat
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	return dump, nil
+}
+
+func (in *Inspector) readPatch(reader io.Reader, dump *Dump) error {
+	g := &genie.Genie{
+		BlockSize: pwr.BlockSize,
+	}
+
+	err := g.ParseHeader(reader)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	dump.Header = g.Header
+	dump.TargetContainer = g.TargetContainer
+	dump.Container = g.SourceContainer
+
+	for index, f := range g.SourceContainer.Files {
+		dump.Files = append(dump.Files, &FileStats{
+			Index: int64(index),
+			Path:  f.Path,
+			Size:  f.Size,
+			Type:  "rsync",
+		})
+	}
+
+	g.OnDiffEntry = func(entry *genie.DiffEntry) {
+		stats := dump.Files[entry.FileIndex]
+		stats.Type = strings.ToLower(entry.Type.String())
+		if entry.TargetIndex >= 0 && entry.TargetIndex < int64(len(g.TargetContainer.Files)) {
+			stats.TargetPath = g.TargetContainer.Files[entry.TargetIndex].Path
+		}
+		stats.BsdiffAddBytes += entry.AddBytes
+		stats.BsdiffCopyBytes += entry.CopyBytes
+		stats.DataBytes += entry.DataBytes
+	}
+
+	if in.Messages {
+		g.OnMessage = func(msg proto.Message) {
+			dump.Messages = append(dump.Messages, proto.Clone(msg))
+		}
+	}
+
+	err = g.ParseContents(func(comp *genie.Composition) {
+		stats := dump.Files[comp.FileIndex]
+		for _, origin := range comp.Origins {
+			switch origin := origin.(type) {
+			case *genie.BlockOrigin:
+				stats.BlockRangeBytes += origin.Size
+			case *genie.FreshOrigin:
+				stats.DataBytes += origin.Size
+			}
+		}
+	})
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+// readHashes reads signatures and manifests, which have a header, a
+// container, then hashes until the end of the file
+func (in *Inspector) readHashes(reader io.Reader, dump *Dump, magic int32, header proto.Message, newHash func() proto.Message) error {
+	rawWire := wire.NewReadContext(reader)
+	err := rawWire.ExpectMagic(magic)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	err = rawWire.ReadMessage(header)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	dump.Header = header
+
+	var compression *pwr.CompressionSettings
+	switch header := header.(type) {
+	case *pwr.SignatureHeader:
+		compression = header.Compression
+	case *pwr.ManifestHeader:
+		compression = header.Compression
+	}
+
+	compressedWire, err := pwr.DecompressWire(rawWire, compression)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return in.readRest(compressedWire, dump, newHash, func(msg proto.Message) {
+		dump.NumHashes++
+	})
+}
+
+func (in *Inspector) readWounds(reader io.Reader, dump *Dump) error {
+	rawWire := wire.NewReadContext(reader)
+	err := rawWire.ExpectMagic(pwr.WoundsMagic)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	header := &pwr.WoundsHeader{}
+	err = rawWire.ReadMessage(header)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	dump.Header = header
+
+	newWound := func() proto.Message {
+		return &pwr.Wound{}
+	}
+
+	return in.readRest(rawWire, dump, newWound, func(msg proto.Message) {
+		wound := msg.(*pwr.Wound)
+		dump.NumWounds++
+		dump.WoundedBytes += wound.Size()
+	})
+}
+
+// readRest reads a container, then messages until the end of the file
+func (in *Inspector) readRest(rctx *wire.ReadContext, dump *Dump, newMessage func() proto.Message, onMessage func(msg proto.Message)) error {
+	container := &tlc.Container{}
+	err := rctx.ReadMessage(container)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+	dump.Container = container
+
+	for {
+		msg := newMessage()
+		err = rctx.ReadMessage(msg)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return errors.Wrap(err, 1)
+		}
+
+		onMessage(msg)
+		if in.Messages {
+			dump.Messages = append(dump.Messages, msg)
+		}
+	}
+}
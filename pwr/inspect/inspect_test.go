@@ -0,0 +1,184 @@
+package inspect
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"github.com/itchio/wharf/pools/fspool"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/state"
+	"github.com/itchio/wharf/tlc"
+	"github.com/itchio/wharf/wire"
+
+	_ "github.com/itchio/wharf/compressors/zstd"
+	_ "github.com/itchio/wharf/decompressors/zstd"
+)
+
+func Test_InspectPatch(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "inspect")
+	assert.NoError(t, err)
+	defer os.RemoveAll(mainDir)
+
+	prng := rand.New(rand.NewSource(0x50))
+	random := func(size int) []byte {
+		buf := make([]byte, size)
+		prng.Read(buf)
+		return buf
+	}
+
+	same := random(int(pwr.BlockSize)*3 + 100)
+	old := random(int(pwr.BlockSize) * 2)
+	changed := append(append([]byte{}, old[:1000]...), random(500)...)
+	changed = append(changed, old[1000:]...)
+
+	v1 := filepath.Join(mainDir, "v1")
+	v2 := filepath.Join(mainDir, "v2")
+	writeFile := func(dir string, name string, data []byte) {
+		assert.NoError(t, os.MkdirAll(dir, 0755))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), data, 0644))
+	}
+	writeFile(v1, "same", same)
+	writeFile(v1, "changed", old)
+	writeFile(v2, "same", same)
+	writeFile(v2, "changed", changed)
+	writeFile(v2, "new", random(1234))
+
+	consumer := &state.Consumer{}
+	compression := &pwr.CompressionSettings{
+		Algorithm: pwr.CompressionAlgorithm_ZSTD,
+		Quality:   1,
+	}
+
+	targetContainer, err := tlc.WalkAny(v1, nil)
+	assert.NoError(t, err)
+	sourceContainer, err := tlc.WalkAny(v2, nil)
+	assert.NoError(t, err)
+
+	targetSignature, err := pwr.ComputeSignature(targetContainer, fspool.New(targetContainer, v1), consumer)
+	assert.NoError(t, err)
+
+	patchBuffer := new(bytes.Buffer)
+	signatureBuffer := new(bytes.Buffer)
+	dctx := &pwr.DiffContext{
+		Compression: compression,
+		Consumer:    consumer,
+
+		SourceContainer: sourceContainer,
+		Pool:            fspool.New(sourceContainer, v2),
+
+		TargetContainer: targetContainer,
+		TargetSignature: targetSignature,
+	}
+	assert.NoError(t, dctx.WritePatch(patchBuffer, signatureBuffer))
+
+	fileStats := func(dump *Dump, path string) *FileStats {
+		for _, stats := range dump.Files {
+			if stats.Path == path {
+				return stats
+			}
+		}
+		t.Fatalf("no stats for %s", path)
+		return nil
+	}
+
+	inspector := &Inspector{}
+	dump, err := inspector.Read(bytes.NewReader(patchBuffer.Bytes()))
+	assert.NoError(t, err)
+	assert.EqualValues(t, KindPatch, dump.Kind)
+	assert.EqualValues(t, 2, len(dump.TargetContainer.Files))
+	assert.EqualValues(t, 3, len(dump.Files))
+	assert.Nil(t, dump.Messages)
+
+	sameStats := fileStats(dump, "same")
+	assert.EqualValues(t, "rsync", sameStats.Type)
+	assert.EqualValues(t, len(same), sameStats.BlockRangeBytes)
+	assert.EqualValues(t, 0, sameStats.DataBytes)
+
+	newStats := fileStats(dump, "new")
+	assert.EqualValues(t, 0, newStats.BlockRangeBytes)
+	assert.EqualValues(t, 1234, newStats.DataBytes)
+
+	changedStats := fileStats(dump, "changed")
+	assert.EqualValues(t, len(changed), changedStats.BlockRangeBytes+changedStats.DataBytes)
+
+	// optimized patches have bsdiff or zstd entries
+	for _, engine := range []pwr.RediffEngine{pwr.RediffEngineBsdiff, pwr.RediffEngineZstd} {
+		rc := &pwr.RediffContext{
+			SourcePool:  fspool.New(sourceContainer, v2),
+			TargetPool:  fspool.New(targetContainer, v1),
+			Compression: compression,
+			Consumer:    consumer,
+			Engine:      engine,
+		}
+		assert.NoError(t, rc.AnalyzePatch(bytes.NewReader(patchBuffer.Bytes())))
+
+		optimizedBuffer := new(bytes.Buffer)
+		assert.NoError(t, rc.OptimizePatch(bytes.NewReader(patchBuffer.Bytes()), optimizedBuffer))
+
+		inspector := &Inspector{
+			Messages: true,
+		}
+		dump, err := inspector.Read(bytes.NewReader(optimizedBuffer.Bytes()))
+		assert.NoError(t, err)
+		assert.True(t, len(dump.Messages) > 0)
+
+		changedStats := fileStats(dump, "changed")
+		assert.EqualValues(t, "changed", changedStats.TargetPath)
+		if engine == pwr.RediffEngineBsdiff {
+			assert.EqualValues(t, "bsdiff", changedStats.Type)
+			assert.EqualValues(t, len(changed), changedStats.BsdiffAddBytes+changedStats.BsdiffCopyBytes)
+		} else {
+			assert.EqualValues(t, "zstd", changedStats.Type)
+			assert.True(t, changedStats.DataBytes > 0)
+		}
+
+		jsonBuffer := new(bytes.Buffer)
+		assert.NoError(t, dump.WriteJSON(jsonBuffer))
+
+		var decoded map[string]interface{}
+		assert.NoError(t, json.Unmarshal(jsonBuffer.Bytes(), &decoded))
+		assert.EqualValues(t, "patch", decoded["kind"])
+		assert.EqualValues(t, len(dump.Messages), len(decoded["messages"].([]interface{})))
+
+		textBuffer := new(bytes.Buffer)
+		assert.NoError(t, dump.WriteText(textBuffer))
+		assert.True(t, strings.Contains(textBuffer.String(), "# wharf patch"))
+		assert.True(t, strings.Contains(textBuffer.String(), "io.itch.wharf.pwr.SyncHeader"))
+	}
+
+	// signatures
+	dump, err = inspector.Read(bytes.NewReader(signatureBuffer.Bytes()))
+	assert.NoError(t, err)
+	assert.EqualValues(t, KindSignature, dump.Kind)
+	numBlocks := int64(0)
+	for _, f := range sourceContainer.Files {
+		numBlocks += pwr.ComputeNumBlocks(f.Size)
+	}
+	assert.EqualValues(t, numBlocks, dump.NumHashes)
+	assert.EqualValues(t, 3, len(dump.Container.Files))
+
+	// wounds
+	woundsBuffer := new(bytes.Buffer)
+	ww := wire.NewWriteContext(woundsBuffer)
+	assert.NoError(t, ww.WriteMagic(pwr.WoundsMagic))
+	assert.NoError(t, ww.WriteMessage(&pwr.WoundsHeader{}))
+	assert.NoError(t, ww.WriteMessage(sourceContainer))
+	assert.NoError(t, ww.WriteMessage(&pwr.Wound{Index: 1, Start: 0, End: 12}))
+	assert.NoError(t, ww.WriteMessage(&pwr.Wound{Index: 2, Start: 100, End: 150}))
+
+	dump, err = inspector.Read(bytes.NewReader(woundsBuffer.Bytes()))
+	assert.NoError(t, err)
+	assert.EqualValues(t, KindWounds, dump.Kind)
+	assert.EqualValues(t, 2, dump.NumWounds)
+	assert.EqualValues(t, 62, dump.WoundedBytes)
+
+	_, err = inspector.Read(bytes.NewReader([]byte("definitely not a wharf file")))
+	assert.Error(t, err)
+}
@@ -0,0 +1,696 @@
+package pwr
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/go-errors/errors"
+	"github.com/itchio/wharf/state"
+)
+
+var (
+	// ErrInterruptedApply is returned by ApplyPatch when a journal from a previous
+	// in-place apply is found next to the output path. RecoverInPlace must be called
+	// before applying anything else.
+	ErrInterruptedApply = errors.New("a previous in-place apply was interrupted, it needs to be recovered first")
+
+	// errSimulatedCrash is returned when failures are injected in the journal, see
+	// ApplyContext.debugJournalFailAt - unlike other errors, it doesn't trigger a rollback
+	errSimulatedCrash = errors.New("simulated crash")
+)
+
+// JournalRecovery describes what RecoverInPlace did
+type JournalRecovery int
+
+const (
+	// JournalRecoveryNone means there was no interrupted apply to recover from
+	JournalRecoveryNone JournalRecovery = iota
+	// JournalRecoveryRolledBack means the interrupted apply was undone, the
+	// output path is back to the target build
+	JournalRecoveryRolledBack
+	// JournalRecoveryFinished means the interrupted apply had already committed,
+	// only cleanup was left: the output path contains the source build
+	JournalRecoveryFinished
+)
+
+type journalOp string
+
+const (
+	journalOpMove    journalOp = "move"
+	journalOpCopy    journalOp = "copy"
+	journalOpRemove  journalOp = "remove"
+	journalOpRmdir   journalOp = "rmdir"
+	journalOpMkdir   journalOp = "mkdir"
+	journalOpSymlink journalOp = "symlink"
+	journalOpChmod   journalOp = "chmod"
+	journalOpCommit  journalOp = "commit"
+)
+
+// A journalEntry is written before the change it describes is made, so the
+// change may or may not have happened: undoing it must work in both cases.
+type journalEntry struct {
+	Op     journalOp `json:"op"`
+	Path   string    `json:"path,omitempty"`
+	Source string    `json:"source,omitempty"`
+	// name of the file Path was moved to in the backup folder,
+	// empty if Path didn't exist before the change.
+	Backup string `json:"backup,omitempty"`
+	// permissions of Path before a chmod
+	Mode uint32 `json:"mode,omitempty"`
+}
+
+// A journal records every change made to an install during an in-place apply,
+// and keeps the files it replaces or deletes, until it's committed.
+type journal struct {
+	dir    string
+	file   *os.File
+	writer *bufio.Writer
+
+	numBackups int64
+
+	// directories whose entries changed, synced before committing
+	dirty map[string]bool
+
+	// for testing
+	brokenRename bool
+	failAt       int
+	steps        int
+}
+
+// JournalPath returns where the journal of an in-place apply to outputPath is kept
+func JournalPath(outputPath string) string {
+	return outputPath + "-journal"
+}
+
+func journalLogPath(dir string) string {
+	return filepath.Join(dir, "journal")
+}
+
+func journalBackupPath(dir string, backup string) string {
+	return filepath.Join(dir, "backup", backup)
+}
+
+func openJournal(outputPath string) (*journal, error) {
+	dir := JournalPath(outputPath)
+
+	_, err := os.Lstat(dir)
+	if err == nil {
+		return nil, errors.Wrap(ErrInterruptedApply, 1)
+	}
+
+	err = os.MkdirAll(filepath.Join(dir, "backup"), 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, 1)
+	}
+
+	file, err := os.Create(journalLogPath(dir))
+	if err != nil {
+		return nil, errors.Wrap(err, 1)
+	}
+
+	// the journal must still be there after a power loss
+	for _, d := range []string{dir, filepath.Dir(dir)} {
+		err = syncPath(d)
+		if err != nil {
+			file.Close()
+			return nil, errors.Wrap(err, 1)
+		}
+	}
+
+	j := &journal{
+		dir:    dir,
+		file:   file,
+		writer: bufio.NewWriter(file),
+		dirty:  make(map[string]bool),
+	}
+	return j, nil
+}
+
+// log appends an entry to the journal and makes sure it's on disk
+func (j *journal) log(entry *journalEntry) error {
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	_, err = j.writer.Write(append(buf, '\n'))
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	err = j.writer.Flush()
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	err = j.file.Sync()
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	return nil
+}
+
+// step is called between every change, so that tests can simulate
+// a crash at any point of the apply
+func (j *journal) step() error {
+	j.steps++
+	if j.failAt > 0 && j.steps == j.failAt {
+		return errSimulatedCrash
+	}
+	return nil
+}
+
+// touch records that the entries of the directories containing paths changed
+func (j *journal) touch(paths ...string) {
+	for _, path := range paths {
+		j.dirty[filepath.Dir(path)] = true
+	}
+}
+
+func (j *journal) nextBackup() string {
+	j.numBackups++
+	return fmt.Sprintf("%d", j.numBackups)
+}
+
+// backup logs entry, then moves its Path out of the way if it exists
+func (j *journal) backup(entry *journalEntry) error {
+	if exists(entry.Path) {
+		entry.Backup = j.nextBackup()
+	}
+
+	err := j.log(entry)
+	if err != nil {
+		return err
+	}
+
+	err = j.step()
+	if err != nil {
+		return err
+	}
+
+	if entry.Backup != "" {
+		backupPath := journalBackupPath(j.dir, entry.Backup)
+		err = os.Rename(entry.Path, backupPath)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+		j.touch(entry.Path, backupPath)
+
+		err = j.step()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (j *journal) move(oldAbsolutePath string, newAbsolutePath string) error {
+	err := j.mkdirAll(filepath.Dir(newAbsolutePath))
+	if err != nil {
+		return err
+	}
+
+	// once moved, nothing else will make sure the staged file was written
+	err = syncFile(oldAbsolutePath)
+	if err != nil {
+		return err
+	}
+
+	err = j.backup(&journalEntry{
+		Op:     journalOpMove,
+		Path:   newAbsolutePath,
+		Source: oldAbsolutePath,
+	})
+	if err != nil {
+		return err
+	}
+
+	if j.brokenRename {
+		err = &os.PathError{}
+	} else {
+		err = os.Rename(oldAbsolutePath, newAbsolutePath)
+	}
+	if err != nil {
+		cErr := copyFile(oldAbsolutePath, newAbsolutePath)
+		if cErr != nil {
+			return cErr
+		}
+
+		cErr = syncFile(newAbsolutePath)
+		if cErr != nil {
+			return cErr
+		}
+
+		cErr = os.Remove(oldAbsolutePath)
+		if cErr != nil {
+			return errors.Wrap(cErr, 1)
+		}
+	}
+	j.touch(oldAbsolutePath, newAbsolutePath)
+
+	return j.step()
+}
+
+func (j *journal) copy(oldAbsolutePath string, newAbsolutePath string) error {
+	err := j.mkdirAll(filepath.Dir(newAbsolutePath))
+	if err != nil {
+		return err
+	}
+
+	err = j.backup(&journalEntry{
+		Op:     journalOpCopy,
+		Path:   newAbsolutePath,
+		Source: oldAbsolutePath,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = copyFile(oldAbsolutePath, newAbsolutePath)
+	if err != nil {
+		return err
+	}
+
+	err = syncFile(newAbsolutePath)
+	if err != nil {
+		return err
+	}
+	j.touch(newAbsolutePath)
+
+	return j.step()
+}
+
+// remove deletes a file or symlink (by moving it to the backup folder). Like
+// os.Remove, it returns an error that satisfies os.IsNotExist if there was
+// nothing to remove.
+func (j *journal) remove(path string) error {
+	if !exists(path) {
+		return &os.PathError{Op: "remove", Path: path, Err: os.ErrNotExist}
+	}
+
+	err := j.backup(&journalEntry{
+		Op:   journalOpRemove,
+		Path: path,
+	})
+	if err != nil {
+		return err
+	}
+
+	return j.step()
+}
+
+// rmdir removes an empty directory, returning the same errors os.Remove would
+func (j *journal) rmdir(path string) error {
+	err := j.log(&journalEntry{
+		Op:   journalOpRmdir,
+		Path: path,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = j.step()
+	if err != nil {
+		return err
+	}
+
+	rmErr := os.Remove(path)
+	j.touch(path)
+
+	err = j.step()
+	if err != nil {
+		return err
+	}
+
+	return rmErr
+}
+
+// mkdirAll is like os.MkdirAll, but logs every directory it creates
+func (j *journal) mkdirAll(path string) error {
+	if exists(path) {
+		return nil
+	}
+
+	err := j.mkdirAll(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+
+	err = j.log(&journalEntry{
+		Op:   journalOpMkdir,
+		Path: path,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = os.Mkdir(path, 0755)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+	j.touch(path)
+
+	return j.step()
+}
+
+func (j *journal) symlink(dest string, path string) error {
+	err := j.mkdirAll(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+
+	err = j.backup(&journalEntry{
+		Op:     journalOpSymlink,
+		Path:   path,
+		Source: dest,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = os.Symlink(dest, path)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+	j.touch(path)
+
+	return j.step()
+}
+
+// chmod changes the permissions of path, logging the ones it had before
+func (j *journal) chmod(path string, mode os.FileMode) error {
+	stats, err := os.Stat(path)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	err = j.log(&journalEntry{
+		Op:   journalOpChmod,
+		Path: path,
+		Mode: uint32(stats.Mode().Perm()),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(path, mode)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	err = syncFile(path)
+	if err != nil {
+		return err
+	}
+
+	return j.step()
+}
+
+// commit marks the apply as done, then gets rid of the journal and backups.
+// Everything the apply changed is synced first: once the commit entry is on
+// disk, recovering means keeping the changes and dropping the backups.
+func (j *journal) commit() error {
+	err := j.step()
+	if err != nil {
+		return err
+	}
+
+	for dir := range j.dirty {
+		if !exists(dir) {
+			// removed later on
+			continue
+		}
+
+		err = syncPath(dir)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+	}
+
+	err = j.log(&journalEntry{
+		Op: journalOpCommit,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = j.step()
+	if err != nil {
+		return err
+	}
+
+	return j.cleanup()
+}
+
+// rollback undoes everything logged so far, then gets rid of the journal
+func (j *journal) rollback() error {
+	err := j.close()
+	if err != nil {
+		return err
+	}
+
+	_, err = recoverJournal(j.dir)
+	return err
+}
+
+func (j *journal) close() error {
+	if j.file == nil {
+		return nil
+	}
+
+	err := j.file.Close()
+	j.file = nil
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+	return nil
+}
+
+func (j *journal) cleanup() error {
+	err := j.close()
+	if err != nil {
+		return err
+	}
+
+	err = os.RemoveAll(j.dir)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+	return nil
+}
+
+// RecoverInPlace looks for the journal of an in-place apply to outputPath that was
+// interrupted (by a crash, or a power loss) and either rolls it back, if it didn't get
+// to commit, or finishes it. It also removes any leftover staging folder.
+func RecoverInPlace(outputPath string, consumer *state.Consumer) (JournalRecovery, error) {
+	dir := JournalPath(outputPath)
+
+	_, err := os.Lstat(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return JournalRecoveryNone, nil
+		}
+		return JournalRecoveryNone, errors.Wrap(err, 1)
+	}
+
+	recovery, err := recoverJournal(dir)
+	if err != nil {
+		return JournalRecoveryNone, err
+	}
+
+	switch recovery {
+	case JournalRecoveryRolledBack:
+		consumer.Infof("Rolled back interrupted apply to %s", outputPath)
+	case JournalRecoveryFinished:
+		consumer.Infof("Finished interrupted apply to %s", outputPath)
+	}
+
+	err = os.RemoveAll(outputPath + "-stage")
+	if err != nil {
+		return JournalRecoveryNone, errors.Wrap(err, 1)
+	}
+
+	return recovery, nil
+}
+
+func recoverJournal(dir string) (JournalRecovery, error) {
+	entries, err := readJournal(journalLogPath(dir))
+	if err != nil {
+		return JournalRecoveryNone, err
+	}
+
+	recovery := JournalRecoveryRolledBack
+	if len(entries) > 0 && entries[len(entries)-1].Op == journalOpCommit {
+		recovery = JournalRecoveryFinished
+	} else {
+		for i := len(entries) - 1; i >= 0; i-- {
+			err = undoJournalEntry(dir, entries[i])
+			if err != nil {
+				return JournalRecoveryNone, err
+			}
+		}
+	}
+
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return JournalRecoveryNone, errors.Wrap(err, 1)
+	}
+
+	return recovery, nil
+}
+
+func readJournal(logPath string) ([]*journalEntry, error) {
+	file, err := os.Open(logPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// crashed before anything was logged
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, 1)
+	}
+	defer file.Close()
+
+	var entries []*journalEntry
+	var lastErr error
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if lastErr != nil {
+			// only the last line may be incomplete
+			return nil, errors.Wrap(lastErr, 1)
+		}
+
+		entry := &journalEntry{}
+		lastErr = json.Unmarshal(scanner.Bytes(), entry)
+		if lastErr == nil {
+			entries = append(entries, entry)
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, errors.Wrap(err, 1)
+	}
+
+	return entries, nil
+}
+
+func undoJournalEntry(dir string, entry *journalEntry) error {
+	backupPath := ""
+	hasBackup := false
+	if entry.Backup != "" {
+		backupPath = journalBackupPath(dir, entry.Backup)
+		hasBackup = exists(backupPath)
+	}
+
+	// whatever is at Path was put there by us if Path didn't exist
+	// before, or if it's been moved to the backup folder.
+	ours := entry.Backup == "" || hasBackup
+
+	switch entry.Op {
+	case journalOpMove:
+		if !ours {
+			// interrupted before anything happened
+			break
+		}
+
+		if !exists(entry.Source) && exists(entry.Path) {
+			err := os.MkdirAll(filepath.Dir(entry.Source), 0755)
+			if err != nil {
+				return errors.Wrap(err, 1)
+			}
+
+			err = os.Rename(entry.Path, entry.Source)
+			if err != nil {
+				return errors.Wrap(err, 1)
+			}
+		} else {
+			// may have been interrupted while copying
+			err := removeIfExists(entry.Path)
+			if err != nil {
+				return err
+			}
+		}
+
+	case journalOpCopy, journalOpSymlink:
+		if ours {
+			err := removeIfExists(entry.Path)
+			if err != nil {
+				return err
+			}
+		}
+
+	case journalOpRemove:
+		// restored from backup below
+
+	case journalOpRmdir:
+		err := os.MkdirAll(entry.Path, 0755)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+
+	case journalOpMkdir:
+		// only removes it if it's empty, which it should
+		// be if everything logged after it was undone
+		os.Remove(entry.Path)
+
+	case journalOpChmod:
+		if exists(entry.Path) {
+			err := os.Chmod(entry.Path, os.FileMode(entry.Mode))
+			if err != nil {
+				return errors.Wrap(err, 1)
+			}
+		}
+
+	case journalOpCommit:
+		// nothing to undo
+
+	default:
+		return fmt.Errorf("unknown journal op: %s", entry.Op)
+	}
+
+	if hasBackup {
+		err := os.Rename(backupPath, entry.Path)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+	}
+
+	return nil
+}
+
+// syncFile makes sure the contents of path are on disk, if it's a regular file
+func syncFile(path string) error {
+	stats, err := os.Lstat(path)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	if !stats.Mode().IsRegular() {
+		return nil
+	}
+
+	err = syncPath(path)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+	return nil
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func removeIfExists(path string) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, 1)
+	}
+	return nil
+}
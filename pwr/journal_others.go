@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package pwr
+
+import "os"
+
+// syncPath makes sure a file's contents, or a directory's entries, are on disk
+func syncPath(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
@@ -0,0 +1,30 @@
+package pwr
+
+import "os"
+
+// syncPath makes sure a file's contents are on disk. Directories can't be
+// opened for syncing on windows, NTFS journals their entries on its own.
+func syncPath(path string) error {
+	stats, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if stats.IsDir() {
+		return nil
+	}
+
+	// FlushFileBuffers needs write access
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
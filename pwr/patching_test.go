@@ -31,12 +31,16 @@ type patchScenario struct {
 	deletedSymlinks       int
 	deletedDirs           int
 	leftDirs              int  // folders that couldn't be deleted during apply (because of non-container files in them)
+	changedModes          int  // files and folders that were chmod'd in-place
 	extraTests            bool // run in-place patching, etc.
 	testBrokenRename      bool // pretend os.Rename() doesn't work (it doesn't, sometimes, across partitions)
 	unchanged             bool // if true, before folder validates, so don't check that
 	ineffectiveCorruption bool // if true, before folder validates, so don't check that
 	testVet               bool // test that vetting rejections do reject
 	partitions            int
+	bsdiffWindowSize      int64 // bsdiff large files in windows during rediff
+	detectExecutables     bool  // use bsdiff filters for executables during rediff
+	rediffEngine          RediffEngine
 }
 
 const largeAmount int64 = 16
@@ -66,7 +70,7 @@ func Test_ChangeOne(t *testing.T) {
 				{path: "dir2/file-2", seed: 0x3},
 			},
 		},
-		healedBytes: BlockSize*17 + 14,
+		healedBytes: BlockSize * 11, // only the blocks built from the corrupted ones
 		extraTests:  true,
 		testVet:     true,
 	})
@@ -99,7 +103,7 @@ func Test_OneBecameShort(t *testing.T) {
 				}},
 			},
 		},
-		healedBytes: BlockSize + 17,
+		healedBytes: BlockSize, // only the first block, the rest is new data
 		extraTests:  true,
 	})
 }
@@ -133,7 +137,7 @@ func Test_EarlySmallWound(t *testing.T) {
 				}},
 			},
 		},
-		healedBytes: BlockSize * (16 + 16),
+		healedBytes: BlockSize * 15, // only the blocks built from the corrupted one
 		extraTests:  true,
 	})
 }
@@ -170,7 +174,7 @@ func Test_ChangeOneInMiddle(t *testing.T) {
 				}},
 			},
 		},
-		healedBytes: (BlockSize*12 + 1) + (BlockSize*12 + 3) + (BlockSize*12 + 4),
+		healedBytes: 8, // only the last (short) block
 		extraTests:  true,
 	})
 }
@@ -549,6 +553,33 @@ func Test_SymlinksRemovedByPatch(t *testing.T) {
 	}
 }
 
+func Test_ModeOnlyChanges(t *testing.T) {
+	runPatchingScenario(t, patchScenario{
+		name:         "mode-only changes",
+		movedFiles:   1,
+		deletedDirs:  1,
+		changedModes: 4,
+		v1: testDirSettings{
+			entries: []testDirEntry{
+				{path: "assets", dir: true, mode: 0755},
+				{path: "assets/data", seed: 0x1},
+				{path: "bin/game", seed: 0x2, mode: 0644},
+				{path: "bin/tool", seed: 0x3, mode: 0755},
+				{path: "lib/helper", seed: 0x4, mode: 0644},
+			},
+		},
+		v2: testDirSettings{
+			entries: []testDirEntry{
+				{path: "assets", dir: true, mode: 0700},
+				{path: "assets/data", seed: 0x1},
+				{path: "bin/game", seed: 0x2, mode: 0755},
+				{path: "bin/tool", seed: 0x3, mode: 0644},
+				{path: "lib2/helper", seed: 0x4, mode: 0755},
+			},
+		},
+	})
+}
+
 type SetupFunc func(actx *ApplyContext)
 
 func runPatchingScenario(t *testing.T, scenario patchScenario) {
@@ -589,6 +620,8 @@ func runPatchingScenario(t *testing.T, scenario patchScenario) {
 	patchBuffer := new(bytes.Buffer)
 	signatureBuffer := new(bytes.Buffer)
 
+	var v1Signature *SignatureInfo
+
 	func() {
 		targetContainer, dErr := tlc.WalkAny(v1, nil)
 		assert.NoError(t, dErr)
@@ -597,6 +630,11 @@ func runPatchingScenario(t *testing.T, scenario patchScenario) {
 		targetSignature, dErr := ComputeSignature(targetContainer, targetPool, consumer)
 		assert.NoError(t, dErr)
 
+		v1Signature = &SignatureInfo{
+			Container: targetContainer,
+			Hashes:    targetSignature,
+		}
+
 		pool := fspool.New(sourceContainer, v2)
 
 		dctx := &DiffContext{
@@ -752,12 +790,29 @@ func runPatchingScenario(t *testing.T, scenario patchScenario) {
 			}))
 
 			assert.NoError(t, AssertValid(v2, signature))
+			assert.NoError(t, AssertValid(v1Before, signature))
 
 			healer, ok := ctx.WoundsConsumer.(Healer)
 			assert.True(t, ok)
 
 			assert.EqualValues(t, healer.TotalHealed(), scenario.healedBytes)
 		}()
+
+		func() {
+			if scenario.ineffectiveCorruption {
+				return
+			}
+
+			log("In-place with signature (dir heal, corruptions)")
+
+			assert.NoError(t, runExtraTest(func(actx *ApplyContext) {
+				actx.Signature = signature
+				actx.HealPath = fmt.Sprintf("dir,%s", v2)
+				makeTestDir(t, v1Before, *scenario.corruptions)
+			}))
+
+			assert.NoError(t, AssertValid(v1Before, signature))
+		}()
 	}
 
 	log("Applying to other directory, with separate check")
@@ -821,11 +876,13 @@ func runPatchingScenario(t *testing.T, scenario patchScenario) {
 			assert.Equal(t, scenario.touchedFiles, actx.Stats.TouchedFiles, "touched files (in-place)")
 			assert.Equal(t, scenario.movedFiles, actx.Stats.MovedFiles, "moved files (in-place)")
 			assert.Equal(t, len(sourceContainer.Files)-scenario.touchedFiles-scenario.movedFiles, actx.Stats.NoopFiles, "noop files (in-place)")
+			assert.Equal(t, scenario.changedModes, actx.Stats.ChangedModes, "changed modes (in-place)")
 
 			signature, sErr := ReadSignature(bytes.NewReader(signatureBuffer.Bytes()))
 			assert.NoError(t, sErr)
 
 			assert.NoError(t, AssertValid(v1Before, signature))
+			assertSameTree(t, v2, v1Before)
 		}()
 
 		if scenario.intermediate != nil {
@@ -872,11 +929,111 @@ func runPatchingScenario(t *testing.T, scenario patchScenario) {
 
 	testAll(nil)
 
+	log("Applying in-place with a journal")
+	testAll(func(actx *ApplyContext) {
+		actx.Journal = true
+	})
+
 	if scenario.testBrokenRename {
 		testAll(func(actx *ApplyContext) {
 			actx.debugBrokenRename = true
 		})
+
+		testAll(func(actx *ApplyContext) {
+			actx.debugBrokenRename = true
+			actx.Journal = true
+		})
 	}
+
+	log("Applying in-place with a journal, crashing at every step")
+	signature, sErr := ReadSignature(bytes.NewReader(signatureBuffer.Bytes()))
+	assert.NoError(t, sErr)
+
+	numRolledBack := 0
+	numFinished := 0
+
+	for failAt := 1; ; failAt++ {
+		assert.NoError(t, os.RemoveAll(v1Before))
+		cpDir(t, v1, v1Before)
+
+		apply := func() error {
+			actx := &ApplyContext{
+				TargetPath: v1Before,
+				OutputPath: v1Before,
+
+				InPlace:            true,
+				Journal:            true,
+				debugJournalFailAt: failAt,
+
+				Consumer: consumer,
+			}
+			return actx.ApplyPatch(bytes.NewReader(patchBuffer.Bytes()))
+		}
+
+		aErr := apply()
+		if aErr == nil {
+			// got through all the steps
+			assert.NoError(t, AssertValid(v1Before, signature))
+			assertSameTree(t, v2, v1Before)
+			break
+		}
+		assert.True(t, errors.Is(aErr, errSimulatedCrash))
+
+		if failAt == 1 {
+			aErr = apply()
+			assert.True(t, errors.Is(aErr, ErrInterruptedApply))
+		}
+
+		recovery, rErr := RecoverInPlace(v1Before, consumer)
+		assert.NoError(t, rErr)
+
+		switch recovery {
+		case JournalRecoveryRolledBack:
+			numRolledBack++
+			assert.NoError(t, AssertValid(v1Before, v1Signature))
+			assertSameTree(t, v1, v1Before)
+		case JournalRecoveryFinished:
+			numFinished++
+			assert.NoError(t, AssertValid(v1Before, signature))
+			assertSameTree(t, v2, v1Before)
+		default:
+			t.Fatalf("unexpected recovery %d after failing at step %d", recovery, failAt)
+		}
+
+		for _, leftover := range []string{JournalPath(v1Before), v1Before + "-stage"} {
+			_, sErr := os.Lstat(leftover)
+			assert.True(t, os.IsNotExist(sErr))
+		}
+	}
+
+	assert.True(t, numRolledBack > 0)
+	assert.EqualValues(t, 1, numFinished)
+}
+
+// assertSameTree checks that two folders have the same files (with the same
+// size and permissions), directories, and symlinks
+func assertSameTree(t *testing.T, expected string, actual string) {
+	expectedContainer, err := tlc.WalkAny(expected, nil)
+	assert.NoError(t, err)
+
+	actualContainer, err := tlc.WalkAny(actual, nil)
+	assert.NoError(t, err)
+
+	describe := func(c *tlc.Container) []string {
+		var lines []string
+		for _, f := range c.Files {
+			lines = append(lines, fmt.Sprintf("file %s %d %o", f.Path, f.Size, f.Mode))
+		}
+		for _, d := range c.Dirs {
+			lines = append(lines, fmt.Sprintf("dir %s", d.Path))
+		}
+		for _, s := range c.Symlinks {
+			lines = append(lines, fmt.Sprintf("symlink %s -> %s", s.Path, s.Dest))
+		}
+		return lines
+	}
+
+	assert.EqualValues(t, describe(expectedContainer), describe(actualContainer))
 }
 
 type CookPatchOperator func(wctx *wire.WriteContext)
@@ -0,0 +1,184 @@
+package pwr
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/itchio/wharf/wsync"
+)
+
+// A ProtectionPolicy keeps an in-place apply from destroying files the user
+// cares about: configuration, mods, saves stored next to the game, etc.
+// Instead of being overwritten or deleted, conflicting files are moved to
+// BackupPath (keeping their relative path) and listed in ApplyStats.BackedUpFiles.
+type ProtectionPolicy struct {
+	// ProtectedGlobs are matched against slash-separated paths relative to the
+	// install, with path.Match. If a glob matches a directory, every file in
+	// it is protected. Protected files are always backed up before being
+	// overwritten or deleted.
+	ProtectedGlobs []string
+
+	// TargetSignature is the signature of the build currently installed. If set,
+	// files are only overwritten or deleted if their contents still match it:
+	// files the user modified, or added where the new build has a file, are
+	// backed up first.
+	TargetSignature *SignatureInfo
+
+	// BackupPath is where conflicting files are moved. Defaults to the output
+	// path with "-backup" appended.
+	BackupPath string
+
+	// internal
+	targetFiles map[string]*protectedFile
+}
+
+type protectedFile struct {
+	size      int64
+	hashGroup []wsync.BlockHash
+}
+
+func (pp *ProtectionPolicy) prepare(outputPath string) error {
+	for _, glob := range pp.ProtectedGlobs {
+		_, err := path.Match(glob, "")
+		if err != nil {
+			return errors.Wrap(fmt.Errorf("invalid protected glob '%s': %s", glob, err.Error()), 1)
+		}
+	}
+
+	if pp.BackupPath == "" {
+		pp.BackupPath = outputPath + "-backup"
+	}
+
+	pp.targetFiles = nil
+	if pp.TargetSignature != nil {
+		container := pp.TargetSignature.Container
+		hashGroups, err := makeHashGroups(container, pp.TargetSignature)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+
+		pp.targetFiles = make(map[string]*protectedFile)
+		for fileIndex, f := range container.Files {
+			pp.targetFiles[f.Path] = &protectedFile{
+				size:      f.Size,
+				hashGroup: hashGroups[int64(fileIndex)],
+			}
+		}
+	}
+
+	return nil
+}
+
+// IsProtected returns true if a slash-separated relative path, or one of
+// its parents, matches one of the protected globs
+func (pp *ProtectionPolicy) IsProtected(relPath string) bool {
+	for p := relPath; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		for _, glob := range pp.ProtectedGlobs {
+			matched, _ := path.Match(glob, p)
+			if matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isPristine returns true if the file at absolutePath matches the target signature
+func (pp *ProtectionPolicy) isPristine(relPath string, absolutePath string) (bool, error) {
+	pf := pp.targetFiles[relPath]
+	if pf == nil {
+		// not part of the installed build, must be the user's
+		return false, nil
+	}
+
+	reader, err := os.Open(absolutePath)
+	if err != nil {
+		return false, errors.Wrap(err, 1)
+	}
+	defer reader.Close()
+
+	stats, err := reader.Stat()
+	if err != nil {
+		return false, errors.Wrap(err, 1)
+	}
+
+	if stats.Size() != pf.size {
+		return false, nil
+	}
+
+	sctx := mksync()
+	buf := make([]byte, BlockSize)
+
+	for blockIndex, bh := range pf.hashGroup {
+		block := buf[:ComputeBlockSize(pf.size, int64(blockIndex))]
+
+		_, err = io.ReadFull(reader, block)
+		if err != nil {
+			return false, errors.Wrap(err, 1)
+		}
+
+		weakHash, strongHash := sctx.HashBlock(block)
+		if bh.WeakHash != weakHash || !bytes.Equal(bh.StrongHash, strongHash) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// protect is called before a file in the install is overwritten or deleted. If the
+// protection policy says it's a conflict, it's moved to the backup folder and protect
+// returns true.
+func (actx *ApplyContext) protect(absolutePath string) (bool, error) {
+	pp := actx.Protection
+	if pp == nil {
+		return false, nil
+	}
+
+	stats, err := os.Lstat(absolutePath)
+	if err != nil || !stats.Mode().IsRegular() {
+		// nothing to protect
+		return false, nil
+	}
+
+	relPath, err := filepath.Rel(actx.actualOutputPath, absolutePath)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		// not part of the install (staging folder, etc.)
+		return false, nil
+	}
+	relPath = filepath.ToSlash(relPath)
+
+	conflict := pp.IsProtected(relPath)
+	if !conflict && pp.targetFiles != nil {
+		pristine, err := pp.isPristine(relPath, absolutePath)
+		if err != nil {
+			return false, err
+		}
+		conflict = !pristine
+	}
+
+	if !conflict {
+		return false, nil
+	}
+
+	backupPath := filepath.Join(pp.BackupPath, filepath.FromSlash(relPath))
+	for i := 1; exists(backupPath); i++ {
+		// don't overwrite backups from previous applies
+		backupPath = filepath.Join(pp.BackupPath, filepath.FromSlash(fmt.Sprintf("%s.%d", relPath, i)))
+	}
+
+	actx.Consumer.Infof("Backing up %s to %s", relPath, backupPath)
+	err = actx.move(absolutePath, backupPath)
+	if err != nil {
+		return false, err
+	}
+
+	actx.Stats.BackedUpFiles = append(actx.Stats.BackedUpFiles, relPath)
+	return true, nil
+}
@@ -0,0 +1,190 @@
+package pwr
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"github.com/itchio/wharf/pools/fspool"
+	"github.com/itchio/wharf/state"
+	"github.com/itchio/wharf/tlc"
+)
+
+func Test_IsProtected(t *testing.T) {
+	pp := &ProtectionPolicy{
+		ProtectedGlobs: []string{"*.ini", "saves", "mods/*/config"},
+	}
+
+	assert.True(t, pp.IsProtected("settings.ini"))
+	assert.True(t, pp.IsProtected("saves/slot1"))
+	assert.True(t, pp.IsProtected("saves/auto/slot2"))
+	assert.True(t, pp.IsProtected("mods/foo/config"))
+	assert.True(t, pp.IsProtected("mods/foo/config/keys.txt"))
+
+	assert.False(t, pp.IsProtected("game.exe"))
+	assert.False(t, pp.IsProtected("data/settings.ini"))
+	assert.False(t, pp.IsProtected("savesx/slot1"))
+	assert.False(t, pp.IsProtected("mods/foo/data"))
+}
+
+func Test_ProtectionPolicy(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "protection")
+	assert.NoError(t, err)
+	defer os.RemoveAll(mainDir)
+
+	consumer := &state.Consumer{}
+
+	v1 := filepath.Join(mainDir, "v1")
+	makeTestDir(t, v1, testDirSettings{
+		entries: []testDirEntry{
+			{path: "game.bin", seed: 0x1},
+			{path: "data.bin", seed: 0x2},
+			{path: "config.ini", seed: 0x3},
+			{path: "old.dat", seed: 0x4},
+			{path: "gone.dat", seed: 0x5},
+			{path: "saves/slot1", seed: 0x6},
+		},
+	})
+
+	v2 := filepath.Join(mainDir, "v2")
+	makeTestDir(t, v2, testDirSettings{
+		entries: []testDirEntry{
+			{path: "game.bin", seed: 0x11},
+			{path: "data.bin", seed: 0x12},
+			{path: "config.ini", seed: 0x13},
+			{path: "saves/slot1", seed: 0x6},
+			{path: "new.txt", seed: 0x17},
+		},
+	})
+
+	// what the player did to their install
+	userChanges := testDirSettings{
+		entries: []testDirEntry{
+			{path: "data.bin", seed: 0x22},
+			{path: "old.dat", seed: 0x24},
+			{path: "new.txt", seed: 0x27},
+		},
+	}
+
+	targetContainer, err := tlc.WalkAny(v1, nil)
+	assert.NoError(t, err)
+	targetHashes, err := ComputeSignature(targetContainer, fspool.New(targetContainer, v1), consumer)
+	assert.NoError(t, err)
+	targetSignature := &SignatureInfo{
+		Container: targetContainer,
+		Hashes:    targetHashes,
+	}
+
+	sourceContainer, err := tlc.WalkAny(v2, nil)
+	assert.NoError(t, err)
+
+	patchBuffer := new(bytes.Buffer)
+	signatureBuffer := new(bytes.Buffer)
+	dctx := &DiffContext{
+		Compression: &CompressionSettings{Algorithm: CompressionAlgorithm_NONE},
+		Consumer:    consumer,
+
+		SourceContainer: sourceContainer,
+		Pool:            fspool.New(sourceContainer, v2),
+
+		TargetContainer: targetContainer,
+		TargetSignature: targetHashes,
+	}
+	assert.NoError(t, dctx.WritePatch(patchBuffer, signatureBuffer))
+
+	signature, err := ReadSignature(bytes.NewReader(signatureBuffer.Bytes()))
+	assert.NoError(t, err)
+
+	readFile := func(path string) []byte {
+		contents, rErr := ioutil.ReadFile(path)
+		assert.NoError(t, rErr)
+		return contents
+	}
+
+	for _, journal := range []bool{false, true} {
+		t.Logf("Applying with protection (journal = %v)", journal)
+
+		install := filepath.Join(mainDir, "install")
+		backup := filepath.Join(mainDir, "backup")
+		user := filepath.Join(mainDir, "user")
+		for _, dir := range []string{install, backup, user} {
+			assert.NoError(t, os.RemoveAll(dir))
+		}
+
+		cpDir(t, v1, install)
+		makeTestDir(t, install, userChanges)
+		cpDir(t, install, user)
+
+		expectedBackups := map[string]string{
+			"config.ini": "config.ini",
+			"data.bin":   "data.bin",
+			"new.txt":    "new.txt",
+			"old.dat":    "old.dat",
+		}
+
+		if journal {
+			// leftovers from a previous apply must not be overwritten
+			makeTestDir(t, backup, testDirSettings{
+				entries: []testDirEntry{
+					{path: "config.ini", seed: 0x33},
+				},
+			})
+			expectedBackups["config.ini"] = "config.ini.1"
+		}
+
+		actx := &ApplyContext{
+			TargetPath: install,
+			OutputPath: install,
+			InPlace:    true,
+			Journal:    journal,
+			Consumer:   consumer,
+
+			Protection: &ProtectionPolicy{
+				ProtectedGlobs:  []string{"*.ini", "saves"},
+				TargetSignature: targetSignature,
+				BackupPath:      backup,
+			},
+		}
+		assert.NoError(t, actx.ApplyPatch(bytes.NewReader(patchBuffer.Bytes())))
+
+		assert.NoError(t, AssertValid(install, signature))
+
+		backedUp := actx.Stats.BackedUpFiles
+		sort.Strings(backedUp)
+		assert.EqualValues(t, []string{"config.ini", "data.bin", "new.txt", "old.dat"}, backedUp)
+
+		for userPath, backupPath := range expectedBackups {
+			assert.EqualValues(t,
+				readFile(filepath.Join(user, userPath)),
+				readFile(filepath.Join(backup, backupPath)),
+				"backup of %s", userPath)
+		}
+
+		// unmodified ghosts are still deleted
+		assert.EqualValues(t, 1, actx.Stats.DeletedFiles)
+		_, err = os.Lstat(filepath.Join(install, "gone.dat"))
+		assert.True(t, os.IsNotExist(err))
+		_, err = os.Lstat(filepath.Join(install, "old.dat"))
+		assert.True(t, os.IsNotExist(err))
+
+		// protected, but not touched by the patch
+		assert.EqualValues(t, readFile(filepath.Join(user, "saves", "slot1")), readFile(filepath.Join(install, "saves", "slot1")))
+	}
+
+	t.Logf("Applying with an invalid glob")
+	actx := &ApplyContext{
+		TargetPath: v1,
+		OutputPath: v1,
+		InPlace:    true,
+		Consumer:   consumer,
+
+		Protection: &ProtectionPolicy{
+			ProtectedGlobs: []string{"[oops"},
+		},
+	}
+	assert.Error(t, actx.ApplyPatch(bytes.NewReader(patchBuffer.Bytes())))
+}
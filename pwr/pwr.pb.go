@@ -12,6 +12,7 @@ It has these top-level messages:
 	PatchHeader
 	SyncHeader
 	BsdiffHeader
+	ZstdHeader
 	SyncOp
 	SignatureHeader
 	BlockHash
@@ -117,15 +118,25 @@ const (
 	SyncHeader_RSYNC SyncHeader_Type = 0
 	// when set, bsdiffTargetIndex must be set
 	SyncHeader_BSDIFF SyncHeader_Type = 1
+	// when set, a ZstdHeader follows, then a zstd frame in DATA ops
+	SyncHeader_ZSTD SyncHeader_Type = 2
+	// same as BSDIFF, but the BsdiffHeader's filter must be applied. It's
+	// a separate type so that versions that don't know about filters reject
+	// the patch, instead of applying it without the filter.
+	SyncHeader_BSDIFF_FILTERED SyncHeader_Type = 3
 )
 
 var SyncHeader_Type_name = map[int32]string{
 	0: "RSYNC",
 	1: "BSDIFF",
+	2: "ZSTD",
+	3: "BSDIFF_FILTERED",
 }
 var SyncHeader_Type_value = map[string]int32{
-	"RSYNC":  0,
-	"BSDIFF": 1,
+	"RSYNC":           0,
+	"BSDIFF":          1,
+	"ZSTD":            2,
+	"BSDIFF_FILTERED": 3,
 }
 
 func (x SyncHeader_Type) String() string {
@@ -133,6 +144,31 @@ func (x SyncHeader_Type) String() string {
 }
 func (SyncHeader_Type) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{1, 0} }
 
+// see bsdiff.Filter
+type BsdiffHeader_Filter int32
+
+const (
+	BsdiffHeader_NONE  BsdiffHeader_Filter = 0
+	BsdiffHeader_X86   BsdiffHeader_Filter = 1
+	BsdiffHeader_ARM64 BsdiffHeader_Filter = 2
+)
+
+var BsdiffHeader_Filter_name = map[int32]string{
+	0: "NONE",
+	1: "X86",
+	2: "ARM64",
+}
+var BsdiffHeader_Filter_value = map[string]int32{
+	"NONE":  0,
+	"X86":   1,
+	"ARM64": 2,
+}
+
+func (x BsdiffHeader_Filter) String() string {
+	return proto.EnumName(BsdiffHeader_Filter_name, int32(x))
+}
+func (BsdiffHeader_Filter) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{2, 0} }
+
 type SyncOp_Type int32
 
 const (
@@ -155,7 +191,7 @@ var SyncOp_Type_value = map[string]int32{
 func (x SyncOp_Type) String() string {
 	return proto.EnumName(SyncOp_Type_name, int32(x))
 }
-func (SyncOp_Type) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{3, 0} }
+func (SyncOp_Type) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{4, 0} }
 
 type PatchHeader struct {
 	Compression *CompressionSettings `protobuf:"bytes,1,opt,name=compression" json:"compression,omitempty"`
@@ -199,6 +235,8 @@ func (m *SyncHeader) GetFileIndex() int64 {
 
 type BsdiffHeader struct {
 	TargetIndex int64 `protobuf:"varint,1,opt,name=targetIndex" json:"targetIndex,omitempty"`
+	// only set for BSDIFF_FILTERED, the patch must be applied with the same filter
+	Filter BsdiffHeader_Filter `protobuf:"varint,2,opt,name=filter,enum=io.itch.wharf.pwr.BsdiffHeader_Filter" json:"filter,omitempty"`
 }
 
 func (m *BsdiffHeader) Reset()                    { *m = BsdiffHeader{} }
@@ -213,6 +251,30 @@ func (m *BsdiffHeader) GetTargetIndex() int64 {
 	return 0
 }
 
+func (m *BsdiffHeader) GetFilter() BsdiffHeader_Filter {
+	if m != nil {
+		return m.Filter
+	}
+	return BsdiffHeader_NONE
+}
+
+type ZstdHeader struct {
+	// the target file is used as a dictionary
+	TargetIndex int64 `protobuf:"varint,1,opt,name=targetIndex" json:"targetIndex,omitempty"`
+}
+
+func (m *ZstdHeader) Reset()                    { *m = ZstdHeader{} }
+func (m *ZstdHeader) String() string            { return proto.CompactTextString(m) }
+func (*ZstdHeader) ProtoMessage()               {}
+func (*ZstdHeader) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
+func (m *ZstdHeader) GetTargetIndex() int64 {
+	if m != nil {
+		return m.TargetIndex
+	}
+	return 0
+}
+
 type SyncOp struct {
 	Type       SyncOp_Type `protobuf:"varint,1,opt,name=type,enum=io.itch.wharf.pwr.SyncOp_Type" json:"type,omitempty"`
 	FileIndex  int64       `protobuf:"varint,2,opt,name=fileIndex" json:"fileIndex,omitempty"`
@@ -224,7 +286,7 @@ type SyncOp struct {
 func (m *SyncOp) Reset()                    { *m = SyncOp{} }
 func (m *SyncOp) String() string            { return proto.CompactTextString(m) }
 func (*SyncOp) ProtoMessage()               {}
-func (*SyncOp) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+func (*SyncOp) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
 
 func (m *SyncOp) GetType() SyncOp_Type {
 	if m != nil {
@@ -268,7 +330,7 @@ type SignatureHeader struct {
 func (m *SignatureHeader) Reset()                    { *m = SignatureHeader{} }
 func (m *SignatureHeader) String() string            { return proto.CompactTextString(m) }
 func (*SignatureHeader) ProtoMessage()               {}
-func (*SignatureHeader) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+func (*SignatureHeader) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
 
 func (m *SignatureHeader) GetCompression() *CompressionSettings {
 	if m != nil {
@@ -285,7 +347,7 @@ type BlockHash struct {
 func (m *BlockHash) Reset()                    { *m = BlockHash{} }
 func (m *BlockHash) String() string            { return proto.CompactTextString(m) }
 func (*BlockHash) ProtoMessage()               {}
-func (*BlockHash) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
+func (*BlockHash) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
 
 func (m *BlockHash) GetWeakHash() uint32 {
 	if m != nil {
@@ -309,7 +371,7 @@ type CompressionSettings struct {
 func (m *CompressionSettings) Reset()                    { *m = CompressionSettings{} }
 func (m *CompressionSettings) String() string            { return proto.CompactTextString(m) }
 func (*CompressionSettings) ProtoMessage()               {}
-func (*CompressionSettings) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
+func (*CompressionSettings) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
 
 func (m *CompressionSettings) GetAlgorithm() CompressionAlgorithm {
 	if m != nil {
@@ -333,7 +395,7 @@ type ManifestHeader struct {
 func (m *ManifestHeader) Reset()                    { *m = ManifestHeader{} }
 func (m *ManifestHeader) String() string            { return proto.CompactTextString(m) }
 func (*ManifestHeader) ProtoMessage()               {}
-func (*ManifestHeader) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
+func (*ManifestHeader) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{8} }
 
 func (m *ManifestHeader) GetCompression() *CompressionSettings {
 	if m != nil {
@@ -356,7 +418,7 @@ type ManifestBlockHash struct {
 func (m *ManifestBlockHash) Reset()                    { *m = ManifestBlockHash{} }
 func (m *ManifestBlockHash) String() string            { return proto.CompactTextString(m) }
 func (*ManifestBlockHash) ProtoMessage()               {}
-func (*ManifestBlockHash) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{8} }
+func (*ManifestBlockHash) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{9} }
 
 func (m *ManifestBlockHash) GetHash() []byte {
 	if m != nil {
@@ -373,7 +435,7 @@ type WoundsHeader struct {
 func (m *WoundsHeader) Reset()                    { *m = WoundsHeader{} }
 func (m *WoundsHeader) String() string            { return proto.CompactTextString(m) }
 func (*WoundsHeader) ProtoMessage()               {}
-func (*WoundsHeader) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{9} }
+func (*WoundsHeader) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{10} }
 
 // Describe a corrupted portion of a file, in [start,end)
 type Wound struct {
@@ -386,7 +448,7 @@ type Wound struct {
 func (m *Wound) Reset()                    { *m = Wound{} }
 func (m *Wound) String() string            { return proto.CompactTextString(m) }
 func (*Wound) ProtoMessage()               {}
-func (*Wound) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{10} }
+func (*Wound) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{11} }
 
 func (m *Wound) GetIndex() int64 {
 	if m != nil {
@@ -420,6 +482,7 @@ func init() {
 	proto.RegisterType((*PatchHeader)(nil), "io.itch.wharf.pwr.PatchHeader")
 	proto.RegisterType((*SyncHeader)(nil), "io.itch.wharf.pwr.SyncHeader")
 	proto.RegisterType((*BsdiffHeader)(nil), "io.itch.wharf.pwr.BsdiffHeader")
+	proto.RegisterType((*ZstdHeader)(nil), "io.itch.wharf.pwr.ZstdHeader")
 	proto.RegisterType((*SyncOp)(nil), "io.itch.wharf.pwr.SyncOp")
 	proto.RegisterType((*SignatureHeader)(nil), "io.itch.wharf.pwr.SignatureHeader")
 	proto.RegisterType((*BlockHash)(nil), "io.itch.wharf.pwr.BlockHash")
@@ -432,52 +495,57 @@ func init() {
 	proto.RegisterEnum("io.itch.wharf.pwr.HashAlgorithm", HashAlgorithm_name, HashAlgorithm_value)
 	proto.RegisterEnum("io.itch.wharf.pwr.WoundKind", WoundKind_name, WoundKind_value)
 	proto.RegisterEnum("io.itch.wharf.pwr.SyncHeader_Type", SyncHeader_Type_name, SyncHeader_Type_value)
+	proto.RegisterEnum("io.itch.wharf.pwr.BsdiffHeader_Filter", BsdiffHeader_Filter_name, BsdiffHeader_Filter_value)
 	proto.RegisterEnum("io.itch.wharf.pwr.SyncOp_Type", SyncOp_Type_name, SyncOp_Type_value)
 }
 
 func init() { proto.RegisterFile("pwr/pwr.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 644 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xac, 0x54, 0x41, 0x53, 0xda, 0x40,
-	0x14, 0x36, 0x24, 0xa8, 0x3c, 0x10, 0xd7, 0xd5, 0x03, 0xd3, 0xb1, 0x0e, 0x93, 0x43, 0x75, 0x3c,
-	0xa4, 0x16, 0x67, 0x9c, 0x1e, 0x3a, 0x9d, 0x02, 0x41, 0xc9, 0x80, 0xc4, 0x49, 0xe8, 0x38, 0xd8,
-	0x03, 0xb3, 0x92, 0x00, 0x3b, 0x62, 0x92, 0x6e, 0xd6, 0xa6, 0x1c, 0xfd, 0x1b, 0xfd, 0x7d, 0xfd,
-	0x21, 0x9d, 0x5d, 0x82, 0x60, 0x8b, 0x3d, 0x79, 0x7b, 0xef, 0xed, 0xf7, 0x7d, 0xef, 0xdb, 0xb7,
-	0x2f, 0x81, 0xad, 0x28, 0x61, 0xef, 0xa3, 0x84, 0x19, 0x11, 0x0b, 0x79, 0x88, 0x77, 0x68, 0x68,
-	0x50, 0x3e, 0x18, 0x1b, 0xc9, 0x98, 0xb0, 0xa1, 0x11, 0x25, 0x4c, 0xbf, 0x86, 0xfc, 0x15, 0xe1,
-	0x83, 0x71, 0xd3, 0x27, 0x9e, 0xcf, 0x70, 0x13, 0xf2, 0x83, 0xf0, 0x3e, 0x62, 0x7e, 0x1c, 0xd3,
-	0x30, 0x28, 0x29, 0x65, 0xe5, 0x28, 0x5f, 0x79, 0x67, 0xfc, 0xc3, 0x33, 0xea, 0x0b, 0x94, 0xeb,
-	0x73, 0x4e, 0x83, 0x51, 0xec, 0x2c, 0x53, 0xf5, 0x47, 0x05, 0xc0, 0x9d, 0x06, 0x83, 0x54, 0xf8,
-	0x0c, 0x34, 0x3e, 0x8d, 0x7c, 0xa9, 0x58, 0xac, 0xe8, 0x2b, 0x14, 0x17, 0x60, 0xa3, 0x3b, 0x8d,
-	0x7c, 0x47, 0xe2, 0xf1, 0x3e, 0xe4, 0x86, 0x74, 0xe2, 0x5b, 0x81, 0xe7, 0xff, 0x2c, 0xa1, 0xb2,
-	0x72, 0xa4, 0x3a, 0x8b, 0x82, 0xfe, 0x16, 0x34, 0x81, 0xc5, 0x39, 0xc8, 0x3a, 0x6e, 0xaf, 0x53,
-	0x47, 0x6b, 0x18, 0x60, 0xbd, 0xe6, 0x9a, 0xd6, 0xf9, 0x39, 0x52, 0xf4, 0x13, 0x28, 0xd4, 0x62,
-	0x8f, 0x0e, 0x87, 0xa9, 0x89, 0x32, 0xe4, 0x39, 0x61, 0x23, 0x9f, 0xcf, 0xe4, 0x14, 0x29, 0xb7,
-	0x5c, 0xd2, 0x7f, 0x2b, 0xb0, 0x2e, 0x8c, 0xd8, 0x11, 0xae, 0x3c, 0x73, 0x7c, 0xf0, 0x82, 0x63,
-	0x3b, 0x7a, 0xd1, 0x6d, 0xe6, 0x2f, 0xb7, 0xf8, 0x00, 0xe0, 0x76, 0x12, 0x0e, 0xee, 0x66, 0xc7,
-	0xaa, 0x3c, 0x5e, 0xaa, 0x08, 0xb6, 0xcc, 0xdc, 0x88, 0x04, 0x25, 0x6d, 0xc6, 0x7e, 0x2a, 0x60,
-	0x0c, 0x9a, 0x47, 0x38, 0x29, 0x65, 0xcb, 0xca, 0x51, 0xc1, 0x91, 0xb1, 0x7e, 0x96, 0xde, 0x7f,
-	0x1b, 0xf2, 0xb5, 0xb6, 0x5d, 0x6f, 0xf5, 0x9d, 0x6a, 0xe7, 0xa2, 0x81, 0xd6, 0xf0, 0x26, 0x68,
-	0x66, 0xb5, 0x5b, 0x45, 0x0a, 0xde, 0x85, 0x62, 0xb3, 0xd1, 0xeb, 0xf7, 0xec, 0xaf, 0x7d, 0xd3,
-	0x32, 0xfb, 0x56, 0x17, 0x3d, 0x22, 0xfd, 0x1b, 0x6c, 0xbb, 0x74, 0x14, 0x10, 0xfe, 0xc0, 0xfc,
-	0x57, 0x7f, 0xf9, 0x0b, 0xc8, 0xd5, 0x84, 0xeb, 0x26, 0x89, 0xc7, 0xf8, 0x0d, 0x6c, 0x26, 0x3e,
-	0x91, 0xb1, 0xd4, 0xdc, 0x72, 0x9e, 0x72, 0x31, 0x8f, 0x98, 0xb3, 0x30, 0x18, 0xc9, 0xd3, 0x8c,
-	0xbc, 0xd7, 0x52, 0x45, 0xff, 0x01, 0xbb, 0x2b, 0x9a, 0xe1, 0x06, 0xe4, 0xc8, 0x64, 0x14, 0x32,
-	0xca, 0xc7, 0xf7, 0xe9, 0xeb, 0x1c, 0xfe, 0xdf, 0x67, 0x75, 0x0e, 0x77, 0x16, 0x4c, 0x5c, 0x82,
-	0x8d, 0xef, 0x0f, 0x64, 0x42, 0xf9, 0x54, 0xb6, 0xce, 0x3a, 0xf3, 0x54, 0xff, 0xa5, 0x40, 0xf1,
-	0x92, 0x04, 0x74, 0xe8, 0xc7, 0xfc, 0xb5, 0xa7, 0x83, 0x3f, 0x2f, 0xbb, 0xcf, 0x48, 0xf7, 0xe5,
-	0x15, 0x3a, 0x62, 0x00, 0xab, 0x6c, 0xeb, 0x87, 0xb0, 0x33, 0xf7, 0xb6, 0x98, 0x32, 0x06, 0x6d,
-	0x3c, 0x9f, 0x70, 0xc1, 0x91, 0xb1, 0x5e, 0x84, 0xc2, 0x75, 0xf8, 0x10, 0x78, 0xf1, 0xec, 0x0a,
-	0x7a, 0x02, 0x59, 0x99, 0xe3, 0x3d, 0xc8, 0xd2, 0xa5, 0xfd, 0x9f, 0x25, 0xa2, 0x1a, 0x73, 0xc2,
-	0x78, 0xba, 0xb6, 0xb3, 0x04, 0x23, 0x50, 0xfd, 0xc0, 0x4b, 0x77, 0x55, 0x84, 0xf8, 0x04, 0xb4,
-	0x3b, 0x1a, 0x78, 0x72, 0x3f, 0x8b, 0x95, 0xfd, 0x15, 0xd6, 0x65, 0x97, 0x16, 0x0d, 0x3c, 0x47,
-	0x22, 0x8f, 0xbf, 0xc0, 0xde, 0xaa, 0xb7, 0x10, 0x3b, 0xda, 0xb1, 0x3b, 0x8d, 0xf4, 0x9b, 0x75,
-	0xec, 0x6e, 0xdb, 0x42, 0x8a, 0xa8, 0x5e, 0xdc, 0x58, 0x57, 0x28, 0x23, 0xa2, 0x1b, 0xb7, 0x6b,
-	0x22, 0xf5, 0xb8, 0x0c, 0x5b, 0xcf, 0xe6, 0x21, 0xf6, 0xdd, 0x6d, 0x56, 0x5b, 0x8d, 0x0f, 0x95,
-	0x8f, 0xfd, 0xd3, 0x0a, 0x5a, 0x3b, 0xfe, 0x04, 0xb9, 0xa7, 0xb6, 0x82, 0x78, 0x6e, 0xb5, 0x85,
-	0x70, 0x1e, 0x36, 0xdc, 0xde, 0x65, 0xdb, 0xea, 0xb4, 0x90, 0x82, 0x37, 0x40, 0x35, 0x2d, 0x07,
-	0x65, 0x04, 0xbb, 0xde, 0xb6, 0xdd, 0x86, 0xd9, 0x97, 0x30, 0xb5, 0x96, 0xbd, 0x51, 0xa3, 0x84,
-	0xdd, 0xae, 0xcb, 0xbf, 0xe4, 0xe9, 0x9f, 0x00, 0x00, 0x00, 0xff, 0xff, 0x6d, 0x1f, 0x29, 0x01,
-	0x36, 0x05, 0x00, 0x00,
+	// 719 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x54, 0x4d, 0x6f, 0xe2, 0x48,
+	0x10, 0x8d, 0xb1, 0x21, 0xa1, 0x20, 0xa4, 0xd3, 0xc9, 0x01, 0xad, 0xa2, 0x08, 0xf5, 0x21, 0x89,
+	0x72, 0xf0, 0xee, 0x92, 0x15, 0xca, 0x21, 0x8a, 0x16, 0x30, 0x04, 0x0b, 0x02, 0x51, 0x9b, 0x55,
+	0x16, 0xe6, 0x80, 0x1c, 0x6c, 0xc0, 0x0a, 0xb1, 0x3d, 0x76, 0x67, 0x18, 0x8e, 0xf3, 0x2f, 0x46,
+	0x73, 0x9a, 0x1f, 0x37, 0x3f, 0x64, 0xd4, 0x6d, 0x3e, 0x9c, 0x19, 0x32, 0x9a, 0x43, 0x6e, 0x5d,
+	0xe5, 0xf7, 0xaa, 0x5e, 0xbf, 0x2e, 0x17, 0xec, 0xfa, 0xb3, 0xe0, 0x4f, 0x7f, 0x16, 0xa8, 0x7e,
+	0xe0, 0x31, 0x0f, 0xef, 0x3b, 0x9e, 0xea, 0xb0, 0xe1, 0x44, 0x9d, 0x4d, 0xcc, 0x60, 0xa4, 0xfa,
+	0xb3, 0x80, 0xdc, 0x43, 0xe6, 0xce, 0x64, 0xc3, 0x49, 0xc3, 0x36, 0x2d, 0x3b, 0xc0, 0x0d, 0xc8,
+	0x0c, 0xbd, 0x27, 0x3f, 0xb0, 0xc3, 0xd0, 0xf1, 0xdc, 0xbc, 0x54, 0x90, 0xce, 0x32, 0xc5, 0x13,
+	0xf5, 0x27, 0x9e, 0x5a, 0x5d, 0xa3, 0x0c, 0x9b, 0x31, 0xc7, 0x1d, 0x87, 0x34, 0x4e, 0x25, 0x5f,
+	0x25, 0x00, 0x63, 0xee, 0x0e, 0x17, 0x85, 0x4b, 0xa0, 0xb0, 0xb9, 0x6f, 0x8b, 0x8a, 0xb9, 0x22,
+	0xd9, 0x50, 0x71, 0x0d, 0x56, 0xbb, 0x73, 0xdf, 0xa6, 0x02, 0x8f, 0x8f, 0x20, 0x3d, 0x72, 0xa6,
+	0xb6, 0xee, 0x5a, 0xf6, 0xc7, 0x3c, 0x2a, 0x48, 0x67, 0x32, 0x5d, 0x27, 0xc8, 0x15, 0x28, 0x1c,
+	0x8b, 0xd3, 0x90, 0xa4, 0x46, 0xaf, 0x5d, 0x45, 0x5b, 0x18, 0x20, 0x55, 0x31, 0x34, 0xbd, 0x5e,
+	0x47, 0x12, 0xde, 0x01, 0xa5, 0x6f, 0x74, 0x35, 0x94, 0xc0, 0x07, 0xb0, 0x17, 0x65, 0x07, 0x75,
+	0xbd, 0xd5, 0xad, 0xd1, 0x9a, 0x86, 0x64, 0xf2, 0x59, 0x82, 0x6c, 0x25, 0xb4, 0x9c, 0xd1, 0x68,
+	0x21, 0xb2, 0x00, 0x19, 0x66, 0x06, 0x63, 0x9b, 0x45, 0xed, 0x24, 0xd1, 0x2e, 0x9e, 0xc2, 0xd7,
+	0x90, 0x1a, 0x39, 0x53, 0x66, 0x07, 0xf9, 0x84, 0xb8, 0xc8, 0x26, 0x6b, 0xe2, 0x25, 0xd5, 0xba,
+	0x40, 0xd3, 0x05, 0x8b, 0x9c, 0x40, 0x2a, 0xca, 0x70, 0x6d, 0xed, 0x4e, 0xbb, 0x86, 0xb6, 0xf0,
+	0x36, 0xc8, 0xff, 0x5f, 0x96, 0x90, 0xc4, 0x6f, 0x51, 0xa6, 0xb7, 0xa5, 0x7f, 0x50, 0x82, 0xa8,
+	0x00, 0xfd, 0x90, 0x59, 0xbf, 0xab, 0x8b, 0x7c, 0x93, 0x20, 0xc5, 0x0d, 0xec, 0xf8, 0xb8, 0xf8,
+	0xc2, 0xe9, 0xe3, 0x57, 0x9c, 0xee, 0xf8, 0xaf, 0xba, 0x9c, 0xf8, 0xc1, 0x65, 0x7c, 0x0c, 0xf0,
+	0x30, 0xf5, 0x86, 0x8f, 0xd1, 0x67, 0x59, 0x7c, 0x8e, 0x65, 0x38, 0x5b, 0x44, 0x86, 0x6f, 0xba,
+	0x79, 0x25, 0x62, 0xaf, 0x12, 0x18, 0x83, 0x62, 0x99, 0xcc, 0xcc, 0x27, 0x0b, 0xd2, 0x59, 0x96,
+	0x8a, 0x33, 0x29, 0x2d, 0xde, 0x6d, 0x0f, 0x32, 0x95, 0x56, 0xa7, 0xda, 0x1c, 0xd0, 0x72, 0xfb,
+	0x86, 0x7b, 0xb1, 0x03, 0x8a, 0x56, 0xee, 0x96, 0x91, 0x84, 0x0f, 0x20, 0xd7, 0xa8, 0xf5, 0x06,
+	0xbd, 0xce, 0x7f, 0x03, 0x4d, 0xd7, 0x06, 0x7a, 0x17, 0x7d, 0x42, 0xe4, 0x1d, 0xec, 0x19, 0xce,
+	0xd8, 0x35, 0xd9, 0x73, 0x60, 0xbf, 0xf9, 0xc4, 0xde, 0x40, 0xba, 0xc2, 0x55, 0x37, 0xcc, 0x70,
+	0x82, 0xff, 0x80, 0x9d, 0x99, 0x6d, 0x8a, 0xb3, 0xa8, 0xb9, 0x4b, 0x57, 0x31, 0xf7, 0x23, 0x64,
+	0x81, 0xe7, 0x8e, 0xc5, 0xd7, 0x84, 0xb8, 0x57, 0x2c, 0x43, 0x3e, 0xc0, 0xc1, 0x86, 0x66, 0xb8,
+	0x06, 0x69, 0x73, 0x3a, 0xf6, 0x02, 0x87, 0x4d, 0x9e, 0x16, 0xaf, 0x73, 0xfa, 0x6b, 0x9d, 0xe5,
+	0x25, 0x9c, 0xae, 0x99, 0x38, 0x0f, 0xdb, 0xef, 0x9f, 0xcd, 0xa9, 0xc3, 0xe6, 0xa2, 0x75, 0x92,
+	0x2e, 0x43, 0xf2, 0x45, 0x82, 0xdc, 0xad, 0xe9, 0x3a, 0x23, 0x3b, 0x64, 0x6f, 0xed, 0x0e, 0xbe,
+	0x8e, 0xab, 0x8f, 0x86, 0xbf, 0xb0, 0xa1, 0x0e, 0x37, 0x60, 0x93, 0x6c, 0x72, 0x0a, 0xfb, 0x4b,
+	0x6d, 0x6b, 0x97, 0x31, 0x28, 0x93, 0xa5, 0xc3, 0x59, 0x2a, 0xce, 0x24, 0x07, 0xd9, 0x7b, 0xef,
+	0xd9, 0xb5, 0xc2, 0xe8, 0x0a, 0x64, 0x06, 0x49, 0x11, 0xe3, 0x43, 0x48, 0x3a, 0xb1, 0xf9, 0x8f,
+	0x02, 0x9e, 0x0d, 0x99, 0x19, 0xb0, 0xc5, 0xd8, 0x46, 0x01, 0x46, 0x20, 0xdb, 0xae, 0xb5, 0x98,
+	0x55, 0x7e, 0xc4, 0x7f, 0x81, 0xf2, 0xe8, 0xb8, 0x96, 0x98, 0xcf, 0x5c, 0xf1, 0x68, 0x83, 0x74,
+	0xd1, 0xa5, 0xe9, 0xb8, 0x16, 0x15, 0xc8, 0xf3, 0x7f, 0xe1, 0x70, 0xd3, 0x5b, 0xc4, 0xfe, 0x5c,
+	0xbe, 0x6b, 0x68, 0xa7, 0xdb, 0xd2, 0xa3, 0x5d, 0x73, 0xd3, 0xd7, 0xef, 0x50, 0x62, 0xb5, 0x75,
+	0xe4, 0xf3, 0x02, 0xec, 0xbe, 0xf0, 0x83, 0xcf, 0xbb, 0xd1, 0x28, 0x37, 0x6b, 0x7f, 0x17, 0x2f,
+	0x07, 0x17, 0x45, 0xb4, 0x75, 0x7e, 0x05, 0xe9, 0x55, 0x5b, 0x4e, 0xac, 0xeb, 0x2d, 0x5e, 0x38,
+	0x03, 0xdb, 0x46, 0xef, 0xb6, 0xa5, 0xb7, 0x9b, 0x48, 0xe2, 0xfb, 0x41, 0xd3, 0x29, 0x4a, 0x70,
+	0x76, 0xb5, 0xd5, 0x31, 0x6a, 0xda, 0x40, 0xc0, 0xe4, 0x4a, 0xb2, 0x2f, 0xfb, 0xb3, 0xe0, 0x21,
+	0x25, 0xb6, 0xfb, 0xc5, 0xf7, 0x01, 0x00, 0x3e, 0x35, 0xba, 0x04, 0xee, 0x05, 0x00, 0x00,
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sync"
 	"time"
 
 	"path/filepath"
@@ -26,6 +27,8 @@ type FileOrigin map[int64]int64
 type DiffMapping struct {
 	TargetIndex int64
 	NumBytes    int64
+	// set on OptimizePatch, if DetectExecutables is enabled
+	Filter bsdiff.Filter
 }
 
 // DiffMappings contains one diff mapping for each pair of files to be bsdiff'd
@@ -68,6 +71,21 @@ type TimelineItem struct {
 	Group   int     `json:"group"`
 }
 
+// A RediffEngine decides how OptimizePatch diffs mapped files
+type RediffEngine int
+
+const (
+	// RediffEngineBsdiff diffs every mapped file with bsdiff
+	RediffEngineBsdiff RediffEngine = iota
+	// RediffEngineZstd compresses every mapped file with zstd, using the old file
+	// as a dictionary. It's much faster than bsdiff, and needs less memory. Pairs
+	// of files too large for ZstdPatchMaxWindowSize are diffed with bsdiff.
+	RediffEngineZstd
+	// RediffEngineBest tries both bsdiff and zstd, and keeps the smallest. Files
+	// larger than the bsdiff window size only get zstd, if they fit its window.
+	RediffEngineBest
+)
+
 // RediffContext holds options for the rediff process, along with
 // some state.
 type RediffContext struct {
@@ -83,6 +101,33 @@ type RediffContext struct {
 	Timeline              *Timeline
 	ForceMapAll           bool
 
+	// NumWorkers is how many files are bsdiff'd concurrently, each worker getting
+	// its own pools from SourcePoolFactory and TargetPoolFactory. Results are still
+	// written in order, so the optimized patch is the same. 0 or 1 means one
+	// file at a time, using SourcePool and TargetPool.
+	NumWorkers        int
+	SourcePoolFactory func() (wsync.Pool, error)
+	TargetPoolFactory func() (wsync.Pool, error)
+	// MemoryBudget caps the memory used by concurrent bsdiffs, as estimated by
+	// BsdiffMemoryEstimate. A file that exceeds it on its own is bsdiff'd alone.
+	// 0 means DefaultRediffMemoryBudget.
+	MemoryBudget int64
+	// BsdiffWindowSize is the largest amount of old (target) file bsdiff looks at
+	// at once. Files larger than that are diffed in windows, which keeps memory
+	// usage bounded at the cost of a less efficient patch. 0 means bsdiff.MaxFileSize.
+	BsdiffWindowSize int64
+	// DetectExecutables makes bsdiff filter files that look like x86 or ARM64
+	// executables, see bsdiff.DetectFilter. This usually makes for much smaller
+	// patches. Filtered files use SyncHeader_BSDIFF_FILTERED, so versions of
+	// wharf that don't know about filters reject these patches.
+	DetectExecutables bool
+	// Engine decides how mapped files are diffed, see RediffEngine. Patches that
+	// use zstd can't be applied by versions of wharf that don't know about it.
+	Engine RediffEngine
+	// ZstdQuality is the zstd level used for zstd patches, see
+	// DefaultZstdPatchQuality. 0 means DefaultZstdPatchQuality.
+	ZstdQuality int32
+
 	// set on Analyze
 	TargetContainer *tlc.Container
 	SourceContainer *tlc.Container
@@ -90,6 +135,10 @@ type RediffContext struct {
 	// internal
 	DiffMappings DiffMappings
 	MeasureMem   bool
+
+	timelineStart     time.Time
+	timelineMutex     sync.Mutex
+	biggestSourceFile int64
 }
 
 // AnalyzePatch parses a non-optimized patch, looking for good bsdiff'ing candidates
@@ -240,12 +289,20 @@ func (rc *RediffContext) AnalyzePatch(patchReader io.Reader) error {
 func (rc *RediffContext) OptimizePatch(patchReader io.Reader, patchWriter io.Writer) error {
 	var err error
 
-	if rc.SourcePool == nil {
-		return errors.Wrap(fmt.Errorf("SourcePool cannot be nil"), 1)
-	}
+	parallel := rc.NumWorkers > 1
 
-	if rc.TargetPool == nil {
-		return errors.Wrap(fmt.Errorf("TargetPool cannot be nil"), 1)
+	if parallel {
+		if rc.SourcePoolFactory == nil || rc.TargetPoolFactory == nil {
+			return errors.Wrap(fmt.Errorf("SourcePoolFactory and TargetPoolFactory are required with more than one worker"), 1)
+		}
+	} else {
+		if rc.SourcePool == nil {
+			return errors.Wrap(fmt.Errorf("SourcePool cannot be nil"), 1)
+		}
+
+		if rc.TargetPool == nil {
+			return errors.Wrap(fmt.Errorf("TargetPool cannot be nil"), 1)
+		}
 	}
 
 	if rc.DiffMappings == nil {
@@ -317,7 +374,6 @@ func (rc *RediffContext) OptimizePatch(patchReader io.Reader, patchWriter io.Wri
 	}
 
 	sh := &SyncHeader{}
-	bh := &BsdiffHeader{}
 	rop := &SyncOp{}
 
 	bdc := &bsdiff.DiffContext{
@@ -325,31 +381,54 @@ func (rc *RediffContext) OptimizePatch(patchReader io.Reader, patchWriter io.Wri
 		Partitions:            rc.Partitions,
 		Stats:                 rc.BsdiffStats,
 		MeasureMem:            rc.MeasureMem,
+		WindowSize:            rc.bsdiffWindowSize(),
 	}
 
 	if rc.Timeline != nil {
-		rc.Timeline.Groups = append(rc.Timeline.Groups, TimelineGroup{
-			ID:      0,
-			Content: "Worker",
-		})
+		if parallel {
+			for i := 0; i < rc.NumWorkers; i++ {
+				rc.Timeline.Groups = append(rc.Timeline.Groups, TimelineGroup{
+					ID:      i,
+					Content: fmt.Sprintf("Worker %d", i+1),
+				})
+			}
+		} else {
+			rc.Timeline.Groups = append(rc.Timeline.Groups, TimelineGroup{
+				ID:      0,
+				Content: "Worker",
+			})
+		}
 	}
 
-	initialStart := time.Now()
-	bconsumer := &state.Consumer{}
+	rc.timelineStart = time.Now()
+	rc.biggestSourceFile = 0
 
-	var biggestSourceFile int64
 	var totalRediffSize int64
 
 	for sourceFileIndex, sourceFile := range sourceContainer.Files {
 		if _, ok := rc.DiffMappings[int64(sourceFileIndex)]; ok {
-			if sourceFile.Size > biggestSourceFile {
-				biggestSourceFile = sourceFile.Size
+			if sourceFile.Size > rc.biggestSourceFile {
+				rc.biggestSourceFile = sourceFile.Size
 			}
 
 			totalRediffSize += sourceFile.Size
 		}
 	}
 
+	if rc.DetectExecutables {
+		err = rc.detectFilters()
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+	}
+
+	var scheduler *rediffScheduler
+	if parallel {
+		scheduler = newRediffScheduler(rc, sourceContainer, targetContainer)
+		scheduler.start()
+		defer scheduler.stop()
+	}
+
 	var doneSize int64
 
 	for sourceFileIndex, sourceFile := range sourceContainer.Files {
@@ -389,22 +468,6 @@ func (rc *RediffContext) OptimizePatch(patchReader io.Reader, patchWriter io.Wri
 				}
 			}
 		} else {
-			// signal bsdiff start to patcher
-			sh.Reset()
-			sh.FileIndex = int64(sourceFileIndex)
-			sh.Type = SyncHeader_BSDIFF
-			err = wctx.WriteMessage(sh)
-			if err != nil {
-				return errors.Wrap(err, 0)
-			}
-
-			bh.Reset()
-			bh.TargetIndex = diffMapping.TargetIndex
-			err = wctx.WriteMessage(bh)
-			if err != nil {
-				return errors.Wrap(err, 0)
-			}
-
 			// throw away old ops
 			for {
 				err = rctx.ReadMessage(rop)
@@ -417,51 +480,17 @@ func (rc *RediffContext) OptimizePatch(patchReader io.Reader, patchWriter io.Wri
 				}
 			}
 
-			// then bsdiff
-			sourceFileReader, err := rc.SourcePool.GetReadSeeker(int64(sourceFileIndex))
-			if err != nil {
-				return errors.Wrap(err, 0)
+			// then bsdiff (or zstd)
+			if parallel {
+				err = scheduler.writeResult(int64(sourceFileIndex), diffMapping, wctx)
+			} else {
+				result := rc.rediffFile(bdc, rc.SourcePool, rc.TargetPool, sourceFile, int64(sourceFileIndex), diffMapping, 0)
+				err = rc.writeResult(wctx, int64(sourceFileIndex), diffMapping, result)
 			}
-
-			targetFileReader, err := rc.TargetPool.GetReadSeeker(diffMapping.TargetIndex)
 			if err != nil {
 				return errors.Wrap(err, 0)
 			}
 
-			rc.Consumer.ProgressLabel(fmt.Sprintf(">%s", sourceFile.Path))
-
-			_, err = sourceFileReader.Seek(0, os.SEEK_SET)
-			if err != nil {
-				return errors.Wrap(err, 0)
-			}
-
-			rc.Consumer.ProgressLabel(fmt.Sprintf("<%s", sourceFile.Path))
-
-			_, err = targetFileReader.Seek(0, os.SEEK_SET)
-			if err != nil {
-				return errors.Wrap(err, 0)
-			}
-
-			rc.Consumer.ProgressLabel(fmt.Sprintf("*%s", sourceFile.Path))
-
-			startTime := time.Now()
-
-			err = bdc.Do(targetFileReader, sourceFileReader, wctx.WriteMessage, bconsumer)
-
-			endTime := time.Now()
-
-			if rc.Timeline != nil {
-				heat := int(float64(sourceFile.Size) / float64(biggestSourceFile) * 240.0)
-				rc.Timeline.Items = append(rc.Timeline.Items, TimelineItem{
-					Content: filepath.Base(sourceFile.Path),
-					Style:   fmt.Sprintf("background-color: hsl(%d, 100%%, 50%%)", heat),
-					Title:   fmt.Sprintf("%s %s", humanize.IBytes(uint64(sourceFile.Size)), sourceFile.Path),
-					Start:   startTime.Sub(initialStart).Seconds(),
-					End:     endTime.Sub(initialStart).Seconds(),
-					Group:   0,
-				})
-			}
-
 			doneSize += sourceFile.Size
 		}
 
@@ -477,6 +506,10 @@ func (rc *RediffContext) OptimizePatch(patchReader io.Reader, patchWriter io.Wri
 		rc.Consumer.Progress(float64(doneSize) / float64(totalRediffSize))
 	}
 
+	if parallel {
+		scheduler.stop()
+	}
+
 	err = wctx.Close()
 	if err != nil {
 		return errors.Wrap(err, 0)
@@ -485,6 +518,226 @@ func (rc *RediffContext) OptimizePatch(patchReader io.Reader, patchWriter io.Wri
 	return nil
 }
 
+// bsdiffFile bsdiffs a source file against the target file it's mapped to,
+// and adds it to the timeline, in the given lane.
+func (rc *RediffContext) bsdiffFile(bdc *bsdiff.DiffContext, sourcePool wsync.Pool, targetPool wsync.Pool, sourceFile *tlc.File,
+	sourceFileIndex int64, diffMapping *DiffMapping, writeMessage bsdiff.WriteMessageFunc, lane int) error {
+	sourceFileReader, err := sourcePool.GetReadSeeker(sourceFileIndex)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	targetFileReader, err := targetPool.GetReadSeeker(diffMapping.TargetIndex)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	rc.Consumer.ProgressLabel(fmt.Sprintf(">%s", sourceFile.Path))
+
+	_, err = sourceFileReader.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	rc.Consumer.ProgressLabel(fmt.Sprintf("<%s", sourceFile.Path))
+
+	_, err = targetFileReader.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	rc.Consumer.ProgressLabel(fmt.Sprintf("*%s", sourceFile.Path))
+
+	startTime := time.Now()
+
+	bdc.Filter = diffMapping.Filter
+	err = bdc.Do(targetFileReader, sourceFileReader, writeMessage, &state.Consumer{})
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	rc.addTimelineItem(sourceFile, "", startTime, lane)
+	return nil
+}
+
+// rediffFile diffs a source file against the target file it's mapped to, with
+// bsdiff, zstd, or both (keeping the smallest), depending on Engine.
+func (rc *RediffContext) rediffFile(bdc *bsdiff.DiffContext, sourcePool wsync.Pool, targetPool wsync.Pool, sourceFile *tlc.File,
+	sourceFileIndex int64, diffMapping *DiffMapping, lane int) *rediffResult {
+	engine := rc.engineFor(rc.TargetContainer.Files[diffMapping.TargetIndex].Size, sourceFile.Size)
+
+	var bsdiffResult *rediffResult
+	if engine != RediffEngineZstd {
+		bsdiffResult = &rediffResult{syncType: SyncHeader_BSDIFF}
+		if diffMapping.Filter != bsdiff.FilterNone {
+			bsdiffResult.syncType = SyncHeader_BSDIFF_FILTERED
+		}
+		wctx := wire.NewWriteContext(&bsdiffResult.messages)
+		bsdiffResult.err = rc.bsdiffFile(bdc, sourcePool, targetPool, sourceFile, sourceFileIndex, diffMapping, wctx.WriteMessage, lane)
+		if engine == RediffEngineBsdiff || bsdiffResult.err != nil {
+			return bsdiffResult
+		}
+	}
+
+	zstdResult := &rediffResult{syncType: SyncHeader_ZSTD}
+	startTime := time.Now()
+	zstdResult.err = rc.zstdFile(sourcePool, targetPool, sourceFileIndex, diffMapping, wire.NewWriteContext(&zstdResult.messages))
+	if zstdResult.err == nil {
+		rc.addTimelineItem(sourceFile, "zstd", startTime, lane)
+	}
+
+	if bsdiffResult == nil {
+		return zstdResult
+	}
+
+	if zstdResult.err == nil && zstdResult.messages.size >= bsdiffResult.messages.size {
+		zstdResult.messages.release()
+		return bsdiffResult
+	}
+
+	bsdiffResult.messages.release()
+	return zstdResult
+}
+
+// engineFor returns the engine to use for a pair of files
+func (rc *RediffContext) engineFor(targetSize int64, sourceSize int64) RediffEngine {
+	if rc.Engine == RediffEngineBsdiff {
+		return RediffEngineBsdiff
+	}
+
+	if !zstdPatchFits(targetSize, sourceSize) {
+		// zstd couldn't reach back to the start of the old file,
+		// bsdiff can at least work in windows
+		return RediffEngineBsdiff
+	}
+
+	if rc.Engine == RediffEngineBest {
+		windowSize := rc.bsdiffWindowSize()
+		if targetSize > windowSize || sourceSize > windowSize {
+			// bsdiff would have to work in windows, zstd sees the whole file
+			return RediffEngineZstd
+		}
+	}
+
+	return rc.Engine
+}
+
+// writeResult writes the headers for a rediff'd source file, followed by its
+// messages, then releases them.
+func (rc *RediffContext) writeResult(wctx *wire.WriteContext, sourceFileIndex int64, diffMapping *DiffMapping, result *rediffResult) error {
+	defer result.messages.release()
+
+	if result.err != nil {
+		return errors.Wrap(result.err, 0)
+	}
+
+	// signal bsdiff (or zstd) start to patcher
+	sh := &SyncHeader{
+		Type:      result.syncType,
+		FileIndex: sourceFileIndex,
+	}
+	err := wctx.WriteMessage(sh)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	switch result.syncType {
+	case SyncHeader_BSDIFF, SyncHeader_BSDIFF_FILTERED:
+		bh := &BsdiffHeader{
+			TargetIndex: diffMapping.TargetIndex,
+			Filter:      BsdiffHeader_Filter(diffMapping.Filter),
+		}
+		err = wctx.WriteMessage(bh)
+	case SyncHeader_ZSTD:
+		zh := &ZstdHeader{
+			TargetIndex: diffMapping.TargetIndex,
+		}
+		err = wctx.WriteMessage(zh)
+	}
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	err = result.messages.replayTo(wctx.Writer())
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+// addTimelineItem adds a diffed file to the timeline, if there is one,
+// in the given lane (one per worker).
+func (rc *RediffContext) addTimelineItem(sourceFile *tlc.File, engine string, startTime time.Time, lane int) {
+	if rc.Timeline == nil {
+		return
+	}
+
+	endTime := time.Now()
+
+	rc.timelineMutex.Lock()
+	defer rc.timelineMutex.Unlock()
+
+	content := filepath.Base(sourceFile.Path)
+	if engine != "" {
+		content = fmt.Sprintf("%s (%s)", content, engine)
+	}
+
+	heat := int(float64(sourceFile.Size) / float64(rc.biggestSourceFile) * 240.0)
+	rc.Timeline.Items = append(rc.Timeline.Items, TimelineItem{
+		Content: content,
+		Style:   fmt.Sprintf("background-color: hsl(%d, 100%%, 50%%)", heat),
+		Title:   fmt.Sprintf("%s %s", humanize.IBytes(uint64(sourceFile.Size)), sourceFile.Path),
+		Start:   startTime.Sub(rc.timelineStart).Seconds(),
+		End:     endTime.Sub(rc.timelineStart).Seconds(),
+		Group:   lane,
+	})
+}
+
+// detectFilters looks at the first few kilobytes of every mapped source file
+// to pick a bsdiff filter for it
+func (rc *RediffContext) detectFilters() error {
+	sourcePool := rc.SourcePool
+	if sourcePool == nil {
+		var err error
+		sourcePool, err = rc.SourcePoolFactory()
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+		defer sourcePool.Close()
+	}
+
+	header := make([]byte, 4096)
+
+	for sourceFileIndex, diffMapping := range rc.DiffMappings {
+		reader, err := sourcePool.GetReadSeeker(sourceFileIndex)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+
+		_, err = reader.Seek(0, os.SEEK_SET)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+
+		n, err := io.ReadFull(reader, header)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return errors.Wrap(err, 0)
+		}
+
+		diffMapping.Filter = bsdiff.DetectFilter(header[:n])
+	}
+
+	return nil
+}
+
+func (rc *RediffContext) bsdiffWindowSize() int64 {
+	if rc.BsdiffWindowSize > 0 {
+		return rc.BsdiffWindowSize
+	}
+	return bsdiff.MaxFileSize
+}
+
 func defaultRediffCompressionSettings() *CompressionSettings {
 	return &CompressionSettings{
 		Algorithm: CompressionAlgorithm_ZSTD,
@@ -0,0 +1,295 @@
+package pwr
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/go-errors/errors"
+	"github.com/itchio/wharf/bsdiff"
+	"github.com/itchio/wharf/tlc"
+	"github.com/itchio/wharf/wire"
+	"github.com/itchio/wharf/wsync"
+)
+
+// DefaultRediffMemoryBudget is the memory budget used by OptimizePatch with
+// more than one worker, when none is specified.
+const DefaultRediffMemoryBudget int64 = 4 * 1024 * 1024 * 1024
+
+// BsdiffMemoryEstimate returns roughly how much memory bsdiff needs for a pair of
+// files: the old file and its suffix array (about 9 times the old file's size),
+// plus the new file. When either is larger than windowSize, only one window of
+// each is in memory at a time.
+func BsdiffMemoryEstimate(targetSize int64, sourceSize int64, windowSize int64) int64 {
+	if windowSize > 0 && (targetSize > windowSize || sourceSize > windowSize) {
+		targetSize = windowSize
+		sourceSize = windowSize / 2
+	}
+	return 9*targetSize + sourceSize
+}
+
+// memoryEstimate returns roughly how much memory diffing a pair of files needs,
+// with the engine they'll be diffed with. Best runs one after the other.
+func (rc *RediffContext) memoryEstimate(targetSize int64, sourceSize int64) int64 {
+	bsdiffEstimate := BsdiffMemoryEstimate(targetSize, sourceSize, rc.bsdiffWindowSize())
+	zstdEstimate := ZstdMemoryEstimate(targetSize, sourceSize)
+
+	switch rc.engineFor(targetSize, sourceSize) {
+	case RediffEngineZstd:
+		return zstdEstimate
+	case RediffEngineBest:
+		if zstdEstimate > bsdiffEstimate {
+			return zstdEstimate
+		}
+		return bsdiffEstimate
+	default:
+		return bsdiffEstimate
+	}
+}
+
+type rediffJob struct {
+	sourceFileIndex int64
+	diffMapping     *DiffMapping
+	cost            int64
+}
+
+type byRediffJobIndex []*rediffJob
+
+func (s byRediffJobIndex) Len() int {
+	return len(s)
+}
+
+func (s byRediffJobIndex) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s byRediffJobIndex) Less(i, j int) bool {
+	return s[i].sourceFileIndex < s[j].sourceFileIndex
+}
+
+type rediffResult struct {
+	syncType SyncHeader_Type
+	messages spillBuffer
+	err      error
+}
+
+// A rediffScheduler diffs mapped files in the background, in source file index
+// order, as long as the memory budget allows it. Results are picked up in the same
+// order by writeResult.
+type rediffScheduler struct {
+	rc              *RediffContext
+	sourceContainer *tlc.Container
+	targetContainer *tlc.Container
+
+	budget    int64
+	inUse     int64
+	cancelled bool
+	cond      *sync.Cond
+
+	window  chan bool
+	cancel  chan struct{}
+	results map[int64]chan *rediffResult
+	stats   []*bsdiff.DiffStats
+	wg      sync.WaitGroup
+	stopped bool
+}
+
+func newRediffScheduler(rc *RediffContext, sourceContainer *tlc.Container, targetContainer *tlc.Container) *rediffScheduler {
+	budget := rc.MemoryBudget
+	if budget == 0 {
+		budget = DefaultRediffMemoryBudget
+	}
+
+	return &rediffScheduler{
+		rc:              rc,
+		sourceContainer: sourceContainer,
+		targetContainer: targetContainer,
+		budget:          budget,
+		cond:            sync.NewCond(&sync.Mutex{}),
+		// workers may only get ahead of the writer by that many files
+		window:  make(chan bool, rc.NumWorkers*2),
+		cancel:  make(chan struct{}),
+		results: make(map[int64]chan *rediffResult),
+	}
+}
+
+func (rs *rediffScheduler) start() {
+	rc := rs.rc
+
+	var jobs []*rediffJob
+	for sourceFileIndex, diffMapping := range rc.DiffMappings {
+		if sourceFileIndex >= int64(len(rs.sourceContainer.Files)) {
+			continue
+		}
+
+		jobs = append(jobs, &rediffJob{
+			sourceFileIndex: sourceFileIndex,
+			diffMapping:     diffMapping,
+			cost: rc.memoryEstimate(
+				rs.targetContainer.Files[diffMapping.TargetIndex].Size,
+				rs.sourceContainer.Files[sourceFileIndex].Size,
+			),
+		})
+		rs.results[sourceFileIndex] = make(chan *rediffResult, 1)
+	}
+	sort.Sort(byRediffJobIndex(jobs))
+
+	jobsChan := make(chan *rediffJob)
+
+	go func() {
+		defer close(jobsChan)
+
+		for _, job := range jobs {
+			select {
+			case rs.window <- true:
+				// muffin
+			case <-rs.cancel:
+				return
+			}
+
+			if !rs.acquire(job.cost) {
+				return
+			}
+
+			select {
+			case jobsChan <- job:
+				// muffin
+			case <-rs.cancel:
+				rs.release(job.cost)
+				return
+			}
+		}
+	}()
+
+	rs.stats = make([]*bsdiff.DiffStats, rc.NumWorkers)
+	for i := 0; i < rc.NumWorkers; i++ {
+		rs.stats[i] = &bsdiff.DiffStats{}
+		rs.wg.Add(1)
+		go func(lane int) {
+			defer rs.wg.Done()
+			rs.work(lane, jobsChan)
+		}(i)
+	}
+}
+
+// acquire waits until cost fits in the memory budget. Jobs bigger than the
+// budget only need nothing else to be running. Returns false if cancelled.
+func (rs *rediffScheduler) acquire(cost int64) bool {
+	rs.cond.L.Lock()
+	defer rs.cond.L.Unlock()
+
+	for !rs.cancelled && rs.inUse > 0 && rs.inUse+cost > rs.budget {
+		rs.cond.Wait()
+	}
+
+	if rs.cancelled {
+		return false
+	}
+
+	rs.inUse += cost
+	return true
+}
+
+func (rs *rediffScheduler) release(cost int64) {
+	rs.cond.L.Lock()
+	rs.inUse -= cost
+	rs.cond.L.Unlock()
+
+	rs.cond.Broadcast()
+}
+
+func (rs *rediffScheduler) work(lane int, jobs chan *rediffJob) {
+	rc := rs.rc
+
+	sourcePool, targetPool, err := rs.makePools()
+	if err != nil {
+		// fail every job we get
+		for job := range jobs {
+			rs.release(job.cost)
+			rs.results[job.sourceFileIndex] <- &rediffResult{err: err}
+		}
+		return
+	}
+	defer sourcePool.Close()
+	defer targetPool.Close()
+
+	bdc := &bsdiff.DiffContext{
+		SuffixSortConcurrency: rc.SuffixSortConcurrency,
+		Partitions:            rc.Partitions,
+		Stats:                 rs.stats[lane],
+		MeasureMem:            rc.MeasureMem,
+		WindowSize:            rc.bsdiffWindowSize(),
+	}
+
+	for job := range jobs {
+		sourceFile := rs.sourceContainer.Files[job.sourceFileIndex]
+		result := rc.rediffFile(bdc, sourcePool, targetPool, sourceFile, job.sourceFileIndex, job.diffMapping, lane)
+
+		rs.release(job.cost)
+		rs.results[job.sourceFileIndex] <- result
+	}
+}
+
+func (rs *rediffScheduler) makePools() (wsync.Pool, wsync.Pool, error) {
+	sourcePool, err := rs.rc.SourcePoolFactory()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, 0)
+	}
+
+	targetPool, err := rs.rc.TargetPoolFactory()
+	if err != nil {
+		sourcePool.Close()
+		return nil, nil, errors.Wrap(err, 0)
+	}
+
+	return sourcePool, targetPool, nil
+}
+
+// writeResult waits for the diff of a source file to be done, and
+// writes it to wctx
+func (rs *rediffScheduler) writeResult(sourceFileIndex int64, diffMapping *DiffMapping, wctx *wire.WriteContext) error {
+	result := <-rs.results[sourceFileIndex]
+
+	err := rs.rc.writeResult(wctx, sourceFileIndex, diffMapping, result)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	<-rs.window
+	return nil
+}
+
+// stop cancels pending jobs, waits for workers to exit, cleans up any
+// leftover results and merges worker stats. It's safe to call more than once.
+func (rs *rediffScheduler) stop() {
+	if rs.stopped {
+		return
+	}
+	rs.stopped = true
+
+	close(rs.cancel)
+	rs.cond.L.Lock()
+	rs.cancelled = true
+	rs.cond.L.Unlock()
+	rs.cond.Broadcast()
+
+	rs.wg.Wait()
+
+	for _, resultChan := range rs.results {
+		select {
+		case result := <-resultChan:
+			result.messages.release()
+		default:
+			// muffin
+		}
+	}
+
+	if stats := rs.rc.BsdiffStats; stats != nil {
+		for _, workerStats := range rs.stats {
+			stats.TimeSpentSorting += workerStats.TimeSpentSorting
+			stats.TimeSpentScanning += workerStats.TimeSpentScanning
+			if workerStats.BiggestAdd > stats.BiggestAdd {
+				stats.BiggestAdd = workerStats.BiggestAdd
+			}
+		}
+	}
+}
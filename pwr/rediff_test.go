@@ -2,20 +2,28 @@ package pwr
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"testing"
 	"time"
 
 	"github.com/Datadog/zstd"
 	"github.com/alecthomas/assert"
 	humanize "github.com/dustin/go-humanize"
+	"github.com/go-errors/errors"
 	"github.com/itchio/wharf/bsdiff"
 	"github.com/itchio/wharf/pools/fspool"
 	"github.com/itchio/wharf/state"
 	"github.com/itchio/wharf/tlc"
+	"github.com/itchio/wharf/wire"
+	"github.com/itchio/wharf/wsync"
+	kzstd "github.com/klauspost/compress/zstd"
 )
 
 type zstdCompressor struct{}
@@ -24,12 +32,29 @@ func (zc *zstdCompressor) Apply(writer io.Writer, quality int32) (io.Writer, err
 	return zstd.NewWriterLevel(writer, int(quality)), nil
 }
 
+func (zc *zstdCompressor) ApplyPatchFrom(writer io.Writer, ref []byte, params *ZstdPatchParams) (io.WriteCloser, error) {
+	return kzstd.NewWriter(writer,
+		kzstd.WithEncoderLevel(kzstd.EncoderLevelFromZstd(int(params.Quality))),
+		kzstd.WithWindowSize(int(params.WindowSize)),
+		kzstd.WithEncoderDictRaw(0, ref))
+}
+
 type zstdDecompressor struct{}
 
 func (zd *zstdDecompressor) Apply(reader io.Reader) (io.Reader, error) {
 	return zstd.NewReader(reader), nil
 }
 
+func (zd *zstdDecompressor) ApplyPatchFrom(reader io.Reader, ref []byte, params *ZstdPatchParams) (io.ReadCloser, error) {
+	decoder, err := kzstd.NewReader(reader,
+		kzstd.WithDecoderMaxWindow(uint64(params.WindowSize)),
+		kzstd.WithDecoderDictRaw(0, ref))
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
 func init() {
 	RegisterCompressor(CompressionAlgorithm_ZSTD, &zstdCompressor{})
 	RegisterDecompressor(CompressionAlgorithm_ZSTD, &zstdDecompressor{})
@@ -192,6 +217,228 @@ func Test_RediffStillBetter(t *testing.T) {
 	})
 }
 
+func Test_RediffWindowed(t *testing.T) {
+	runRediffScenario(t, patchScenario{
+		name:         "rediff large files in windows",
+		touchedFiles: 2,
+		deletedFiles: 0,
+		v1: testDirSettings{
+			entries: []testDirEntry{
+				{path: "big", seed: 0x1, size: BlockSize * 24},
+				{path: "small", seed: 0x2, size: BlockSize},
+			},
+		},
+		v2: testDirSettings{
+			entries: []testDirEntry{
+				{path: "big", seed: 0x1, size: BlockSize * 28, bsmods: []bsmod{
+					bsmod{interval: BlockSize/7 + 3, delta: 0x4, max: 16, skip: 20},
+				}},
+				{path: "small", seed: 0x2, size: BlockSize, bsmods: []bsmod{
+					bsmod{interval: BlockSize/13 + 7, delta: 0x18, max: 6, skip: 20},
+				}},
+			},
+		},
+		bsdiffWindowSize: BlockSize * 4,
+	})
+}
+
+func Test_RediffExecutables(t *testing.T) {
+	runRediffScenario(t, patchScenario{
+		name:         "rediff executables with a filter",
+		touchedFiles: 2,
+		deletedFiles: 0,
+		v1: testDirSettings{
+			entries: []testDirEntry{
+				{path: "game", data: fakeExecutable(0)},
+				{path: "data.bin", seed: 0x2, size: BlockSize * 8},
+			},
+		},
+		v2: testDirSettings{
+			entries: []testDirEntry{
+				{path: "game", data: fakeExecutable(48)},
+				{path: "data.bin", seed: 0x2, size: BlockSize * 8, bsmods: []bsmod{
+					bsmod{interval: BlockSize/13 + 7, delta: 0x18, max: 6, skip: 20},
+				}},
+			},
+		},
+		detectExecutables: true,
+	})
+
+	// filters are only allowed on BSDIFF_FILTERED entries
+	_, err := bsdiffFilter(&SyncHeader{Type: SyncHeader_BSDIFF}, &BsdiffHeader{Filter: BsdiffHeader_X86})
+	assert.Error(t, err)
+
+	filter, err := bsdiffFilter(&SyncHeader{Type: SyncHeader_BSDIFF_FILTERED}, &BsdiffHeader{Filter: BsdiffHeader_ARM64})
+	assert.NoError(t, err)
+	assert.EqualValues(t, bsdiff.FilterARM64, filter)
+}
+
+func Test_RediffZstd(t *testing.T) {
+	for _, engine := range []RediffEngine{RediffEngineZstd, RediffEngineBest} {
+		runRediffScenario(t, patchScenario{
+			name:         "rediff with zstd",
+			touchedFiles: 3,
+			deletedFiles: 0,
+			v1: testDirSettings{
+				entries: []testDirEntry{
+					{path: "subdir/file-1", seed: 0x1, size: BlockSize*11 + 14},
+					{path: "file-1", seed: 0x2, size: BlockSize * 8},
+					{path: "dir2/file-2", seed: 0x3},
+				},
+			},
+			v2: testDirSettings{
+				entries: []testDirEntry{
+					{path: "subdir/file-1", seed: 0x1, size: BlockSize*17 + 14, bsmods: []bsmod{
+						bsmod{interval: BlockSize/7 + 3, delta: 0x4, max: 12, skip: 10},
+					}},
+					{path: "file-1", seed: 0x2, size: BlockSize * 8, bsmods: []bsmod{
+						bsmod{interval: BlockSize/13 + 7, delta: 0x18, max: 6, skip: 20},
+					}},
+					{path: "dir2/file-2", seed: 0x3, size: BlockSize * 3},
+				},
+			},
+			rediffEngine: engine,
+		})
+	}
+}
+
+func Test_ZstdPatchWindow(t *testing.T) {
+	assert.EqualValues(t, zstdPatchMinWindowSize, zstdPatchWindowSize(10, 20))
+	assert.EqualValues(t, 8*1024*1024, zstdPatchWindowSize(4*1024*1024, 4*1024*1024))
+	assert.EqualValues(t, 16*1024*1024, zstdPatchWindowSize(4*1024*1024, 4*1024*1024+1))
+
+	// pairs too large for zstd's window fall back to bsdiff
+	huge := ZstdPatchMaxWindowSize
+	for _, engine := range []RediffEngine{RediffEngineZstd, RediffEngineBest} {
+		rc := &RediffContext{Engine: engine, BsdiffWindowSize: 1024 * 1024}
+		assert.EqualValues(t, RediffEngineBsdiff, rc.engineFor(huge, 1))
+		assert.EqualValues(t, RediffEngineZstd, rc.engineFor(huge/4, huge/4))
+	}
+
+	// matches reach back to the start of the old file, however far it is
+	prng := rand.New(rand.NewSource(0x46))
+	oldFile := make([]byte, 6*1024*1024)
+	prng.Read(oldFile)
+	newFile := append([]byte{}, oldFile...)
+	for i := 0; i < len(newFile); i += 64 * 1024 {
+		newFile[i]++
+	}
+
+	params := &ZstdPatchParams{
+		Quality:    DefaultZstdPatchQuality,
+		WindowSize: zstdPatchWindowSize(int64(len(oldFile)), int64(len(newFile))),
+	}
+
+	compressed := new(bytes.Buffer)
+	zw, err := (&zstdCompressor{}).ApplyPatchFrom(compressed, oldFile, params)
+	assert.NoError(t, err)
+	_, err = zw.Write(newFile)
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	assert.True(t, compressed.Len() < len(newFile)/100, "zstd patch should be tiny, was %s", humanize.IBytes(uint64(compressed.Len())))
+
+	zr, err := (&zstdDecompressor{}).ApplyPatchFrom(bytes.NewReader(compressed.Bytes()), oldFile, params)
+	assert.NoError(t, err)
+	decompressed, err := ioutil.ReadAll(zr)
+	assert.NoError(t, err)
+	assert.NoError(t, zr.Close())
+	assert.True(t, bytes.Equal(newFile, decompressed), "zstd patch should round-trip")
+
+	// lower qualities are faster, but don't reach as far back
+	fastCompressed := new(bytes.Buffer)
+	zw, err = (&zstdCompressor{}).ApplyPatchFrom(fastCompressed, oldFile, &ZstdPatchParams{
+		Quality:    1,
+		WindowSize: params.WindowSize,
+	})
+	assert.NoError(t, err)
+	_, err = zw.Write(newFile)
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	assert.True(t, fastCompressed.Len() > compressed.Len(), "quality should be honored")
+
+	// decompressors refuse windows larger than expected
+	zr, err = (&zstdDecompressor{}).ApplyPatchFrom(bytes.NewReader(compressed.Bytes()), oldFile, &ZstdPatchParams{
+		WindowSize: params.WindowSize / 2,
+	})
+	if err == nil {
+		_, err = ioutil.ReadAll(zr)
+	}
+	assert.Error(t, err)
+}
+
+func Test_ZstdDataOps(t *testing.T) {
+	buf := new(bytes.Buffer)
+	wctx := wire.NewWriteContext(buf)
+
+	data := make([]byte, zstdPatchChunkSize*2+123)
+	rand.New(rand.NewSource(0x46)).Read(data)
+
+	dow := &dataOpWriter{wctx: wctx}
+	for i := 0; i < len(data); i += 4000 {
+		end := i + 4000
+		if end > len(data) {
+			end = len(data)
+		}
+		_, err := dow.Write(data[i:end])
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, dow.flush())
+	assert.NoError(t, wctx.WriteMessage(&SyncOp{Type: SyncOp_HEY_YOU_DID_IT}))
+	assert.NoError(t, wctx.WriteMessage(&SyncOp{Type: SyncOp_DATA, Data: []byte("after")}))
+
+	rctx := wire.NewReadContext(bytes.NewReader(buf.Bytes()))
+	read, err := ioutil.ReadAll(&dataOpReader{rctx: rctx})
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, read), "data should round-trip")
+
+	// stops right after HEY_YOU_DID_IT
+	op := &SyncOp{}
+	assert.NoError(t, rctx.ReadMessage(op))
+	assert.EqualValues(t, "after", string(op.Data))
+
+	// other ops are not welcome
+	buf.Reset()
+	assert.NoError(t, wctx.WriteMessage(&SyncOp{Type: SyncOp_BLOCK_RANGE}))
+	rctx = wire.NewReadContext(bytes.NewReader(buf.Bytes()))
+	_, err = ioutil.ReadAll(&dataOpReader{rctx: rctx})
+	assert.True(t, errors.Is(err, ErrMalformedPatch))
+}
+
+// fakeExecutable returns a little-endian x86-64 ELF file whose code calls into
+// a few runtime functions, with growth bytes of code inserted halfway through.
+func fakeExecutable(growth int) []byte {
+	header := make([]byte, 64)
+	copy(header, "\x7fELF\x02\x01")
+	binary.LittleEndian.PutUint16(header[18:], 62)
+
+	const numFunctions = 2048
+	const functionSize = 128
+
+	code := make([]byte, numFunctions*functionSize+growth)
+	prng := rand.New(rand.NewSource(0x42))
+
+	start := func(i int) int {
+		if i >= numFunctions/2 {
+			return i*functionSize + growth
+		}
+		return i * functionSize
+	}
+
+	for i := 0; i < numFunctions; i++ {
+		fn := code[start(i) : start(i)+functionSize]
+		for j := 0; j+8 <= len(fn); j += 8 {
+			callee := start(prng.Intn(16))
+			fn[j] = 0xe8
+			binary.LittleEndian.PutUint32(fn[j+1:], uint32(callee-(start(i)+j+5)))
+			fn[j+5] = byte(prng.Intn(256))
+			fn[j+6] = byte(i)
+			fn[j+7] = 0x90
+		}
+	}
+
+	return append(header, code...)
+}
+
 func runRediffScenario(t *testing.T, scenario patchScenario) {
 	log := t.Logf
 
@@ -294,6 +541,9 @@ func runRediffScenario(t *testing.T, scenario patchScenario) {
 			Compression:           compression,
 			SuffixSortConcurrency: 0,
 			Partitions:            scenario.partitions,
+			BsdiffWindowSize:      scenario.bsdiffWindowSize,
+			DetectExecutables:     scenario.detectExecutables,
+			Engine:                scenario.rediffEngine,
 
 			BsdiffStats: bsdiffStats,
 		}
@@ -310,6 +560,20 @@ func runRediffScenario(t *testing.T, scenario patchScenario) {
 		beforeOptimize := time.Now()
 		oErr := rc.OptimizePatch(patchReader, optimizedPatchBuffer)
 		assert.NoError(t, oErr)
+
+		if scenario.detectExecutables {
+			filteredFiles := 0
+			for _, diffMapping := range rc.DiffMappings {
+				if diffMapping.Filter != bsdiff.FilterNone {
+					filteredFiles++
+				}
+			}
+			assert.EqualValues(t, 1, filteredFiles)
+
+			// so that older versions reject the patch rather than applying it wrong
+			syncTypes := patchSyncTypes(t, optimizedPatchBuffer.Bytes())
+			assert.EqualValues(t, filteredFiles, syncTypes[SyncHeader_BSDIFF_FILTERED])
+		}
 		log("Optimized patch in %s (spent %s sorting, %s scanning)",
 			time.Since(beforeOptimize),
 			bsdiffStats.TimeSpentSorting,
@@ -345,9 +609,147 @@ func runRediffScenario(t *testing.T, scenario patchScenario) {
 			assert.NoError(t, AssertValid(v1After, signature))
 			log("Optimized patch applies cleanly.")
 		}()
+
+		for _, memoryBudget := range []int64{0, 1} {
+			log("Optimizing with 4 workers (memory budget %d)...", memoryBudget)
+
+			timeline := &Timeline{}
+			prc := &RediffContext{
+				SourcePoolFactory: func() (wsync.Pool, error) {
+					return fspool.New(sourceContainer, v2), nil
+				},
+				TargetPoolFactory: func() (wsync.Pool, error) {
+					return fspool.New(targetContainer, v1), nil
+				},
+				NumWorkers:   4,
+				MemoryBudget: memoryBudget,
+
+				Consumer:              consumer,
+				Compression:           compression,
+				SuffixSortConcurrency: 0,
+				Partitions:            scenario.partitions,
+				BsdiffWindowSize:      scenario.bsdiffWindowSize,
+				DetectExecutables:     scenario.detectExecutables,
+				Engine:                scenario.rediffEngine,
+
+				BsdiffStats: &bsdiff.DiffStats{},
+				Timeline:    timeline,
+			}
+
+			patchReader := bytes.NewReader(patchBuffer.Bytes())
+			assert.NoError(t, prc.AnalyzePatch(patchReader))
+
+			patchReader.Seek(0, os.SEEK_SET)
+			parallelPatchBuffer := new(bytes.Buffer)
+			assert.NoError(t, prc.OptimizePatch(patchReader, parallelPatchBuffer))
+
+			assert.True(t, bytes.Equal(optimizedPatchBuffer.Bytes(), parallelPatchBuffer.Bytes()), "parallel optimized patch should be byte-identical")
+			assert.EqualValues(t, 4, len(timeline.Groups))
+			itemsPerFile := 1
+			if scenario.rediffEngine == RediffEngineBest {
+				// one for bsdiff, one for zstd
+				itemsPerFile = 2
+			}
+			assert.EqualValues(t, len(prc.DiffMappings)*itemsPerFile, len(timeline.Items))
+
+			if memoryBudget == 1 {
+				// every file is over budget, so they're bsdiff'd one at a time
+				items := append([]TimelineItem{}, timeline.Items...)
+				sort.Sort(byTimelineStart(items))
+				for i := 1; i < len(items); i++ {
+					assert.True(t, items[i].Start >= items[i-1].End, "bsdiffs should not overlap")
+				}
+			}
+		}
 	}()
 }
 
+type byTimelineStart []TimelineItem
+
+func (s byTimelineStart) Len() int {
+	return len(s)
+}
+
+func (s byTimelineStart) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s byTimelineStart) Less(i, j int) bool {
+	return s[i].Start < s[j].Start
+}
+
+func Test_RediffManyFiles(t *testing.T) {
+	scenario := patchScenario{
+		name: "rediff many changed files",
+	}
+
+	for i := 0; i < 12; i++ {
+		path := fmt.Sprintf("bin/file%d", i)
+		seed := int64(0x300 + i)
+
+		scenario.v1.entries = append(scenario.v1.entries, testDirEntry{
+			path: path,
+			chunks: []testDirChunk{
+				{seed: seed, size: BlockSize*int64(2+i%3) + 12},
+				{seed: seed + 0x10, size: BlockSize*2 + 5},
+			},
+		})
+		scenario.v2.entries = append(scenario.v2.entries, testDirEntry{
+			path: path,
+			chunks: []testDirChunk{
+				{seed: seed, size: BlockSize*int64(2+i%3) + 12},
+				{seed: seed + 0x20, size: BlockSize + 7},
+				{seed: seed + 0x10, size: BlockSize*2 + 5},
+			},
+		})
+	}
+
+	runRediffScenario(t, scenario)
+}
+
+// patchSyncTypes counts the sync header types used by the files of a patch
+func patchSyncTypes(t *testing.T, patch []byte) map[SyncHeader_Type]int {
+	rawPatchWire := wire.NewReadContext(bytes.NewReader(patch))
+	assert.NoError(t, rawPatchWire.ExpectMagic(PatchMagic))
+
+	header := &PatchHeader{}
+	assert.NoError(t, rawPatchWire.ReadMessage(header))
+
+	patchWire, err := DecompressWire(rawPatchWire, header.Compression)
+	assert.NoError(t, err)
+
+	targetContainer := &tlc.Container{}
+	assert.NoError(t, patchWire.ReadMessage(targetContainer))
+	sourceContainer := &tlc.Container{}
+	assert.NoError(t, patchWire.ReadMessage(sourceContainer))
+
+	syncTypes := make(map[SyncHeader_Type]int)
+	sh := &SyncHeader{}
+	rop := &SyncOp{}
+	for range sourceContainer.Files {
+		sh.Reset()
+		assert.NoError(t, patchWire.ReadMessage(sh))
+		syncTypes[sh.Type]++
+
+		switch sh.Type {
+		case SyncHeader_BSDIFF, SyncHeader_BSDIFF_FILTERED:
+			assert.NoError(t, skipBsdiff(patchWire))
+		case SyncHeader_ZSTD:
+			assert.NoError(t, skipZstd(patchWire))
+		default:
+			for {
+				rop.Reset()
+				assert.NoError(t, patchWire.ReadMessage(rop))
+				if rop.Type == SyncOp_HEY_YOU_DID_IT {
+					break
+				}
+			}
+		}
+	}
+
+	return syncTypes
+}
+
 func max(a, b int) int {
 	if a > b {
 		return a
@@ -0,0 +1,410 @@
+package pwr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/itchio/wharf/tlc"
+)
+
+// ReportFormat is how a WoundsReporter writes its report
+type ReportFormat int
+
+const (
+	// ReportFormatJSON writes the whole ValidationReport as a single JSON object
+	ReportFormatJSON ReportFormat = iota
+	// ReportFormatJSONL writes one JSON object per line: one per entry, then
+	// the summary, which has "kind": "summary"
+	ReportFormatJSONL
+)
+
+// ReportStatus describes the state of an entry after validation
+type ReportStatus string
+
+const (
+	// ReportStatusOK means the entry is exactly as in the signature
+	ReportStatusOK ReportStatus = "ok"
+	// ReportStatusMissing means the file or symlink doesn't exist
+	ReportStatusMissing ReportStatus = "missing"
+	// ReportStatusSizeMismatch means the file exists but is too short or too long
+	ReportStatusSizeMismatch ReportStatus = "size_mismatch"
+	// ReportStatusCorrupted means the file has the right size, but some of its blocks don't match
+	ReportStatusCorrupted ReportStatus = "corrupted"
+	// ReportStatusWrongTarget means the symlink points somewhere else
+	ReportStatusWrongTarget ReportStatus = "wrong_target"
+	// ReportStatusMissingDir means the directory doesn't exist, or isn't a directory
+	ReportStatusMissingDir ReportStatus = "missing_dir"
+	// ReportStatusUnchecked means validation stopped before this file was checked
+	ReportStatusUnchecked ReportStatus = "unchecked"
+)
+
+// A ReportRange is a range of corrupted bytes in a file
+type ReportRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// A ReportEntry describes the state of a file, directory or symlink
+type ReportEntry struct {
+	Path string `json:"path"`
+	// Kind is one of "file", "dir", "symlink"
+	Kind   string       `json:"kind"`
+	Status ReportStatus `json:"status"`
+
+	// Size is the expected size of a file
+	Size int64 `json:"size,omitempty"`
+	// ActualSize is set for size mismatches
+	ActualSize int64 `json:"actualSize,omitempty"`
+	// CorruptedRanges is set for corrupted files and size mismatches
+	CorruptedRanges []ReportRange `json:"corruptedRanges,omitempty"`
+
+	// Cached is set if the validation cache vouched for the file, in which
+	// case it wasn't read at all
+	Cached bool `json:"cached,omitempty"`
+	// BytesChecked is how much of the file was actually read and hashed
+	BytesChecked int64 `json:"bytesChecked"`
+	// Duration is the time, in seconds, spent reading and hashing the file.
+	// For large files validated as several ranges in parallel, it's the sum
+	// of the time spent on each range.
+	Duration float64 `json:"duration"`
+}
+
+// A ValidationSummary counts entries by status
+type ValidationSummary struct {
+	Files    int `json:"files"`
+	Dirs     int `json:"dirs"`
+	Symlinks int `json:"symlinks"`
+
+	OK           int `json:"ok"`
+	Missing      int `json:"missing"`
+	SizeMismatch int `json:"sizeMismatch"`
+	Corrupted    int `json:"corrupted"`
+	WrongTarget  int `json:"wrongTarget"`
+	MissingDirs  int `json:"missingDirs"`
+	Unchecked    int `json:"unchecked"`
+
+	BytesChecked   int64 `json:"bytesChecked"`
+	CorruptedBytes int64 `json:"corruptedBytes"`
+	// Duration of the whole validation, in seconds
+	Duration float64 `json:"duration"`
+}
+
+// A ValidationReport has one entry per file, directory and symlink of a
+// container (in that order), and a summary.
+type ValidationReport struct {
+	Entries []*ReportEntry     `json:"entries"`
+	Summary *ValidationSummary `json:"summary"`
+}
+
+type reportSummaryLine struct {
+	Kind string `json:"kind"`
+	*ValidationSummary
+}
+
+// WoundsReporter builds a ValidationReport from wounds, and optionally
+// writes it as JSON once all wounds have been received.
+//
+// The validator also tells it how each file was checked. Used on its own,
+// it only sees wounds: wounded files are reported as corrupted, wounded
+// symlinks as pointing to the wrong target, and nothing counts as checked.
+type WoundsReporter struct {
+	// optional
+
+	// Writer receives the report, in Format, if non-nil
+	Writer io.Writer
+	Format ReportFormat
+
+	// internal
+	container *tlc.Container
+	startTime time.Time
+
+	// guards files and symlinks, validator workers report on files
+	// while wounds are still coming in
+	mutex    sync.Mutex
+	files    []*fileReport
+	dirs     []bool
+	symlinks []ReportStatus
+
+	report         *ValidationReport
+	totalCorrupted int64
+	hasWounds      bool
+}
+
+type fileReport struct {
+	covered int64
+	wounds  []*Wound
+
+	// as reported by the validator
+	bytesChecked int64
+	duration     time.Duration
+	cached       bool
+	missing      bool
+	sizeMismatch bool
+	actualSize   int64
+}
+
+// fileCheck is what the validator found out about a file, or a range of it
+type fileCheck struct {
+	// bytesChecked is how much was read and hashed
+	bytesChecked int64
+	duration     time.Duration
+
+	// cached is set if the validation cache vouched for the file
+	cached bool
+	// missing is set if the file couldn't be opened because it doesn't exist
+	missing bool
+	// sizeMismatch is set if reading stopped before the end of the range, or
+	// went past the end of the file, actualSize is where reading stopped.
+	sizeMismatch bool
+	actualSize   int64
+}
+
+var _ WoundsConsumer = (*WoundsReporter)(nil)
+
+// Do receives wounds until the channel is closed, then builds (and writes) the report
+func (wr *WoundsReporter) Do(container *tlc.Container, wounds chan *Wound) error {
+	wr.begin(container)
+
+	for wound := range wounds {
+		err := wr.add(wound)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+	}
+
+	return wr.finish()
+}
+
+func (wr *WoundsReporter) begin(container *tlc.Container) {
+	wr.container = container
+	wr.startTime = time.Now()
+
+	wr.files = make([]*fileReport, len(container.Files))
+	for i := range wr.files {
+		wr.files[i] = &fileReport{}
+	}
+	wr.dirs = make([]bool, len(container.Dirs))
+	wr.symlinks = make([]ReportStatus, len(container.Symlinks))
+}
+
+// fileChecked records what the validator found out about a file. Ranges
+// of a file checked separately are added up.
+func (wr *WoundsReporter) fileChecked(fileIndex int64, check fileCheck) {
+	wr.mutex.Lock()
+	defer wr.mutex.Unlock()
+
+	fr := wr.files[fileIndex]
+	fr.bytesChecked += check.bytesChecked
+	fr.duration += check.duration
+	fr.cached = fr.cached || check.cached
+	fr.missing = fr.missing || check.missing
+
+	if check.sizeMismatch {
+		// ranges past the end of a short file all stop at their start,
+		// the one that actually reached the end stops first.
+		if !fr.sizeMismatch || check.actualSize < fr.actualSize {
+			fr.actualSize = check.actualSize
+		}
+		fr.sizeMismatch = true
+	}
+}
+
+// symlinkMissing records that a symlink doesn't exist at all, as opposed
+// to pointing to the wrong target.
+func (wr *WoundsReporter) symlinkMissing(symlinkIndex int64) {
+	wr.mutex.Lock()
+	defer wr.mutex.Unlock()
+
+	wr.symlinks[symlinkIndex] = ReportStatusMissing
+}
+
+func (wr *WoundsReporter) add(wound *Wound) error {
+	if !wound.Healthy() {
+		wr.totalCorrupted += wound.Size()
+		wr.hasWounds = true
+	}
+
+	switch wound.Kind {
+	case WoundKind_DIR:
+		wr.dirs[wound.Index] = true
+
+	case WoundKind_SYMLINK:
+		wr.mutex.Lock()
+		if wr.symlinks[wound.Index] == "" {
+			wr.symlinks[wound.Index] = ReportStatusWrongTarget
+		}
+		wr.mutex.Unlock()
+
+	case WoundKind_FILE, WoundKind_CLOSED_FILE:
+		wr.mutex.Lock()
+		defer wr.mutex.Unlock()
+
+		fr := wr.files[wound.Index]
+		fr.covered += wound.Size()
+		if wound.Kind == WoundKind_FILE {
+			fr.wounds = append(fr.wounds, wound)
+		}
+
+	default:
+		return fmt.Errorf("unknown wound kind: %d", wound.Kind)
+	}
+
+	return nil
+}
+
+func (wr *WoundsReporter) finish() error {
+	container := wr.container
+	report := &ValidationReport{
+		Summary: &ValidationSummary{
+			Files:    len(container.Files),
+			Dirs:     len(container.Dirs),
+			Symlinks: len(container.Symlinks),
+		},
+	}
+	summary := report.Summary
+
+	for fileIndex, file := range container.Files {
+		entry := wr.fileEntry(file, wr.files[fileIndex])
+		report.Entries = append(report.Entries, entry)
+
+		summary.BytesChecked += entry.BytesChecked
+		for _, r := range entry.CorruptedRanges {
+			summary.CorruptedBytes += r.End - r.Start
+		}
+	}
+
+	for dirIndex, dir := range container.Dirs {
+		entry := &ReportEntry{
+			Path:   dir.Path,
+			Kind:   "dir",
+			Status: ReportStatusOK,
+		}
+		if wr.dirs[dirIndex] {
+			entry.Status = ReportStatusMissingDir
+		}
+		report.Entries = append(report.Entries, entry)
+	}
+
+	for symlinkIndex, symlink := range container.Symlinks {
+		entry := &ReportEntry{
+			Path:   symlink.Path,
+			Kind:   "symlink",
+			Status: ReportStatusOK,
+		}
+		if wr.symlinks[symlinkIndex] != "" {
+			entry.Status = wr.symlinks[symlinkIndex]
+		}
+		report.Entries = append(report.Entries, entry)
+	}
+
+	for _, entry := range report.Entries {
+		switch entry.Status {
+		case ReportStatusOK:
+			summary.OK++
+		case ReportStatusMissing:
+			summary.Missing++
+		case ReportStatusSizeMismatch:
+			summary.SizeMismatch++
+		case ReportStatusCorrupted:
+			summary.Corrupted++
+		case ReportStatusWrongTarget:
+			summary.WrongTarget++
+		case ReportStatusMissingDir:
+			summary.MissingDirs++
+		case ReportStatusUnchecked:
+			summary.Unchecked++
+		}
+	}
+
+	summary.Duration = time.Since(wr.startTime).Seconds()
+	wr.report = report
+
+	if wr.Writer != nil {
+		err := wr.write()
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+	}
+
+	return nil
+}
+
+func (wr *WoundsReporter) fileEntry(file *tlc.File, fr *fileReport) *ReportEntry {
+	entry := &ReportEntry{
+		Path:         file.Path,
+		Kind:         "file",
+		Size:         file.Size,
+		Status:       ReportStatusOK,
+		Cached:       fr.cached,
+		BytesChecked: fr.bytesChecked,
+		Duration:     fr.duration.Seconds(),
+	}
+
+	if len(fr.wounds) == 0 {
+		if fr.covered < file.Size {
+			entry.Status = ReportStatusUnchecked
+		}
+		return entry
+	}
+
+	entry.Status = ReportStatusCorrupted
+	for _, wound := range MergeWounds(fr.wounds) {
+		entry.CorruptedRanges = append(entry.CorruptedRanges, ReportRange{
+			Start: wound.Start,
+			End:   wound.End,
+		})
+	}
+
+	if fr.missing {
+		entry.Status = ReportStatusMissing
+	} else if fr.sizeMismatch {
+		entry.Status = ReportStatusSizeMismatch
+		entry.ActualSize = fr.actualSize
+	}
+
+	return entry
+}
+
+func (wr *WoundsReporter) write() error {
+	encoder := json.NewEncoder(wr.Writer)
+
+	switch wr.Format {
+	case ReportFormatJSON:
+		return encoder.Encode(wr.report)
+
+	case ReportFormatJSONL:
+		for _, entry := range wr.report.Entries {
+			err := encoder.Encode(entry)
+			if err != nil {
+				return err
+			}
+		}
+
+		return encoder.Encode(&reportSummaryLine{
+			Kind:              "summary",
+			ValidationSummary: wr.report.Summary,
+		})
+
+	default:
+		return fmt.Errorf("unknown report format: %d", wr.Format)
+	}
+}
+
+// Report returns the report built by Do, or nil if Do hasn't returned yet
+func (wr *WoundsReporter) Report() *ValidationReport {
+	return wr.report
+}
+
+// TotalCorrupted returns the total size of wounds received by this reporter
+func (wr *WoundsReporter) TotalCorrupted() int64 {
+	return wr.totalCorrupted
+}
+
+// HasWounds returns true if this reporter received any wounds
+func (wr *WoundsReporter) HasWounds() bool {
+	return wr.hasWounds
+}
@@ -0,0 +1,152 @@
+package pwr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"github.com/itchio/wharf/pools/fspool"
+	"github.com/itchio/wharf/state"
+	"github.com/itchio/wharf/tlc"
+)
+
+func Test_ValidationReport(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "validationreport")
+	assert.NoError(t, err)
+	defer os.RemoveAll(mainDir)
+
+	targetDir := filepath.Join(mainDir, "target")
+
+	makeTestDir(t, targetDir, testDirSettings{
+		entries: []testDirEntry{
+			{path: "fine", seed: 0x1, size: BlockSize*2 + 3},
+			{path: "corrupted", seed: 0x2, size: BlockSize * 4},
+			{path: "short", seed: 0x3, size: BlockSize * 4},
+			{path: "gone", seed: 0x4, size: 1024},
+			{path: "link-wrong", dest: "fine"},
+			{path: "link-gone", dest: "fine"},
+		},
+	})
+	assert.NoError(t, os.MkdirAll(filepath.Join(targetDir, "empty-dir"), 0755))
+
+	container, err := tlc.WalkAny(targetDir, nil)
+	assert.NoError(t, err)
+
+	hashes, err := ComputeSignature(container, fspool.New(container, targetDir), &state.Consumer{})
+	assert.NoError(t, err)
+
+	signature := &SignatureInfo{
+		Container: container,
+		Hashes:    hashes,
+	}
+
+	f, err := os.OpenFile(filepath.Join(targetDir, "corrupted"), os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xde, 0xad}, BlockSize+12)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	assert.NoError(t, os.Truncate(filepath.Join(targetDir, "short"), BlockSize*2+1))
+	assert.NoError(t, os.Remove(filepath.Join(targetDir, "gone")))
+	assert.NoError(t, os.Remove(filepath.Join(targetDir, "empty-dir")))
+	assert.NoError(t, os.Remove(filepath.Join(targetDir, "link-gone")))
+	assert.NoError(t, os.Remove(filepath.Join(targetDir, "link-wrong")))
+	assert.NoError(t, os.Symlink("corrupted", filepath.Join(targetDir, "link-wrong")))
+
+	validate := func(format ReportFormat) (*ValidatorContext, []byte) {
+		buf := new(bytes.Buffer)
+		vctx := &ValidatorContext{
+			Consumer:     &state.Consumer{},
+			ReportWriter: buf,
+			ReportFormat: format,
+		}
+		assert.NoError(t, vctx.Validate(targetDir, signature))
+		return vctx, buf.Bytes()
+	}
+
+	vctx, output := validate(ReportFormatJSON)
+
+	report := &ValidationReport{}
+	assert.NoError(t, json.Unmarshal(output, report))
+
+	entries := make(map[string]*ReportEntry)
+	for _, entry := range report.Entries {
+		entries[entry.Path] = entry
+	}
+
+	assert.Equal(t, ReportStatusOK, entries["fine"].Status)
+	assert.EqualValues(t, BlockSize*2+3, entries["fine"].BytesChecked)
+	assert.False(t, entries["fine"].Cached)
+
+	assert.Equal(t, ReportStatusCorrupted, entries["corrupted"].Status)
+	assert.EqualValues(t, []ReportRange{{Start: BlockSize, End: BlockSize * 2}}, entries["corrupted"].CorruptedRanges)
+	assert.EqualValues(t, BlockSize*4, entries["corrupted"].BytesChecked)
+
+	assert.Equal(t, ReportStatusSizeMismatch, entries["short"].Status)
+	assert.EqualValues(t, BlockSize*2+1, entries["short"].ActualSize)
+	assert.EqualValues(t, BlockSize*2+1, entries["short"].BytesChecked)
+	assert.EqualValues(t, []ReportRange{{Start: BlockSize * 2, End: BlockSize * 4}}, entries["short"].CorruptedRanges)
+
+	assert.Equal(t, ReportStatusMissing, entries["gone"].Status)
+	assert.EqualValues(t, 0, entries["gone"].BytesChecked)
+
+	assert.Equal(t, ReportStatusMissingDir, entries["empty-dir"].Status)
+	assert.Equal(t, ReportStatusWrongTarget, entries["link-wrong"].Status)
+	assert.Equal(t, ReportStatusMissing, entries["link-gone"].Status)
+
+	summary := report.Summary
+	assert.EqualValues(t, 4, summary.Files)
+	assert.EqualValues(t, 2, summary.Symlinks)
+	assert.EqualValues(t, 1, summary.Corrupted)
+	assert.EqualValues(t, 1, summary.SizeMismatch)
+	assert.EqualValues(t, 2, summary.Missing)
+	assert.EqualValues(t, 1, summary.WrongTarget)
+	assert.EqualValues(t, 1, summary.MissingDirs)
+	assert.EqualValues(t, 0, summary.Unchecked)
+	assert.EqualValues(t, summary.Dirs, summary.OK)
+	assert.EqualValues(t, BlockSize+BlockSize*2+1024, summary.CorruptedBytes)
+
+	// the summary is also available without a writer
+	assert.EqualValues(t, summary.Missing, vctx.Summary.Missing)
+	assert.EqualValues(t, summary.BytesChecked, vctx.Summary.BytesChecked)
+
+	t.Logf("...as json lines")
+	_, output = validate(ReportFormatJSONL)
+
+	var lines [][]byte
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		lines = append(lines, append([]byte{}, scanner.Bytes()...))
+	}
+	assert.EqualValues(t, len(report.Entries)+1, len(lines))
+
+	entry := &ReportEntry{}
+	assert.NoError(t, json.Unmarshal(lines[0], entry))
+	assert.Equal(t, report.Entries[0].Path, entry.Path)
+
+	summaryLine := &reportSummaryLine{}
+	assert.NoError(t, json.Unmarshal(lines[len(lines)-1], summaryLine))
+	assert.Equal(t, "summary", summaryLine.Kind)
+	assert.EqualValues(t, 2, summaryLine.Missing)
+
+	t.Logf("...with a validation cache")
+	cachePath := filepath.Join(mainDir, "validation-cache")
+	for i := 0; i < 2; i++ {
+		vctx := &ValidatorContext{
+			Consumer:  &state.Consumer{},
+			CachePath: cachePath,
+		}
+		assert.NoError(t, vctx.Validate(targetDir, signature))
+		if i == 0 {
+			assert.EqualValues(t, summary.BytesChecked, vctx.Summary.BytesChecked)
+		} else {
+			// only the files that failed are hashed again
+			assert.EqualValues(t, BlockSize*4+BlockSize*2+1, vctx.Summary.BytesChecked)
+		}
+	}
+}
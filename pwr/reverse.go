@@ -0,0 +1,554 @@
+package pwr
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/go-errors/errors"
+	"github.com/itchio/wharf/bsdiff"
+	"github.com/itchio/wharf/state"
+	"github.com/itchio/wharf/tlc"
+	"github.com/itchio/wharf/wire"
+	"github.com/itchio/wharf/wsync"
+)
+
+// A ReverseContext writes rollback patches: given a patch from an old build
+// to a new one, and the old build, it writes a patch from the new build back
+// to the old one.
+//
+// Nothing is diffed, and the new build is never rebuilt: the forward patch's
+// BLOCK_RANGE ops are inverted, so that whatever they copied from the old build
+// into whole blocks of the new build is copied back. The rest of the old build
+// is written as DATA, read from TargetPool. That includes files the forward
+// patch rebuilt with bsdiff or zstd, so, like squashed patches, rollback patches
+// can (and should) be optimized with a RediffContext afterwards.
+type ReverseContext struct {
+	// required
+	Compression *CompressionSettings
+	// TargetPool is the old build, the one the forward patch applies to.
+	// It's closed by WriteReversePatch.
+	TargetPool wsync.Pool
+
+	// optional
+	Consumer *state.Consumer
+
+	// set on WriteReversePatch
+	// TargetContainer is the old build, which the rollback patch goes to
+	TargetContainer *tlc.Container
+	// SourceContainer is the new build, which the rollback patch goes from
+	SourceContainer *tlc.Container
+
+	ReusedBytes int64
+	FreshBytes  int64
+}
+
+// A reverseBlock is a block of the new build that was copied from a file
+// of the old build by the forward patch.
+type reverseBlock struct {
+	// where it comes from in the old file
+	oldOffset int64
+	length    int64
+
+	newFileIndex  int64
+	newBlockIndex int64
+}
+
+// WriteReversePatch reads a forward patch from patchReader, and writes
+// the rollback patch and the old build's signature to reversePatchWriter
+// and reverseSignatureWriter.
+func (rctx *ReverseContext) WriteReversePatch(patchReader io.Reader, reversePatchWriter io.Writer, reverseSignatureWriter io.Writer) error {
+	if rctx.Compression == nil {
+		return errors.Wrap(fmt.Errorf("No compression settings specified, bailing out"), 0)
+	}
+
+	if rctx.TargetPool == nil {
+		return errors.Wrap(fmt.Errorf("reverse: need a TargetPool"), 0)
+	}
+
+	consumer := rctx.Consumer
+	if consumer == nil {
+		consumer = &state.Consumer{}
+	}
+
+	consumer.Info("Inverting forward patch...")
+	blocks, err := rctx.readForwardPatch(patchReader)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	consumer.Info("Writing rollback patch...")
+	err = rctx.writePatch(reversePatchWriter, blocks, consumer)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	consumer.Info("Computing old build signature...")
+	err = rctx.writeSignature(reverseSignatureWriter, consumer)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+// readForwardPatch reads the forward patch, and returns the blocks of the
+// new build that come from the old build, for each file of the old build.
+func (rctx *ReverseContext) readForwardPatch(patchReader io.Reader) ([][]reverseBlock, error) {
+	rawPatchWire := wire.NewReadContext(patchReader)
+	err := rawPatchWire.ExpectMagic(PatchMagic)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	header := &PatchHeader{}
+	err = rawPatchWire.ReadMessage(header)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	patchWire, err := DecompressWire(rawPatchWire, header.Compression)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	rctx.TargetContainer = &tlc.Container{}
+	err = patchWire.ReadMessage(rctx.TargetContainer)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	rctx.SourceContainer = &tlc.Container{}
+	err = patchWire.ReadMessage(rctx.SourceContainer)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	blocks := make([][]reverseBlock, len(rctx.TargetContainer.Files))
+
+	sh := &SyncHeader{}
+	for fileIndex := range rctx.SourceContainer.Files {
+		sh.Reset()
+		err = patchWire.ReadMessage(sh)
+		if err != nil {
+			return nil, errors.Wrap(err, 0)
+		}
+
+		if sh.FileIndex != int64(fileIndex) {
+			return nil, errors.Wrap(ErrMalformedPatch, 0)
+		}
+
+		switch sh.Type {
+		case SyncHeader_RSYNC:
+			err = rctx.invertOps(patchWire, int64(fileIndex), blocks)
+		case SyncHeader_BSDIFF, SyncHeader_BSDIFF_FILTERED:
+			err = skipBsdiff(patchWire)
+		case SyncHeader_ZSTD:
+			err = skipZstd(patchWire)
+		default:
+			err = errors.Wrap(ErrMalformedPatch, 0)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, 0)
+		}
+	}
+
+	return blocks, nil
+}
+
+// invertOps reads the BLOCK_RANGE and DATA ops of a new file, up until
+// HEY_YOU_DID_IT, and adds the whole blocks of it that come from the old
+// build to blocks.
+func (rctx *ReverseContext) invertOps(patchWire *wire.ReadContext, newFileIndex int64, blocks [][]reverseBlock) error {
+	newSize := rctx.SourceContainer.Files[newFileIndex].Size
+	rop := &SyncOp{}
+
+	// how much of the new file the ops have written so far
+	var written int64
+
+	for {
+		rop.Reset()
+		err := patchWire.ReadMessage(rop)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+
+		switch rop.Type {
+		case SyncOp_BLOCK_RANGE:
+			if rop.FileIndex < 0 || rop.FileIndex >= int64(len(rctx.TargetContainer.Files)) {
+				return errors.Wrap(ErrMalformedPatch, 0)
+			}
+
+			oldSize := rctx.TargetContainer.Files[rop.FileIndex].Size
+			oldOffset := rop.BlockIndex * BlockSize
+			length := rop.BlockSpan * BlockSize
+			if oldOffset+length > oldSize {
+				length = oldSize - oldOffset
+			}
+
+			// only blocks of the new file that are entirely copied
+			// from the old one can be copied back
+			end := written + length
+			for blockIndex := ComputeNumBlocks(written); blockIndex*BlockSize < end && blockIndex*BlockSize < newSize; blockIndex++ {
+				blockStart := blockIndex * BlockSize
+				blockSize := ComputeBlockSize(newSize, blockIndex)
+				if blockStart+blockSize > end {
+					break
+				}
+
+				blocks[rop.FileIndex] = append(blocks[rop.FileIndex], reverseBlock{
+					oldOffset:     oldOffset + blockStart - written,
+					length:        blockSize,
+					newFileIndex:  newFileIndex,
+					newBlockIndex: blockIndex,
+				})
+			}
+			written = end
+
+		case SyncOp_DATA:
+			written += int64(len(rop.Data))
+
+		case SyncOp_HEY_YOU_DID_IT:
+			return nil
+
+		default:
+			return errors.Wrap(ErrMalformedPatch, 0)
+		}
+	}
+}
+
+// skipBsdiff reads the bsdiff header and controls of a file, up until
+// HEY_YOU_DID_IT
+func skipBsdiff(patchWire *wire.ReadContext) error {
+	bh := &BsdiffHeader{}
+	err := patchWire.ReadMessage(bh)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	ctrl := &bsdiff.Control{}
+	for {
+		ctrl.Reset()
+		err = patchWire.ReadMessage(ctrl)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+
+		if ctrl.Eof {
+			break
+		}
+	}
+
+	rop := &SyncOp{}
+	err = patchWire.ReadMessage(rop)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	if rop.Type != SyncOp_HEY_YOU_DID_IT {
+		return errors.Wrap(ErrMalformedPatch, 0)
+	}
+	return nil
+}
+
+// skipZstd reads the zstd header and DATA ops of a file, up until
+// HEY_YOU_DID_IT
+func skipZstd(patchWire *wire.ReadContext) error {
+	zh := &ZstdHeader{}
+	err := patchWire.ReadMessage(zh)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	rop := &SyncOp{}
+	for {
+		rop.Reset()
+		err = patchWire.ReadMessage(rop)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+
+		switch rop.Type {
+		case SyncOp_DATA:
+			// skip
+		case SyncOp_HEY_YOU_DID_IT:
+			return nil
+		default:
+			return errors.Wrap(ErrMalformedPatch, 0)
+		}
+	}
+}
+
+func (rctx *ReverseContext) writePatch(patchWriter io.Writer, blocks [][]reverseBlock, consumer *state.Consumer) error {
+	rawPatchWire := wire.NewWriteContext(patchWriter)
+	err := rawPatchWire.WriteMagic(PatchMagic)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	header := &PatchHeader{
+		Compression: rctx.Compression,
+	}
+
+	err = rawPatchWire.WriteMessage(header)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	patchWire, err := CompressWire(rawPatchWire, rctx.Compression)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	// the rollback patch goes from the new build to the old one
+	err = patchWire.WriteMessage(rctx.SourceContainer)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	err = patchWire.WriteMessage(rctx.TargetContainer)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	sh := &SyncHeader{}
+	rop := &SyncOp{}
+	var doneBytes int64
+
+	for oldFileIndex, oldFile := range rctx.TargetContainer.Files {
+		consumer.ProgressLabel(oldFile.Path)
+
+		sh.Reset()
+		sh.FileIndex = int64(oldFileIndex)
+		err = patchWire.WriteMessage(sh)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+
+		ow := &reverseOpWriter{
+			rctx:         rctx,
+			wctx:         patchWire,
+			oldFileIndex: int64(oldFileIndex),
+		}
+
+		fileBlocks := blocks[oldFileIndex]
+		sort.SliceStable(fileBlocks, func(i, j int) bool {
+			return fileBlocks[i].oldOffset < fileBlocks[j].oldOffset
+		})
+
+		// how much of the old file has been written so far
+		var written int64
+		for _, block := range fileBlocks {
+			if block.oldOffset < written {
+				// overlaps with a block we already used
+				continue
+			}
+
+			err = ow.writeData(written, block.oldOffset-written)
+			if err != nil {
+				return errors.Wrap(err, 0)
+			}
+
+			err = ow.writeBlock(block)
+			if err != nil {
+				return errors.Wrap(err, 0)
+			}
+			written = block.oldOffset + block.length
+		}
+
+		err = ow.writeData(written, oldFile.Size-written)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+
+		err = ow.flush()
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+
+		rop.Reset()
+		rop.Type = SyncOp_HEY_YOU_DID_IT
+		err = patchWire.WriteMessage(rop)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+
+		doneBytes += oldFile.Size
+		consumer.Progress(float64(doneBytes) / float64(rctx.TargetContainer.Size))
+	}
+
+	err = patchWire.Close()
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+func (rctx *ReverseContext) writeSignature(signatureWriter io.Writer, consumer *state.Consumer) error {
+	rawSigWire := wire.NewWriteContext(signatureWriter)
+	err := rawSigWire.WriteMagic(SignatureMagic)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	err = rawSigWire.WriteMessage(&SignatureHeader{
+		Compression: rctx.Compression,
+	})
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	sigWire, err := CompressWire(rawSigWire, rctx.Compression)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	err = sigWire.WriteMessage(rctx.TargetContainer)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	err = ComputeSignatureToWriter(rctx.TargetContainer, rctx.TargetPool, consumer, makeSigWriter(sigWire))
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	err = sigWire.Close()
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+// A reverseOpWriter writes the ops of a file of the old build: consecutive
+// blocks of the new build are merged into a single BLOCK_RANGE op, and bytes
+// read from the old build into DATA ops. flush must be called at the end.
+type reverseOpWriter struct {
+	rctx         *ReverseContext
+	wctx         *wire.WriteContext
+	oldFileIndex int64
+	reader       io.ReadSeeker
+
+	// the BLOCK_RANGE op being built, if span > 0
+	rangeFileIndex  int64
+	rangeBlockIndex int64
+	rangeSpan       int64
+
+	data []byte
+	op   SyncOp
+}
+
+func (ow *reverseOpWriter) writeBlock(block reverseBlock) error {
+	if ow.rangeSpan > 0 && block.newFileIndex == ow.rangeFileIndex && block.newBlockIndex == ow.rangeBlockIndex+ow.rangeSpan {
+		ow.rangeSpan++
+	} else {
+		err := ow.flush()
+		if err != nil {
+			return err
+		}
+
+		ow.rangeFileIndex = block.newFileIndex
+		ow.rangeBlockIndex = block.newBlockIndex
+		ow.rangeSpan = 1
+	}
+
+	ow.rctx.ReusedBytes += block.length
+	return nil
+}
+
+// writeData adds length bytes of the old file at offset to the DATA ops
+func (ow *reverseOpWriter) writeData(offset int64, length int64) error {
+	if length <= 0 {
+		return nil
+	}
+
+	err := ow.flushRange()
+	if err != nil {
+		return err
+	}
+
+	if ow.reader == nil {
+		ow.reader, err = ow.rctx.TargetPool.GetReadSeeker(ow.oldFileIndex)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+	}
+
+	_, err = ow.reader.Seek(offset, os.SEEK_SET)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	for length > 0 {
+		n := int64(wsync.MaxDataOp - len(ow.data))
+		if n > length {
+			n = length
+		}
+
+		start := len(ow.data)
+		ow.data = append(ow.data, make([]byte, n)...)
+		_, err = io.ReadFull(ow.reader, ow.data[start:])
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+		length -= n
+
+		if len(ow.data) == wsync.MaxDataOp {
+			err = ow.flushData()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (ow *reverseOpWriter) flush() error {
+	err := ow.flushRange()
+	if err != nil {
+		return err
+	}
+
+	return ow.flushData()
+}
+
+func (ow *reverseOpWriter) flushRange() error {
+	if ow.rangeSpan == 0 {
+		return nil
+	}
+
+	ow.op.Reset()
+	ow.op.Type = SyncOp_BLOCK_RANGE
+	ow.op.FileIndex = ow.rangeFileIndex
+	ow.op.BlockIndex = ow.rangeBlockIndex
+	ow.op.BlockSpan = ow.rangeSpan
+	err := ow.wctx.WriteMessage(&ow.op)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	ow.rangeSpan = 0
+	return nil
+}
+
+func (ow *reverseOpWriter) flushData() error {
+	if len(ow.data) == 0 {
+		return nil
+	}
+
+	ow.op.Reset()
+	ow.op.Type = SyncOp_DATA
+	ow.op.Data = ow.data
+	err := ow.wctx.WriteMessage(&ow.op)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	ow.rctx.FreshBytes += int64(len(ow.data))
+	ow.data = ow.data[:0]
+	return nil
+}
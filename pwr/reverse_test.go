@@ -0,0 +1,130 @@
+package pwr
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"github.com/itchio/wharf/pools/fspool"
+	"github.com/itchio/wharf/state"
+	"github.com/itchio/wharf/tlc"
+)
+
+func Test_ReversePatch(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "reverse")
+	assert.NoError(t, err)
+	defer os.RemoveAll(mainDir)
+
+	v1 := filepath.Join(mainDir, "v1")
+	makeTestDir(t, v1, testDirSettings{
+		entries: []testDirEntry{
+			{path: "subdir/file-1", seed: 0x1, size: BlockSize*11 + 14},
+			{path: "file-1", seed: 0x2},
+			{path: "dir2/file-2", seed: 0x3},
+			{path: "gone", seed: 0x4, size: BlockSize * 2},
+		},
+	})
+
+	v2 := filepath.Join(mainDir, "v2")
+	makeTestDir(t, v2, testDirSettings{
+		entries: []testDirEntry{
+			{path: "subdir/file-1", seed: 0x1, size: BlockSize*17 + 14, bsmods: []bsmod{
+				bsmod{interval: BlockSize/7 + 3, delta: 0x4, max: 12, skip: 10},
+			}},
+			{path: "file-1-renamed", seed: 0x2},
+			{path: "dir2/file-2", seed: 0x3},
+			{path: "new", seed: 0x5, size: BlockSize * 3},
+		},
+	})
+
+	compression := &CompressionSettings{
+		Algorithm: CompressionAlgorithm_NONE,
+	}
+	consumer := &state.Consumer{}
+
+	targetContainer, err := tlc.WalkAny(v1, nil)
+	assert.NoError(t, err)
+	sourceContainer, err := tlc.WalkAny(v2, nil)
+	assert.NoError(t, err)
+
+	targetSignature, err := ComputeSignature(targetContainer, fspool.New(targetContainer, v1), consumer)
+	assert.NoError(t, err)
+
+	patchBuffer := new(bytes.Buffer)
+	dctx := &DiffContext{
+		Compression: compression,
+		Consumer:    consumer,
+
+		SourceContainer: sourceContainer,
+		Pool:            fspool.New(sourceContainer, v2),
+
+		TargetContainer: targetContainer,
+		TargetSignature: targetSignature,
+	}
+	assert.NoError(t, dctx.WritePatch(patchBuffer, ioutil.Discard))
+
+	// only the old build and the forward patch are needed
+	rctx := &ReverseContext{
+		Compression: compression,
+		TargetPool:  fspool.New(targetContainer, v1),
+		Consumer:    consumer,
+	}
+
+	reversePatchBuffer := new(bytes.Buffer)
+	reverseSignatureBuffer := new(bytes.Buffer)
+	assert.NoError(t, rctx.WriteReversePatch(bytes.NewReader(patchBuffer.Bytes()), reversePatchBuffer, reverseSignatureBuffer))
+	assert.EqualValues(t, len(targetContainer.Files), len(rctx.TargetContainer.Files))
+	assert.EqualValues(t, len(sourceContainer.Files), len(rctx.SourceContainer.Files))
+	assert.True(t, rctx.ReusedBytes > rctx.FreshBytes, "rollback patch should reuse most of the new build")
+
+	v1After := filepath.Join(mainDir, "v1After")
+	actx := &ApplyContext{
+		TargetPath: v2,
+		OutputPath: v1After,
+		Consumer:   consumer,
+	}
+	assert.NoError(t, actx.ApplyPatch(bytes.NewReader(reversePatchBuffer.Bytes())))
+
+	// the rollback patch's signature is the old build's
+	signature, err := ReadSignature(bytes.NewReader(reverseSignatureBuffer.Bytes()))
+	assert.NoError(t, err)
+	assert.NoError(t, AssertValid(v1After, signature))
+	assert.NoError(t, AssertValid(v1, signature))
+
+	t.Logf("...from an optimized patch")
+	rc := &RediffContext{
+		SourcePool:  fspool.New(sourceContainer, v2),
+		TargetPool:  fspool.New(targetContainer, v1),
+		Compression: compression,
+		Consumer:    consumer,
+		Engine:      RediffEngineBsdiff,
+	}
+	assert.NoError(t, rc.AnalyzePatch(bytes.NewReader(patchBuffer.Bytes())))
+	optimizedBuffer := new(bytes.Buffer)
+	assert.NoError(t, rc.OptimizePatch(bytes.NewReader(patchBuffer.Bytes()), optimizedBuffer))
+
+	rctx = &ReverseContext{
+		Compression: compression,
+		TargetPool:  fspool.New(targetContainer, v1),
+		Consumer:    consumer,
+	}
+	reversePatchBuffer.Reset()
+	assert.NoError(t, rctx.WriteReversePatch(bytes.NewReader(optimizedBuffer.Bytes()), reversePatchBuffer, ioutil.Discard))
+
+	assert.NoError(t, os.RemoveAll(v1After))
+	actx = &ApplyContext{
+		TargetPath: v2,
+		OutputPath: v1After,
+		Consumer:   consumer,
+	}
+	assert.NoError(t, actx.ApplyPatch(bytes.NewReader(reversePatchBuffer.Bytes())))
+	assert.NoError(t, AssertValid(v1After, signature))
+
+	rctx = &ReverseContext{
+		TargetPool: fspool.New(targetContainer, v1),
+	}
+	assert.Error(t, rctx.WriteReversePatch(bytes.NewReader(patchBuffer.Bytes()), ioutil.Discard, ioutil.Discard))
+}
@@ -0,0 +1,718 @@
+package pwr
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/go-errors/errors"
+	"github.com/itchio/wharf/bsdiff"
+	"github.com/itchio/wharf/state"
+	"github.com/itchio/wharf/tlc"
+	"github.com/itchio/wharf/wire"
+	"github.com/itchio/wharf/wsync"
+)
+
+var (
+	// ErrSquashNeedsTarget is returned by Squash when the squashed patch needs
+	// bytes from the first build, and no TargetPool was given
+	ErrSquashNeedsTarget = errors.New("squashing these patches needs the first build")
+)
+
+// A SquashContext composes a chain of consecutive patches (A to B, B to C, ...)
+// into a single patch, from the first build straight to the last one.
+//
+// Every file of every build is tracked as a list of segments, which either come
+// from the first build, or are literal bytes. Files patched with BLOCK_RANGE and
+// DATA ops are composed from the patches alone, and end up as BLOCK_RANGE ops
+// when what they reuse from the first build is block-aligned. Unaligned reuse
+// is turned into DATA, which needs TargetPool. Files patched with bsdiff or zstd
+// are rebuilt, which also needs TargetPool if they're based on the first build.
+// Intermediate builds are never written out as a whole.
+//
+// The squashed patch only has BLOCK_RANGE and DATA ops, so it can (and should)
+// be optimized with a RediffContext afterwards.
+type SquashContext struct {
+	// required
+	Compression *CompressionSettings
+
+	// optional
+	// TargetPool is the first build, the one the first patch applies to
+	TargetPool wsync.Pool
+	Consumer   *state.Consumer
+
+	// set on Squash
+	// TargetContainer is the first build
+	TargetContainer *tlc.Container
+	// SourceContainer is the last build
+	SourceContainer *tlc.Container
+
+	Stats SquashStats
+
+	// internal
+	store *squashStore
+}
+
+// SquashStats contains information on how patches were squashed
+type SquashStats struct {
+	// ReusedBytes is how much of the last build comes from the first build, via BLOCK_RANGE ops
+	ReusedBytes int64
+	// FreshBytes is how much of the last build is stored in DATA ops
+	FreshBytes int64
+	// RebuiltFiles is how many files had to be rebuilt because they were patched
+	// with bsdiff or zstd
+	RebuiltFiles int64
+}
+
+// Squash reads consecutive patches from patchReaders, and writes a single
+// patch that goes from the first patch's target to the last patch's source.
+func (sc *SquashContext) Squash(patchReaders []io.Reader, patchWriter io.Writer) error {
+	if sc.Compression == nil {
+		return errors.Wrap(fmt.Errorf("No compression settings specified, bailing out"), 0)
+	}
+
+	if len(patchReaders) == 0 {
+		return errors.Wrap(fmt.Errorf("squash: need at least one patch"), 0)
+	}
+
+	if sc.Consumer == nil {
+		sc.Consumer = &state.Consumer{}
+	}
+
+	store, err := newSquashStore()
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	defer store.close()
+	sc.store = store
+	sc.Stats = SquashStats{}
+
+	var files []squashFile
+	var buildContainer *tlc.Container
+	for i, patchReader := range patchReaders {
+		sc.Consumer.Infof("Squashing patch %d/%d...", i+1, len(patchReaders))
+
+		files, buildContainer, err = sc.squashPatch(patchReader, files, buildContainer)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+	}
+	sc.SourceContainer = buildContainer
+
+	err = sc.writePatch(patchWriter, files)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+// squashPatch reads a patch that applies to the build made of files, and
+// returns the files of the build it produces
+func (sc *SquashContext) squashPatch(patchReader io.Reader, files []squashFile, previousContainer *tlc.Container) ([]squashFile, *tlc.Container, error) {
+	rawPatchWire := wire.NewReadContext(patchReader)
+	err := rawPatchWire.ExpectMagic(PatchMagic)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, 0)
+	}
+
+	header := &PatchHeader{}
+	err = rawPatchWire.ReadMessage(header)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, 0)
+	}
+
+	patchWire, err := DecompressWire(rawPatchWire, header.Compression)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, 0)
+	}
+
+	targetContainer := &tlc.Container{}
+	err = patchWire.ReadMessage(targetContainer)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, 0)
+	}
+
+	sourceContainer := &tlc.Container{}
+	err = patchWire.ReadMessage(sourceContainer)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, 0)
+	}
+
+	if previousContainer == nil {
+		// first patch: every file of the first build is made of itself
+		sc.TargetContainer = targetContainer
+		files = make([]squashFile, len(targetContainer.Files))
+		for i, f := range targetContainer.Files {
+			files[i] = files[i].append(int64(i), 0, f.Size)
+		}
+	} else if !sameFiles(previousContainer, targetContainer) {
+		return nil, nil, errors.Wrap(fmt.Errorf("squash: patch doesn't apply to the build the previous patch produces"), 0)
+	}
+
+	pool := &squashPool{sc: sc, files: files}
+	newFiles := make([]squashFile, len(sourceContainer.Files))
+
+	sh := &SyncHeader{}
+	rop := &SyncOp{}
+
+	for fileIndex, f := range sourceContainer.Files {
+		sc.Consumer.ProgressLabel(f.Path)
+
+		sh.Reset()
+		err = patchWire.ReadMessage(sh)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, 0)
+		}
+
+		if sh.FileIndex != int64(fileIndex) {
+			return nil, nil, errors.Wrap(ErrMalformedPatch, 0)
+		}
+
+		switch sh.Type {
+		case SyncHeader_RSYNC:
+			newFiles[fileIndex], err = sc.squashOps(patchWire, targetContainer, files)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, 0)
+			}
+
+		case SyncHeader_BSDIFF, SyncHeader_BSDIFF_FILTERED:
+			bh := &BsdiffHeader{}
+			err = patchWire.ReadMessage(bh)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, 0)
+			}
+
+			filter, err := bsdiffFilter(sh, bh)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, 0)
+			}
+
+			targetReader, err := pool.GetReadSeeker(bh.TargetIndex)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, 0)
+			}
+
+			offset := sc.store.size
+			pc := &bsdiff.PatchContext{
+				Filter: filter,
+			}
+			err = pc.Patch(targetReader, sc.store, f.Size, patchWire.ReadMessage)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, 0)
+			}
+
+			rop.Reset()
+			err = patchWire.ReadMessage(rop)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, 0)
+			}
+
+			if rop.Type != SyncOp_HEY_YOU_DID_IT {
+				return nil, nil, errors.Wrap(ErrMalformedPatch, 0)
+			}
+
+			newFiles[fileIndex], err = sc.rebuiltFile(offset, f.Size)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, 0)
+			}
+
+		case SyncHeader_ZSTD:
+			zh := &ZstdHeader{}
+			err = patchWire.ReadMessage(zh)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, 0)
+			}
+
+			offset := sc.store.size
+			err = applyZstd(patchWire, pool, zh.TargetIndex, sc.store, f.Size)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, 0)
+			}
+
+			newFiles[fileIndex], err = sc.rebuiltFile(offset, f.Size)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, 0)
+			}
+
+		default:
+			return nil, nil, errors.Wrap(ErrMalformedPatch, 0)
+		}
+	}
+
+	return newFiles, sourceContainer, nil
+}
+
+// squashOps reads BLOCK_RANGE and DATA ops up until HEY_YOU_DID_IT, and
+// returns the file they make out of files
+func (sc *SquashContext) squashOps(patchWire *wire.ReadContext, targetContainer *tlc.Container, files []squashFile) (squashFile, error) {
+	var result squashFile
+	rop := &SyncOp{}
+
+	for {
+		rop.Reset()
+		err := patchWire.ReadMessage(rop)
+		if err != nil {
+			return nil, errors.Wrap(err, 0)
+		}
+
+		switch rop.Type {
+		case SyncOp_BLOCK_RANGE:
+			if rop.FileIndex < 0 || rop.FileIndex >= int64(len(files)) {
+				return nil, errors.Wrap(ErrMalformedPatch, 0)
+			}
+
+			fileSize := targetContainer.Files[rop.FileIndex].Size
+			offset := rop.BlockIndex * BlockSize
+			length := rop.BlockSpan * BlockSize
+			if offset+length > fileSize {
+				length = fileSize - offset
+			}
+
+			result, err = files[rop.FileIndex].slice(result, offset, length)
+			if err != nil {
+				return nil, errors.Wrap(err, 0)
+			}
+
+		case SyncOp_DATA:
+			offset := sc.store.size
+			_, err = sc.store.Write(rop.Data)
+			if err != nil {
+				return nil, errors.Wrap(err, 0)
+			}
+			result = result.append(-1, offset, int64(len(rop.Data)))
+
+		case SyncOp_HEY_YOU_DID_IT:
+			return result, nil
+
+		default:
+			return nil, errors.Wrap(ErrMalformedPatch, 0)
+		}
+	}
+}
+
+// rebuiltFile returns a file made of what was written to the store since offset
+func (sc *SquashContext) rebuiltFile(offset int64, size int64) (squashFile, error) {
+	if sc.store.size-offset != size {
+		return nil, errors.Wrap(ErrMalformedPatch, 1)
+	}
+
+	sc.Stats.RebuiltFiles++
+
+	var result squashFile
+	return result.append(-1, offset, size), nil
+}
+
+func (sc *SquashContext) writePatch(patchWriter io.Writer, files []squashFile) error {
+	rawPatchWire := wire.NewWriteContext(patchWriter)
+	err := rawPatchWire.WriteMagic(PatchMagic)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	header := &PatchHeader{
+		Compression: sc.Compression,
+	}
+
+	err = rawPatchWire.WriteMessage(header)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	patchWire, err := CompressWire(rawPatchWire, sc.Compression)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	err = patchWire.WriteMessage(sc.TargetContainer)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	err = patchWire.WriteMessage(sc.SourceContainer)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	sh := &SyncHeader{}
+	rop := &SyncOp{}
+
+	for fileIndex, file := range files {
+		sh.Reset()
+		sh.FileIndex = int64(fileIndex)
+		err = patchWire.WriteMessage(sh)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+
+		ow := &squashOpWriter{sc: sc, wctx: patchWire}
+		for _, seg := range file {
+			err = ow.writeSegment(seg)
+			if err != nil {
+				return errors.Wrap(err, 0)
+			}
+		}
+
+		err = ow.flush()
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+
+		rop.Reset()
+		rop.Type = SyncOp_HEY_YOU_DID_IT
+		err = patchWire.WriteMessage(rop)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+	}
+
+	err = patchWire.Close()
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+// readAt reads len(p) bytes of a segment's source at offset
+func (sc *SquashContext) readAt(fileIndex int64, offset int64, p []byte) error {
+	if fileIndex < 0 {
+		_, err := sc.store.file.ReadAt(p, offset)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+		return nil
+	}
+
+	if sc.TargetPool == nil {
+		return errors.Wrap(ErrSquashNeedsTarget, 1)
+	}
+
+	reader, err := sc.TargetPool.GetReadSeeker(fileIndex)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	_, err = reader.Seek(offset, os.SEEK_SET)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	_, err = io.ReadFull(reader, p)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	return nil
+}
+
+func sameFiles(a *tlc.Container, b *tlc.Container) bool {
+	if len(a.Files) != len(b.Files) {
+		return false
+	}
+
+	for i, f := range a.Files {
+		if f.Path != b.Files[i].Path || f.Size != b.Files[i].Size {
+			return false
+		}
+	}
+
+	return true
+}
+
+// A squashSegment is a part of a file, that comes either from a file of the
+// first build, or from the store.
+type squashSegment struct {
+	// pos is where the segment starts in the file it's a part of
+	pos    int64
+	length int64
+
+	// fileIndex is the first build's file the segment comes from, or -1
+	// if it's from the store
+	fileIndex int64
+	offset    int64
+}
+
+// A squashFile is the contents of a file, as a list of segments
+type squashFile []squashSegment
+
+func (sf squashFile) size() int64 {
+	if len(sf) == 0 {
+		return 0
+	}
+	last := sf[len(sf)-1]
+	return last.pos + last.length
+}
+
+// append adds a segment at the end of the file, merging it with the last
+// segment if they're contiguous
+func (sf squashFile) append(fileIndex int64, offset int64, length int64) squashFile {
+	if length == 0 {
+		return sf
+	}
+
+	if n := len(sf); n > 0 {
+		last := &sf[n-1]
+		if last.fileIndex == fileIndex && last.offset+last.length == offset {
+			last.length += length
+			return sf
+		}
+	}
+
+	return append(sf, squashSegment{
+		pos:       sf.size(),
+		length:    length,
+		fileIndex: fileIndex,
+		offset:    offset,
+	})
+}
+
+// slice appends the segments for length bytes of sf at offset to dst
+func (sf squashFile) slice(dst squashFile, offset int64, length int64) (squashFile, error) {
+	if offset < 0 || length < 0 || offset+length > sf.size() {
+		return nil, errors.Wrap(ErrMalformedPatch, 1)
+	}
+
+	i := sort.Search(len(sf), func(i int) bool {
+		return sf[i].pos+sf[i].length > offset
+	})
+
+	for ; length > 0; i++ {
+		seg := sf[i]
+		skip := offset - seg.pos
+		n := seg.length - skip
+		if n > length {
+			n = length
+		}
+
+		dst = dst.append(seg.fileIndex, seg.offset+skip, n)
+		offset += n
+		length -= n
+	}
+
+	return dst, nil
+}
+
+// A squashStore keeps the bytes that don't come from the first build in a
+// temporary file: the contents of DATA ops, and rebuilt files.
+type squashStore struct {
+	file *os.File
+	size int64
+}
+
+var _ io.Writer = (*squashStore)(nil)
+
+func newSquashStore() (*squashStore, error) {
+	file, err := ioutil.TempFile("", "wharf-squash")
+	if err != nil {
+		return nil, errors.Wrap(err, 1)
+	}
+
+	return &squashStore{file: file}, nil
+}
+
+func (ss *squashStore) Write(p []byte) (int, error) {
+	n, err := ss.file.WriteAt(p, ss.size)
+	ss.size += int64(n)
+	return n, err
+}
+
+func (ss *squashStore) close() error {
+	err := ss.file.Close()
+	os.Remove(ss.file.Name())
+	return err
+}
+
+// A squashPool reads the files of an intermediate build
+type squashPool struct {
+	sc    *SquashContext
+	files []squashFile
+}
+
+var _ wsync.Pool = (*squashPool)(nil)
+
+func (sp *squashPool) GetSize(fileIndex int64) int64 {
+	return sp.files[fileIndex].size()
+}
+
+func (sp *squashPool) GetReader(fileIndex int64) (io.Reader, error) {
+	return sp.GetReadSeeker(fileIndex)
+}
+
+func (sp *squashPool) GetReadSeeker(fileIndex int64) (io.ReadSeeker, error) {
+	if fileIndex < 0 || fileIndex >= int64(len(sp.files)) {
+		return nil, errors.Wrap(ErrMalformedPatch, 1)
+	}
+
+	return &squashReader{sc: sp.sc, file: sp.files[fileIndex]}, nil
+}
+
+func (sp *squashPool) Close() error {
+	return nil
+}
+
+// A squashReader reads a squashFile
+type squashReader struct {
+	sc   *SquashContext
+	file squashFile
+	pos  int64
+}
+
+var _ io.ReadSeeker = (*squashReader)(nil)
+
+func (sr *squashReader) Read(p []byte) (int, error) {
+	if sr.pos >= sr.file.size() {
+		return 0, io.EOF
+	}
+
+	i := sort.Search(len(sr.file), func(i int) bool {
+		return sr.file[i].pos+sr.file[i].length > sr.pos
+	})
+	seg := sr.file[i]
+	skip := sr.pos - seg.pos
+
+	n := seg.length - skip
+	if n > int64(len(p)) {
+		n = int64(len(p))
+	}
+
+	err := sr.sc.readAt(seg.fileIndex, seg.offset+skip, p[:n])
+	if err != nil {
+		return 0, err
+	}
+
+	sr.pos += n
+	return int(n), nil
+}
+
+func (sr *squashReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_SET:
+		sr.pos = offset
+	case os.SEEK_CUR:
+		sr.pos += offset
+	case os.SEEK_END:
+		sr.pos = sr.file.size() + offset
+	}
+
+	if sr.pos < 0 {
+		return 0, fmt.Errorf("squash: negative position")
+	}
+	return sr.pos, nil
+}
+
+// A squashOpWriter turns segments into BLOCK_RANGE and DATA ops. flush
+// must be called at the end of every file.
+type squashOpWriter struct {
+	sc   *SquashContext
+	wctx *wire.WriteContext
+	data []byte
+	op   SyncOp
+}
+
+func (ow *squashOpWriter) writeSegment(seg squashSegment) error {
+	if seg.fileIndex < 0 {
+		return ow.writeData(seg.fileIndex, seg.offset, seg.length)
+	}
+
+	fileSize := ow.sc.TargetContainer.Files[seg.fileIndex].Size
+	offset := seg.offset
+	length := seg.length
+
+	// unaligned start
+	if head := offset % BlockSize; head != 0 {
+		n := BlockSize - head
+		if n > length {
+			n = length
+		}
+
+		err := ow.writeData(seg.fileIndex, offset, n)
+		if err != nil {
+			return err
+		}
+		offset += n
+		length -= n
+	}
+
+	// whole blocks, including the last block of the file, which may be short
+	span := length / BlockSize
+	if offset+length == fileSize && length%BlockSize != 0 {
+		span++
+	}
+
+	if span > 0 {
+		err := ow.flush()
+		if err != nil {
+			return err
+		}
+
+		ow.op.Reset()
+		ow.op.Type = SyncOp_BLOCK_RANGE
+		ow.op.FileIndex = seg.fileIndex
+		ow.op.BlockIndex = offset / BlockSize
+		ow.op.BlockSpan = span
+		err = ow.wctx.WriteMessage(&ow.op)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+
+		covered := span * BlockSize
+		if covered > length {
+			covered = length
+		}
+		ow.sc.Stats.ReusedBytes += covered
+		offset += covered
+		length -= covered
+	}
+
+	// unaligned end
+	return ow.writeData(seg.fileIndex, offset, length)
+}
+
+// writeData adds bytes from the store or the first build to the DATA ops
+func (ow *squashOpWriter) writeData(fileIndex int64, offset int64, length int64) error {
+	for length > 0 {
+		n := int64(wsync.MaxDataOp - len(ow.data))
+		if n > length {
+			n = length
+		}
+
+		start := len(ow.data)
+		ow.data = append(ow.data, make([]byte, n)...)
+		err := ow.sc.readAt(fileIndex, offset, ow.data[start:])
+		if err != nil {
+			return err
+		}
+		offset += n
+		length -= n
+
+		if len(ow.data) == wsync.MaxDataOp {
+			err = ow.flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (ow *squashOpWriter) flush() error {
+	if len(ow.data) == 0 {
+		return nil
+	}
+
+	ow.op.Reset()
+	ow.op.Type = SyncOp_DATA
+	ow.op.Data = ow.data
+	err := ow.wctx.WriteMessage(&ow.op)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	ow.sc.Stats.FreshBytes += int64(len(ow.data))
+	ow.data = ow.data[:0]
+	return nil
+}
@@ -0,0 +1,233 @@
+package pwr
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"github.com/go-errors/errors"
+	"github.com/itchio/wharf/pools/fspool"
+	"github.com/itchio/wharf/state"
+	"github.com/itchio/wharf/tlc"
+	"github.com/itchio/wharf/wsync"
+)
+
+func Test_SquashAligned(t *testing.T) {
+	// only renames, whole-file copies and new files: everything stays aligned,
+	// so the first build isn't needed
+	runSquashScenario(t, []testDirSettings{
+		{
+			entries: []testDirEntry{
+				{path: "a", seed: 0x1, size: BlockSize*3 + 12},
+				{path: "b", seed: 0x2},
+			},
+		},
+		{
+			entries: []testDirEntry{
+				{path: "a-renamed", seed: 0x1, size: BlockSize*3 + 12},
+				{path: "b", seed: 0x2},
+				{path: "c", seed: 0x3, size: BlockSize * 2},
+			},
+		},
+		{
+			entries: []testDirEntry{
+				{path: "a-renamed", seed: 0x1, size: BlockSize*3 + 12},
+				{path: "b-copy", seed: 0x2},
+				{path: "c", seed: 0x3, size: BlockSize * 2},
+				{path: "d", seed: 0x4, size: 100},
+			},
+		},
+	}, false, false, RediffEngineBsdiff)
+}
+
+func Test_SquashUnaligned(t *testing.T) {
+	chain := []testDirSettings{
+		{
+			entries: []testDirEntry{
+				{path: "big", chunks: []testDirChunk{
+					{seed: 0x1, size: BlockSize * 5},
+				}},
+				{path: "gone", seed: 0x2, size: BlockSize * 2},
+			},
+		},
+		{
+			entries: []testDirEntry{
+				{path: "big", chunks: []testDirChunk{
+					{seed: 0x9, size: 1000},
+					{seed: 0x1, size: BlockSize * 5},
+				}},
+			},
+		},
+		{
+			entries: []testDirEntry{
+				{path: "big", chunks: []testDirChunk{
+					{seed: 0x9, size: 1000},
+					{seed: 0x1, size: BlockSize * 5},
+					{seed: 0x7, size: BlockSize},
+				}},
+				{path: "small", seed: 0x3, size: 123},
+			},
+		},
+		{
+			entries: []testDirEntry{
+				{path: "big", chunks: []testDirChunk{
+					{seed: 0x1, size: BlockSize * 5},
+					{seed: 0x7, size: BlockSize},
+				}},
+				{path: "small", seed: 0x3, size: 123},
+			},
+		},
+	}
+
+	// reusing parts of "big" that aren't aligned anymore needs the first build
+	runSquashScenario(t, chain, true, false, RediffEngineBsdiff)
+
+	// intermediate patches may be optimized, then files get rebuilt
+	runSquashScenario(t, chain, true, true, RediffEngineBsdiff)
+	runSquashScenario(t, chain, true, true, RediffEngineZstd)
+}
+
+// runSquashScenario writes a patch between every pair of consecutive builds,
+// squashes them, and checks that the squashed patch (optimized or not) goes from
+// the first build to the last. If optimize is set, patches are optimized with
+// engine before being squashed.
+func runSquashScenario(t *testing.T, builds []testDirSettings, needsTarget bool, optimize bool, engine RediffEngine) {
+	mainDir, err := ioutil.TempDir("", "squash")
+	assert.NoError(t, err)
+	defer os.RemoveAll(mainDir)
+
+	consumer := &state.Consumer{}
+	compression := &CompressionSettings{
+		Algorithm: CompressionAlgorithm_NONE,
+	}
+
+	var dirs []string
+	var containers []*tlc.Container
+	for i, settings := range builds {
+		dir := filepath.Join(mainDir, string('A'+rune(i)))
+		makeTestDir(t, dir, settings)
+		dirs = append(dirs, dir)
+
+		container, err := tlc.WalkAny(dir, nil)
+		assert.NoError(t, err)
+		containers = append(containers, container)
+	}
+
+	var patches []*bytes.Buffer
+	var lastSignature *bytes.Buffer
+	for i := 1; i < len(builds); i++ {
+		targetContainer := containers[i-1]
+		sourceContainer := containers[i]
+
+		targetSignature, err := ComputeSignature(targetContainer, fspool.New(targetContainer, dirs[i-1]), consumer)
+		assert.NoError(t, err)
+
+		patchBuffer := new(bytes.Buffer)
+		lastSignature = new(bytes.Buffer)
+		dctx := &DiffContext{
+			Compression: compression,
+			Consumer:    consumer,
+
+			SourceContainer: sourceContainer,
+			Pool:            fspool.New(sourceContainer, dirs[i]),
+
+			TargetContainer: targetContainer,
+			TargetSignature: targetSignature,
+		}
+		assert.NoError(t, dctx.WritePatch(patchBuffer, lastSignature))
+
+		if optimize {
+			rc := &RediffContext{
+				SourcePool:  fspool.New(sourceContainer, dirs[i]),
+				TargetPool:  fspool.New(targetContainer, dirs[i-1]),
+				Compression: compression,
+				Consumer:    consumer,
+				Engine:      engine,
+			}
+			assert.NoError(t, rc.AnalyzePatch(bytes.NewReader(patchBuffer.Bytes())))
+
+			optimizedBuffer := new(bytes.Buffer)
+			assert.NoError(t, rc.OptimizePatch(bytes.NewReader(patchBuffer.Bytes()), optimizedBuffer))
+			patchBuffer = optimizedBuffer
+		}
+
+		patches = append(patches, patchBuffer)
+	}
+
+	patchReaders := func() []io.Reader {
+		var readers []io.Reader
+		for _, patch := range patches {
+			readers = append(readers, bytes.NewReader(patch.Bytes()))
+		}
+		return readers
+	}
+
+	firstContainer := containers[0]
+	firstDir := dirs[0]
+
+	if needsTarget {
+		sc := &SquashContext{
+			Compression: compression,
+		}
+		err = sc.Squash(patchReaders(), ioutil.Discard)
+		assert.Error(t, err)
+		assert.True(t, errors.Is(err, ErrSquashNeedsTarget), "squashing without the first build should fail")
+	}
+
+	sc := &SquashContext{
+		Compression: compression,
+		Consumer:    consumer,
+	}
+	if needsTarget {
+		sc.TargetPool = fspool.New(firstContainer, firstDir)
+	}
+
+	squashedBuffer := new(bytes.Buffer)
+	assert.NoError(t, sc.Squash(patchReaders(), squashedBuffer))
+	assert.EqualValues(t, len(firstContainer.Files), len(sc.TargetContainer.Files))
+	assert.EqualValues(t, len(containers[len(containers)-1].Files), len(sc.SourceContainer.Files))
+	if !optimize {
+		assert.True(t, sc.Stats.ReusedBytes > 0, "squashed patch should reuse the first build")
+	} else {
+		assert.True(t, sc.Stats.RebuiltFiles > 0, "optimized patches should rebuild files")
+	}
+
+	signature, err := ReadSignature(bytes.NewReader(lastSignature.Bytes()))
+	assert.NoError(t, err)
+
+	applySquashed := func(patch []byte) {
+		outDir := filepath.Join(mainDir, "out")
+		assert.NoError(t, os.RemoveAll(outDir))
+
+		actx := &ApplyContext{
+			TargetPath: firstDir,
+			OutputPath: outDir,
+			Consumer:   consumer,
+		}
+		assert.NoError(t, actx.ApplyPatch(bytes.NewReader(patch)))
+		assert.NoError(t, AssertValid(outDir, signature))
+	}
+	applySquashed(squashedBuffer.Bytes())
+
+	// the squashed patch can be optimized like any other
+	rc := &RediffContext{
+		SourcePoolFactory: func() (wsync.Pool, error) {
+			return fspool.New(sc.SourceContainer, dirs[len(dirs)-1]), nil
+		},
+		TargetPoolFactory: func() (wsync.Pool, error) {
+			return fspool.New(firstContainer, firstDir), nil
+		},
+		NumWorkers:  2,
+		Compression: compression,
+		Consumer:    consumer,
+	}
+	assert.NoError(t, rc.AnalyzePatch(bytes.NewReader(squashedBuffer.Bytes())))
+
+	optimizedBuffer := new(bytes.Buffer)
+	assert.NoError(t, rc.OptimizePatch(bytes.NewReader(squashedBuffer.Bytes()), optimizedBuffer))
+	applySquashed(optimizedBuffer.Bytes())
+}
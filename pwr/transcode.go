@@ -0,0 +1,148 @@
+package pwr
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/go-errors/errors"
+	"github.com/itchio/wharf/wire"
+)
+
+// Transcode rewrites a patch (.pwr), signature (.pws), manifest (.pwm) or wounds
+// (.pww) file with different compression settings. Messages are copied as-is,
+// without being decoded, so it streams, and works on files of any size.
+//
+// The uncompressed payload is left untouched, so manifest indices (.pwmi) still
+// apply to transcoded manifests. Wounds files aren't compressed, so they're
+// copied as-is.
+func Transcode(reader io.Reader, writer io.Writer, compression *CompressionSettings) error {
+	if compression == nil {
+		return errors.Wrap(fmt.Errorf("No compression settings specified, bailing out"), 0)
+	}
+
+	rawReadWire := wire.NewReadContext(reader)
+	rawWriteWire := wire.NewWriteContext(writer)
+
+	var magic int32
+	err := binary.Read(reader, Endianness, &magic)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	err = rawWriteWire.WriteMagic(magic)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	var oldCompression *CompressionSettings
+
+	switch magic {
+	case PatchMagic:
+		header := &PatchHeader{}
+		err = rawReadWire.ReadMessage(header)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+		oldCompression = header.Compression
+
+		header.Compression = compression
+		err = rawWriteWire.WriteMessage(header)
+	case SignatureMagic:
+		header := &SignatureHeader{}
+		err = rawReadWire.ReadMessage(header)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+		oldCompression = header.Compression
+
+		header.Compression = compression
+		err = rawWriteWire.WriteMessage(header)
+	case ManifestMagic:
+		header := &ManifestHeader{}
+		err = rawReadWire.ReadMessage(header)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+		oldCompression = header.Compression
+
+		header.Compression = compression
+		err = rawWriteWire.WriteMessage(header)
+	case WoundsMagic:
+		_, err = io.Copy(writer, reader)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+		return nil
+	default:
+		return errors.Wrap(wire.ErrFormat, 0)
+	}
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	readWire, err := DecompressWire(rawReadWire, oldCompression)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	writeWire, err := CompressWire(rawWriteWire, compression)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	err = copyMessages(readWire.Reader(), writeWire.Writer())
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	err = writeWire.Close()
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+// copyMessages copies every varint-framed message from r to w, until the end
+// of the stream, with the same writes WriteContext.WriteMessage would make:
+// some compressors flush on every write, so the output only stays
+// byte-identical if the writes are split the same way.
+func copyMessages(r io.Reader, w io.Writer) error {
+	reader := bufio.NewReader(r)
+
+	varintBuffer := make([]byte, binary.MaxVarintLen64)
+	var msgBuf []byte
+
+	for {
+		length, err := binary.ReadUvarint(reader)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.Wrap(err, 1)
+		}
+
+		if uint64(cap(msgBuf)) < length {
+			msgBuf = make([]byte, length)
+		}
+		msgBuf = msgBuf[:length]
+
+		_, err = io.ReadFull(reader, msgBuf)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+
+		n := binary.PutUvarint(varintBuffer, length)
+		_, err = w.Write(varintBuffer[:n])
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+
+		_, err = w.Write(msgBuf)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+	}
+}
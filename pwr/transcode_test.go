@@ -0,0 +1,139 @@
+package pwr
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"github.com/go-errors/errors"
+	"github.com/itchio/wharf/pools/fspool"
+	"github.com/itchio/wharf/state"
+	"github.com/itchio/wharf/tlc"
+	"github.com/itchio/wharf/wire"
+)
+
+func Test_Transcode(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "transcode")
+	assert.NoError(t, err)
+	defer os.RemoveAll(mainDir)
+
+	v1 := filepath.Join(mainDir, "v1")
+	makeTestDir(t, v1, testDirSettings{
+		entries: []testDirEntry{
+			{path: "subdir/file-1", seed: 0x1, size: BlockSize*11 + 14},
+			{path: "file-1", seed: 0x2},
+		},
+	})
+
+	v2 := filepath.Join(mainDir, "v2")
+	makeTestDir(t, v2, testDirSettings{
+		entries: []testDirEntry{
+			{path: "subdir/file-1", seed: 0x1, size: BlockSize*17 + 14},
+			{path: "file-1", seed: 0x22},
+		},
+	})
+
+	consumer := &state.Consumer{}
+	none := &CompressionSettings{
+		Algorithm: CompressionAlgorithm_NONE,
+	}
+	zstd := &CompressionSettings{
+		Algorithm: CompressionAlgorithm_ZSTD,
+		Quality:   3,
+	}
+
+	targetContainer, err := tlc.WalkAny(v1, nil)
+	assert.NoError(t, err)
+	sourceContainer, err := tlc.WalkAny(v2, nil)
+	assert.NoError(t, err)
+
+	targetSignature, err := ComputeSignature(targetContainer, fspool.New(targetContainer, v1), consumer)
+	assert.NoError(t, err)
+
+	patchBuffer := new(bytes.Buffer)
+	signatureBuffer := new(bytes.Buffer)
+	dctx := &DiffContext{
+		Compression: none,
+		Consumer:    consumer,
+
+		SourceContainer: sourceContainer,
+		Pool:            fspool.New(sourceContainer, v2),
+
+		TargetContainer: targetContainer,
+		TargetSignature: targetSignature,
+	}
+	assert.NoError(t, dctx.WritePatch(patchBuffer, signatureBuffer))
+
+	roundTrip := func(original []byte) []byte {
+		compressed := new(bytes.Buffer)
+		assert.NoError(t, Transcode(bytes.NewReader(original), compressed, zstd))
+		assert.False(t, bytes.Equal(original, compressed.Bytes()), "transcoding should change something")
+
+		uncompressed := new(bytes.Buffer)
+		assert.NoError(t, Transcode(bytes.NewReader(compressed.Bytes()), uncompressed, none))
+		assert.True(t, bytes.Equal(original, uncompressed.Bytes()), "transcoding back should give the original")
+
+		return compressed.Bytes()
+	}
+
+	// patches
+	compressedPatch := roundTrip(patchBuffer.Bytes())
+
+	signature, err := ReadSignature(bytes.NewReader(signatureBuffer.Bytes()))
+	assert.NoError(t, err)
+
+	v1After := filepath.Join(mainDir, "v1After")
+	actx := &ApplyContext{
+		TargetPath: v1,
+		OutputPath: v1After,
+		Consumer:   consumer,
+	}
+	assert.NoError(t, actx.ApplyPatch(bytes.NewReader(compressedPatch)))
+	assert.NoError(t, AssertValid(v1After, signature))
+
+	// signatures
+	compressedSignature := roundTrip(signatureBuffer.Bytes())
+	signature, err = ReadSignature(bytes.NewReader(compressedSignature))
+	assert.NoError(t, err)
+	assert.NoError(t, AssertValid(v2, signature))
+
+	// manifests
+	manifestBuffer := new(bytes.Buffer)
+	mw := wire.NewWriteContext(manifestBuffer)
+	assert.NoError(t, mw.WriteMagic(ManifestMagic))
+	assert.NoError(t, mw.WriteMessage(&ManifestHeader{
+		Compression: none,
+		Algorithm:   HashAlgorithm_SHAKE128_32,
+	}))
+	assert.NoError(t, mw.WriteMessage(sourceContainer))
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, mw.WriteMessage(&ManifestBlockHash{Hash: bytes.Repeat([]byte{byte(i)}, 32)}))
+	}
+
+	compressedManifest := roundTrip(manifestBuffer.Bytes())
+	mr := wire.NewReadContext(bytes.NewReader(compressedManifest))
+	assert.NoError(t, mr.ExpectMagic(ManifestMagic))
+	manifestHeader := &ManifestHeader{}
+	assert.NoError(t, mr.ReadMessage(manifestHeader))
+	assert.EqualValues(t, CompressionAlgorithm_ZSTD, manifestHeader.Compression.Algorithm)
+	assert.EqualValues(t, HashAlgorithm_SHAKE128_32, manifestHeader.Algorithm)
+
+	// wounds aren't compressed
+	woundsBuffer := new(bytes.Buffer)
+	ww := wire.NewWriteContext(woundsBuffer)
+	assert.NoError(t, ww.WriteMagic(WoundsMagic))
+	assert.NoError(t, ww.WriteMessage(&WoundsHeader{}))
+	assert.NoError(t, ww.WriteMessage(sourceContainer))
+	assert.NoError(t, ww.WriteMessage(&Wound{Index: 1, Start: 0, End: 12}))
+
+	transcodedWounds := new(bytes.Buffer)
+	assert.NoError(t, Transcode(bytes.NewReader(woundsBuffer.Bytes()), transcodedWounds, zstd))
+	assert.True(t, bytes.Equal(woundsBuffer.Bytes(), transcodedWounds.Bytes()), "wounds should be copied as-is")
+
+	// anything else isn't a wharf file we know
+	err = Transcode(bytes.NewReader([]byte("not a wharf file")), ioutil.Discard, zstd)
+	assert.True(t, errors.Is(err, wire.ErrFormat))
+}
@@ -58,6 +58,14 @@ func (vp *ValidatingPool) GetReadSeeker(fileIndex int64) (io.ReadSeeker, error)
 // pool's writer. It tries really hard to be transparent, but does buffer some data,
 // which means some writing is only done when the returned writer is closed.
 func (vp *ValidatingPool) GetWriter(fileIndex int64) (io.WriteCloser, error) {
+	return vp.GetWriterAt(fileIndex, 0)
+}
+
+// GetWriterAt is like GetWriter, except the data written is checked against the
+// hashes of the file starting at block startBlock. This lets several writers
+// validate different parts of the same file concurrently. The underlying pool's
+// writer only sees the data written, so it should be a null pool unless startBlock is 0.
+func (vp *ValidatingPool) GetWriterAt(fileIndex int64, startBlock int64) (io.WriteCloser, error) {
 	var wounds chan *Wound
 	var woundsDone chan bool
 
@@ -94,7 +102,7 @@ func (vp *ValidatingPool) GetWriter(fileIndex int64) (io.WriteCloser, error) {
 	}
 
 	hashGroup := vp.hashGroups[fileIndex]
-	blockIndex := int64(0)
+	blockIndex := startBlock
 	file := vp.Container.Files[fileIndex]
 	fileSize := file.Size
 
@@ -184,16 +192,29 @@ func (vp *ValidatingPool) GetWriter(fileIndex int64) (io.WriteCloser, error) {
 }
 
 func (vp *ValidatingPool) makeHashGroups() error {
+	hashGroups, err := makeHashGroups(vp.Container, vp.Signature)
+	if err != nil {
+		return err
+	}
+
+	vp.hashGroups = hashGroups
+	return nil
+}
+
+// makeHashGroups returns the signature's hashes grouped by file, indexed by
+// their file index in container (which may be ordered differently from the
+// signature's container)
+func makeHashGroups(container *tlc.Container, signature *SignatureInfo) (map[int64][]wsync.BlockHash, error) {
 	// see blockpool's validator for a slightly different take on this
 	pathToFileIndex := make(map[string]int64)
-	for fileIndex, f := range vp.Container.Files {
+	for fileIndex, f := range container.Files {
 		pathToFileIndex[f.Path] = int64(fileIndex)
 	}
 
-	vp.hashGroups = make(map[int64][]wsync.BlockHash)
+	hashGroups := make(map[int64][]wsync.BlockHash)
 	hashIndex := int64(0)
 
-	for _, f := range vp.Signature.Container.Files {
+	for _, f := range signature.Container.Files {
 		fileIndex := pathToFileIndex[f.Path]
 
 		if f.Size == 0 {
@@ -203,16 +224,21 @@ func (vp *ValidatingPool) makeHashGroups() error {
 		}
 
 		numBlocks := ComputeNumBlocks(f.Size)
-		vp.hashGroups[fileIndex] = vp.Signature.Hashes[hashIndex : hashIndex+numBlocks]
+		if hashIndex+numBlocks > int64(len(signature.Hashes)) {
+			err := fmt.Errorf("expected to have at least %d hashes in signature, had %d", hashIndex+numBlocks, len(signature.Hashes))
+			return nil, errors.Wrap(err, 1)
+		}
+
+		hashGroups[fileIndex] = signature.Hashes[hashIndex : hashIndex+numBlocks]
 		hashIndex += numBlocks
 	}
 
-	if hashIndex != int64(len(vp.Signature.Hashes)) {
-		err := fmt.Errorf("expected to have %d hashes in signature, had %d", hashIndex, len(vp.Signature.Hashes))
-		return errors.Wrap(err, 1)
+	if hashIndex != int64(len(signature.Hashes)) {
+		err := fmt.Errorf("expected to have %d hashes in signature, had %d", hashIndex, len(signature.Hashes))
+		return nil, errors.Wrap(err, 1)
 	}
 
-	return nil
+	return hashGroups, nil
 }
 
 // Close closes the underlying pool (and its reader, if any)
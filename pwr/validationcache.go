@@ -0,0 +1,257 @@
+package pwr
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/go-errors/errors"
+	"github.com/itchio/wharf/wire"
+	"github.com/itchio/wharf/wsync"
+)
+
+// A ValidationCacheEntry records what a file looked like on disk the
+// last time it passed validation.
+type ValidationCacheEntry struct {
+	Size int64
+	// ModTime is in nanoseconds since the unix epoch
+	ModTime int64
+	// Inode is 0 on platforms that don't have them
+	Inode uint64
+	// Digest identifies the signature hashes the file was checked against,
+	// see ComputeFileDigest
+	Digest [sha256.Size]byte
+}
+
+// A ValidationCache remembers which files passed validation, so that they
+// don't need to be hashed again as long as their size, modification time and
+// inode haven't changed. It's safe for concurrent use.
+//
+// This trades safety for speed: corruption that doesn't touch stat data
+// (bit rot, some disk tools) goes unnoticed. See ValidatorContext.Paranoid.
+type ValidationCache struct {
+	entries map[string]ValidationCacheEntry
+	mutex   sync.Mutex
+}
+
+// NewValidationCache returns an empty validation cache
+func NewValidationCache() *ValidationCache {
+	return &ValidationCache{
+		entries: make(map[string]ValidationCacheEntry),
+	}
+}
+
+// LoadValidationCache reads a validation cache from a file. A missing file
+// is not an error, an empty cache is returned instead.
+func LoadValidationCache(cachePath string) (*ValidationCache, error) {
+	reader, err := os.Open(cachePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return NewValidationCache(), nil
+		}
+		return nil, errors.Wrap(err, 1)
+	}
+	defer reader.Close()
+
+	return ReadValidationCache(bufio.NewReader(reader))
+}
+
+// ReadValidationCache decodes a validation cache written by Write
+func ReadValidationCache(reader io.Reader) (*ValidationCache, error) {
+	var magic int32
+	err := binary.Read(reader, Endianness, &magic)
+	if err != nil {
+		return nil, errors.Wrap(err, 1)
+	}
+
+	if magic != ValidationCacheMagic {
+		return nil, errors.Wrap(wire.ErrFormat, 1)
+	}
+
+	var numEntries int64
+	err = binary.Read(reader, Endianness, &numEntries)
+	if err != nil {
+		return nil, errors.Wrap(err, 1)
+	}
+
+	if numEntries < 0 {
+		return nil, errors.Wrap(fmt.Errorf("invalid validation cache: %d entries", numEntries), 1)
+	}
+
+	vc := NewValidationCache()
+	for i := int64(0); i < numEntries; i++ {
+		var pathLength uint32
+		err = binary.Read(reader, Endianness, &pathLength)
+		if err != nil {
+			return nil, errors.Wrap(err, 1)
+		}
+
+		pathBytes := make([]byte, pathLength)
+		_, err = io.ReadFull(reader, pathBytes)
+		if err != nil {
+			return nil, errors.Wrap(err, 1)
+		}
+
+		var entry ValidationCacheEntry
+		err = binary.Read(reader, Endianness, &entry)
+		if err != nil {
+			return nil, errors.Wrap(err, 1)
+		}
+
+		vc.entries[string(pathBytes)] = entry
+	}
+
+	return vc, nil
+}
+
+// Save writes the validation cache to a file, replacing it atomically
+func (vc *ValidationCache) Save(cachePath string) error {
+	tmpPath := cachePath + ".tmp"
+
+	writer, err := os.Create(tmpPath)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	bufferedWriter := bufio.NewWriter(writer)
+
+	err = vc.Write(bufferedWriter)
+	if err != nil {
+		writer.Close()
+		return errors.Wrap(err, 1)
+	}
+
+	err = bufferedWriter.Flush()
+	if err != nil {
+		writer.Close()
+		return errors.Wrap(err, 1)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	err = os.Rename(tmpPath, cachePath)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	return nil
+}
+
+// Write encodes the validation cache, entries are sorted by path
+// so that the output is stable.
+func (vc *ValidationCache) Write(writer io.Writer) error {
+	vc.mutex.Lock()
+	defer vc.mutex.Unlock()
+
+	err := binary.Write(writer, Endianness, ValidationCacheMagic)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	err = binary.Write(writer, Endianness, int64(len(vc.entries)))
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	var paths []string
+	for path := range vc.entries {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		err = binary.Write(writer, Endianness, uint32(len(path)))
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+
+		_, err = io.WriteString(writer, path)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+
+		err = binary.Write(writer, Endianness, vc.entries[path])
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+	}
+
+	return nil
+}
+
+// Check returns true if the file at path passed validation against
+// the same digest, and hasn't changed since according to stats.
+func (vc *ValidationCache) Check(path string, stats os.FileInfo, digest [sha256.Size]byte) bool {
+	vc.mutex.Lock()
+	entry, ok := vc.entries[path]
+	vc.mutex.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	return entry == makeValidationCacheEntry(stats, digest)
+}
+
+// Record remembers that the file at path, as described by stats,
+// passed validation against digest.
+func (vc *ValidationCache) Record(path string, stats os.FileInfo, digest [sha256.Size]byte) {
+	vc.mutex.Lock()
+	defer vc.mutex.Unlock()
+
+	vc.entries[path] = makeValidationCacheEntry(stats, digest)
+}
+
+// Forget removes any entry for the file at path
+func (vc *ValidationCache) Forget(path string) {
+	vc.mutex.Lock()
+	defer vc.mutex.Unlock()
+
+	delete(vc.entries, path)
+}
+
+// Len returns the number of entries in the cache
+func (vc *ValidationCache) Len() int {
+	vc.mutex.Lock()
+	defer vc.mutex.Unlock()
+
+	return len(vc.entries)
+}
+
+func makeValidationCacheEntry(stats os.FileInfo, digest [sha256.Size]byte) ValidationCacheEntry {
+	return ValidationCacheEntry{
+		Size:    stats.Size(),
+		ModTime: stats.ModTime().UnixNano(),
+		Inode:   fileInode(stats),
+		Digest:  digest,
+	}
+}
+
+// ComputeFileDigest returns a digest of the signature hashes of a file,
+// so that validation cache entries are invalidated when checking
+// against a different build.
+func ComputeFileDigest(fileSize int64, hashGroup []wsync.BlockHash) [sha256.Size]byte {
+	h := sha256.New()
+
+	buf := make([]byte, 8)
+	Endianness.PutUint64(buf, uint64(fileSize))
+	h.Write(buf)
+
+	for _, bh := range hashGroup {
+		Endianness.PutUint32(buf, bh.WeakHash)
+		h.Write(buf[:4])
+		h.Write(bh.StrongHash)
+	}
+
+	var digest [sha256.Size]byte
+	copy(digest[:], h.Sum(nil))
+	return digest
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package pwr
+
+import (
+	"os"
+	"syscall"
+)
+
+func fileInode(stats os.FileInfo) uint64 {
+	if sys, ok := stats.Sys().(*syscall.Stat_t); ok {
+		return uint64(sys.Ino)
+	}
+	return 0
+}
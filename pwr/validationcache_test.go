@@ -0,0 +1,131 @@
+package pwr
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert"
+	"github.com/itchio/wharf/pools/fspool"
+	"github.com/itchio/wharf/state"
+	"github.com/itchio/wharf/tlc"
+	"github.com/itchio/wharf/wsync"
+)
+
+func Test_ValidationCache(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "validationcache")
+	assert.NoError(t, err)
+	defer os.RemoveAll(mainDir)
+
+	targetDir := filepath.Join(mainDir, "target")
+	cachePath := filepath.Join(mainDir, "cache.pwv")
+
+	makeTestDir(t, targetDir, testDirSettings{
+		entries: []testDirEntry{
+			{path: "subdir/file-1", seed: 0x1, size: BlockSize*4 + 14},
+			{path: "file-2", seed: 0x2},
+			{path: "empty", size: 0},
+		},
+	})
+
+	container, err := tlc.WalkAny(targetDir, nil)
+	assert.NoError(t, err)
+
+	hashes, err := ComputeSignature(container, fspool.New(container, targetDir), &state.Consumer{})
+	assert.NoError(t, err)
+
+	signature := &SignatureInfo{
+		Container: container,
+		Hashes:    hashes,
+	}
+
+	validate := func(signature *SignatureInfo, paranoid bool) error {
+		vctx := &ValidatorContext{
+			FailFast:  true,
+			CachePath: cachePath,
+			Paranoid:  paranoid,
+			Consumer:  &state.Consumer{},
+		}
+		return vctx.Validate(targetDir, signature)
+	}
+
+	loadCache := func() *ValidationCache {
+		cache, err := LoadValidationCache(cachePath)
+		assert.NoError(t, err)
+		return cache
+	}
+
+	t.Logf("...first run fills the cache")
+	assert.EqualValues(t, 0, loadCache().Len())
+	assert.NoError(t, validate(signature, false))
+	assert.EqualValues(t, len(container.Files), loadCache().Len())
+
+	// round-trip
+	buf := new(bytes.Buffer)
+	assert.NoError(t, loadCache().Write(buf))
+	cache, err := ReadValidationCache(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.EqualValues(t, len(container.Files), cache.Len())
+
+	_, err = ReadValidationCache(bytes.NewReader([]byte("nope, not a cache")))
+	assert.Error(t, err)
+
+	t.Logf("...corruption that leaves stat data alone goes unnoticed")
+	filePath := filepath.Join(targetDir, "subdir", "file-1")
+	stats, err := os.Stat(filePath)
+	assert.NoError(t, err)
+
+	f, err := os.OpenFile(filePath, os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xde, 0xad}, BlockSize+3)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.NoError(t, os.Chtimes(filePath, stats.ModTime(), stats.ModTime()))
+
+	assert.NoError(t, validate(signature, false))
+
+	t.Logf("...unless we're paranoid")
+	assert.Error(t, validate(signature, true))
+	assert.EqualValues(t, len(container.Files)-1, loadCache().Len())
+	assert.Error(t, validate(signature, false))
+
+	t.Logf("...changing the modification time invalidates the entry")
+	makeTestDir(t, targetDir, testDirSettings{
+		entries: []testDirEntry{
+			{path: "subdir/file-1", seed: 0x1, size: BlockSize*4 + 14},
+		},
+	})
+	assert.NoError(t, validate(signature, false))
+	assert.EqualValues(t, len(container.Files), loadCache().Len())
+
+	f, err = os.OpenFile(filePath, os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xde, 0xad}, BlockSize+3)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	later := time.Now().Add(time.Hour)
+	assert.NoError(t, os.Chtimes(filePath, later, later))
+
+	assert.Error(t, validate(signature, false))
+
+	t.Logf("...a different signature invalidates the entry")
+	makeTestDir(t, targetDir, testDirSettings{
+		entries: []testDirEntry{
+			{path: "subdir/file-1", seed: 0x1, size: BlockSize*4 + 14},
+		},
+	})
+	assert.NoError(t, validate(signature, false))
+
+	otherHashes := append([]wsync.BlockHash{}, hashes...)
+	for i := range otherHashes {
+		otherHashes[i].WeakHash++
+	}
+	other := &SignatureInfo{
+		Container: container,
+		Hashes:    otherHashes,
+	}
+	assert.Error(t, validate(other, false))
+}
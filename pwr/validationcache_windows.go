@@ -0,0 +1,9 @@
+package pwr
+
+import "os"
+
+// there are file indices on windows, but they're not part of os.FileInfo,
+// size and modification time will have to do.
+func fileInode(stats os.FileInfo) uint64 {
+	return 0
+}
@@ -1,12 +1,14 @@
 package pwr
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sync/atomic"
+	"time"
 
 	"github.com/go-errors/errors"
 	"github.com/itchio/wharf/counter"
@@ -22,6 +24,11 @@ import (
 // and so it isn't done yet.
 const MaxWoundSize int64 = 4 * 1024 * 1024 // 4MB
 
+// DefaultSplitSize is the default value for ValidatorContext.SplitSize. It's
+// large enough that small and medium files are still checked by a single
+// worker, but a very large file will keep all workers busy.
+const DefaultSplitSize int64 = 128 * 1024 * 1024 // 128MB
+
 // ValidatorContext holds both input and output parameters to the validation
 // process (checking that a container corresponds to its signature: that all
 // directories exist, symlinks exist and point to the right destinations, files
@@ -36,11 +43,36 @@ type ValidatorContext struct {
 	// FailFast makes Validate return Wounds as errors and stop checking
 	FailFast bool
 
+	// CachePath is where the validation cache is loaded from and saved to,
+	// if non-empty. Files whose size, modification time and inode haven't
+	// changed since they last passed validation aren't hashed again.
+	// Only works when target is a directory.
+	CachePath string
+
+	// Paranoid makes Validate hash every file even if the validation cache
+	// says it's fine. The cache is still updated.
+	Paranoid bool
+
+	// SplitSize is how large a file has to be before it's split into
+	// ranges that are validated in parallel. Defaults to DefaultSplitSize.
+	SplitSize int64
+
+	// ReportWriter, if non-nil, receives a report of the state of every file,
+	// directory and symlink once validation is done, see WoundsReporter
+	ReportWriter io.Writer
+	ReportFormat ReportFormat
+
 	// Result
 
+	// Summary is set by Validate once files have been checked, even if it
+	// returns an error. Files that weren't checked because validation stopped
+	// early are counted as Unchecked.
+	Summary *ValidationSummary
+
 	// internal
 	Wounds         chan *Wound
 	WoundsConsumer WoundsConsumer
+	reporter       *WoundsReporter
 }
 
 // Validate checks the directory at target using the container info and hashes
@@ -56,6 +88,32 @@ func (vctx *ValidatorContext) Validate(target string, signature *SignatureInfo)
 		numWorkers = runtime.NumCPU() + 1
 	}
 
+	var cache *ValidationCache
+	var digests map[int64][sha256.Size]byte
+
+	if vctx.CachePath != "" {
+		targetStats, err := os.Stat(target)
+		if err == nil && !targetStats.IsDir() {
+			return fmt.Errorf("ValidatorContext: CachePath only works with directories")
+		}
+
+		cache, err = LoadValidationCache(vctx.CachePath)
+		if err != nil {
+			vctx.Consumer.Warnf("Ignoring validation cache: %s", err.Error())
+			cache = NewValidationCache()
+		}
+
+		hashGroups, err := makeHashGroups(signature.Container, signature)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+
+		digests = make(map[int64][sha256.Size]byte)
+		for fileIndex, file := range signature.Container.Files {
+			digests[int64(fileIndex)] = ComputeFileDigest(file.Size, hashGroups[int64(fileIndex)])
+		}
+	}
+
 	vctx.Wounds = make(chan *Wound, 1024)
 	workerErrs := make(chan error, numWorkers)
 	consumerErrs := make(chan error, 1)
@@ -106,6 +164,10 @@ func (vctx *ValidatorContext) Validate(target string, signature *SignatureInfo)
 			return err
 		}
 
+		if sh, ok := healer.(SignatureHealer); ok {
+			sh.SetSignature(signature)
+		}
+
 		woundsStateConsumer = &state.Consumer{
 			OnProgress: func(progress float64) {
 				healerProgress = progress
@@ -124,13 +186,37 @@ func (vctx *ValidatorContext) Validate(target string, signature *SignatureInfo)
 		}
 	}
 
+	// every wound goes through the reporter first, so that
+	// we can build a summary whatever the consumer is
+	reporter := &WoundsReporter{
+		Writer: vctx.ReportWriter,
+		Format: vctx.ReportFormat,
+	}
+	reporter.begin(signature.Container)
+	vctx.reporter = reporter
+
+	consumerWounds := make(chan *Wound, 1024)
+	reporterErrs := make(chan error, 1)
+
 	go func() {
-		consumerErrs <- vctx.WoundsConsumer.Do(signature.Container, vctx.Wounds)
+		var err error
+		for wound := range vctx.Wounds {
+			if err == nil {
+				err = reporter.add(wound)
+			}
+			consumerWounds <- wound
+		}
+		close(consumerWounds)
+		reporterErrs <- err
+	}()
+
+	go func() {
+		consumerErrs <- vctx.WoundsConsumer.Do(signature.Container, consumerWounds)
 
 		// throw away wounds until closed
 		for {
 			select {
-			case _, ok := <-vctx.Wounds:
+			case _, ok := <-consumerWounds:
 				if !ok {
 					return
 				}
@@ -168,6 +254,7 @@ func (vctx *ValidatorContext) Validate(target string, signature *SignatureInfo)
 		dest, err := os.Readlink(path)
 		if err != nil {
 			if os.IsNotExist(err) {
+				reporter.symlinkMissing(int64(symlinkIndex))
 				vctx.Wounds <- &Wound{
 					Kind:  WoundKind_SYMLINK,
 					Index: int64(symlinkIndex),
@@ -187,10 +274,10 @@ func (vctx *ValidatorContext) Validate(target string, signature *SignatureInfo)
 		}
 	}
 
-	fileIndices := make(chan int64)
+	jobs := make(chan *validationJob)
 
 	for i := 0; i < numWorkers; i++ {
-		go vctx.validate(target, signature, fileIndices, workerErrs, onProgress, cancelled)
+		go vctx.validate(target, signature, cache, digests, jobs, workerErrs, onProgress, cancelled)
 	}
 
 	var retErr error
@@ -201,25 +288,31 @@ func (vctx *ValidatorContext) Validate(target string, signature *SignatureInfo)
 			break
 		}
 
-		select {
-		case workerErr := <-workerErrs:
-			workerErrs <- nil
-			retErr = workerErr
-			close(cancelled)
-			sending = false
-
-		case consumerErr := <-consumerErrs:
-			consumerErrs <- nil
-			retErr = consumerErr
-			close(cancelled)
-			sending = false
+		for _, job := range vctx.makeJobs(target, signature, cache, digests, int64(fileIndex)) {
+			if !sending {
+				break
+			}
 
-		case fileIndices <- int64(fileIndex):
-			// just queued another file
+			select {
+			case workerErr := <-workerErrs:
+				workerErrs <- nil
+				retErr = workerErr
+				close(cancelled)
+				sending = false
+
+			case consumerErr := <-consumerErrs:
+				consumerErrs <- nil
+				retErr = consumerErr
+				close(cancelled)
+				sending = false
+
+			case jobs <- job:
+				// just queued another job
+			}
 		}
 	}
 
-	close(fileIndices)
+	close(jobs)
 
 	// wait for all workers to finish
 	for i := 0; i < numWorkers; i++ {
@@ -241,13 +334,112 @@ func (vctx *ValidatorContext) Validate(target string, signature *SignatureInfo)
 		}
 	}
 
+	rErr := <-reporterErrs
+	fErr := reporter.finish()
+	if rErr == nil {
+		rErr = fErr
+	}
+	if rErr != nil && retErr == nil {
+		retErr = rErr
+	}
+	vctx.Summary = reporter.Report().Summary
+
+	if cache != nil {
+		// entries are only recorded for files that passed, so even a partial
+		// validation is worth saving
+		err := cache.Save(vctx.CachePath)
+		if err != nil && retErr == nil {
+			retErr = err
+		}
+	}
+
 	return retErr
 }
 
 type onProgressFunc func(delta int64)
 
-func (vctx *ValidatorContext) validate(target string, signature *SignatureInfo, fileIndices chan int64,
-	errs chan error, onProgress onProgressFunc, cancelled chan struct{}) {
+// A validationJob is either a whole file, or a range of blocks of a large file
+type validationJob struct {
+	fileIndex  int64
+	startBlock int64
+	// exclusive
+	endBlock int64
+	// whether this is the last job for this file
+	last bool
+
+	// set if the validation cache says the whole file is fine
+	cached bool
+	// shared by all jobs for the same file, nil if there's no cache
+	tracker *validationTracker
+}
+
+// validationTracker keeps track of the jobs for a file, so that it's only
+// recorded in the validation cache if they all passed.
+type validationTracker struct {
+	path      string
+	stats     os.FileInfo
+	remaining int64
+	wounded   int32
+}
+
+func (vctx *ValidatorContext) makeJobs(target string, signature *SignatureInfo, cache *ValidationCache, digests map[int64][sha256.Size]byte,
+	fileIndex int64) []*validationJob {
+
+	file := signature.Container.Files[fileIndex]
+
+	var tracker *validationTracker
+	if cache != nil {
+		stats, err := os.Stat(filepath.Join(target, filepath.FromSlash(file.Path)))
+		if err != nil {
+			cache.Forget(file.Path)
+		} else if !vctx.Paranoid && cache.Check(file.Path, stats, digests[fileIndex]) {
+			return []*validationJob{{fileIndex: fileIndex, cached: true}}
+		} else {
+			tracker = &validationTracker{path: file.Path, stats: stats}
+		}
+	}
+
+	splitSize := vctx.SplitSize
+	if splitSize == 0 {
+		splitSize = DefaultSplitSize
+	}
+
+	numBlocks := ComputeNumBlocks(file.Size)
+	blocksPerJob := numBlocks
+	if file.Size > splitSize {
+		blocksPerJob = ComputeNumBlocks(splitSize)
+	}
+
+	var jobs []*validationJob
+	for startBlock := int64(0); startBlock == 0 || startBlock < numBlocks; startBlock += blocksPerJob {
+		endBlock := startBlock + blocksPerJob
+		if endBlock > numBlocks {
+			endBlock = numBlocks
+		}
+
+		jobs = append(jobs, &validationJob{
+			fileIndex:  fileIndex,
+			startBlock: startBlock,
+			endBlock:   endBlock,
+			last:       endBlock == numBlocks,
+			tracker:    tracker,
+		})
+
+		if blocksPerJob == 0 {
+			// empty file
+			break
+		}
+	}
+
+	if tracker != nil {
+		tracker.remaining = int64(len(jobs))
+	}
+
+	return jobs
+}
+
+func (vctx *ValidatorContext) validate(target string, signature *SignatureInfo, cache *ValidationCache, digests map[int64][sha256.Size]byte,
+	jobs chan *validationJob, errs chan error, onProgress onProgressFunc, cancelled chan struct{}) {
 
 	var retErr error
 
@@ -267,6 +459,10 @@ func (vctx *ValidatorContext) validate(target string, signature *SignatureInfo,
 		errs <- retErr
 	}()
 
+	// set when the job currently being validated has wounds, only
+	// read after its writer is closed.
+	var wounded bool
+
 	validatingPool := &ValidatingPool{
 		Pool:      nullpool.New(signature.Container),
 		Container: signature.Container,
@@ -274,43 +470,87 @@ func (vctx *ValidatorContext) validate(target string, signature *SignatureInfo,
 
 		Wounds: vctx.Wounds,
 		WoundsFilter: func(wounds chan *Wound) chan *Wound {
+			if cache != nil {
+				wounds = watchWounds(wounds, func() {
+					wounded = true
+				})
+			}
 			return AggregateWounds(wounds, MaxWoundSize)
 		},
 	}
 
-	doOne := func(fileIndex int64) error {
+	doOne := func(job *validationJob) error {
+		fileIndex := job.fileIndex
 		file := signature.Container.Files[fileIndex]
 
+		if job.cached {
+			vctx.reporter.fileChecked(fileIndex, fileCheck{cached: true})
+			vctx.sendHealthy(fileIndex, file.Size, cancelled)
+			onProgress(file.Size)
+			return nil
+		}
+
+		startTime := time.Now()
+		wounded = false
+		whole := job.startBlock == 0 && job.last
+
+		rangeStart := job.startBlock * BlockSize
+		rangeEnd := job.endBlock * BlockSize
+		if rangeEnd > file.Size {
+			rangeEnd = file.Size
+		}
+		rangeSize := rangeEnd - rangeStart
+
 		var reader io.Reader
-		reader, err = targetPool.GetReader(fileIndex)
+		if whole {
+			reader, err = targetPool.GetReader(fileIndex)
+		} else {
+			var rs io.ReadSeeker
+			rs, err = targetPool.GetReadSeeker(fileIndex)
+			if err == nil {
+				_, err = rs.Seek(rangeStart, os.SEEK_SET)
+			}
+			reader = rs
+
+			if err == nil && !job.last {
+				// the last job reads until EOF, so files
+				// that are too large still get wounds
+				reader = io.LimitReader(rs, rangeSize)
+			}
+		}
+
 		if err != nil {
 			if os.IsNotExist(err) {
-				// whole file is missing
+				// whole range is missing
 				wound := &Wound{
 					Kind:  WoundKind_FILE,
 					Index: fileIndex,
-					Start: 0,
-					End:   file.Size,
+					Start: rangeStart,
+					End:   rangeEnd,
 				}
-				onProgress(file.Size)
+				onProgress(rangeSize)
+				vctx.reporter.fileChecked(fileIndex, fileCheck{
+					missing:  true,
+					duration: time.Since(startTime),
+				})
 
 				select {
 				case vctx.Wounds <- wound:
 				case <-cancelled:
 				}
+
+				vctx.finishJob(cache, digests, job, true)
 				return nil
 			}
 			return err
 		}
 
 		var writer io.WriteCloser
-		writer, err = validatingPool.GetWriter(fileIndex)
+		writer, err = validatingPool.GetWriterAt(fileIndex, job.startBlock)
 		if err != nil {
 			return err
 		}
 
-		defer writer.Close()
-
 		lastCount := int64(0)
 		countingWriter := counter.NewWriterCallback(func(count int64) {
 			delta := count - lastCount
@@ -320,37 +560,55 @@ func (vctx *ValidatorContext) validate(target string, signature *SignatureInfo,
 
 		var writtenBytes int64
 		writtenBytes, err = io.Copy(countingWriter, reader)
+		if err != nil {
+			writer.Close()
+			return err
+		}
+
+		err = writer.Close()
 		if err != nil {
 			return err
 		}
 
-		if writtenBytes != file.Size {
-			onProgress(file.Size - writtenBytes)
+		check := fileCheck{
+			bytesChecked: writtenBytes,
+			duration:     time.Since(startTime),
+		}
+
+		if (whole && writtenBytes != rangeSize) || (!whole && writtenBytes < rangeSize) {
+			check.sizeMismatch = true
+			check.actualSize = rangeStart + writtenBytes
+
+			onProgress(rangeSize - writtenBytes)
 			wound := &Wound{
 				Kind:  WoundKind_FILE,
 				Index: fileIndex,
-				Start: writtenBytes,
-				End:   file.Size,
+				Start: rangeStart + writtenBytes,
+				End:   rangeEnd,
 			}
 
 			select {
 			case vctx.Wounds <- wound:
 			case <-cancelled:
 			}
+
+			wounded = true
 		}
+		vctx.reporter.fileChecked(fileIndex, check)
 
+		vctx.finishJob(cache, digests, job, wounded)
 		return nil
 	}
 
 	for {
 		select {
-		case fileIndex, ok := <-fileIndices:
+		case job, ok := <-jobs:
 			if !ok {
 				// no more work
 				return
 			}
 
-			err := doOne(fileIndex)
+			err := doOne(job)
 			if err != nil {
 				if retErr == nil {
 					retErr = err
@@ -364,6 +622,69 @@ func (vctx *ValidatorContext) validate(target string, signature *SignatureInfo,
 	}
 }
 
+// finishJob updates the validation cache once all jobs for a file are done
+func (vctx *ValidatorContext) finishJob(cache *ValidationCache, digests map[int64][sha256.Size]byte, job *validationJob, wounded bool) {
+	tracker := job.tracker
+	if tracker == nil {
+		return
+	}
+
+	if wounded {
+		atomic.StoreInt32(&tracker.wounded, 1)
+	}
+
+	if atomic.AddInt64(&tracker.remaining, -1) > 0 {
+		// other jobs still running
+		return
+	}
+
+	if atomic.LoadInt32(&tracker.wounded) == 1 {
+		cache.Forget(tracker.path)
+	} else {
+		cache.Record(tracker.path, tracker.stats, digests[job.fileIndex])
+	}
+}
+
+// sendHealthy emits the same wounds a file would have if it was
+// hashed and found to be intact
+func (vctx *ValidatorContext) sendHealthy(fileIndex int64, fileSize int64, cancelled chan struct{}) {
+	numBlocks := ComputeNumBlocks(fileSize)
+	for blockIndex := int64(0); blockIndex < numBlocks; blockIndex++ {
+		start := blockIndex * BlockSize
+		wound := &Wound{
+			Kind:  WoundKind_CLOSED_FILE,
+			Index: fileIndex,
+			Start: start,
+			End:   start + ComputeBlockSize(fileSize, blockIndex),
+		}
+
+		select {
+		case vctx.Wounds <- wound:
+		case <-cancelled:
+			return
+		}
+	}
+}
+
+// watchWounds calls onWound whenever an unhealthy wound is sent
+// on the returned channel, before passing it along to outWounds.
+func watchWounds(outWounds chan *Wound, onWound func()) chan *Wound {
+	inWounds := make(chan *Wound)
+
+	go func() {
+		for wound := range inWounds {
+			if !wound.Healthy() {
+				onWound()
+			}
+			outWounds <- wound
+		}
+
+		close(outWounds)
+	}()
+
+	return inWounds
+}
+
 // AssertValid validates target in FailFast mode - it's a shorthand
 // so that setting up ValidatorContext isn't needed
 func AssertValid(target string, signature *SignatureInfo) error {
@@ -0,0 +1,113 @@
+package pwr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"github.com/itchio/wharf/pools/fspool"
+	"github.com/itchio/wharf/state"
+	"github.com/itchio/wharf/tlc"
+)
+
+func Test_SplitValidation(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "splitvalidation")
+	assert.NoError(t, err)
+	defer os.RemoveAll(mainDir)
+
+	targetDir := filepath.Join(mainDir, "target")
+	woundsPath := filepath.Join(mainDir, "wounds.pww")
+	cachePath := filepath.Join(mainDir, "cache.pwv")
+
+	makeTestDir(t, targetDir, testDirSettings{
+		entries: []testDirEntry{
+			{path: "big", seed: 0x1, size: BlockSize*20 + 5},
+			{path: "small", seed: 0x2, size: BlockSize + 12},
+		},
+	})
+
+	container, err := tlc.WalkAny(targetDir, nil)
+	assert.NoError(t, err)
+
+	hashes, err := ComputeSignature(container, fspool.New(container, targetDir), &state.Consumer{})
+	assert.NoError(t, err)
+
+	signature := &SignatureInfo{
+		Container: container,
+		Hashes:    hashes,
+	}
+
+	var bigIndex int64
+	for i, f := range container.Files {
+		if f.Path == "big" {
+			bigIndex = int64(i)
+		}
+	}
+	bigPath := filepath.Join(targetDir, "big")
+	bigSize := container.Files[bigIndex].Size
+
+	validate := func() []*Wound {
+		os.Remove(woundsPath)
+		vctx := &ValidatorContext{
+			WoundsPath: woundsPath,
+			CachePath:  cachePath,
+			Paranoid:   true,
+			SplitSize:  BlockSize * 3,
+			NumWorkers: 4,
+			Consumer:   &state.Consumer{},
+		}
+		assert.NoError(t, vctx.Validate(targetDir, signature))
+
+		if _, err := os.Stat(woundsPath); os.IsNotExist(err) {
+			// wounds files are only written when there are wounds
+			return nil
+		}
+
+		wc := &woundsCollector{}
+		assert.NoError(t, HealFromWounds(woundsPath, wc))
+		return MergeWounds(wc.wounds)
+	}
+
+	t.Logf("...intact")
+	assert.EqualValues(t, 0, len(validate()))
+
+	cache, err := LoadValidationCache(cachePath)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, cache.Len())
+
+	t.Logf("...with corruption in several ranges")
+	f, err := os.OpenFile(bigPath, os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	for _, offset := range []int64{BlockSize*2 + 1, BlockSize * 3, BlockSize*10 + 7, BlockSize*20 + 1} {
+		_, err = f.WriteAt([]byte{0xde, 0xad}, offset)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, f.Close())
+
+	assert.EqualValues(t, []*Wound{
+		{Kind: WoundKind_FILE, Index: bigIndex, Start: BlockSize * 2, End: BlockSize * 4},
+		{Kind: WoundKind_FILE, Index: bigIndex, Start: BlockSize * 10, End: BlockSize * 11},
+		{Kind: WoundKind_FILE, Index: bigIndex, Start: BlockSize * 20, End: bigSize},
+	}, validate())
+
+	cache, err = LoadValidationCache(cachePath)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, cache.Len())
+
+	t.Logf("...truncated")
+	assert.NoError(t, os.Truncate(bigPath, BlockSize*7+3))
+	wounds := validate()
+	assert.EqualValues(t, 2, len(wounds))
+	assert.EqualValues(t, BlockSize*2, wounds[0].Start)
+	assert.EqualValues(t, BlockSize*4, wounds[0].End)
+	assert.EqualValues(t, BlockSize*7, wounds[1].Start)
+	assert.EqualValues(t, bigSize, wounds[1].End)
+
+	t.Logf("...missing")
+	assert.NoError(t, os.Remove(bigPath))
+	assert.EqualValues(t, []*Wound{
+		{Kind: WoundKind_FILE, Index: bigIndex, Start: 0, End: bigSize},
+	}, validate())
+}
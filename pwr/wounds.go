@@ -2,7 +2,9 @@ package pwr
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"sort"
 
 	humanize "github.com/dustin/go-humanize"
 	"github.com/go-errors/errors"
@@ -204,6 +206,272 @@ func (wp *WoundsPrinter) HasWounds() bool {
 	return wp.hasWounds
 }
 
+///////////////////////////////
+// Reader
+///////////////////////////////
+
+// A WoundsReader reads wounds back from a .pww (wharf wounds file format) file,
+// one at a time.
+type WoundsReader struct {
+	// Container is read as soon as the reader is created
+	Container *tlc.Container
+
+	rc *wire.ReadContext
+}
+
+// NewWoundsReader reads the header and container of a wounds file, and
+// returns a WoundsReader ready to read wounds.
+func NewWoundsReader(reader io.Reader) (*WoundsReader, error) {
+	rc := wire.NewReadContext(reader)
+
+	err := rc.ExpectMagic(WoundsMagic)
+	if err != nil {
+		return nil, errors.Wrap(err, 1)
+	}
+
+	err = rc.ReadMessage(&WoundsHeader{})
+	if err != nil {
+		return nil, errors.Wrap(err, 1)
+	}
+
+	container := &tlc.Container{}
+	err = rc.ReadMessage(container)
+	if err != nil {
+		return nil, errors.Wrap(err, 1)
+	}
+
+	return &WoundsReader{
+		Container: container,
+		rc:        rc,
+	}, nil
+}
+
+// Next returns the next wound in the file, or io.EOF when
+// there are no wounds left.
+func (wr *WoundsReader) Next() (*Wound, error) {
+	wound := &Wound{}
+	err := wr.rc.ReadMessage(wound)
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, errors.Wrap(err, 1)
+	}
+
+	return wound, nil
+}
+
+// Stream sends all remaining wounds to the given channel, then closes it.
+func (wr *WoundsReader) Stream(wounds chan *Wound) error {
+	defer close(wounds)
+
+	for {
+		wound, err := wr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		wounds <- wound
+	}
+}
+
+// ReadWounds reads the container of a wounds file, and returns it along with
+// a channel all wounds will be sent to. Once all wounds have been sent, the
+// wounds channel is closed and the (possibly nil) reading error is sent to errs.
+func ReadWounds(reader io.Reader) (*tlc.Container, chan *Wound, chan error, error) {
+	wr, err := NewWoundsReader(reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	wounds := make(chan *Wound)
+	errs := make(chan error, 1)
+
+	go func() {
+		errs <- wr.Stream(wounds)
+	}()
+
+	return wr.Container, wounds, errs, nil
+}
+
+// HealFromWounds feeds all wounds from the .pww file at woundsPath to
+// the given consumer (typically a Healer). This lets one validate a build
+// first, and heal it later (for example, when a network connection is available).
+func HealFromWounds(woundsPath string, consumer WoundsConsumer) error {
+	file, err := os.Open(woundsPath)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+	defer file.Close()
+
+	container, wounds, errs, err := ReadWounds(file)
+	if err != nil {
+		return err
+	}
+
+	doErr := consumer.Do(container, wounds)
+
+	// if the consumer bailed out early, let the reader finish
+	for range wounds {
+		// muffin
+	}
+
+	readErr := <-errs
+
+	if doErr != nil {
+		return doErr
+	}
+	return readErr
+}
+
+///////////////////////////////
+// Merge
+///////////////////////////////
+
+// MergeWoundsFiles reads several .pww files, which must all have been written
+// for the same container, and returns that container along with the merged
+// wounds (see MergeWounds).
+func MergeWoundsFiles(woundsPaths []string) (*tlc.Container, []*Wound, error) {
+	var container *tlc.Container
+	var allWounds []*Wound
+
+	for _, woundsPath := range woundsPaths {
+		err := func() error {
+			file, err := os.Open(woundsPath)
+			if err != nil {
+				return errors.Wrap(err, 1)
+			}
+			defer file.Close()
+
+			wr, err := NewWoundsReader(file)
+			if err != nil {
+				return err
+			}
+
+			if container == nil {
+				container = wr.Container
+			} else {
+				err = ensureSameLayout(container, wr.Container)
+				if err != nil {
+					return errors.Wrap(fmt.Errorf("%s: %s", woundsPath, err.Error()), 1)
+				}
+			}
+
+			for {
+				wound, err := wr.Next()
+				if err != nil {
+					if err == io.EOF {
+						return nil
+					}
+					return err
+				}
+
+				allWounds = append(allWounds, wound)
+			}
+		}()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return container, MergeWounds(allWounds), nil
+}
+
+// MergeWounds deduplicates the given wounds: overlapping or contiguous file
+// wounds are merged, and dir or symlink wounds only appear once. Healthy wounds
+// are dropped. The result is sorted by kind, index, then offset.
+func MergeWounds(wounds []*Wound) []*Wound {
+	var sorted []*Wound
+	for _, wound := range wounds {
+		if wound.Healthy() {
+			continue
+		}
+		sorted = append(sorted, &Wound{
+			Kind:  wound.Kind,
+			Index: wound.Index,
+			Start: wound.Start,
+			End:   wound.End,
+		})
+	}
+
+	sort.Sort(byWoundPosition(sorted))
+
+	var merged []*Wound
+	for _, wound := range sorted {
+		if len(merged) > 0 {
+			last := merged[len(merged)-1]
+			if last.Kind == wound.Kind && last.Index == wound.Index {
+				if wound.Kind != WoundKind_FILE {
+					// same dir or symlink, nothing to add
+					continue
+				}
+
+				if wound.Start <= last.End {
+					if wound.End > last.End {
+						last.End = wound.End
+					}
+					continue
+				}
+			}
+		}
+
+		merged = append(merged, wound)
+	}
+
+	return merged
+}
+
+type byWoundPosition []*Wound
+
+func (s byWoundPosition) Len() int {
+	return len(s)
+}
+
+func (s byWoundPosition) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s byWoundPosition) Less(i, j int) bool {
+	if s[i].Kind != s[j].Kind {
+		return s[i].Kind < s[j].Kind
+	}
+	if s[i].Index != s[j].Index {
+		return s[i].Index < s[j].Index
+	}
+	return s[i].Start < s[j].Start
+}
+
+// ensureSameLayout returns an error if wounds referring to c1 can't be
+// used with c2, ie. if entries don't have the same indices
+func ensureSameLayout(c1 *tlc.Container, c2 *tlc.Container) error {
+	if len(c1.Files) != len(c2.Files) || len(c1.Dirs) != len(c2.Dirs) || len(c1.Symlinks) != len(c2.Symlinks) {
+		return fmt.Errorf("container mismatch: %s vs %s", c1.Stats(), c2.Stats())
+	}
+
+	for i, f := range c1.Files {
+		if f.Path != c2.Files[i].Path || f.Size != c2.Files[i].Size {
+			return fmt.Errorf("container mismatch: file %d is %s vs %s", i, f.ToString(), c2.Files[i].ToString())
+		}
+	}
+
+	for i, d := range c1.Dirs {
+		if d.Path != c2.Dirs[i].Path {
+			return fmt.Errorf("container mismatch: dir %d is %s vs %s", i, d.Path, c2.Dirs[i].Path)
+		}
+	}
+
+	for i, s := range c1.Symlinks {
+		if s.Path != c2.Symlinks[i].Path || s.Dest != c2.Symlinks[i].Dest {
+			return fmt.Errorf("container mismatch: symlink %d is %s vs %s", i, s.ToString(), c2.Symlinks[i].ToString())
+		}
+	}
+
+	return nil
+}
+
 ///////////////////////////////
 // Utils
 ///////////////////////////////
@@ -0,0 +1,117 @@
+package pwr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"github.com/itchio/wharf/tlc"
+)
+
+type woundsCollector struct {
+	wounds []*Wound
+}
+
+var _ WoundsConsumer = (*woundsCollector)(nil)
+
+func (wc *woundsCollector) Do(container *tlc.Container, wounds chan *Wound) error {
+	for wound := range wounds {
+		wc.wounds = append(wc.wounds, wound)
+	}
+	return nil
+}
+
+func (wc *woundsCollector) TotalCorrupted() int64 {
+	return 0
+}
+
+func (wc *woundsCollector) HasWounds() bool {
+	return len(wc.wounds) > 0
+}
+
+func Test_WoundsFiles(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "woundsfiles")
+	assert.NoError(t, err)
+	defer os.RemoveAll(mainDir)
+
+	container := &tlc.Container{
+		Files: []*tlc.File{
+			{Path: "a", Size: 1024},
+			{Path: "b", Size: 2048},
+		},
+		Dirs: []*tlc.Dir{
+			{Path: "d"},
+		},
+	}
+
+	writeWounds := func(name string, c *tlc.Container, wounds []*Wound) string {
+		woundsPath := filepath.Join(mainDir, name)
+		ww := &WoundsWriter{WoundsPath: woundsPath}
+
+		woundsChan := make(chan *Wound)
+		go func() {
+			for _, wound := range wounds {
+				woundsChan <- wound
+			}
+			close(woundsChan)
+		}()
+
+		assert.NoError(t, ww.Do(c, woundsChan))
+		return woundsPath
+	}
+
+	firstPath := writeWounds("first.pww", container, []*Wound{
+		{Kind: WoundKind_FILE, Index: 1, Start: 0, End: 100},
+		{Kind: WoundKind_CLOSED_FILE, Index: 1},
+		{Kind: WoundKind_FILE, Index: 0, Start: 512, End: 1024},
+		{Kind: WoundKind_DIR, Index: 0},
+	})
+	secondPath := writeWounds("second.pww", container, []*Wound{
+		{Kind: WoundKind_FILE, Index: 1, Start: 50, End: 200},
+		{Kind: WoundKind_FILE, Index: 1, Start: 1000, End: 1100},
+		{Kind: WoundKind_DIR, Index: 0},
+	})
+
+	// read back a single file
+	wc := &woundsCollector{}
+	assert.NoError(t, HealFromWounds(firstPath, wc))
+	assert.EqualValues(t, 3, len(wc.wounds))
+	assert.EqualValues(t, 512, wc.wounds[1].Start)
+	assert.EqualValues(t, WoundKind_DIR, wc.wounds[2].Kind)
+
+	// consumers that bail out early don't block the reader
+	assert.Error(t, HealFromWounds(firstPath, &WoundsGuardian{}))
+
+	// merge both files
+	mergedContainer, merged, err := MergeWoundsFiles([]string{firstPath, secondPath})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, len(mergedContainer.Files))
+	assert.EqualValues(t, []*Wound{
+		{Kind: WoundKind_FILE, Index: 0, Start: 512, End: 1024},
+		{Kind: WoundKind_FILE, Index: 1, Start: 0, End: 200},
+		{Kind: WoundKind_FILE, Index: 1, Start: 1000, End: 1100},
+		{Kind: WoundKind_DIR, Index: 0},
+	}, merged)
+
+	// wounds from different containers can't be merged
+	otherContainer := &tlc.Container{
+		Files: []*tlc.File{
+			{Path: "b", Size: 2048},
+			{Path: "a", Size: 1024},
+		},
+		Dirs: []*tlc.Dir{
+			{Path: "d"},
+		},
+	}
+	otherPath := writeWounds("other.pww", otherContainer, []*Wound{
+		{Kind: WoundKind_FILE, Index: 0, Start: 0, End: 10},
+	})
+
+	_, _, err = MergeWoundsFiles([]string{firstPath, otherPath})
+	assert.Error(t, err)
+
+	// not a wounds file
+	assert.Error(t, HealFromWounds(filepath.Join(mainDir, "missing.pww"), wc))
+}
@@ -0,0 +1,296 @@
+package pwr
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/go-errors/errors"
+	"github.com/itchio/wharf/wire"
+	"github.com/itchio/wharf/wsync"
+)
+
+// DefaultZstdPatchQuality is the zstd level used by OptimizePatch for zstd patches,
+// when none is specified. Lower levels are faster, but may not find matches far
+// back in the old file.
+const DefaultZstdPatchQuality int32 = 19
+
+// ZstdPatchMaxWindowSize is the largest window zstd patches are made with. Pairs
+// of files that need a larger one are diffed with bsdiff instead, and patches that
+// need a larger one are refused on apply. Applying a zstd patch needs about twice
+// the window in memory: the old file, plus the window itself.
+const ZstdPatchMaxWindowSize int64 = 64 * 1024 * 1024
+
+// zstdPatchMinWindowSize is the smallest window zstd allows
+const zstdPatchMinWindowSize int64 = 1024
+
+// zstdPatchChunkSize is how much of a zstd frame is stored in a single DATA op
+const zstdPatchChunkSize = 1024 * 1024
+
+// ErrZstdWindowTooLarge is returned when a zstd patch would need a window larger
+// than ZstdPatchMaxWindowSize
+var ErrZstdWindowTooLarge = errors.New("zstd patch window too large")
+
+// ZstdMemoryEstimate returns roughly how much memory a zstd patch needs for a pair
+// of files: the old file (the dictionary), plus the compressor's history and
+// match tables, which grow with the window.
+func ZstdMemoryEstimate(targetSize int64, sourceSize int64) int64 {
+	return targetSize + 2*zstdPatchWindowSize(targetSize, sourceSize)
+}
+
+// zstdPatchWindowSize returns the window a zstd patch between two files is made
+// with: the smallest power of two that holds both, so that the end of the new
+// file can still reference the start of the old one.
+func zstdPatchWindowSize(targetSize int64, sourceSize int64) int64 {
+	windowSize := zstdPatchMinWindowSize
+	for windowSize < targetSize+sourceSize {
+		windowSize *= 2
+	}
+	return windowSize
+}
+
+// zstdPatchFits returns true if a zstd patch between two files can be made
+// without exceeding ZstdPatchMaxWindowSize
+func zstdPatchFits(targetSize int64, sourceSize int64) bool {
+	return zstdPatchWindowSize(targetSize, sourceSize) <= ZstdPatchMaxWindowSize
+}
+
+// zstdFile compresses a source file with zstd, using the target file it's mapped
+// to as a dictionary, and writes the resulting frame as DATA ops.
+func (rc *RediffContext) zstdFile(sourcePool wsync.Pool, targetPool wsync.Pool, sourceFileIndex int64,
+	diffMapping *DiffMapping, wctx *wire.WriteContext) error {
+	compressor, ok := compressors[CompressionAlgorithm_ZSTD].(ZstdPatchCompressor)
+	if !ok {
+		return errors.Wrap(fmt.Errorf("zstd patches need a ZstdPatchCompressor registered for %s", CompressionAlgorithm_ZSTD), 0)
+	}
+
+	quality := rc.ZstdQuality
+	if quality == 0 {
+		quality = DefaultZstdPatchQuality
+	}
+
+	params, err := zstdPatchParams(targetPool, diffMapping.TargetIndex, sourcePool.GetSize(sourceFileIndex))
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	params.Quality = quality
+
+	ref, err := readReference(targetPool, diffMapping.TargetIndex)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	sourceFileReader, err := sourcePool.GetReadSeeker(sourceFileIndex)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	_, err = sourceFileReader.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	dow := &dataOpWriter{wctx: wctx}
+	zw, err := compressor.ApplyPatchFrom(dow, ref, params)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	_, err = io.Copy(zw, sourceFileReader)
+	if err != nil {
+		zw.Close()
+		return errors.Wrap(err, 0)
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	err = dow.flush()
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+// applyZstd decompresses a zstd frame read from DATA ops, using a target file
+// as a dictionary, and writes the result to writer. It reads up to and including
+// the HEY_YOU_DID_IT op.
+func applyZstd(patchWire *wire.ReadContext, targetPool wsync.Pool, targetIndex int64, writer io.Writer, newSize int64) error {
+	decompressor, ok := decompressors[CompressionAlgorithm_ZSTD].(ZstdPatchDecompressor)
+	if !ok {
+		return errors.Wrap(fmt.Errorf("zstd patches need a ZstdPatchDecompressor registered for %s", CompressionAlgorithm_ZSTD), 0)
+	}
+
+	params, err := zstdPatchParams(targetPool, targetIndex, newSize)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	ref, err := readReference(targetPool, targetIndex)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	dor := &dataOpReader{rctx: patchWire}
+	reader, err := decompressor.ApplyPatchFrom(dor, ref, params)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	defer reader.Close()
+
+	_, err = io.CopyN(writer, reader, newSize)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	// the frame must not have more than that
+	extra, err := io.Copy(ioutil.Discard, reader)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	if extra > 0 {
+		return errors.Wrap(fmt.Errorf("zstd: expected new file to be %d, was %d", newSize, newSize+extra), 0)
+	}
+
+	err = dor.drain()
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+// zstdPatchParams returns the params for a zstd patch from a target file to a
+// source file of sourceSize bytes, refusing windows over ZstdPatchMaxWindowSize
+// before anything is read.
+func zstdPatchParams(targetPool wsync.Pool, targetIndex int64, sourceSize int64) (*ZstdPatchParams, error) {
+	targetSize := targetPool.GetSize(targetIndex)
+	if !zstdPatchFits(targetSize, sourceSize) {
+		return nil, errors.Wrap(ErrZstdWindowTooLarge, 1)
+	}
+
+	params := &ZstdPatchParams{
+		WindowSize: zstdPatchWindowSize(targetSize, sourceSize),
+	}
+	return params, nil
+}
+
+// readReference reads a whole target file, to be used as a zstd dictionary.
+// zstdPatchParams must have been called first, so it's bounded.
+func readReference(pool wsync.Pool, fileIndex int64) ([]byte, error) {
+	reader, err := pool.GetReadSeeker(fileIndex)
+	if err != nil {
+		return nil, errors.Wrap(err, 1)
+	}
+
+	_, err = reader.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return nil, errors.Wrap(err, 1)
+	}
+
+	ref := make([]byte, pool.GetSize(fileIndex))
+	_, err = io.ReadFull(reader, ref)
+	if err != nil {
+		return nil, errors.Wrap(err, 1)
+	}
+
+	return ref, nil
+}
+
+// A dataOpWriter writes what's written to it as DATA ops of at most
+// zstdPatchChunkSize bytes. flush must be called at the end.
+type dataOpWriter struct {
+	wctx *wire.WriteContext
+	buf  []byte
+	op   SyncOp
+}
+
+var _ io.Writer = (*dataOpWriter)(nil)
+
+func (dow *dataOpWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		n := zstdPatchChunkSize - len(dow.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+
+		dow.buf = append(dow.buf, p[:n]...)
+		p = p[n:]
+		written += n
+
+		if len(dow.buf) == zstdPatchChunkSize {
+			err := dow.flush()
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+func (dow *dataOpWriter) flush() error {
+	if len(dow.buf) == 0 {
+		return nil
+	}
+
+	dow.op.Reset()
+	dow.op.Type = SyncOp_DATA
+	dow.op.Data = dow.buf
+	err := dow.wctx.WriteMessage(&dow.op)
+	if err != nil {
+		return err
+	}
+
+	dow.buf = dow.buf[:0]
+	return nil
+}
+
+// A dataOpReader reads the data of DATA ops, until HEY_YOU_DID_IT
+type dataOpReader struct {
+	rctx *wire.ReadContext
+	op   SyncOp
+	buf  []byte
+	done bool
+}
+
+var _ io.Reader = (*dataOpReader)(nil)
+
+func (dor *dataOpReader) Read(p []byte) (int, error) {
+	for len(dor.buf) == 0 {
+		if dor.done {
+			return 0, io.EOF
+		}
+
+		dor.op.Reset()
+		err := dor.rctx.ReadMessage(&dor.op)
+		if err != nil {
+			return 0, err
+		}
+
+		switch dor.op.Type {
+		case SyncOp_DATA:
+			dor.buf = dor.op.Data
+		case SyncOp_HEY_YOU_DID_IT:
+			dor.done = true
+		default:
+			return 0, errors.Wrap(ErrMalformedPatch, 0)
+		}
+	}
+
+	n := copy(p, dor.buf)
+	dor.buf = dor.buf[n:]
+	return n, nil
+}
+
+// drain reads ops until HEY_YOU_DID_IT, if it hasn't been read yet
+func (dor *dataOpReader) drain() error {
+	_, err := io.Copy(ioutil.Discard, dor)
+	return err
+}
@@ -13,6 +13,8 @@ import (
 var (
 	// ErrFormat is returned when we find a magic number that isn't the one we expected
 	ErrFormat = errors.New("wrong magic (invalid input file)")
+	// ErrMessageTooLarge is returned when a message is larger than the read context accepts
+	ErrMessageTooLarge = errors.New("message too large")
 )
 
 // ReadContext holds state of a wharf wire format reader
@@ -21,11 +23,23 @@ type ReadContext struct {
 
 	byteBuffer []byte
 	msgBuf     []byte
+
+	maxMessageSize int64
 }
 
 // NewReadContext builds a new ReadContext that reads from a given reader
 func NewReadContext(reader io.Reader) *ReadContext {
-	return &ReadContext{reader, make([]byte, 1), make([]byte, 32)}
+	return &ReadContext{
+		reader:     reader,
+		byteBuffer: make([]byte, 1),
+		msgBuf:     make([]byte, 32),
+	}
+}
+
+// SetMaxMessageSize makes ReadMessage reject messages longer than size bytes,
+// before allocating anything for them. 0 means no limit.
+func (r *ReadContext) SetMaxMessageSize(size int64) {
+	r.maxMessageSize = size
 }
 
 // ReadByte reads a single byte from the underlying reader
@@ -65,6 +79,10 @@ func (r *ReadContext) ReadMessage(msg proto.Message) error {
 		return err
 	}
 
+	if r.maxMessageSize > 0 && length > uint64(r.maxMessageSize) {
+		return errors.Wrap(ErrMessageTooLarge, 0)
+	}
+
 	if cap(r.msgBuf) < int(length) {
 		r.msgBuf = make([]byte, length)
 	}